@@ -0,0 +1,232 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	"github.com/slntopp/nocloud-driver-ione/pkg/server"
+	apb "github.com/slntopp/nocloud-proto/billing/addons"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	statuspb "github.com/slntopp/nocloud-proto/statuses"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate [input.json]",
+	Short: "Run Instance billing against the given VM timeline, nothing is published",
+	Long: `Runs the same billing pipeline Monitoring does against fake VM made of the input
+and prints the records, changed Instance data and events it would emit.
+
+Input is JSON, read from stdin if file isn't given or is "-":
+
+  {
+    "instance": {...},            Instance in protojson: billing_plan, data, resources, config
+    "services_provider": {...},   optional, e.g. for suspend rules and billing_attributes
+    "addons": {"uuid": {...}},    optional
+    "status": "UP",               Instances Group status
+    "balance": 100,               Account balance for auto_renew Instances
+    "now": 1700000000,            time to bill at, defaults to current time
+    "vm": {
+      "template": "VCPU=\"2\" MEMORY=\"2048\"",
+      "history": [{"start": 1690000000, "end": 1695000000, "action": "poweroff", "until": 1696000000}, {"start": 1696000000}],
+      "monitoring": ["TIMESTAMP=\"1696000060\" CPU=\"50\" NETTX=\"1024\""]
+    }
+  }
+
+History records are what VM did: running from start to end (open if end isn't set), then action state until "until".`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runSimulate,
+}
+
+var (
+	simulateAt      string
+	simulateVerbose bool
+)
+
+func init() {
+	simulateCmd.Flags().StringVar(&simulateAt, "at", "", "Time to bill at, unix timestamp or RFC3339, overrides input now")
+	simulateCmd.Flags().BoolVarP(&simulateVerbose, "verbose", "v", false, "Print billing logs to stderr")
+	rootCmd.AddCommand(simulateCmd)
+}
+
+type simulationInput struct {
+	Instance         json.RawMessage            `json:"instance"`
+	ServicesProvider json.RawMessage            `json:"services_provider,omitempty"`
+	Addons           map[string]json.RawMessage `json:"addons,omitempty"`
+	Status           string                     `json:"status,omitempty"`
+	Balance          float64                    `json:"balance,omitempty"`
+	Now              int64                      `json:"now,omitempty"`
+	VM               struct {
+		Template   string              `json:"template"`
+		History    []simulationHistory `json:"history"`
+		Monitoring []string            `json:"monitoring,omitempty"`
+	} `json:"vm"`
+}
+
+type simulationHistory struct {
+	Start  int64  `json:"start"`
+	End    int64  `json:"end,omitempty"`
+	Action string `json:"action,omitempty"`
+	Until  int64  `json:"until,omitempty"`
+}
+
+// ONe history actions, see one.MakeTimelineRecords
+var historyActions = map[string]int{"": 0, "poweroff": 20, "suspend": 9, "terminate": 27}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func runSimulate(cmd *cobra.Command, args []string) error {
+	var in io.Reader = os.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var input simulationInput
+	if err := json.NewDecoder(in).Decode(&input); err != nil {
+		return fmt.Errorf("can't read input: %w", err)
+	}
+
+	inst := &ipb.Instance{}
+	if err := protojson.Unmarshal(input.Instance, inst); err != nil {
+		return fmt.Errorf("can't read instance: %w", err)
+	}
+	sp := &sppb.ServicesProvider{}
+	if len(input.ServicesProvider) > 0 {
+		if err := protojson.Unmarshal(input.ServicesProvider, sp); err != nil {
+			return fmt.Errorf("can't read services provider: %w", err)
+		}
+	}
+	addons := make(map[string]*apb.Addon, len(input.Addons))
+	for id, raw := range input.Addons {
+		addon := &apb.Addon{}
+		if err := protojson.Unmarshal(raw, addon); err != nil {
+			return fmt.Errorf("can't read addon %s: %w", id, err)
+		}
+		addons[id] = addon
+	}
+
+	status := statuspb.NoCloudStatus_UP
+	if input.Status != "" {
+		value, ok := statuspb.NoCloudStatus_value[strings.ToUpper(input.Status)]
+		if !ok {
+			return fmt.Errorf("unknown status %q", input.Status)
+		}
+		status = statuspb.NoCloudStatus(value)
+	}
+
+	now := time.Now()
+	if input.Now > 0 {
+		now = time.Unix(input.Now, 0)
+	}
+	if simulateAt != "" {
+		at, err := parseTime(simulateAt)
+		if err != nil {
+			return err
+		}
+		now = at
+	}
+
+	logger := zap.NewNop()
+	if simulateVerbose {
+		logger = log
+	}
+
+	client := fake.NewClient(logger)
+	client.Clock = fixedClock(now)
+	history := make([]vm.HistoryRecord, 0, len(input.VM.History))
+	for _, h := range input.VM.History {
+		action, ok := historyActions[h.Action]
+		if !ok {
+			return fmt.Errorf("unknown history action %q", h.Action)
+		}
+		history = append(history, vm.HistoryRecord{STime: int(h.Start), RSTime: int(h.Start), RETime: int(h.End), ETime: int(h.Until), Action: action})
+	}
+	vmid, err := client.AddVM(inst.GetUuid(), input.VM.Template, history)
+	if err != nil {
+		return fmt.Errorf("can't make VM: %w", err)
+	}
+	for _, record := range input.VM.Monitoring {
+		if err := client.AddVMMonitoring(vmid, record); err != nil {
+			return fmt.Errorf("can't add monitoring record: %w", err)
+		}
+	}
+	if inst.Data == nil {
+		inst.Data = make(map[string]*structpb.Value)
+	}
+	inst.Data[one.DATA_VM_ID] = structpb.NewNumberValue(float64(vmid))
+
+	res := server.SimulateBilling(logger, client, inst, status, input.Balance, addons, sp, fixedClock(now))
+
+	out := struct {
+		Records []json.RawMessage `json:"records"`
+		Events  []json.RawMessage `json:"events"`
+		Data    json.RawMessage   `json:"data"`
+		Balance float64           `json:"balance"`
+	}{Records: []json.RawMessage{}, Events: []json.RawMessage{}, Balance: res.Balance}
+	for _, record := range res.Records {
+		out.Records = append(out.Records, marshalProto(record))
+	}
+	for _, event := range res.Events {
+		out.Events = append(out.Events, marshalProto(event))
+	}
+	out.Data = marshalProto(&structpb.Struct{Fields: res.Data})
+
+	enc := json.NewEncoder(cmd.OutOrStdout())
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func marshalProto(m proto.Message) json.RawMessage {
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		return json.RawMessage(strconv.Quote(err.Error()))
+	}
+	return b
+}
+
+// Parses unix timestamp or RFC3339 time
+func parseTime(s string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("time must be unix timestamp or RFC3339: %w", err)
+	}
+	return t, nil
+}
@@ -17,6 +17,7 @@ package main
 
 import (
 	"context"
+
 	"github.com/slntopp/nocloud-proto/ansible"
 	epb "github.com/slntopp/nocloud-proto/events"
 	"github.com/slntopp/nocloud/pkg/nocloud/auth"
@@ -35,6 +36,7 @@ import (
 	"google.golang.org/protobuf/proto"
 
 	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
+	"github.com/slntopp/nocloud-driver-ione/pkg/rdns"
 	"github.com/slntopp/nocloud-driver-ione/pkg/server"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -53,6 +55,9 @@ var (
 	ansibleHost  string
 
 	nocloudBaseUrl string
+
+	rdnsProvider string
+	rdnsConfig   rdns.Config
 )
 
 func init() {
@@ -79,6 +84,15 @@ func init() {
 
 	viper.SetDefault("NOCLOUD_BASE_URL", "https://api.nc2dev.support.by")
 	nocloudBaseUrl = viper.GetString("NOCLOUD_BASE_URL")
+
+	viper.SetDefault("RDNS_PROVIDER", "")
+	rdnsProvider = viper.GetString("RDNS_PROVIDER")
+	rdnsConfig = rdns.Config{
+		URL:      viper.GetString("RDNS_API_URL"),
+		APIKey:   viper.GetString("RDNS_API_KEY"),
+		ServerID: viper.GetString("RDNS_SERVER_ID"),
+		TTL:      viper.GetInt("RDNS_TTL"),
+	}
 }
 
 func main() {
@@ -104,6 +118,15 @@ func main() {
 	datas.Configure(log, rbmq)
 	actions.ConfigureStatusesClient(log)
 
+	if rdnsProvider != "" {
+		provider, err := rdns.New(rdnsProvider, rdnsConfig)
+		if err != nil {
+			log.Fatal("Failed to setup rDNS provider", zap.String("provider", rdnsProvider), zap.Error(err))
+		}
+		log.Info("rDNS provider", zap.String("provider", rdnsProvider))
+		rdns.Configure(provider)
+	}
+
 	s := grpc.NewServer()
 	server.SetDriverType(type_key)
 
@@ -41,6 +41,7 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/structpb"
 
 	opennebulavm "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
@@ -62,20 +63,38 @@ type AnsibleAction func(
 ) (*ipb.InvokeResponse, error)
 
 var Actions = map[string]ServiceAction{
-	"poweroff":        Poweroff,
-	"suspend":         Suspend,
-	"reboot":          Reboot,
-	"resume":          Resume,
-	"reinstall":       Reinstall,
-	"monitoring":      Monitoring,
-	"state":           State,
-	"snapcreate":      SnapCreate,
-	"snapdelete":      SnapDelete,
-	"snaprevert":      SnapRevert,
-	"start_vnc":       StartVNC,
-	"get_backup_info": GetBackupInfo,
-	"freeze":          Freeze,
-	"unfreeze":        Unfreeze,
+	"poweroff":         Poweroff,
+	"suspend":          Suspend,
+	"reboot":           Reboot,
+	"resume":           Resume,
+	"reinstall":        Reinstall,
+	"monitoring":       Monitoring,
+	"state":            State,
+	"snapcreate":       SnapCreate,
+	"snapdelete":       SnapDelete,
+	"snaprevert":       SnapRevert,
+	"start_vnc":        StartVNC,
+	"get_backup_info":  GetBackupInfo,
+	"freeze":           Freeze,
+	"unfreeze":         Unfreeze,
+	"backup_create":    BackupCreate,
+	"backup_list":      BackupList,
+	"backup_restore":   BackupRestore,
+	"backup_delete":    BackupDelete,
+	"rescue_enter":     RescueEnter,
+	"rescue_exit":      RescueExit,
+	"iso_attach":       ISOAttach,
+	"iso_detach":       ISODetach,
+	"reset_password":   ResetPassword,
+	"set_ssh_keys":     SetSSHKeys,
+	"clone":            Clone,
+	"save_as_template": SaveAsTemplate,
+	"move_instance":    MoveInstance,
+	"ip_assign":        IPAssign,
+	"ip_unassign":      IPUnassign,
+	"set_ptr":          SetPTR,
+	"firewall_set":     FirewallSet,
+	"firewall_list":    FirewallList,
 }
 
 var BillingActions = map[string]ServiceAction{
@@ -86,12 +105,14 @@ var BillingActions = map[string]ServiceAction{
 
 var AnsibleActions = map[string]AnsibleAction{
 	"exec":              BackupInstance,
+	"restore_backup":    RestoreInstance,
 	"check_linux_stats": CheckLinuxStats,
 }
 
 var AdminActions = map[string]bool{
 	"suspend":         true,
 	"get_backup_info": true,
+	"move_instance":   true,
 }
 
 // Creates new snapshot of vm
@@ -173,7 +194,8 @@ func SnapRevert(
 	return StatusesClient(client, inst, data, &ipb.InvokeResponse{Result: true})
 }
 
-// Remove VM and create with same specs and user
+// Remove VM and create with same specs and user.
+// If template_id, password or ssh_public_key are given, VM is recreated from the(possibly other) template with them
 func Reinstall(
 	client one.IClient,
 	inst *ipb.Instance,
@@ -185,6 +207,12 @@ func Reinstall(
 		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
 	}
 
+	for _, key := range []string{"template_id", "password", "ssh_public_key"} {
+		if _, ok := data[key]; ok {
+			return reinstallTemplate(client, inst, data)
+		}
+	}
+
 	err = client.Reinstall(vmid)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Can't Reinstall VM, error: %v", err)
@@ -193,6 +221,67 @@ func Reinstall(
 	return StatusesClient(client, inst, data, &ipb.InvokeResponse{Result: true})
 }
 
+// Returns password VM is reinstalled with, if Template reinstall is requested
+func ReinstallSecrets(inst *ipb.Instance, data map[string]*structpb.Value) map[string]*structpb.Value {
+	_, template := data["template_id"]
+	_, key := data["ssh_public_key"]
+	password, ok := data["password"]
+	if !ok && (template || key) {
+		password, ok = inst.GetConfig()["password"]
+	}
+	if !ok {
+		return nil
+	}
+	return map[string]*structpb.Value{"password": password}
+}
+
+func reinstallTemplate(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	instance := proto.Clone(inst).(*ipb.Instance)
+	if instance.Config == nil {
+		instance.Config = make(map[string]*structpb.Value)
+	}
+	for _, key := range []string{"template_id", "password", "ssh_public_key"} {
+		if v, ok := data[key]; ok {
+			instance.Config[key] = v
+		}
+	}
+	if _, ok := instance.Config["template_id"]; !ok {
+		return nil, status.Error(codes.InvalidArgument, "No Template id")
+	}
+
+	vmid, err := client.ReinstallTemplate(instance)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Reinstall VM, error: %v", err)
+	}
+
+	if inst.Config == nil {
+		inst.Config = make(map[string]*structpb.Value)
+	}
+	for _, key := range []string{"template_id", "password", "ssh_public_key"} {
+		if v, ok := instance.Config[key]; ok {
+			inst.Config[key] = v
+		}
+	}
+	inst.Data = instance.Data
+	datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+
+	res, err := StatusesClient(client, inst, inst.GetData(), &ipb.InvokeResponse{Result: true})
+	if err != nil {
+		return nil, err
+	}
+	res.Meta[one.DATA_VM_ID] = structpb.NewNumberValue(float64(vmid))
+	res.Meta["template_id"] = inst.Config["template_id"]
+	if password, ok := inst.Config["password"]; ok {
+		res.Meta["password"] = password
+	}
+	return res, nil
+}
+
 // Powers off a running VM
 func Poweroff(
 	client one.IClient,
@@ -343,6 +432,7 @@ func State(
 		"state_str":     state_str,
 		"lcm_state":     lcm_state,
 		"lcm_state_str": lcm_state_str,
+		"rescue":        inst.GetData()["rescue"].GetBoolValue(),
 		"ts":            time.Now().Unix(),
 	}
 
@@ -354,9 +444,13 @@ func State(
 		m["updated"] = upd.GetListValue().AsSlice()
 	}
 
-	m["networking"], err = client.NetworkingVM(vmid)
-	if err != nil {
+	if networking, err := client.NetworkingVM(vmid); err != nil {
 		return nil, status.Errorf(codes.Internal, "Can't get Networking VM, error: %v", err)
+	} else {
+		if ptr := cachedPTRs(inst, networking); len(ptr) > 0 {
+			networking["ptr"] = ptr
+		}
+		m["networking"] = networking
 	}
 
 	m["snapshots"], err = client.GetInstSnapshots(inst)
@@ -693,16 +787,55 @@ func BackupInstance(
 	data map[string]*structpb.Value,
 	sp *sppb.ServicesProvider,
 ) (*ipb.InvokeResponse, error) {
-	logger := log.Named("BackupInstance")
+	playbookUuid, ok := ansibleParams["playbook_uuid"].(string)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "No ansible playbook")
+	}
+
+	return runPoweroffPlaybook(ctx, log.Named("BackupInstance"), client, ansibleParams, playbookUuid, inst, sp, map[string]string{
+		"snapshot_date": data["snapshot_date"].GetStringValue(),
+	})
+}
 
+// Restores backup made by exec action for the given snapshot_date with the restore_playbook_uuid playbook
+func RestoreInstance(
+	ctx context.Context,
+	client ansible.AnsibleServiceClient,
+	ansibleParams map[string]any,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+	sp *sppb.ServicesProvider,
+) (*ipb.InvokeResponse, error) {
+	playbookUuid, ok := ansibleParams["restore_playbook_uuid"].(string)
+	if !ok || playbookUuid == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "No ansible restore playbook")
+	}
+	snapshotDate := data["snapshot_date"].GetStringValue()
+	if snapshotDate == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "No snapshot_date")
+	}
+
+	return runPoweroffPlaybook(ctx, log.Named("RestoreInstance"), client, ansibleParams, playbookUuid, inst, sp, map[string]string{
+		"snapshot_date": snapshotDate,
+	})
+}
+
+// Runs playbook against the datastore host of the VM disks(through the hop if enabled) while VM is powered off.
+// vm_dir is added to the given vars, progress is reported to the job running the action
+func runPoweroffPlaybook(
+	ctx context.Context,
+	logger *zap.Logger,
+	client ansible.AnsibleServiceClient,
+	ansibleParams map[string]any,
+	playbookUuid string,
+	inst *ipb.Instance,
+	sp *sppb.ServicesProvider,
+	vars map[string]string,
+) (*ipb.InvokeResponse, error) {
 	oneClient, err := one.NewClientFromSP(sp, logger)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Error making client: %v", err)
 	}
-	playbookUuid, ok := ansibleParams["playbook_uuid"].(string)
-	if !ok {
-		return nil, status.Errorf(codes.InvalidArgument, "No ansible playbook")
-	}
 	hop, ok := ansibleParams["hop"].(map[string]any)
 	if !ok {
 		return nil, status.Errorf(codes.InvalidArgument, "No ansible playbook")
@@ -729,8 +862,6 @@ func BackupInstance(
 	if vmDir == "" {
 		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Empty vmdir"))
 	}
-	snapshotDate := data["snapshot_date"].GetStringValue()
-
 	datastores, ok := ansibleParams["datastores"].(map[string]any)
 	if !ok {
 		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Failed to find datastores in service provider"))
@@ -816,30 +947,23 @@ func BackupInstance(
 			ansibleInstance,
 		},
 		PlaybookUuid: playbookUuid,
-		Vars: map[string]string{
-			"vm_dir":        vmDir,
-			"snapshot_date": snapshotDate,
-		},
-		Hop: hopInstance,
+		Vars:         vars,
+		Hop:          hopInstance,
 	}
-	logger.Debug("Backup run", zap.Any("run", run))
+	vars["vm_dir"] = vmDir
+	logger.Debug("Playbook run", zap.Any("run", run))
 	create, err := client.Create(ctx, &ansible.CreateRunRequest{
 		Run: run,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ansible run: %w", err)
 	}
-	inst.Data["running_playbook"] = structpb.NewStringValue(create.GetUuid())
-	inst.Data["running_playbook_start"] = structpb.NewNumberValue(float64(time.Now().Unix()))
-	datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+	reportProgress(ctx, 10, "playbook_created")
 
 	// Poweroff and wait for poweroff before start
 	vmState, _, _, _, _ := oneClient.StateVM(vm.ID)
 	if vmState != int(opennebulavm.Poweroff) {
 		if err = oneClient.PoweroffVM(vm.ID, true); err != nil {
-			inst.Data["running_playbook"] = structpb.NewStringValue("")
-			inst.Data["running_playbook_start"] = structpb.NewNumberValue(0)
-			datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
 			return nil, fmt.Errorf("failed to poweroff vm: %w", err)
 		}
 	}
@@ -849,22 +973,27 @@ func BackupInstance(
 		}
 	}()
 	logger.Debug("Waiting for vm poweroff", zap.Int("vm", vm.ID))
-	oneClient.WaitForPoweroff(vm.ID)
+	reportProgress(ctx, 20, "poweroff")
+	if err = oneClient.WaitForPoweroff(vm.ID); err != nil {
+		return nil, fmt.Errorf("failed to poweroff vm: %w", err)
+	}
 	logger.Debug("Poweroff complete", zap.Int("vm", vm.ID))
 
+	reportProgress(ctx, 30, "playbook_running")
 	_, err = client.Exec(context.WithoutCancel(ctx), &ansible.ExecRunRequest{
 		Uuid:       create.GetUuid(),
 		WaitFinish: true,
 	})
 	if err != nil {
-		inst.Data["running_playbook"] = structpb.NewStringValue("")
-		inst.Data["running_playbook_start"] = structpb.NewNumberValue(0)
-		datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
 		return nil, fmt.Errorf("failed to execute ansible run: %w", err)
 	}
+	reportProgress(ctx, 90, "resume")
 
 	return &ipb.InvokeResponse{
 		Result: true,
+		Meta: map[string]*structpb.Value{
+			"playbook": structpb.NewStringValue(create.GetUuid()),
+		},
 	}, nil
 }
 
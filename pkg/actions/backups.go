@@ -0,0 +1,125 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Creates native OpenNebula backup of the VM in the backup_ds Datastore.
+// Optional data: mode(FULL or INCREMENT), keep(number of backups to retain), reset(new incremental chain)
+func BackupCreate(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	mode := data["mode"].GetStringValue()
+	keep := int(data["keep"].GetNumberValue())
+	reset := data["reset"].GetBoolValue()
+
+	err = client.BackupVM(vmid, mode, keep, reset)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Create Backup, error: %v", err)
+	}
+
+	return StatusesClient(client, inst, data, &ipb.InvokeResponse{Result: true})
+}
+
+// Lists VM backups
+func BackupList(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	backups, err := client.GetInstBackups(inst)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't List Backups, error: %v", err)
+	}
+
+	meta, err := structpb.NewValue(map[string]interface{}{"backups": backups})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't pass Backups, error: %v", err)
+	}
+
+	return &ipb.InvokeResponse{Result: true, Meta: meta.GetStructValue().Fields}, nil
+}
+
+// Restores VM from the backup by ID, optionally up to the given increment
+func BackupRestore(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	v, ok := data["backup_id"]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "No Backup id")
+	}
+	backupID := int(v.GetNumberValue())
+
+	incrementID := -1
+	if v, ok := data["increment_id"]; ok {
+		incrementID = int(v.GetNumberValue())
+	}
+
+	err = client.RestoreBackup(vmid, backupID, incrementID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Restore Backup, error: %v", err)
+	}
+
+	return StatusesClient(client, inst, data, &ipb.InvokeResponse{Result: true})
+}
+
+// Deletes VM backup by ID
+func BackupDelete(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	v, ok := data["backup_id"]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "No Backup id")
+	}
+
+	err = client.DeleteBackup(vmid, int(v.GetNumberValue()))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Delete Backup, error: %v", err)
+	}
+
+	return StatusesClient(client, inst, data, &ipb.InvokeResponse{Result: true})
+}
@@ -0,0 +1,91 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"github.com/slntopp/nocloud/pkg/nocloud/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Makes a new VM from the Instance one with the same resources, returns its vmid and image_id of the saved system disk.
+// uuid of the Instance to be attached to the new VM can be given, the VM is named after it then, as deployed ones are.
+// Saved Image stays in use by the new VM, so it's recorded in the Instance clone_images data
+func Clone(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	name := data["name"].GetStringValue()
+	token := ""
+	if uuid := data["uuid"].GetStringValue(); uuid != "" {
+		var err error
+		token, err = auth.MakeTokenInstance(uuid)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Can't generate VM token, error: %v", err)
+		}
+		if name == "" {
+			name = uuid
+		}
+	}
+
+	vmid, imageID, err := client.CloneVM(inst, name, token)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Clone VM, error: %v", err)
+	}
+
+	if inst.Data == nil {
+		inst.Data = make(map[string]*structpb.Value)
+	}
+	images := inst.Data["clone_images"].GetListValue().GetValues()
+	inst.Data["clone_images"] = structpb.NewListValue(&structpb.ListValue{
+		Values: append(images, structpb.NewNumberValue(float64(imageID))),
+	})
+	datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+
+	return &ipb.InvokeResponse{Result: true, Meta: map[string]*structpb.Value{
+		one.DATA_VM_ID: structpb.NewNumberValue(float64(vmid)),
+		"image_id":     structpb.NewNumberValue(float64(imageID)),
+	}}, nil
+}
+
+// Saves VM system disk as private template of the VM owner, returns its template_id and image_id
+func SaveAsTemplate(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	templateID, imageID, err := client.SaveAsTemplate(vmid, data["name"].GetStringValue())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Save VM as Template, error: %v", err)
+	}
+
+	return &ipb.InvokeResponse{Result: true, Meta: map[string]*structpb.Value{
+		"template_id": structpb.NewNumberValue(float64(templateID)),
+		"image_id":    structpb.NewNumberValue(float64(imageID)),
+	}}, nil
+}
@@ -0,0 +1,154 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm/keys"
+	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Length of generated password
+const PASSWORD_LENGTH = 16
+
+// Running VM is rebooted to apply new context unless reboot is false
+func rebootParam(data map[string]*structpb.Value) bool {
+	if v, ok := data["reboot"]; ok {
+		return v.GetBoolValue()
+	}
+	return true
+}
+
+// Sets new VM password, taken from data or generated and returned in password.
+// Password is kept in the VM USER_TEMPLATE, CredentialsFromVM takes it from there for Ansible actions,
+// and published with Instance data, since config changes made by actions aren't sent back to NoCloud
+func ResetPassword(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	password := data["password"].GetStringValue()
+	if password == "" {
+		password = utils.RandomPassword(PASSWORD_LENGTH)
+	}
+
+	err = client.ResetPassword(vmid, password, rebootParam(data))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Reset Password, error: %v", err)
+	}
+
+	publishCredentials(inst, "password", password)
+
+	res, err := StatusesClient(client, inst, inst.GetData(), &ipb.InvokeResponse{Result: true})
+	if err != nil {
+		return nil, err
+	}
+	res.Meta["password"] = structpb.NewStringValue(password)
+	return res, nil
+}
+
+// Replaces VM SSH public keys with ssh_keys list or ssh_public_key(keys separated by new lines)
+func SetSSHKeys(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	var keys []string
+	if list := data["ssh_keys"].GetListValue(); list != nil {
+		for _, key := range list.GetValues() {
+			keys = append(keys, key.GetStringValue())
+		}
+	} else {
+		keys = strings.Split(data["ssh_public_key"].GetStringValue(), "\n")
+	}
+	sshKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); key != "" {
+			sshKeys = append(sshKeys, key)
+		}
+	}
+	if len(sshKeys) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "No SSH keys")
+	}
+	sshKey := strings.Join(sshKeys, "\n")
+
+	err = client.SetSSHKeys(vmid, sshKey, rebootParam(data))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Set SSH Keys, error: %v", err)
+	}
+
+	publishCredentials(inst, "ssh_public_key", sshKey)
+
+	return StatusesClient(client, inst, inst.GetData(), &ipb.InvokeResponse{Result: true})
+}
+
+// Sets credentials to Instance config for the rest of the request and publishes them with Instance data
+func publishCredentials(inst *ipb.Instance, key, value string) {
+	if inst.Config == nil {
+		inst.Config = make(map[string]*structpb.Value)
+	}
+	inst.Config[key] = structpb.NewStringValue(value)
+
+	if inst.Data == nil {
+		inst.Data = make(map[string]*structpb.Value)
+	}
+	inst.Data[key] = structpb.NewStringValue(value)
+	datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+}
+
+// Takes credentials set by ResetPassword and SetSSHKeys from the VM into Instance config.
+// Config changes made by actions aren't sent back to NoCloud, so the VM is the source of truth for them
+func CredentialsFromVM(client one.IClient, inst *ipb.Instance) {
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return
+	}
+	vm, err := client.GetVM(vmid)
+	if err != nil {
+		return
+	}
+
+	if inst.Config == nil {
+		inst.Config = make(map[string]*structpb.Value)
+	}
+	if password, err := vm.UserTemplate.GetStr("PASSWORD"); err == nil && password != "" {
+		inst.Config["password"] = structpb.NewStringValue(password)
+	}
+	if ctx, err := vm.Template.GetVector(string(keys.ContextVec)); err == nil {
+		if sshKey, err := ctx.GetStr(string(keys.SSHPubKey)); err == nil && sshKey != "" {
+			inst.Config["ssh_public_key"] = structpb.NewStringValue(sshKey)
+		}
+	}
+}
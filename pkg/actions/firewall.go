@@ -0,0 +1,106 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Replaces firewall rules of the Instances Group security group the Instance NICs reference.
+// Rules are shared by all Instances of the group. Group must be created by PrepareService from the Instances Group
+// firewall config first, so every NIC references it. If ig is given as {uuid, data}, security_group is set to its data and republished
+func FirewallSet(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	vm, err := client.GetVM(vmid)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "Can't get VM, error: %v", err)
+	}
+
+	rules, err := one.FirewallRulesFromValue(data["rules"])
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid rules: %v", err)
+	}
+
+	// NICs made before the group exists don't reference it, so rules wouldn't be applied to them
+	id, err := client.GetVMSecurityGroup(vm)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, "Security group isn't created yet, firewall must be set in the Instances Group config first")
+	}
+
+	err = client.SetFirewallRules(id, rules)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Set Firewall Rules, error: %v", err)
+	}
+
+	ig := data["ig"].GetStructValue().GetFields()
+	if uuid, igData := ig["uuid"].GetStringValue(), ig["data"].GetStructValue().GetFields(); uuid != "" && igData != nil {
+		igData["security_group"] = structpb.NewNumberValue(float64(id))
+		datas.DataPublisher(datas.POST_IG_DATA)(uuid, igData)
+	}
+
+	return &ipb.InvokeResponse{Result: true, Meta: map[string]*structpb.Value{
+		"security_group": structpb.NewNumberValue(float64(id)),
+		"rules":          one.FirewallRulesValue(rules),
+	}}, nil
+}
+
+// Lists firewall rules of the Instances Group security group the Instance NICs reference, empty if there is no group
+func FirewallList(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	vm, err := client.GetVM(vmid)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "Can't get VM, error: %v", err)
+	}
+
+	id, err := client.GetVMSecurityGroup(vm)
+	if err != nil {
+		return &ipb.InvokeResponse{Result: true, Meta: map[string]*structpb.Value{
+			"rules": one.FirewallRulesValue(nil),
+		}}, nil
+	}
+
+	rules, err := client.GetFirewallRules(id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Get Firewall Rules, error: %v", err)
+	}
+
+	return &ipb.InvokeResponse{Result: true, Meta: map[string]*structpb.Value{
+		"rules": one.FirewallRulesValue(rules),
+	}}, nil
+}
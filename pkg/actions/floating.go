@@ -0,0 +1,103 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"slices"
+
+	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Attaches address from the Instances Group public network to the VM, it's kept in floating_ips data until unassigned
+func IPAssign(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	ip := data["ip"].GetStringValue()
+	if ip == "" {
+		return nil, status.Error(codes.InvalidArgument, "IP is not given")
+	}
+
+	err = client.AssignIP(vmid, ip)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Assign IP, error: %v", err)
+	}
+
+	setFloatingIPs(inst, append(floatingIPs(inst), ip))
+	datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+
+	return StatusesClient(client, inst, inst.GetData(), &ipb.InvokeResponse{Result: true})
+}
+
+// Detaches floating IP from the VM, address stays reserved for the Instances Group and can be assigned to another Instance
+func IPUnassign(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	ip := data["ip"].GetStringValue()
+	if ip == "" {
+		return nil, status.Error(codes.InvalidArgument, "IP is not given")
+	}
+
+	err = client.UnassignIP(vmid, ip)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Unassign IP, error: %v", err)
+	}
+
+	releaseInstancePTRs(inst, ip)
+	setFloatingIPs(inst, slices.DeleteFunc(floatingIPs(inst), func(s string) bool { return s == ip }))
+	datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+
+	return StatusesClient(client, inst, inst.GetData(), &ipb.InvokeResponse{Result: true})
+}
+
+func floatingIPs(inst *ipb.Instance) []string {
+	var ips []string
+	for _, ip := range inst.GetData()["floating_ips"].GetListValue().GetValues() {
+		ips = append(ips, ip.GetStringValue())
+	}
+	return ips
+}
+
+func setFloatingIPs(inst *ipb.Instance, ips []string) {
+	values := make([]*structpb.Value, 0, len(ips))
+	for _, ip := range ips {
+		values = append(values, structpb.NewStringValue(ip))
+	}
+	if inst.Data == nil {
+		inst.Data = make(map[string]*structpb.Value)
+	}
+	inst.Data["floating_ips"] = structpb.NewListValue(&structpb.ListValue{Values: values})
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Attaches allowed ISO Image by image_id, VM boots from it unless boot is false
+func ISOAttach(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	v, ok := data["image_id"]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "No Image id")
+	}
+	imageID := int(v.GetNumberValue())
+
+	boot := true
+	if v, ok := data["boot"]; ok {
+		boot = v.GetBoolValue()
+	}
+
+	err = client.AttachISO(vmid, imageID, boot)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Attach ISO, error: %v", err)
+	}
+
+	inst.Data["iso"] = structpb.NewNumberValue(float64(imageID))
+	datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+
+	return StatusesClient(client, inst, inst.GetData(), &ipb.InvokeResponse{Result: true})
+}
+
+// Detaches ISO Image
+func ISODetach(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	err = client.DetachISO(vmid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Detach ISO, error: %v", err)
+	}
+
+	delete(inst.Data, "iso")
+	datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+
+	return StatusesClient(client, inst, inst.GetData(), &ipb.InvokeResponse{Result: true})
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"slices"
+
+	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Moves Instance VM to the ONe User of another Instances Group, both groups are given as {uuid, data, resources}:
+// target_ig is required and must have userid in data, source_ig is optional.
+// Groups data is updated with their User VNets and public addresses count and republished,
+// target group ips_public including the moved Instance addresses is returned in meta
+func MoveInstance(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	target := data["target_ig"].GetStructValue().GetFields()
+	targetData := target["data"].GetStructValue().GetFields()
+	if target["uuid"].GetStringValue() == "" || targetData["userid"] == nil {
+		return nil, status.Error(codes.InvalidArgument, "Target Instances Group uuid and userid must be given")
+	}
+	uid := int(targetData["userid"].GetNumberValue())
+
+	networking, err := client.NetworkingVM(vmid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't get Networking VM, error: %v", err)
+	}
+
+	err = client.MoveVM(vmid, targetData)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Move VM, error: %v", err)
+	}
+
+	// Addresses VM doesn't have anymore lose their PTR records
+	changed := false
+	if moved, err := client.NetworkingVM(vmid); err == nil {
+		current := PublicAddresses(moved)
+		changed = releaseInstancePTRs(inst, slices.DeleteFunc(PublicAddresses(networking), func(ip string) bool {
+			return slices.Contains(current, ip)
+		})...)
+	}
+
+	// Floating IPs are kept by the source group
+	if _, ok := inst.GetData()["floating_ips"]; ok {
+		delete(inst.Data, "floating_ips")
+		changed = true
+	}
+	if changed {
+		datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+	}
+
+	// Floating IPs aren't counted in Instance ips_public, so it's exactly what moves with the VM
+	moved := int(inst.GetResources()["ips_public"].GetNumberValue())
+	targetData = userVNetsData(client, uid, targetData)
+	addPublicIPs(targetData, moved)
+
+	publisher := datas.DataPublisher(datas.POST_IG_DATA)
+	publisher(target["uuid"].GetStringValue(), targetData)
+
+	source := data["source_ig"].GetStructValue().GetFields()
+	if uuid := source["uuid"].GetStringValue(); uuid != "" {
+		sourceData := source["data"].GetStructValue().GetFields()
+		if sourceData["userid"] != nil {
+			sourceData = userVNetsData(client, int(sourceData["userid"].GetNumberValue()), sourceData)
+		}
+		addPublicIPs(sourceData, -moved)
+		publisher(uuid, sourceData)
+	}
+
+	res, err := StatusesClient(client, inst, inst.GetData(), &ipb.InvokeResponse{Result: true})
+	if err != nil {
+		return nil, err
+	}
+	res.Meta["userid"] = structpb.NewNumberValue(float64(uid))
+	ipsPublic := int(target["resources"].GetStructValue().GetFields()["ips_public"].GetNumberValue()) + moved
+	res.Meta["ips_public"] = structpb.NewNumberValue(float64(ipsPublic))
+	return res, nil
+}
+
+// Changes public_ips_total of Instances Group data by the given amount of addresses, it never goes below zero
+func addPublicIPs(data map[string]*structpb.Value, n int) {
+	if data == nil || n == 0 {
+		return
+	}
+	total := max(int(data["public_ips_total"].GetNumberValue())+n, 0)
+	data["public_ips_total"] = structpb.NewNumberValue(float64(total))
+}
+
+// Sets userid, public_vn and private_vn of Instances Group data to the ones of the given ONe User
+func userVNetsData(client one.IClient, uid int, data map[string]*structpb.Value) map[string]*structpb.Value {
+	if data == nil {
+		data = make(map[string]*structpb.Value)
+	}
+	data["userid"] = structpb.NewNumberValue(float64(uid))
+	if vn, err := client.GetUserPublicVNet(uid); err == nil {
+		data["public_vn"] = structpb.NewNumberValue(float64(vn))
+	}
+	if vn, err := client.GetUserPrivateVNet(uid); err == nil {
+		data["private_vn"] = structpb.NewNumberValue(float64(vn))
+	}
+	return data
+}
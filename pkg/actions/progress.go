@@ -0,0 +1,79 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"context"
+
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Actions run as jobs: Invoke returns job ID right away and the action result is stored with the job
+var AsyncActions = map[string]bool{
+	"restore_backup":   true,
+	"backup_restore":   true,
+	"rescue_enter":     true,
+	"rescue_exit":      true,
+	"iso_attach":       true,
+	"iso_detach":       true,
+	"clone":            true,
+	"save_as_template": true,
+	"move_instance":    true,
+	"ip_assign":        true,
+	"ip_unassign":      true,
+}
+
+// Actions which used to be run in place, they're run as jobs only if called with async: true,
+// so existing callers still get the action result
+var OptInAsyncActions = map[string]bool{
+	"exec":      true,
+	"reinstall": true,
+}
+
+// Tells whether the action is run as job
+func IsAsync(method string, params map[string]*structpb.Value) bool {
+	if OptInAsyncActions[method] {
+		return params["async"].GetBoolValue()
+	}
+	return AsyncActions[method]
+}
+
+// Result Meta keys holding credentials, they're never stored with jobs
+var SecretMeta = []string{"password", "rescue_password"}
+
+// Prepares params of async actions generating credentials, so they're given in Invoke response right away
+// instead of the job result. Returns secrets for the response
+var JobSecrets = map[string]func(inst *ipb.Instance, data map[string]*structpb.Value) map[string]*structpb.Value{
+	"rescue_enter": RescueSecrets,
+	"reinstall":    ReinstallSecrets,
+}
+
+// Reports action progress(0-100) and the current stage
+type ProgressFunc func(progress int, stage string)
+
+type progressKey struct{}
+
+func WithProgress(ctx context.Context, report ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
+// Reports progress to the job running the action, if any
+func reportProgress(ctx context.Context, progress int, stage string) {
+	if report, ok := ctx.Value(progressKey{}).(ProgressFunc); ok {
+		report(progress, stage)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"context"
+	"slices"
+
+	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/rdns"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Sets PTR record of the Instance public address, empty ptr removes the record
+func SetPTR(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	provider, ok := rdns.Get()
+	if !ok {
+		return nil, status.Error(codes.Unavailable, "rDNS management is not configured")
+	}
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	ip := data["ip"].GetStringValue()
+	if ip == "" {
+		return nil, status.Error(codes.InvalidArgument, "IP is not given")
+	}
+
+	networking, err := client.NetworkingVM(vmid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't get Networking VM, error: %v", err)
+	}
+	if !slices.Contains(PublicAddresses(networking), ip) {
+		return nil, status.Errorf(codes.InvalidArgument, "IP %s isn't public address of the Instance", ip)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rdns.Timeout)
+	defer cancel()
+
+	ptr := data["ptr"].GetStringValue()
+	if ptr == "" {
+		err = provider.DeletePTR(ctx, ip)
+	} else if ptr, err = rdns.Canonical(ptr); err == nil {
+		err = provider.SetPTR(ctx, ip, ptr)
+	} else {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Set PTR, error: %v", err)
+	}
+
+	// Records are cached in Instance data, so State doesn't query the provider on every Monitoring pass
+	ptrs := lookupPTRs(ctx, provider, PublicAddresses(networking))
+	if ptrs == nil {
+		ptrs = cachedPTRs(inst, networking)
+		if ptr == "" {
+			delete(ptrs, ip)
+		} else {
+			ptrs[ip] = ptr
+		}
+	}
+	setCachedPTRs(inst, ptrs)
+	datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+
+	return &ipb.InvokeResponse{Result: true, Meta: map[string]*structpb.Value{
+		"ip":  structpb.NewStringValue(ip),
+		"ptr": structpb.NewStringValue(ptr),
+	}}, nil
+}
+
+// Returns public IPv4 and IPv6 addresses from the networking state meta
+func PublicAddresses(networking map[string]interface{}) []string {
+	var res []string
+	for _, key := range []string{"public", "public_ipv6"} {
+		ips, _ := networking[key].([]interface{})
+		for _, ip := range ips {
+			if ip, ok := ip.(string); ok {
+				res = append(res, ip)
+			}
+		}
+	}
+	return res
+}
+
+// Returns PTR records of the addresses, nil if lookup failed
+func lookupPTRs(ctx context.Context, provider rdns.Provider, ips []string) map[string]interface{} {
+	records, err := provider.LookupPTR(ctx, ips)
+	if err != nil {
+		log.Warn("Can't lookup PTR records", zap.Strings("ips", ips), zap.Error(err))
+		return nil
+	}
+	res := make(map[string]interface{}, len(records))
+	for ip, ptr := range records {
+		res[ip] = ptr
+	}
+	return res
+}
+
+// Returns PTR records cached in Instance data by set_ptr for the current public addresses
+func cachedPTRs(inst *ipb.Instance, networking map[string]interface{}) map[string]interface{} {
+	cached := inst.GetData()["ptr"].GetStructValue().AsMap()
+	res := make(map[string]interface{}, len(cached))
+	for _, ip := range PublicAddresses(networking) {
+		if ptr, ok := cached[ip]; ok {
+			res[ip] = ptr
+		}
+	}
+	return res
+}
+
+func setCachedPTRs(inst *ipb.Instance, ptrs map[string]interface{}) {
+	value, err := structpb.NewStruct(ptrs)
+	if err != nil {
+		return
+	}
+	if inst.Data == nil {
+		inst.Data = make(map[string]*structpb.Value)
+	}
+	inst.Data["ptr"] = structpb.NewStructValue(value)
+}
+
+// Removes PTR records of the addresses detached from the Instance VM and drops them from the cache.
+// Returns true if Instance data is changed
+func releaseInstancePTRs(inst *ipb.Instance, ips ...string) bool {
+	if err := rdns.Release(ips...); err != nil {
+		log.Warn("Can't release PTR records", zap.String("instance", inst.GetUuid()), zap.Error(err))
+	}
+	cached := inst.GetData()["ptr"].GetStructValue().GetFields()
+	changed := false
+	for _, ip := range ips {
+		if _, ok := cached[ip]; ok {
+			delete(cached, ip)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Removes PTR records of the Instances public addresses, as they are going back to the pool
+func ReleasePTRs(client one.IClient, instances []*ipb.Instance) {
+	if _, ok := rdns.Get(); !ok {
+		return
+	}
+
+	for _, inst := range instances {
+		vmid, err := one.GetVMIDFromData(client, inst)
+		if err != nil {
+			continue
+		}
+		networking, err := client.NetworkingVM(vmid)
+		if err != nil {
+			log.Warn("Can't get Networking VM to release PTRs", zap.String("instance", inst.GetUuid()), zap.Error(err))
+			continue
+		}
+		releaseInstancePTRs(inst, PublicAddresses(networking)...)
+	}
+}
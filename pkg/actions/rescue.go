@@ -0,0 +1,93 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package actions
+
+import (
+	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Length of generated rescue password
+const RESCUE_PASSWORD_LENGTH = 16
+
+// Generates rescue password into data unless given, returns it in rescue_password
+func RescueSecrets(_ *ipb.Instance, data map[string]*structpb.Value) map[string]*structpb.Value {
+	if data["password"].GetStringValue() == "" {
+		data["password"] = structpb.NewStringValue(utils.RandomPassword(RESCUE_PASSWORD_LENGTH))
+	}
+	return map[string]*structpb.Value{"rescue_password": data["password"]}
+}
+
+// Boots VM into rescue system, temporary password is taken from data or generated and returned in rescue_password
+func RescueEnter(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	password := data["password"].GetStringValue()
+	if password == "" {
+		password = utils.RandomPassword(RESCUE_PASSWORD_LENGTH)
+	}
+
+	err = client.RescueEnter(vmid, password)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Enter Rescue Mode, error: %v", err)
+	}
+
+	inst.Data["rescue"] = structpb.NewBoolValue(true)
+	datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+
+	res, err := StatusesClient(client, inst, inst.GetData(), &ipb.InvokeResponse{Result: true})
+	if err != nil {
+		return nil, err
+	}
+	res.Meta["rescue_password"] = structpb.NewStringValue(password)
+	return res, nil
+}
+
+// Boots VM back from its own disks
+func RescueExit(
+	client one.IClient,
+	inst *ipb.Instance,
+	data map[string]*structpb.Value,
+) (*ipb.InvokeResponse, error) {
+
+	vmid, err := one.GetVMIDFromData(client, inst)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "VM ID is not present or can't be gathered by name")
+	}
+
+	err = client.RescueExit(vmid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't Exit Rescue Mode, error: %v", err)
+	}
+
+	inst.Data["rescue"] = structpb.NewBoolValue(false)
+	datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
+
+	return StatusesClient(client, inst, inst.GetData(), &ipb.InvokeResponse{Result: true})
+}
@@ -38,17 +38,33 @@ func GetUsers(client one.IClient, data map[string]*structpb.Value) (*sppb.Invoke
 			data["vm_name"] = vm.Name
 			resources["cpu"], _ = vm.Template.GetVCPU()
 			resources["ram"], _ = vm.Template.GetMemory()
-			resources["drive_type"], _ = vm.Template.GetStrFromVec("DISK", "DRIVE_TYPE")
-			driveSize, _ := vm.Template.GetStrFromVec("DISK", "SIZE")
-			resources["drive_size"], _ = strconv.Atoi(driveSize)
+			if disks := vm.Template.GetDisks(); len(disks) > 0 {
+				resources["drive_type"], _ = disks[0].GetStr("DRIVE_TYPE")
+				driveSize, _ := disks[0].GetStr("SIZE")
+				resources["drive_size"], _ = strconv.Atoi(driveSize)
+			}
+			if dataDisks := one.DataDisksFromVM(&vm.Template); len(dataDisks) > 0 {
+				var disks []interface{}
+				for i, disk := range dataDisks {
+					driveType, _ := disk.GetStr("DRIVE_TYPE")
+					size, _ := disk.GetInt("SIZE")
+					disks = append(disks, map[string]interface{}{"id": one.DataDiskID(&disk, i), "size": size, "type": driveType})
+				}
+				resources["disks"] = disks
+			}
 			config["template_id"], _ = vm.Template.GetInt("TEMPLATE_ID")
 			config["password"], _ = vm.UserTemplate.GetStr("PASSWORD")
 			publicIps, privateIps := 0, 0
+			publicIPv6, privateIPv6 := 0, 0
 			nics := vm.Template.GetVectors("NIC")
 			for _, nic := range nics {
 				str, _ := nic.GetStr("NETWORK")
 				if strings.HasSuffix(str, "pub-vnet") {
 					publicIps += 1
+				} else if strings.HasSuffix(str, "pub6-vnet") {
+					publicIPv6 += 1
+				} else if strings.HasSuffix(str, "private6-vnet") {
+					privateIPv6 += 1
 				} else {
 					privateIps += 1
 				}
@@ -57,6 +73,12 @@ func GetUsers(client one.IClient, data map[string]*structpb.Value) (*sppb.Invoke
 			groupPublicIps += publicIps
 			resources["ips_private"] = privateIps
 			groupPrivateIps += privateIps
+			if publicIPv6 > 0 {
+				resources["public_ipv6"] = publicIPv6
+			}
+			if privateIPv6 > 0 {
+				resources["private_ipv6"] = privateIPv6
+			}
 
 			vmInfo["config"] = config
 			vmInfo["data"] = data
@@ -73,6 +95,10 @@ func GetUsers(client one.IClient, data map[string]*structpb.Value) (*sppb.Invoke
 		for _, network := range userNetworks.VirtualNetworks {
 			if strings.HasSuffix(network.Name, "pub-vnet") {
 				igData["public_vn"] = network.ID
+			} else if strings.HasSuffix(network.Name, "pub6-vnet") {
+				igData["public_vn6"] = network.ID
+			} else if strings.HasSuffix(network.Name, "private6-vnet") {
+				igData["private_vn6"] = network.ID
 			} else {
 				igData["private_vn"] = network.ID
 			}
@@ -108,40 +108,31 @@ func StatusesClient(
 	}
 	history := historyVal.AsMap()
 	networkingValue := networking.GetStructValue().AsMap()
-	publicHistory, ok := history["public"].([]interface{})
-	if !ok {
-		publicHistory = []interface{}{}
-	}
-	privateHistory, ok := history["private"].([]interface{})
-	if !ok {
-		privateHistory = []interface{}{}
-	}
-	publicIps, ok := networkingValue["public"].([]interface{})
-	if ok {
-		for _, val := range publicIps {
-			if !slices.Contains(publicHistory, val) {
-				publicHistory = append(publicHistory, val)
-			}
+	for _, key := range []string{"public", "private", "public_ipv6", "private_ipv6"} {
+		ips, ok := networkingValue[key].([]interface{})
+		if !ok && history[key] == nil && strings.HasSuffix(key, "_ipv6") {
+			continue
 		}
-	}
-	privateIps, ok := networkingValue["private"].([]interface{})
-	if ok {
-		for _, val := range privateIps {
-			if !slices.Contains(privateHistory, val) {
-				privateHistory = append(privateHistory, val)
+		keyHistory, ok := history[key].([]interface{})
+		if !ok {
+			keyHistory = []interface{}{}
+		}
+		for _, val := range ips {
+			if !slices.Contains(keyHistory, val) {
+				keyHistory = append(keyHistory, val)
 			}
 		}
+		history[key] = keyHistory
 	}
-	history["public"] = publicHistory
-	history["private"] = privateHistory
 	historyVal, _ = structpb.NewStruct(history)
 	if data != nil {
 		data[ipsHistoryKey] = structpb.NewStructValue(historyVal)
 	}
 
-	_, err = datas.StIPub(request)
-	if err != nil {
-		log.Error("Failed to post State", zap.Any("instance_state", request), zap.Error(err))
+	if datas.StIPub != nil {
+		if _, err = datas.StIPub(request); err != nil {
+			log.Error("Failed to post State", zap.Any("instance_state", request), zap.Error(err))
+		}
 	}
 
 	return &ipb.InvokeResponse{Result: result.Result, Meta: result.Meta}, nil
@@ -0,0 +1,244 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	"go.uber.org/zap"
+)
+
+const (
+	BACKUP_MODE_FULL      = "FULL"
+	BACKUP_MODE_INCREMENT = "INCREMENT"
+)
+
+// BACKUP_CONFIG of the VM, OpenNebula 6.6+
+type BackupConfig struct {
+	Mode     string `xml:"MODE,omitempty"`
+	KeepLast string `xml:"KEEP_LAST,omitempty"`
+}
+
+// BACKUPS section of the VM body, goca schemas don't have it yet
+type VMBackups struct {
+	Config BackupConfig `xml:"BACKUP_CONFIG"`
+	IDs    []int        `xml:"BACKUP_IDS>ID"`
+}
+
+// VM template sections which one.vm.updateconf replaces as a whole
+var updateConfSections = []string{"OS", "FEATURES", "INPUT", "GRAPHICS", "RAW", "CONTEXT", "CPU_MODEL"}
+
+// Updates VM configuration with the given vectors. The rest of updatable sections are sent as they are,
+// since one.vm.updateconf drops sections missing in the template
+func (c *ONeClient) updateConf(vmid int, vectors ...*dynamic.Vector) error {
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return err
+	}
+
+	replaced := make(map[string]bool)
+	for _, v := range vectors {
+		replaced[v.Key()] = true
+	}
+
+	tmpl := dynamic.NewTemplate()
+	for _, key := range updateConfSections {
+		if replaced[key] {
+			continue
+		}
+		for _, v := range VM.Template.GetVectors(key) {
+			tmpl.Elements = append(tmpl.Elements, v)
+		}
+	}
+	for _, v := range vectors {
+		tmpl.Elements = append(tmpl.Elements, v)
+	}
+
+	return c.ctrl.VM(vmid).UpdateConf(tmpl.String())
+}
+
+// Returns copy of the VM CONTEXT with the given keys set, empty value removes the key
+func contextWith(VM *vm.VM, pairs map[string]string) *dynamic.Vector {
+	ctx := dynamic.NewVector("CONTEXT")
+	if current, err := VM.Template.GetVector("CONTEXT"); err == nil {
+		for _, pair := range current.Pairs {
+			if _, ok := pairs[pair.Key()]; !ok {
+				ctx.AddPair(pair.Key(), pair.Value)
+			}
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(pairs)) {
+		if pairs[key] != "" {
+			ctx.AddPair(key, pairs[key])
+		}
+	}
+	return ctx
+}
+
+// Reads BACKUPS section of the VM
+func (c *ONeClient) GetVMBackups(vmid int) (*VMBackups, error) {
+	resp, err := c.Client.Call("one.vm.info", vmid, false)
+	if err != nil {
+		return nil, err
+	}
+	res := struct {
+		Backups VMBackups `xml:"BACKUPS"`
+	}{}
+	if err := xml.Unmarshal([]byte(resp.Body()), &res); err != nil {
+		return nil, err
+	}
+	return &res.Backups, nil
+}
+
+// Starts VM backup to the Datastore set by backup_ds var. Mode and keep(number of backups to retain)
+// fallback to backup_mode and backup_keep vars. Reset starts new incremental chain with a full backup
+func (c *ONeClient) BackupVM(vmid int, mode string, keep int, reset bool) error {
+	log := c.log.Named("BackupVM").With(zap.Int("vmid", vmid))
+
+	ds, err := GetVarValue(c.vars[BACKUP_DS], "default")
+	if err != nil {
+		return fmt.Errorf("backup datastore isn't set: %w", err)
+	}
+
+	if mode == "" {
+		mode = BACKUP_MODE_FULL
+		if v, err := GetVarValue(c.vars[BACKUP_MODE], "default"); err == nil {
+			mode = v.GetStringValue()
+		}
+	}
+	mode = strings.ToUpper(mode)
+	if mode != BACKUP_MODE_FULL && mode != BACKUP_MODE_INCREMENT {
+		return fmt.Errorf("unknown backup mode %s", mode)
+	}
+	if keep <= 0 {
+		if v, err := GetVarValue(c.vars[BACKUP_KEEP], "default"); err == nil {
+			keep = int(v.GetNumberValue())
+		}
+	}
+
+	backups, err := c.GetVMBackups(vmid)
+	if err != nil {
+		return err
+	}
+	config := BackupConfig{Mode: mode}
+	if keep > 0 {
+		config.KeepLast = strconv.Itoa(keep)
+	}
+	if backups.Config != config {
+		log.Debug("Updating backup config", zap.Any("config", config))
+		vec := dynamic.NewVector("BACKUP_CONFIG")
+		vec.AddPair("MODE", config.Mode)
+		if config.KeepLast != "" {
+			vec.AddPair("KEEP_LAST", config.KeepLast)
+		}
+		if err := c.updateConf(vmid, vec); err != nil {
+			return err
+		}
+	}
+
+	return c.ctrl.VM(vmid).Backup(int(ds.GetNumberValue()), reset)
+}
+
+// Restores VM disks in place from the backup Image, incrementID -1 stands for the latest increment.
+// VM is powered off for restore and resumed back if it was running
+func (c *ONeClient) RestoreBackup(vmid, imageID, incrementID int) error {
+	log := c.log.Named("RestoreBackup").With(zap.Int("vmid", vmid), zap.Int("image", imageID))
+
+	backups, err := c.GetVMBackups(vmid)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(backups.IDs, imageID) {
+		return fmt.Errorf("image %d isn't a backup of VM %d", imageID, vmid)
+	}
+
+	state, _, _, _, err := c.StateVM(vmid)
+	if err != nil {
+		return err
+	}
+	running := state != int(vm.Poweroff)
+	if running {
+		if err := c.PoweroffVM(vmid, true); err != nil {
+			return err
+		}
+		if err := c.WaitForPoweroff(vmid); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.Client.Call("one.vm.restore", vmid, imageID, incrementID, -1); err != nil {
+		return err
+	}
+	// VM is back to POWEROFF once disks are restored
+	if err := c.WaitForPoweroff(vmid); err != nil {
+		return err
+	}
+
+	if running {
+		if err := c.ResumeVM(vmid); err != nil {
+			log.Error("Error resuming VM after restore", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// Deletes backup Image of the VM
+func (c *ONeClient) DeleteBackup(vmid, imageID int) error {
+	backups, err := c.GetVMBackups(vmid)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(backups.IDs, imageID) {
+		return fmt.Errorf("image %d isn't a backup of VM %d", imageID, vmid)
+	}
+	return c.ctrl.Image(imageID).Delete()
+}
+
+// Lists VM backups as map of backup Image ID to its name, registration timestamp and size(MB)
+func (c *ONeClient) GetInstBackups(inst *pb.Instance) (map[string]interface{}, error) {
+	vmid, err := GetVMIDFromData(c, inst)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := c.GetVMBackups(vmid)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]interface{}, len(backups.IDs))
+	for _, id := range backups.IDs {
+		image, err := c.GetImage(id)
+		if err != nil {
+			c.log.Warn("Error getting backup Image", zap.Int("image", id), zap.Error(err))
+			continue
+		}
+		res[strconv.Itoa(id)] = map[string]interface{}{
+			"name": image.Name,
+			"ts":   image.RegTime,
+			"size": image.Size,
+			"mode": backups.Config.Mode,
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestBackups(t *testing.T) {
+	c, clock, ig := setup(t)
+	vmid := deploy(t, c, ig)
+	inst := ig.Instances[0]
+	s := c.Server
+
+	if err := c.BackupVM(vmid, "", 0, false); err == nil {
+		t.Fatal("Expected error without backup datastore set")
+	}
+
+	c.SetVars(vars(map[string]*sppb.Var{
+		one.BACKUP_DS:   {Value: map[string]*structpb.Value{"default": structpb.NewNumberValue(110)}},
+		one.BACKUP_KEEP: {Value: map[string]*structpb.Value{"default": structpb.NewNumberValue(2)}},
+	}))
+	for i := 0; i < 3; i++ {
+		clock.Add(time.Hour)
+		if err := c.BackupVM(vmid, "", 0, false); err != nil {
+			t.Fatalf("BackupVM() => %v", err)
+		}
+	}
+
+	calls := s.CallsTo("one.vm.backup")
+	if len(calls) != 3 || calls[0].Args[1] != int64(110) || calls[0].Args[2] != false {
+		t.Fatalf("Unexpected backup calls: %+v", calls)
+	}
+	if calls := s.CallsTo("one.vm.updateconf"); len(calls) != 1 || !strings.Contains(calls[0].Args[1].(string), "KEEP_LAST") {
+		t.Fatalf("Backup config must be set once: %+v", calls)
+	}
+	v, _ := c.GetVM(vmid)
+	if len(v.Template.GetVectors("CONTEXT")) != 1 {
+		t.Fatal("CONTEXT must survive updateconf")
+	}
+
+	backups, err := c.GetInstBackups(inst)
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("Only last two backups must be kept: %v, %v", backups, err)
+	}
+
+	// Incremental chain
+	if err := c.BackupVM(vmid, "increment", 1, true); err != nil {
+		t.Fatalf("BackupVM() => %v", err)
+	}
+	if err := c.BackupVM(vmid, "increment", 1, false); err != nil {
+		t.Fatalf("BackupVM() => %v", err)
+	}
+	b, _ := c.GetVMBackups(vmid)
+	last := b.IDs[len(b.IDs)-1]
+	if b.Config.Mode != one.BACKUP_MODE_INCREMENT || c.Increments(last) != 2 {
+		t.Fatalf("Expected second increment of %d: %+v, %d", last, b, c.Increments(last))
+	}
+
+	s.Reset()
+	if err := c.RestoreBackup(vmid, last, -1); err != nil {
+		t.Fatalf("RestoreBackup() => %v", err)
+	}
+	actions := s.CallsTo("one.vm.action")
+	if len(actions) != 2 || actions[0].Args[0] != "poweroff-hard" || actions[1].Args[0] != "resume" {
+		t.Fatalf("Unexpected actions: %+v", actions)
+	}
+	if len(s.CallsTo("one.vm.restore")) != 1 {
+		t.Fatal("VM must be restored")
+	}
+
+	if err := c.DeleteBackup(vmid, 1000); err == nil {
+		t.Fatal("Expected error deleting foreign Image")
+	}
+	if err := c.DeleteBackup(vmid, last); err != nil {
+		t.Fatalf("DeleteBackup() => %v", err)
+	}
+	if b, _ := c.GetVMBackups(vmid); slices.Contains(b.IDs, last) {
+		t.Fatalf("Backup %d must be deleted: %v", last, b.IDs)
+	}
+}
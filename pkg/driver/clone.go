@@ -0,0 +1,269 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/image"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	tmpl "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/template"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm/keys"
+	driver_shared "github.com/slntopp/nocloud-driver-ione/pkg/shared"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Maximum time to wait for Image to be ready, copying disks takes much longer than VM state changes
+var ImageWaitTimeout = time.Hour
+
+// Returns ID of the VM system disk: the first one, which isn't data volume, rescue or ISO
+func SystemDiskID(VM *vm.VM) (int, bool) {
+	for _, disk := range VM.Template.GetDisks() {
+		marked := false
+		for _, marker := range []shared.DiskKeys{driver_shared.NOCLOUD_DATA_DISK, driver_shared.NOCLOUD_RESCUE, driver_shared.NOCLOUD_ISO} {
+			if value, _ := disk.Get(marker); value == "YES" {
+				marked = true
+			}
+		}
+		if marked {
+			continue
+		}
+		if id, err := disk.ID(); err == nil {
+			return id, true
+		}
+	}
+	return -1, false
+}
+
+// Saves VM disk current state as a new Image, returns its ID. Image is being copied for a while after that, see waitForImage
+func (c *ONeClient) DiskSaveAs(vmid, diskID int, name string) (int, error) {
+	return c.ctrl.VM(vmid).Disk(diskID).Saveas(name, "", -1)
+}
+
+// Polls Image state until it's ready, gives up after ImageWaitTimeout or if Image failed
+func (c *ONeClient) waitForImage(id int) error {
+	deadline := clock.Now().Add(ImageWaitTimeout)
+	for {
+		img, err := c.GetImage(id)
+		if err == nil {
+			switch image.State(img.StateRaw) {
+			case image.Ready:
+				return nil
+			case image.Error:
+				return fmt.Errorf("image %d is in error state", id)
+			}
+		}
+		if clock.Now().After(deadline) {
+			return fmt.Errorf("image %d isn't ready in %v", id, ImageWaitTimeout)
+		}
+		time.Sleep(StateWaitInterval)
+	}
+}
+
+// Makes a new VM out of the Instance one: system disk is saved as Image(owned by the VM owner) and the new VM
+// is made from it with the same resources, in the owner's VNets. Data volumes are created empty.
+// Token and name are for the new VM, name defaults to the source VM name with -clone suffix. Returns new VM and Image IDs.
+// Image is deleted if VM isn't made, otherwise it's kept, as it's in use by the new VM, and must be recorded by the caller
+func (c *ONeClient) CloneVM(inst *pb.Instance, name, token string) (int, int, error) {
+	log := c.log.Named("CloneVM").With(zap.String("instance", inst.GetUuid()))
+
+	vmid, err := GetVMIDFromData(c, inst)
+	if err != nil {
+		return -1, -1, err
+	}
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return -1, -1, err
+	}
+	diskID, ok := SystemDiskID(VM)
+	if !ok {
+		return -1, -1, errors.New("VM has no system disk")
+	}
+	if name == "" {
+		name = VM.Name + "-clone"
+	}
+
+	// Instance is taken as it is, except the disks
+	ig := &pb.InstancesGroup{Data: map[string]*structpb.Value{
+		"userid": structpb.NewNumberValue(float64(VM.UID)),
+	}}
+	// Addresses are reserved before NICs are requested, as for the new Instances
+	resources := inst.GetResources()
+	if n := int(resources["ips_public"].GetNumberValue()); n > 0 {
+		vn, err := c.GetUserPublicVNet(VM.UID)
+		if err != nil {
+			vn = -1
+		}
+		vn, err = c.reserveFreeLeases(vn, n, func(n int) (int, error) {
+			return c.ReservePublicIP(VM.UID, n)
+		})
+		if err != nil {
+			return -1, -1, fmt.Errorf("can't reserve public addresses for user %d: %w", VM.UID, err)
+		}
+		ig.Data["public_vn"] = structpb.NewNumberValue(float64(vn))
+	}
+	if resources["ips_private"].GetNumberValue() > 0 {
+		vn, err := c.GetUserPrivateVNet(VM.UID)
+		if err != nil {
+			return -1, -1, fmt.Errorf("can't get private VNet of user %d: %w", VM.UID, err)
+		}
+		ig.Data["private_vn"] = structpb.NewNumberValue(float64(vn))
+	}
+	if n := int(resources["public_ipv6"].GetNumberValue()); n > 0 {
+		vn, err := c.GetUserPublicVNet6(VM.UID)
+		if err != nil {
+			vn = -1
+		}
+		vn, err = c.reserveFreeLeases(vn, n, func(n int) (int, error) {
+			return c.ReservePublicIPv6(VM.UID, n)
+		})
+		if err != nil {
+			return -1, -1, fmt.Errorf("can't reserve public IPv6 addresses for user %d: %w", VM.UID, err)
+		}
+		ig.Data["public_vn6"] = structpb.NewNumberValue(float64(vn))
+	}
+	if resources["private_ipv6"].GetNumberValue() > 0 {
+		vn, err := c.GetUserPrivateVNet6(VM.UID)
+		if err != nil {
+			return -1, -1, fmt.Errorf("can't get private IPv6 VNet of user %d: %w", VM.UID, err)
+		}
+		ig.Data["private_vn6"] = structpb.NewNumberValue(float64(vn))
+	}
+	instance := proto.Clone(inst).(*pb.Instance)
+	template_id, tmpl, _, err := c.vmTemplateFromInstance(instance, ig, token, nil)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	imageID, err := c.DiskSaveAs(vmid, diskID, fmt.Sprintf("%s-disk-%d", name, clock.Now().Unix()))
+	if err != nil {
+		return -1, -1, err
+	}
+	if err := c.Chown("image", imageID, VM.UID, VM.GID); err != nil {
+		log.Warn("Error changing Image owner", zap.Int("image", imageID), zap.Error(err))
+	}
+	log.Info("Saving system disk", zap.Int("disk", diskID), zap.Int("image", imageID))
+	if err := c.waitForImage(imageID); err != nil {
+		c.deleteImage(log, imageID)
+		return -1, -1, err
+	}
+
+	// Template disks are replaced with the saved one, data volumes are kept
+	data := DataDisksFromVM(tmpl)
+	tmpl.Del(string(shared.DiskVec))
+	disk := tmpl.AddDisk()
+	disk.Add(shared.ImageID, imageID)
+	if size := resources["drive_size"]; size != nil {
+		disk.Add(shared.Size, int(size.GetNumberValue()))
+		disk.Add(driver_shared.DRIVE_TYPE, resources["drive_type"].GetStringValue())
+	}
+	for i := range data {
+		tmpl.Elements = append(tmpl.Elements, &data[i].Vector)
+	}
+
+	newID, err := c.InstantiateTemplate(template_id, name, tmpl.String(), false)
+	if err != nil {
+		c.deleteImage(log, imageID)
+		return -1, -1, err
+	}
+	if err := c.Chown("vm", newID, VM.UID, VM.GID); err != nil {
+		log.Error("Error changing VM owner", zap.Int("vmid", newID), zap.Error(err))
+	}
+	log.Info("VM cloned", zap.Int("vmid", newID), zap.Int("image", imageID))
+	return newID, imageID, nil
+}
+
+// Deletes Image left by the failed operation, errors are only logged as the operation error matters more
+func (c *ONeClient) deleteImage(log *zap.Logger, id int) {
+	if err := c.ctrl.Image(id).Delete(); err != nil {
+		log.Error("Error deleting Image", zap.Int("image", id), zap.Error(err))
+	}
+}
+
+// Templates made by users out of their VMs are marked with it, such templates are available to their owner only
+const TEMPLATE_PRIVATE = "NOCLOUD_PRIVATE"
+
+// Checks whether the template is private one, see TEMPLATE_PRIVATE
+func IsPrivateTemplate(t *tmpl.Template) bool {
+	value, err := t.Template.GetStr(TEMPLATE_PRIVATE)
+	return err == nil && strings.EqualFold(value, "YES")
+}
+
+// Saves VM system disk as Image and makes private template with it, both owned by the VM owner.
+// Template is based on the one VM was made from, if it still exists. Returns new Template and Image IDs
+func (c *ONeClient) SaveAsTemplate(vmid int, name string) (int, int, error) {
+	log := c.log.Named("SaveAsTemplate").With(zap.Int("vmid", vmid))
+
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return -1, -1, err
+	}
+	diskID, ok := SystemDiskID(VM)
+	if !ok {
+		return -1, -1, errors.New("VM has no system disk")
+	}
+	if name == "" {
+		name = fmt.Sprintf("%s-%d", VM.Name, clock.Now().Unix())
+	}
+
+	imageID, err := c.DiskSaveAs(vmid, diskID, name)
+	if err != nil {
+		return -1, -1, err
+	}
+	if err := c.Chown("image", imageID, VM.UID, VM.GID); err != nil {
+		return -1, imageID, err
+	}
+	log.Info("Saving system disk", zap.Int("disk", diskID), zap.Int("image", imageID))
+	if err := c.waitForImage(imageID); err != nil {
+		return -1, imageID, err
+	}
+
+	t := vm.NewTemplate()
+	if id, err := VM.Template.GetInt("TEMPLATE_ID"); err == nil {
+		if source, err := c.GetTemplate(id); err == nil {
+			t.Template = source.Template.Template
+		} else {
+			log.Warn("Error getting source Template", zap.Int("template", id), zap.Error(err))
+		}
+	}
+	for _, key := range []string{"NAME", string(shared.DiskVec), TEMPLATE_PRIVATE} {
+		t.Del(key)
+	}
+	t.Add(keys.Name, name)
+	t.Add(keys.Template(TEMPLATE_PRIVATE), "YES")
+	t.AddDisk().Add(shared.ImageID, imageID)
+	if _, err := t.GetVector(string(keys.ContextVec)); err != nil {
+		t.AddCtx(keys.NetworkCtx, "YES")
+		t.AddCtx(keys.SSHPubKey, "$USER[SSH_PUBLIC_KEY]")
+	}
+
+	templateID, err := c.ctrl.Templates().Create(t.String())
+	if err != nil {
+		return -1, imageID, err
+	}
+	if err := c.Chown("template", templateID, VM.UID, VM.GID); err != nil {
+		return templateID, imageID, err
+	}
+	log.Info("Private Template created", zap.Int("template", templateID), zap.Int("image", imageID))
+	return templateID, imageID, nil
+}
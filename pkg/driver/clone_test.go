@@ -0,0 +1,145 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"strconv"
+	"testing"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestCloneVM(t *testing.T) {
+	c, _, ig := setup(t)
+	vmid := deploy(t, c, ig)
+	s := c.Server
+
+	uid := int(ig.Data["userid"].GetNumberValue())
+	inst := ig.Instances[0]
+	newID, imageID, err := c.CloneVM(inst, "clone", "")
+	if err != nil {
+		t.Fatalf("CloneVM() => %v", err)
+	}
+	if calls := s.CallsTo("one.vn.reserve"); len(calls) != 1 {
+		t.Fatalf("Expected missing public address to be reserved, got %v", s.Methods())
+	}
+	if calls := s.CallsTo("one.vm.disksaveas"); len(calls) != 1 || calls[0].Args[0] != int64(vmid) || calls[0].Args[1] != int64(0) {
+		t.Fatalf("Expected system disk to be saved, got %+v", calls)
+	}
+
+	image, _ := c.GetImage(imageID)
+	src, _ := c.GetVM(vmid)
+	v, _ := c.GetVM(newID)
+	if image.UID != uid || v.UID != uid || v.GID != src.GID || v.Name != "clone" {
+		t.Fatalf("Unexpected clone: name %s, owner %d:%d, image owner %d", v.Name, v.UID, v.GID, image.UID)
+	}
+	disks := v.Template.GetDisks()
+	if len(disks) != 1 {
+		t.Fatalf("Expected single disk, got %d", len(disks))
+	}
+	if id, _ := disks[0].GetInt("IMAGE_ID"); id != imageID {
+		t.Fatalf("Clone must use saved Image, got %d", id)
+	}
+	if size, _ := disks[0].GetInt("SIZE"); size != 20480 {
+		t.Fatalf("Expected drive_size to be kept, got %d", size)
+	}
+	if cpu, _ := v.Template.GetInt("VCPU"); cpu != 2 {
+		t.Fatalf("Expected resources to be kept, got %d VCPU", cpu)
+	}
+
+	srcIP, _ := src.Template.GetNICs()[0].GetStr("IP")
+	nics := v.Template.GetNICs()
+	if len(nics) != 1 {
+		t.Fatalf("Expected single NIC, got %d", len(nics))
+	}
+	ip, _ := nics[0].GetStr("IP")
+	vn, _ := nics[0].GetInt("NETWORK_ID")
+	if ip == "" || ip == srcIP || vn != int(ig.Data["public_vn"].GetNumberValue()) {
+		t.Fatalf("Expected new lease in the user public VNet, got %s in %d", ip, vn)
+	}
+}
+
+func TestCloneVMFailed(t *testing.T) {
+	c, _, ig := setup(t)
+	deploy(t, c, ig)
+	s := c.Server
+
+	s.FailNext("one.template.instantiate", 1)
+	if _, _, err := c.CloneVM(ig.Instances[0], "clone", ""); err == nil {
+		t.Fatal("Expected error when clone can't be instantiated")
+	}
+	calls := s.CallsTo("one.vm.disksaveas")
+	deleted := s.CallsTo("one.image.delete")
+	if len(calls) != 1 || len(deleted) != 1 {
+		t.Fatalf("Expected saved Image to be deleted, got %v", s.Methods())
+	}
+	if _, err := c.GetImage(int(deleted[0].Args[0].(int64))); err == nil {
+		t.Fatal("Saved Image must not be left behind")
+	}
+}
+
+func TestSaveAsTemplate(t *testing.T) {
+	c, _, ig := setup(t)
+	vmid := deploy(t, c, ig)
+
+	templateID, imageID, err := c.SaveAsTemplate(vmid, "configured")
+	if err != nil {
+		t.Fatalf("SaveAsTemplate() => %v", err)
+	}
+	uid := int(ig.Data["userid"].GetNumberValue())
+	tmpl, _ := c.GetTemplate(templateID)
+	image, _ := c.GetImage(imageID)
+	if tmpl.UID != uid || image.UID != uid || !one.IsPrivateTemplate(tmpl) {
+		t.Fatalf("Expected private Template and Image of user %d, got %d and %d", uid, tmpl.UID, image.UID)
+	}
+	if id, _ := tmpl.Template.GetDisks()[0].GetInt("IMAGE_ID"); id != imageID || len(tmpl.Template.GetDisks()) != 1 {
+		t.Fatalf("Template must use saved Image, got %d", id)
+	}
+	if desc, _ := tmpl.Template.GetStr("DESCRIPTION"); desc != "Ubuntu 22.04" {
+		t.Fatalf("Template must be based on the source one, got description %q", desc)
+	}
+
+	_, pd, err := c.MonitorLocation(&sppb.ServicesProvider{})
+	if err != nil {
+		t.Fatalf("MonitorLocation() => %v", err)
+	}
+	if _, ok := pd.PublicData["templates"].GetStructValue().AsMap()[strconv.Itoa(templateID)]; ok {
+		t.Fatal("Private Template mustn't be listed as public")
+	}
+	private := pd.PublicData["private_templates"].GetStructValue().AsMap()
+	if _, ok := private[strconv.Itoa(uid)].(map[string]interface{})[strconv.Itoa(templateID)]; !ok {
+		t.Fatalf("Expected Template in user %d private ones, got %v", uid, private)
+	}
+
+	inst := &pb.Instance{
+		Uuid:   "other-uuid",
+		Config: map[string]*structpb.Value{"template_id": structpb.NewNumberValue(float64(templateID))},
+		Resources: map[string]*structpb.Value{
+			"cpu": structpb.NewNumberValue(1),
+			"ram": structpb.NewNumberValue(1024),
+		},
+	}
+	other := &pb.InstancesGroup{Data: map[string]*structpb.Value{"userid": structpb.NewNumberValue(float64(uid + 1))}}
+	if _, err := c.InstantiateTemplateHelper(inst, other, ""); err == nil {
+		t.Fatal("Private Template must be available to the owner only")
+	}
+	if _, err := c.InstantiateTemplateHelper(inst, ig, ""); err != nil {
+		t.Fatalf("InstantiateTemplateHelper() => %v", err)
+	}
+}
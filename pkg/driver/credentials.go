@@ -0,0 +1,58 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/parameters"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm/keys"
+	"go.uber.org/zap"
+)
+
+// Sets the given CONTEXT keys, running VM is rebooted if asked so contextualization applies them
+func (c *ONeClient) updateContext(vmid int, pairs map[string]string, reboot bool) error {
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return err
+	}
+	if err := c.updateConf(vmid, contextWith(VM, pairs)); err != nil {
+		return err
+	}
+
+	state, lcm, err := VM.State()
+	if err != nil || !reboot || state != vm.Active || lcm != vm.Running {
+		return err
+	}
+	c.log.Named("UpdateContext").Info("Rebooting VM to apply context", zap.Int("vmid", vmid))
+	return c.RebootVM(vmid, false)
+}
+
+// Sets new password to the VM USER_TEMPLATE and CONTEXT. USER_TEMPLATE is where it's read from on import and rescue exit,
+// so it goes first: VM never boots with the password which isn't stored anywhere else
+func (c *ONeClient) ResetPassword(vmid int, password string, reboot bool) error {
+	tmpl := dynamic.NewTemplate()
+	tmpl.AddPair("PASSWORD", password)
+	if err := c.ctrl.VM(vmid).Update(tmpl.String(), parameters.Merge); err != nil {
+		return err
+	}
+	return c.updateContext(vmid, map[string]string{"PASSWORD": password}, reboot)
+}
+
+// Replaces SSH public keys in the VM CONTEXT, keys are separated by new lines
+func (c *ONeClient) SetSSHKeys(vmid int, sshKeys string, reboot bool) error {
+	return c.updateContext(vmid, map[string]string{string(keys.SSHPubKey): sshKeys}, reboot)
+}
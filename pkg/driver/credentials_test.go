@@ -0,0 +1,63 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCredentials(t *testing.T) {
+	c, _, ig := setup(t)
+	vmid := deploy(t, c, ig)
+	s := c.Server
+
+	if err := c.ResetPassword(vmid, "new-secret", false); err != nil {
+		t.Fatalf("ResetPassword() => %v", err)
+	}
+	// USER_TEMPLATE goes first, so the password is stored before VM gets it
+	methods := s.Methods()
+	if update, updateconf := slices.Index(methods, "one.vm.update"), slices.Index(methods, "one.vm.updateconf"); update < 0 || update > updateconf {
+		t.Fatalf("USER_TEMPLATE must be updated before CONTEXT: %v", methods)
+	}
+	v, _ := c.GetVM(vmid)
+	if pass, _ := v.Template.GetStrFromVec("CONTEXT", "PASSWORD"); pass != "new-secret" {
+		t.Fatalf("Expected new password in context, got %q", pass)
+	}
+	if pass, _ := v.UserTemplate.GetStr("PASSWORD"); pass != "new-secret" {
+		t.Fatalf("Expected new password in user template, got %q", pass)
+	}
+	if network, _ := v.Template.GetStrFromVec("CONTEXT", "NETWORK"); network != "YES" {
+		t.Fatal("The rest of context must be kept")
+	}
+	if calls := s.CallsTo("one.vm.action"); len(calls) != 0 {
+		t.Fatalf("VM mustn't be rebooted, got %+v", calls)
+	}
+
+	if err := c.SetSSHKeys(vmid, "ssh-ed25519 AAAA\nssh-rsa BBBB", true); err != nil {
+		t.Fatalf("SetSSHKeys() => %v", err)
+	}
+	v, _ = c.GetVM(vmid)
+	if keys, _ := v.Template.GetStrFromVec("CONTEXT", "SSH_PUBLIC_KEY"); keys != "ssh-ed25519 AAAA\nssh-rsa BBBB" {
+		t.Fatalf("Unexpected SSH keys: %q", keys)
+	}
+	if pass, _ := v.Template.GetStrFromVec("CONTEXT", "PASSWORD"); pass != "new-secret" {
+		t.Fatal("Password must be kept")
+	}
+	if calls := s.CallsTo("one.vm.action"); len(calls) != 1 || calls[0].Args[0] != "reboot" {
+		t.Fatalf("Running VM must be rebooted, got %+v", calls)
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/image"
+	imagekeys "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/image/keys"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	driver_shared "github.com/slntopp/nocloud-driver-ione/pkg/shared"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Additional data volume requested by Instance resources, size is in MB like drive_size.
+// ID is kept on the VM disk, so volumes are matched by it rather than by position
+type DataDisk struct {
+	ID   string
+	Size int
+	Type string
+}
+
+// Name of the blank Image data volumes are cloned from, one per Image Datastore
+const DATA_DISK_IMAGE_NAME_PATTERN = "nocloud-data-disk-ds-%d"
+
+// Reads data volumes from Instance resources "disks": [{ "id": "data", "size": 10240, "type": "SSD" }].
+// Volumes without id are identified by their position
+func DataDisksFromResources(resources map[string]*structpb.Value) []DataDisk {
+	var res []DataDisk
+	for i, value := range resources["disks"].GetListValue().GetValues() {
+		fields := value.GetStructValue().GetFields()
+		res = append(res, DataDisk{
+			ID:   dataDiskID(fields["id"], i),
+			Size: int(fields["size"].GetNumberValue()),
+			Type: fields["type"].GetStringValue(),
+		})
+	}
+	return res
+}
+
+func dataDiskID(value *structpb.Value, i int) string {
+	switch v := value.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		if v.StringValue != "" {
+			return v.StringValue
+		}
+	case *structpb.Value_NumberValue:
+		return strconv.Itoa(int(v.NumberValue))
+	}
+	return strconv.Itoa(i)
+}
+
+// Returns VM disks attached as data volumes, in order of attachment
+func DataDisksFromVM(tmpl *vm.Template) []shared.Disk {
+	var res []shared.Disk
+	for _, disk := range tmpl.GetDisks() {
+		if marker, _ := disk.Get(driver_shared.NOCLOUD_DATA_DISK); marker == "YES" {
+			res = append(res, disk)
+		}
+	}
+	return res
+}
+
+// Returns ID of the i-th VM data volume, volumes made without ID are identified by their position
+func DataDiskID(disk *shared.Disk, i int) string {
+	id, err := disk.Get(driver_shared.NOCLOUD_DISK_ID)
+	if err != nil || id == "" {
+		return strconv.Itoa(i)
+	}
+	return id
+}
+
+// Returns data volumes of the VM by their IDs, see DataDiskID
+func DataDisksByID(tmpl *vm.Template) map[string]shared.Disk {
+	res := make(map[string]shared.Disk)
+	for i, disk := range DataDisksFromVM(tmpl) {
+		res[DataDiskID(&disk, i)] = disk
+	}
+	return res
+}
+
+// Adds data disk to the template. Disk is cloned from the blank Image in the Image Datastore of its type,
+// see DataDiskImage, and grown to the requested size
+func (c *ONeClient) AddDataDisk(tmpl *vm.Template, d DataDisk) error {
+	image, err := c.DataDiskImage(d.Type)
+	if err != nil {
+		return err
+	}
+	disk := tmpl.AddDisk()
+	disk.Add(shared.ImageID, image)
+	disk.Add(shared.Size, d.Size)
+	disk.Add(driver_shared.DRIVE_TYPE, d.Type)
+	disk.Add(driver_shared.NOCLOUD_DATA_DISK, "YES")
+	disk.Add(driver_shared.NOCLOUD_DISK_ID, d.ID)
+	return nil
+}
+
+// Returns blank Image data volumes of the drive type are cloned from, Image is allocated at the first use
+// in the Image Datastore set for the drive type in IMAGE_DS. Fails if there is no Datastore for the drive type
+func (c *ONeClient) DataDiskImage(driveType string) (int, error) {
+	value, err := GetVarValue(c.vars[IMAGE_DS], driveType)
+	if err != nil {
+		return -1, fmt.Errorf("no Image Datastore for %s drives: %w", driveType, err)
+	}
+	ds := int(value.GetNumberValue())
+	if value.GetStringValue() != "" {
+		if ds, err = strconv.Atoi(value.GetStringValue()); err != nil {
+			return -1, fmt.Errorf("malformed Image Datastore ID for %s drives: %w", driveType, err)
+		}
+	}
+
+	name := fmt.Sprintf(DATA_DISK_IMAGE_NAME_PATTERN, ds)
+	if id, err := c.ctrl.Images().ByName(name); err == nil {
+		return id, nil
+	}
+
+	tmpl := image.NewTemplate()
+	tmpl.Add(imagekeys.Name, name)
+	tmpl.SetType(image.Datablock)
+	tmpl.Add(imagekeys.Size, 1)
+	tmpl.Add(imagekeys.Persistent, "NO")
+	tmpl.Add(imagekeys.Template("FORMAT"), "raw")
+	id, err := c.ctrl.Images().Create(tmpl.String(), uint(ds))
+	if err != nil {
+		return -1, fmt.Errorf("can't allocate data disk Image in Datastore %d: %w", ds, err)
+	}
+	c.log.Info("Data disk Image allocated", zap.Int("image", id), zap.Int("datastore", ds))
+	return id, c.waitForImage(id)
+}
+
+// Sums drive sizes(MB) by lowercase drive type, system drive included
+func DrivesByType(resources map[string]*structpb.Value) map[string]float64 {
+	res := make(map[string]float64)
+	if resources["drive_size"] != nil {
+		res[strings.ToLower(resources["drive_type"].GetStringValue())] += resources["drive_size"].GetNumberValue()
+	}
+	for _, disk := range DataDisksFromResources(resources) {
+		res[strings.ToLower(disk.Type)] += float64(disk.Size)
+	}
+	return res
+}
+
+// Brings VM data disks in line with the requested ones, matching them by ID: grows, attaches new and detaches
+// ones not requested anymore. Returns whether anything has been changed
+func (c *ONeClient) updateDataDisks(vmid int, VM *vm.VM, requested []DataDisk) (changed bool) {
+	log := c.log.Named("updateDataDisks").With(zap.Int("vmid", vmid))
+	vmc := c.ctrl.VM(vmid)
+	current := DataDisksByID(&VM.Template)
+
+	for _, d := range requested {
+		disk, ok := current[d.ID]
+		if !ok {
+			tmpl := vm.NewTemplate()
+			if err := c.AddDataDisk(tmpl, d); err != nil {
+				log.Error("Error making Disk", zap.Any("disk", d), zap.Error(err))
+				continue
+			}
+			if err := vmc.DiskAttach(tmpl.String()); err != nil {
+				log.Error("Error attaching Disk", zap.Any("disk", d), zap.Error(err))
+				continue
+			}
+			if err := c.waitForHotplugFinish(vmid); err != nil {
+				log.Error("Error waiting for Disk attach", zap.Error(err))
+				return true
+			}
+			changed = true
+			continue
+		}
+		delete(current, d.ID)
+
+		id, err := disk.ID()
+		if err != nil {
+			log.Error("Error getting Disk ID", zap.Error(err))
+			continue
+		}
+		if driveType, _ := disk.Get(driver_shared.DRIVE_TYPE); !strings.EqualFold(driveType, d.Type) {
+			log.Warn("Disk type can't be changed", zap.Int("disk", id), zap.String("current", driveType), zap.String("requested", d.Type))
+		}
+		size, _ := disk.GetI(shared.Size)
+		if d.Size < size {
+			log.Warn("Disk can't be shrinked", zap.Int("disk", id), zap.Int("current", size), zap.Int("requested", d.Size))
+		} else if d.Size > size {
+			if err := vmc.Disk(id).Resize(strconv.Itoa(d.Size)); err != nil {
+				log.Error("Error resizing Disk", zap.Int("disk", id), zap.Error(err))
+				continue
+			}
+			changed = true
+		}
+	}
+
+	// Disks left aren't requested anymore, detached from the last attached one
+	var detach []int
+	for _, disk := range current {
+		if id, err := disk.ID(); err == nil {
+			detach = append(detach, id)
+		} else {
+			log.Error("Error getting Disk ID", zap.Error(err))
+		}
+	}
+	slices.Sort(detach)
+	slices.Reverse(detach)
+	for _, id := range detach {
+		if err := vmc.Disk(id).Detach(); err != nil {
+			log.Error("Error detaching Disk", zap.Int("disk", id), zap.Error(err))
+			continue
+		}
+		if err := c.waitForHotplugFinish(vmid); err != nil {
+			log.Error("Error waiting for Disk detach", zap.Error(err))
+			return true
+		}
+		changed = true
+	}
+
+	return changed
+}
+
+// Returns ID of the first(system) VM disk, 0 if it can't be read
+func systemDiskID(VM *vm.VM) int {
+	disks := VM.Template.GetDisks()
+	if len(disks) == 0 {
+		return 0
+	}
+	id, err := disks[0].ID()
+	if err != nil {
+		return 0
+	}
+	return id
+}
@@ -0,0 +1,148 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestDataDisks(t *testing.T) {
+	c, _, ig := setup(t)
+	inst := ig.Instances[0]
+	c.SetVars(vars(map[string]*sppb.Var{
+		one.IMAGE_DS: {Value: map[string]*structpb.Value{
+			"SSD": structpb.NewNumberValue(1),
+			"HDD": structpb.NewNumberValue(101),
+		}},
+	}))
+	disks := func(disks ...interface{}) *structpb.Value {
+		v, _ := structpb.NewValue(disks)
+		return v
+	}
+	inst.Resources["disks"] = disks(map[string]interface{}{"id": "data", "size": 10240, "type": "HDD"})
+	s := c.Server
+
+	vmid, err := c.InstantiateTemplateHelper(inst, ig, "token")
+	if err != nil {
+		t.Fatalf("InstantiateTemplateHelper() => %v", err)
+	}
+	allocated := s.CallsTo("one.image.allocate")
+	if len(allocated) != 1 || allocated[0].Args[1] != int64(101) {
+		t.Fatalf("Expected blank Image to be allocated in HDD Image Datastore, got %+v", allocated)
+	}
+	hdd, err := c.DataDiskImage("HDD")
+	if err != nil {
+		t.Fatalf("DataDiskImage() => %v", err)
+	}
+	extra := s.CallsTo("one.template.instantiate")[0].Args[3].(string)
+	for _, expected := range []string{
+		`IMAGE_ID="` + strconv.Itoa(hdd) + `"`,
+		`SIZE="10240"`,
+		`DRIVE_TYPE="HDD"`,
+		`NOCLOUD_DATA_DISK="YES"`,
+		`NOCLOUD_DISK_ID="data"`,
+	} {
+		if !strings.Contains(extra, expected) {
+			t.Errorf("Template misses %s:\n%s", expected, extra)
+		}
+	}
+	if strings.Contains(extra, "DATASTORE_ID") {
+		t.Errorf("Data disk mustn't be volatile:\n%s", extra)
+	}
+	if err := c.Chown("vm", vmid, int(ig.Data["userid"].GetNumberValue()), fake.USERS_GROUP); err != nil {
+		t.Fatalf("Chown() => %v", err)
+	}
+
+	res, err := c.VMToInstance(vmid)
+	if err != nil {
+		t.Fatalf("VMToInstance() => %v", err)
+	}
+	if got := one.DataDisksFromResources(res.Resources); !reflect.DeepEqual(got, []one.DataDisk{{ID: "data", Size: 10240, Type: "HDD"}}) {
+		t.Fatalf("Unexpected data disks: %+v", got)
+	}
+	if diff := one.VmResourcesDiff(res, inst); len(diff) != 0 {
+		t.Fatalf("Expected no diff, got %+v", diff)
+	}
+
+	// Grow the first one and attach another
+	inst.Resources["disks"] = disks(
+		map[string]interface{}{"id": "data", "size": 20480, "type": "HDD"},
+		map[string]interface{}{"id": "logs", "size": 5120, "type": "SSD"},
+	)
+	diff := one.VmResourcesDiff(res, inst)
+	if len(diff) != 2 || diff[0].ResName != "drive_hdd" || diff[0].NewResCount != 20 || diff[1].ResName != "drive_ssd" || diff[1].NewResCount != 25 {
+		t.Fatalf("Unexpected diff: %+v", diff)
+	}
+	s.Reset()
+	c.CheckInstancesGroupResponseProcess(&one.CheckInstancesGroupResponse{ToBeUpdated: []*pb.Instance{inst}}, ig, fake.USERS_GROUP, nil)
+
+	if updated := inst.State.Meta["updated"].GetListValue().AsSlice(); len(updated) != 1 || updated[0] != "disks" {
+		t.Fatalf("Unexpected updated resources: %v", updated)
+	}
+	if calls := s.CallsTo("one.vm.diskresize"); len(calls) != 1 || calls[0].Args[1] != int64(1) || calls[0].Args[2] != "20480" {
+		t.Fatalf("Unexpected resize calls: %+v", calls)
+	}
+	if calls := s.CallsTo("one.vm.attach"); len(calls) != 1 || !strings.Contains(calls[0].Args[1].(string), `NOCLOUD_DISK_ID="logs"`) {
+		t.Fatalf("Unexpected attach calls: %+v", calls)
+	}
+	if allocated := s.CallsTo("one.image.allocate"); len(allocated) != 1 || allocated[0].Args[1] != int64(1) {
+		t.Fatalf("Expected blank Image to be allocated in SSD Image Datastore, got %+v", allocated)
+	}
+
+	// Drop the first one, the second one must be kept though it's not at the same position anymore
+	inst.Resources["disks"] = disks(map[string]interface{}{"id": "logs", "size": 5120, "type": "SSD"})
+	s.Reset()
+	c.CheckInstancesGroupResponseProcess(&one.CheckInstancesGroupResponse{ToBeUpdated: []*pb.Instance{inst}}, ig, fake.USERS_GROUP, nil)
+
+	if calls := s.CallsTo("one.vm.detach"); len(calls) != 1 || calls[0].Args[1] != int64(1) {
+		t.Fatalf("Only the dropped disk must be detached: %+v", calls)
+	}
+	if calls := s.Methods(); slices.Contains(calls, "one.vm.attach") || slices.Contains(calls, "one.vm.diskresize") {
+		t.Fatalf("Kept disk mustn't be touched: %v", calls)
+	}
+	v, _ := c.GetVM(vmid)
+	if disks := one.DataDisksByID(&v.Template); len(disks) != 1 || !slices.Contains(slices.Collect(maps.Keys(disks)), "logs") {
+		t.Fatalf("Only logs disk must be left, got %+v", disks)
+	}
+}
+
+func TestDataDisksWithoutDatastore(t *testing.T) {
+	c, _, ig := setup(t)
+	inst := ig.Instances[0]
+	c.SetVars(vars(map[string]*sppb.Var{
+		one.IMAGE_DS: {Value: map[string]*structpb.Value{"SSD": structpb.NewNumberValue(1)}},
+	}))
+	v, _ := structpb.NewValue([]interface{}{map[string]interface{}{"size": 10240, "type": "HDD"}})
+	inst.Resources["disks"] = v
+
+	if _, err := c.InstantiateTemplateHelper(inst, ig, "token"); err == nil {
+		t.Fatal("Expected error when drive type has no Image Datastore")
+	}
+	if calls := c.Server.CallsTo("one.template.instantiate"); len(calls) != 0 {
+		t.Fatalf("VM mustn't be made without data disk: %+v", calls)
+	}
+}
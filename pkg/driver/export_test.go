@@ -0,0 +1,29 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"testing"
+
+	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
+)
+
+// SetClock replaces the driver clock for the test, e.g. to be within the maintenance window
+func SetClock(t testing.TB, c utils.IClock) {
+	prev := clock
+	clock = c
+	t.Cleanup(func() { clock = prev })
+}
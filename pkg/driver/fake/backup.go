@@ -0,0 +1,188 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	img "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/image"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+)
+
+// ONe image type of backups
+const BACKUP_IMAGE_TYPE = "6"
+
+// VM template sections replaced by one.vm.updateconf, missing ones are dropped
+var updateConfSections = []string{"OS", "FEATURES", "INPUT", "GRAPHICS", "RAW", "CONTEXT", "CPU_MODEL"}
+
+// updateConf replaces VM configuration sections like one.vm.updateconf does, BACKUP_CONFIG included
+func (c *Cloud) updateConf(vmid int, template string) error {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return actionError("updateconf", vmid, err.Error())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+
+	elements := make([]dynamic.Element, 0, len(v.Template.Elements))
+	for _, el := range v.Template.Elements {
+		if vec, ok := el.(*dynamic.Vector); ok && slices.Contains(updateConfSections, vec.Key()) {
+			continue
+		}
+		elements = append(elements, el)
+	}
+	for _, vec := range t.GetVectors("BACKUP_CONFIG") {
+		config := &c.vmBackups(vmid).Config
+		config.Mode, _ = vec.GetStr("MODE")
+		config.KeepLast, _ = vec.GetStr("KEEP_LAST")
+	}
+	for _, el := range t.Elements {
+		if vec, ok := el.(*dynamic.Vector); ok && slices.Contains(updateConfSections, vec.Key()) {
+			elements = append(elements, vec)
+		}
+	}
+	v.Template.Elements = elements
+	c.recordAction(vmid, "updateconf")
+	return nil
+}
+
+// getVMBackups returns copy of the VM BACKUPS section
+func (c *Cloud) getVMBackups(vmid int) (*one.VMBackups, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.vms[vmid]; !ok {
+		return nil, noExists("vm", vmid)
+	}
+	b := c.vmBackups(vmid)
+	return &one.VMBackups{Config: b.Config, IDs: append([]int{}, b.IDs...)}, nil
+}
+
+// Increments returns number of increments of the incremental backup Image
+func (c *Cloud) Increments(imageID int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.increments[imageID]
+}
+
+// Backup mimics one.vm.backup with the VM BACKUP_CONFIG: full backup creates new Image and
+// KEEP_LAST oldest ones are removed, incremental one adds increment to the last Image unless reset
+func (c *Cloud) backup(vmid, dsID int, reset bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+	if !(v.StateRaw == int(vm.Active) && v.LCMStateRaw == int(vm.Running)) && v.StateRaw != int(vm.Poweroff) {
+		return actionError("backup", vmid, "Wrong state to perform action backup")
+	}
+	if dsID < 0 {
+		return actionError("backup", vmid, fmt.Sprintf("Datastore %d does not exist", dsID))
+	}
+
+	b := c.vmBackups(vmid)
+	if b.Config.Mode == one.BACKUP_MODE_INCREMENT && len(b.IDs) > 0 && !reset {
+		c.increments[b.IDs[len(b.IDs)-1]]++
+		c.recordAction(vmid, "backup")
+		return nil
+	}
+
+	size := 0
+	for _, disk := range v.Template.GetDisks() {
+		s, _ := disk.GetI(shared.Size)
+		size += s
+	}
+	now := c.now()
+	id := c.nextID("image")
+	c.images[id] = &img.Image{
+		ID: id, Name: fmt.Sprintf("%d %s", vmid, time.Unix(int64(now), 0).UTC().Format("02-Jan 15.04.05")),
+		Type: BACKUP_IMAGE_TYPE, Size: size,
+		UID: v.UID, GID: v.GID, UName: v.UName, GName: v.GName,
+		RegTime: now,
+	}
+	c.increments[id] = 1
+	b.IDs = append(b.IDs, id)
+
+	if keep, _ := strconv.Atoi(b.Config.KeepLast); keep > 0 && b.Config.Mode != one.BACKUP_MODE_INCREMENT {
+		for len(b.IDs) > keep {
+			delete(c.images, b.IDs[0])
+			b.IDs = b.IDs[1:]
+		}
+	}
+	c.recordAction(vmid, "backup")
+	return nil
+}
+
+// restore mimics one.vm.restore, VM must be powered off
+func (c *Cloud) restore(vmid, imageID, incrementID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+	if v.StateRaw != int(vm.Poweroff) {
+		return actionError("restore", vmid, "Wrong state to perform action restore")
+	}
+	if !slices.Contains(c.vmBackups(vmid).IDs, imageID) {
+		return actionError("restore", vmid, fmt.Sprintf("Image %d is not a backup of the VM", imageID))
+	}
+	if incrementID >= c.increments[imageID] {
+		return actionError("restore", vmid, fmt.Sprintf("Increment %d does not exist", incrementID))
+	}
+	c.recordAction(vmid, "restore")
+	return nil
+}
+
+// deleteImage deletes Image, backups are also removed from their VM
+func (c *Cloud) deleteImage(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.images[id]; !ok {
+		return noExists("image", id)
+	}
+	delete(c.images, id)
+	delete(c.increments, id)
+	for _, b := range c.backups {
+		b.IDs = slices.DeleteFunc(b.IDs, func(i int) bool { return i == id })
+	}
+	return nil
+}
+
+func (c *Cloud) vmBackups(vmid int) *one.VMBackups {
+	b, ok := c.backups[vmid]
+	if !ok {
+		b = &one.VMBackups{}
+		c.backups[vmid] = b
+	}
+	return b
+}
@@ -0,0 +1,49 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"fmt"
+
+	img "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/image"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+)
+
+// diskSaveAs registers VM disk as a new ready Image of the disk size, like one.vm.disksaveas
+func (c *Cloud) diskSaveAs(vmid, diskID int, name string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return -1, noExists("vm", vmid)
+	}
+	for _, disk := range v.Template.GetDisks() {
+		if id, _ := disk.ID(); id != diskID {
+			continue
+		}
+		size, _ := disk.GetInt(string(shared.Size))
+		id := c.nextID("image")
+		c.images[id] = &img.Image{
+			ID: id, Name: name, Size: size, StateRaw: int(img.Ready),
+			UID: ADMIN_USER, GID: ADMIN_GROUP, UName: "oneadmin", GName: "oneadmin",
+			RegTime: c.now(),
+		}
+		c.recordAction(vmid, "disk-saveas")
+		return id, nil
+	}
+	return -1, actionError("disksaveas", vmid, fmt.Sprintf("Disk %d does not exist", diskID))
+}
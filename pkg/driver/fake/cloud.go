@@ -0,0 +1,148 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	goca_errors "github.com/OpenNebula/one/src/oca/go/src/goca/errors"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/group"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/host"
+	img "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/image"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/securitygroup"
+	tmpl "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/template"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/user"
+	vnet "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/virtualnetwork"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	ADMIN_USER  = 0
+	ADMIN_GROUP = 0
+	USERS_GROUP = 1
+)
+
+// Cloud keeps OpenNebula objects in memory and mimics ONe behaviour
+// close enough for the driver: VMs states and history, leases, ownership and quotas
+type Cloud struct {
+	mu sync.Mutex
+
+	log   *zap.Logger
+	Clock utils.IClock
+
+	users       map[int]*user.User
+	groups      map[int]*group.Group
+	vms         map[int]*vm.VM
+	vnets       map[int]*vnet.VirtualNetwork
+	vnTemplates map[int]*dynamic.Template
+	templates   map[int]*tmpl.Template
+	images      map[int]*img.Image
+	hosts       map[int]*host.Host
+	secgroups   map[int]*securitygroup.SecurityGroup
+
+	hostsMonitoring map[int]*host.Monitoring
+	vmsMonitoring   map[int]*vm.Monitoring
+	quotas          map[int][]string
+	backups         map[int]*one.VMBackups
+	increments      map[int]int
+
+	ids     map[string]int
+	actions map[int][]string
+}
+
+func NewCloud(log *zap.Logger) *Cloud {
+	c := &Cloud{
+		log:   log.Named("FakeONe"),
+		Clock: &utils.Clock{},
+
+		users:       map[int]*user.User{},
+		groups:      map[int]*group.Group{},
+		vms:         map[int]*vm.VM{},
+		vnets:       map[int]*vnet.VirtualNetwork{},
+		vnTemplates: map[int]*dynamic.Template{},
+		templates:   map[int]*tmpl.Template{},
+		images:      map[int]*img.Image{},
+		hosts:       map[int]*host.Host{},
+		secgroups:   map[int]*securitygroup.SecurityGroup{},
+
+		hostsMonitoring: map[int]*host.Monitoring{},
+		vmsMonitoring:   map[int]*vm.Monitoring{},
+		quotas:          map[int][]string{},
+		backups:         map[int]*one.VMBackups{},
+		increments:      map[int]int{},
+
+		ids:     map[string]int{},
+		actions: map[int][]string{},
+	}
+
+	c.addGroup("oneadmin")
+	c.addGroup("users")
+	c.users[ADMIN_USER] = &user.User{UserShort: user.UserShort{
+		ID: c.nextID("user"), Name: "oneadmin", GID: ADMIN_GROUP, GName: "oneadmin",
+		Groups: sharedIDs(ADMIN_GROUP), AuthDriver: "core", Enabled: 1,
+	}}
+
+	return c
+}
+
+func (c *Cloud) now() int {
+	return int(c.Clock.Now().Unix())
+}
+
+// Objects IDs are sequential per class, like in ONe
+func (c *Cloud) nextID(class string) int {
+	id := c.ids[class]
+	c.ids[class] = id + 1
+	return id
+}
+
+func noExists(class string, id int) error {
+	return &goca_errors.ResponseError{
+		Code: goca_errors.OneNoExistsError,
+		Msg:  fmt.Sprintf("[one.%s.info] Error getting %s [%d].", class, class, id),
+	}
+}
+
+func actionError(method string, vmid int, reason string) error {
+	return &goca_errors.ResponseError{
+		Code: goca_errors.OneActionError,
+		Msg:  fmt.Sprintf("[one.vm.%s] Error performing action on virtual machine [%d]. %s", method, vmid, reason),
+	}
+}
+
+func authorizationError(method, reason string) error {
+	return &goca_errors.ResponseError{
+		Code: goca_errors.OneAuthorizationError,
+		Msg:  fmt.Sprintf("[one.%s] %s", method, reason),
+	}
+}
+
+// Actions returns names of the actions performed on the VM in order
+func (c *Cloud) Actions(vmid int) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.actions[vmid]...)
+}
+
+func (c *Cloud) recordAction(vmid int, action string) {
+	c.actions[vmid] = append(c.actions[vmid], action)
+}
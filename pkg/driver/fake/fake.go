@@ -0,0 +1,50 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides in-memory OpenNebula served over XML-RPC, so the driver code
+// including Monitoring, Invoke and Billing flows can be tested without the real one.
+package fake
+
+import (
+	"net/http"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"go.uber.org/zap"
+)
+
+var _ one.IClient = (*Client)(nil)
+
+// Calls never leave the process, see Server.RoundTrip
+const ENDPOINT = "http://fake-one/RPC2"
+
+// Client is ONeClient connected to the in-memory Cloud through the Server, so only the XML-RPC API is faked.
+// Cloud helpers are used to prepare objects and Server to assert the calls made
+type Client struct {
+	*one.ONeClient
+	*Cloud
+
+	Server *Server
+}
+
+func NewClient(log *zap.Logger) *Client {
+	cloud := NewCloud(log)
+	srv := NewServer(cloud)
+	return &Client{
+		ONeClient: one.NewClientWithHTTP("oneadmin", "pass", ENDPOINT, &http.Client{Transport: srv}, log),
+		Cloud:     cloud,
+		Server:    srv,
+	}
+}
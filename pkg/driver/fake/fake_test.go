@@ -0,0 +1,79 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"go.uber.org/zap"
+)
+
+func TestParseTemplate(t *testing.T) {
+	src := vm.NewTemplate()
+	src.Add("NAME", `quoted "name" with \ slash`)
+	src.AddCtx("SSH_PUBLIC_KEY", "ssh-rsa AAAA\nssh-ed25519 BBBB")
+	src.AddNIC().Add("NETWORK_ID", 5)
+	src.AddNIC().Add("NETWORK_ID", 6)
+
+	parsed, err := ParseTemplate(src.String())
+	if err != nil {
+		t.Fatalf("ParseTemplate() => %v", err)
+	}
+	if parsed.String() != src.String() {
+		t.Fatalf("Template isn't preserved:\n%s\n---\n%s", src.String(), parsed.String())
+	}
+
+	bare, err := ParseTemplate("SIZE=1\nNAME=user-1-pub-vnet\nAR = [\n\tIP = \"10.0.0.0\",\n\tSIZE = \"255\" ]")
+	if err != nil {
+		t.Fatalf("ParseTemplate() => %v", err)
+	}
+	if name, _ := bare.GetStr("NAME"); name != "user-1-pub-vnet" {
+		t.Fatalf("Expected bare value, got %q", name)
+	}
+	if size, _ := bare.GetStrFromVec("AR", "SIZE"); size != "255" {
+		t.Fatalf("Expected AR SIZE to be 255, got %q", size)
+	}
+
+	if _, err := ParseTemplate("VEC=[ KEY=\"value\""); err == nil {
+		t.Fatal("Expected error on unclosed vector")
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer(NewCloud(zap.NewNop()))
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	client := one.NewClient("oneadmin", "pass", srv.URL, zap.NewNop())
+
+	if _, err := client.GetVM(100); err == nil || !strings.Contains(err.Error(), "Error getting vm [100]") {
+		t.Fatalf("Expected not exists error, got %v", err)
+	}
+	if err := client.Reinstall(100); err == nil {
+		t.Fatal("Expected error on unknown VM")
+	}
+	if _, err := client.Client.Call("one.zone.info", 0); err == nil {
+		t.Fatal("Expected error on unsupported method")
+	}
+
+	calls := s.Calls()
+	if len(calls) != 3 || calls[2].Method != "one.zone.info" {
+		t.Fatalf("Failed calls must be recorded too: %+v", calls)
+	}
+}
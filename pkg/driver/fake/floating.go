@@ -0,0 +1,78 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"fmt"
+
+	vnet "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/virtualnetwork"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+)
+
+// holdLease puts address from LEASES=[IP=...] template on hold, like one.vn.hold
+func (c *Cloud) holdLease(vnID int, template string) error {
+	ip, err := leaseIP(template)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vn, ok := c.vnets[vnID]
+	if !ok {
+		return noExists("vn", vnID)
+	}
+	return c.allocateIP(vn, ip, func(l *vnet.Lease) { l.VM = -1 })
+}
+
+// releaseLease frees address on hold, like one.vn.release
+func (c *Cloud) releaseLease(vnID int, template string) error {
+	ip, err := leaseIP(template)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vn, ok := c.vnets[vnID]
+	if !ok {
+		return noExists("vn", vnID)
+	}
+	lease, ok := one.VNetLease(vn, ip)
+	if !ok || lease.VM != -1 {
+		return fmt.Errorf("[one.vn.release] IP %s isn't on hold in virtual network %d", ip, vnID)
+	}
+	c.freeLease(vn, ip)
+	return nil
+}
+
+func leaseIP(template string) (string, error) {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return "", err
+	}
+	leases, err := t.GetVector("LEASES")
+	if err != nil {
+		return "", err
+	}
+	ip, err := leases.GetStr("IP")
+	if err != nil || ip == "" {
+		return "", fmt.Errorf("lease template has no IP")
+	}
+	return ip, nil
+}
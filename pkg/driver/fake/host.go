@@ -0,0 +1,147 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"errors"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/host"
+	img "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/image"
+)
+
+// AddHost registers Host with given VM MAD and capacity, CPU in percents and RAM in KB like in ONe
+func (c *Cloud) AddHost(name, vmMad string, totalCPU, totalMem int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextID("host")
+	c.hosts[id] = &host.Host{
+		ID: id, Name: name, IMMAD: vmMad, VMMAD: vmMad,
+		Share: host.Share{TotalCPU: totalCPU, MaxCPU: totalCPU, TotalMem: totalMem, MaxMem: totalMem},
+	}
+	return id
+}
+
+// AddHostMonitoring appends Host monitoring record in ONe syntax
+func (c *Cloud) AddHostMonitoring(id int, record string) error {
+	t, err := ParseTemplate(record)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.hosts[id]; !ok {
+		return noExists("host", id)
+	}
+	if _, err := t.GetInt("TIMESTAMP"); err != nil {
+		t.AddPair("TIMESTAMP", c.now())
+	}
+	if _, ok := c.hostsMonitoring[id]; !ok {
+		c.hostsMonitoring[id] = &host.Monitoring{}
+	}
+	c.hostsMonitoring[id].Records = append(c.hostsMonitoring[id].Records, *t)
+	return nil
+}
+
+func (c *Cloud) getHosts() (*host.Pool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pool := &host.Pool{}
+	for _, id := range sortedKeys(c.hosts) {
+		pool.Hosts = append(pool.Hosts, *c.hosts[id])
+	}
+	return pool, nil
+}
+
+func (c *Cloud) hostMonitoring(id int) (*host.Monitoring, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.hosts[id]; !ok {
+		return nil, noExists("host", id)
+	}
+	mon, ok := c.hostsMonitoring[id]
+	if !ok {
+		return &host.Monitoring{}, nil
+	}
+	return &host.Monitoring{Records: append([]dynamic.Template{}, mon.Records...)}, nil
+}
+
+// AddImage registers Image of the given size in MB, returns its ID
+func (c *Cloud) AddImage(name string, size int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextID("image")
+	c.images[id] = &img.Image{
+		ID: id, Name: name, Size: size,
+		UID: ADMIN_USER, GID: ADMIN_GROUP, UName: "oneadmin", GName: "oneadmin",
+		RegTime: c.now(),
+	}
+	return id
+}
+
+// allocateImage registers ready Image of the template NAME, TYPE and SIZE in the Datastore, like one.image.allocate
+func (c *Cloud) allocateImage(template string, ds int) (int, error) {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return -1, err
+	}
+	name, err := t.GetStr("NAME")
+	if err != nil {
+		return -1, errors.New("[one.image.allocate] NAME is not set")
+	}
+	size, _ := t.GetInt("SIZE")
+	typ, _ := t.GetStr("TYPE")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextID("image")
+	c.images[id] = &img.Image{
+		ID: id, Name: name, Size: size, Type: typ, StateRaw: int(img.Ready), DatastoreID: &ds,
+		UID: ADMIN_USER, GID: ADMIN_GROUP, UName: "oneadmin", GName: "oneadmin",
+		RegTime: c.now(),
+	}
+	return id, nil
+}
+
+func (c *Cloud) getImage(id int) (*img.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i, ok := c.images[id]
+	if !ok {
+		return nil, noExists("image", id)
+	}
+	res := *i
+	return &res, nil
+}
+
+func (c *Cloud) listImages() ([]img.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := make([]img.Image, 0, len(c.images))
+	for _, id := range sortedKeys(c.images) {
+		res = append(res, *c.images[id])
+	}
+	return res, nil
+}
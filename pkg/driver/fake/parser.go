@@ -0,0 +1,172 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+)
+
+// ParseTemplate parses template in OpenNebula syntax, e.g. produced by dynamic.Template.String():
+//
+//	KEY="value"
+//	VECTOR=[
+//	    KEY="value",
+//	    OTHER=1 ]
+func ParseTemplate(s string) (*dynamic.Template, error) {
+	p := &templateParser{src: []rune(s)}
+	t := dynamic.NewTemplate()
+
+	for {
+		p.skip(" \t\r\n,")
+		if p.eof() {
+			return t, nil
+		}
+
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+
+		p.skip(" \t")
+		if p.peek() != '[' {
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			t.Elements = append(t.Elements, &dynamic.Pair{XMLName: xml.Name{Local: key}, Value: value})
+			continue
+		}
+
+		p.pos++
+		vec := &dynamic.Vector{XMLName: xml.Name{Local: key}}
+		for {
+			p.skip(" \t\r\n,")
+			if p.eof() {
+				return nil, fmt.Errorf("vector %s is not closed", key)
+			}
+			if p.peek() == ']' {
+				p.pos++
+				break
+			}
+
+			pkey, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skip(" \t")
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			vec.Pairs = append(vec.Pairs, dynamic.Pair{XMLName: xml.Name{Local: pkey}, Value: value})
+		}
+		t.Elements = append(t.Elements, vec)
+	}
+}
+
+type templateParser struct {
+	src []rune
+	pos int
+}
+
+func (p *templateParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *templateParser) peek() rune {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *templateParser) skip(chars string) {
+	for !p.eof() && strings.ContainsRune(chars, p.peek()) {
+		p.pos++
+	}
+}
+
+// Reads key up to the '=' sign, keys are case-insensitive in ONe and stored uppercased
+func (p *templateParser) key() (string, error) {
+	start := p.pos
+	for !p.eof() && p.peek() != '=' && p.peek() != '\n' {
+		p.pos++
+	}
+	if p.peek() != '=' {
+		return "", fmt.Errorf("expected '=' after %q", string(p.src[start:p.pos]))
+	}
+	key := strings.TrimSpace(string(p.src[start:p.pos]))
+	p.pos++
+	if key == "" {
+		return "", fmt.Errorf("empty key at %d", start)
+	}
+	return strings.ToUpper(key), nil
+}
+
+// Reads either double-quoted value with backslash escapes or bare value up to the line, pair or vector end
+func (p *templateParser) value() (string, error) {
+	if p.peek() != '"' {
+		start := p.pos
+		for !p.eof() && !strings.ContainsRune("\n,]", p.peek()) {
+			p.pos++
+		}
+		return strings.TrimSpace(string(p.src[start:p.pos])), nil
+	}
+
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		r := p.src[p.pos]
+		p.pos++
+		switch r {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", fmt.Errorf("unterminated escape sequence")
+			}
+			e := p.src[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				b.WriteRune('\n')
+			case 't':
+				b.WriteRune('\t')
+			case 'r':
+				b.WriteRune('\r')
+			default:
+				b.WriteRune(e)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+// Merges src into dst, pairs are replaced and vectors with the same key are replaced as a whole
+func mergeTemplate(dst, src *dynamic.Template) {
+	for _, el := range src.Elements {
+		dst.Del(el.Key())
+	}
+	dst.Elements = append(dst.Elements, src.Elements...)
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+)
+
+// updateNICBandwidth replaces QoS attributes of the NIC with the limits, like one.vm.updatenic
+func (c *Cloud) updateNICBandwidth(vmid, nicID int, limits one.BandwidthLimits) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+	if v.StateRaw != int(vm.Active) && v.StateRaw != int(vm.Poweroff) {
+		return actionError("updatenic", vmid, "Wrong state to perform action nic-update")
+	}
+
+	for _, nic := range v.Template.GetVectors(string(shared.NICVec)) {
+		if id, err := nic.GetInt(string(shared.NICID)); err != nil || id != nicID {
+			continue
+		}
+		for _, attr := range one.BANDWIDTH_KEYS {
+			nic.Del(string(attr))
+		}
+		for _, attr := range slices.Sorted(maps.Keys(limits)) {
+			nic.AddPair(string(attr), limits[attr])
+		}
+		c.recordAction(vmid, "nic-update")
+		return nil
+	}
+	return actionError("updatenic", vmid, "NIC does not exist")
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/parameters"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/securitygroup"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+)
+
+// Mirrors one.secgroup.allocate: NAME is required, the rest of the template is kept as is
+func (c *Cloud) createSecurityGroup(template string) (int, error) {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return -1, fmt.Errorf("[one.secgroup.allocate] Error parsing template: %w", err)
+	}
+	name, err := t.GetStr("NAME")
+	if err != nil || name == "" {
+		return -1, errors.New("[one.secgroup.allocate] No NAME in template for Security Group.")
+	}
+	t.Del("NAME")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, sg := range c.secgroups {
+		if sg.Name == name && sg.UID == ADMIN_USER {
+			return -1, fmt.Errorf("[one.secgroup.allocate] NAME is already taken by SECGROUP %d.", sg.ID)
+		}
+	}
+	id := c.nextID("secgroup")
+	c.secgroups[id] = &securitygroup.SecurityGroup{
+		ID: id, Name: name,
+		UID: ADMIN_USER, GID: ADMIN_GROUP, UName: "oneadmin", GName: "oneadmin",
+		Permissions: &shared.Permissions{OwnerU: 1, OwnerM: 1, OwnerA: 1},
+		Template:    securitygroup.Template{Template: *t},
+	}
+	return id, nil
+}
+
+func (c *Cloud) getSecurityGroup(id int) (*securitygroup.SecurityGroup, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sg, ok := c.secgroups[id]
+	if !ok {
+		return nil, noExists("secgroup", id)
+	}
+	return copySecGroup(sg), nil
+}
+
+func (c *Cloud) updateSecurityGroup(id int, template string, uType parameters.UpdateType) error {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sg, ok := c.secgroups[id]
+	if !ok {
+		return noExists("secgroup", id)
+	}
+	if uType == parameters.Replace {
+		sg.Template = securitygroup.Template{Template: *t}
+		return nil
+	}
+	mergeTemplate(&sg.Template.Template, t)
+	return nil
+}
+
+func (c *Cloud) deleteSecurityGroup(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.secgroups[id]; !ok {
+		return noExists("secgroup", id)
+	}
+	delete(c.secgroups, id)
+	return nil
+}
+
+func copySecGroup(sg *securitygroup.SecurityGroup) *securitygroup.SecurityGroup {
+	res := *sg
+	res.Template = securitygroup.Template{Template: copyTemplate(&sg.Template.Template)}
+	return &res
+}
@@ -0,0 +1,1155 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	goca_errors "github.com/OpenNebula/one/src/oca/go/src/goca/errors"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/parameters"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/datastore"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/host"
+	img "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/image"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/securitygroup"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	tmpl "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/template"
+	vnet "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/virtualnetwork"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vntemplate"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"go.uber.org/zap"
+)
+
+// Call is the XML-RPC call received by Server, session token is omitted from Args
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+type handler func(p *params) (interface{}, error)
+
+// Server emulates subset of OpenNebula XML-RPC API used by the driver on top of the Cloud state,
+// so ONeClient can be tested against it and the calls it makes can be asserted.
+// It's either served over HTTP or used as the http.Client transport
+//
+//	srv := httptest.NewServer(fake.NewServer(cloud))
+//	client := one.NewClient("oneadmin", "pass", srv.URL, log)
+type Server struct {
+	c   *Cloud
+	log *zap.Logger
+
+	mu    sync.Mutex
+	calls []Call
+	fail  map[string]int
+
+	handlers map[string]handler
+}
+
+func NewServer(c *Cloud) *Server {
+	s := &Server{c: c, log: c.log.Named("Server")}
+	s.handlers = map[string]handler{
+		"one.vm.info":       s.vmInfo,
+		"one.vm.action":     s.vmAction,
+		"one.vm.recover":    s.vmRecover,
+		"one.vm.monitoring": s.vmMonitoring,
+		"one.vm.attachnic":  s.vmAttachNIC,
+		"one.vm.detachnic":  s.vmDetachNIC,
+		"one.vm.updatenic":  s.vmUpdateNIC,
+		"one.vm.resize":     s.vmResize,
+		"one.vm.diskresize": s.vmDiskResize,
+		"one.vm.attach": func(p *params) (interface{}, error) {
+			id, template := p.int(0), p.str(1)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.attachDisk(id, template)
+		},
+		"one.vm.detach": func(p *params) (interface{}, error) {
+			id, disk := p.int(0), p.int(1)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.detachDisk(id, disk)
+		},
+		"one.vm.snapshotcreate": func(p *params) (interface{}, error) {
+			id, name := p.int(0), p.str(1)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.snapshotCreate(name, id)
+		},
+		"one.vm.snapshotdelete": func(p *params) (interface{}, error) {
+			id, snap := p.int(0), p.int(1)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.snapshotDelete(snap, id)
+		},
+		"one.vm.snapshotrevert": func(p *params) (interface{}, error) {
+			id, snap := p.int(0), p.int(1)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.snapshotRevert(snap, id)
+		},
+		"one.vm.updateconf": func(p *params) (interface{}, error) {
+			id, template := p.int(0), p.str(1)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.updateConf(id, template)
+		},
+		"one.vm.update": func(p *params) (interface{}, error) {
+			id, template, uType := p.int(0), p.str(1), p.int(2)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.updateVM(id, template, parameters.UpdateType(uType))
+		},
+		"one.vm.disksaveas": func(p *params) (interface{}, error) {
+			id, disk, name := p.int(0), p.int(1), p.str(2)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return c.diskSaveAs(id, disk, name)
+		},
+		"one.vm.backup": func(p *params) (interface{}, error) {
+			id, ds, reset := p.int(0), p.int(1), p.bool(2)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.backup(id, ds, reset)
+		},
+		"one.vm.restore": func(p *params) (interface{}, error) {
+			id, image, increment := p.int(0), p.int(1), p.int(2)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.restore(id, image, increment)
+		},
+		"one.vmpool.info":         s.vmPoolInfo,
+		"one.vmpool.infoextended": s.vmPoolInfo,
+
+		"one.template.info":        s.templateInfo,
+		"one.templatepool.info":    s.templatePoolInfo,
+		"one.template.instantiate": s.templateInstantiate,
+		"one.template.allocate": func(p *params) (interface{}, error) {
+			template := p.str(0)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return c.createTemplate(template)
+		},
+
+		"one.image.info":     s.imageInfo,
+		"one.imagepool.info": s.imagePoolInfo,
+		"one.image.allocate": func(p *params) (interface{}, error) {
+			template, ds := p.str(0), p.int(1)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return c.allocateImage(template, ds)
+		},
+		"one.image.delete": func(p *params) (interface{}, error) {
+			id := p.int(0)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.deleteImage(id)
+		},
+
+		"one.vn.info":     s.vnInfo,
+		"one.vnpool.info": s.vnPoolInfo,
+		"one.vn.reserve":  s.vnReserve,
+		"one.vn.update":   s.vnUpdate,
+		"one.vn.rename":   s.vnRename,
+		"one.vn.delete": func(p *params) (interface{}, error) {
+			id := p.int(0)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.deleteVNet(id)
+		},
+		"one.vn.hold": func(p *params) (interface{}, error) {
+			id, template := p.int(0), p.str(1)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.holdLease(id, template)
+		},
+		"one.vn.release": func(p *params) (interface{}, error) {
+			id, template := p.int(0), p.str(1)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.releaseLease(id, template)
+		},
+
+		"one.secgroup.info":     s.secgroupInfo,
+		"one.secgrouppool.info": s.secgroupPoolInfo,
+		"one.secgroup.allocate": func(p *params) (interface{}, error) {
+			template := p.str(0)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return c.createSecurityGroup(template)
+		},
+		"one.secgroup.update": func(p *params) (interface{}, error) {
+			id, template, uType := p.int(0), p.str(1), p.int(2)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.updateSecurityGroup(id, template, parameters.UpdateType(uType))
+		},
+		"one.secgroup.delete": func(p *params) (interface{}, error) {
+			id := p.int(0)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.deleteSecurityGroup(id)
+		},
+
+		"one.vntemplate.info":        s.vnTemplateInfo,
+		"one.vntemplate.instantiate": s.vnTemplateInstantiate,
+
+		"one.user.info":     s.userInfo,
+		"one.userpool.info": s.userPoolInfo,
+		"one.user.allocate": s.userAllocate,
+		"one.user.update":   s.userUpdate,
+		"one.user.quota":    s.userQuota,
+		"one.user.delete": func(p *params) (interface{}, error) {
+			id := p.int(0)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.deleteUser(id)
+		},
+
+		"one.group.info": func(p *params) (interface{}, error) {
+			id := p.int(0)
+			if p.err != nil {
+				return nil, p.err
+			}
+			g, err := c.getGroup(id)
+			if err != nil {
+				return nil, err
+			}
+			return marshal(g)
+		},
+
+		"one.hostpool.info":   s.hostPoolInfo,
+		"one.host.monitoring": s.hostMonitoring,
+
+		// Datastores aren't emulated by Cloud
+		"one.datastorepool.info": func(p *params) (interface{}, error) {
+			return marshal(&datastore.Pool{})
+		},
+	}
+
+	for _, class := range []string{"vm", "vn", "template", "image", "secgroup"} {
+		class := class
+		s.handlers[fmt.Sprintf("one.%s.chown", class)] = func(p *params) (interface{}, error) {
+			id, uid, gid := p.int(0), p.int(1), p.int(2)
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.chown(class, id, uid, gid)
+		}
+		s.handlers[fmt.Sprintf("one.%s.chmod", class)] = func(p *params) (interface{}, error) {
+			id := p.int(0)
+			perm := &shared.Permissions{
+				OwnerU: p.int8(1), OwnerM: p.int8(2), OwnerA: p.int8(3),
+				GroupU: p.int8(4), GroupM: p.int8(5), GroupA: p.int8(6),
+				OtherU: p.int8(7), OtherM: p.int8(8), OtherA: p.int8(9),
+			}
+			if p.err != nil {
+				return nil, p.err
+			}
+			return id, c.chmod(class, id, perm)
+		}
+	}
+
+	return s
+}
+
+// Calls returns all calls received by the Server in order
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call{}, s.calls...)
+}
+
+// Methods returns names of the called methods in order, handy to assert calls sequences
+func (s *Server) Methods() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]string, len(s.calls))
+	for i, call := range s.calls {
+		res[i] = call.Method
+	}
+	return res
+}
+
+// CallsTo returns calls of the given method in order
+func (s *Server) CallsTo(method string) []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res []Call
+	for _, call := range s.calls {
+		if call.Method == method {
+			res = append(res, call)
+		}
+	}
+	return res
+}
+
+// Reset forgets recorded calls and pending failures, Cloud state is kept
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+	s.fail = nil
+}
+
+// FailNext makes the next n calls of the method fail with action error without touching Cloud state,
+// so error paths of the client can be tested
+func (s *Server) FailNext(method string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail == nil {
+		s.fail = make(map[string]int)
+	}
+	s.fail[method] += n
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	method, args, err := decodeCall(body)
+	if err != nil {
+		s.log.Warn("Couldn't decode method call", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// First argument is always the session token
+	if len(args) > 0 {
+		args = args[1:]
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, Call{Method: method, Args: args})
+	failed := s.fail[method] > 0
+	if failed {
+		s.fail[method]--
+	}
+	s.mu.Unlock()
+
+	var result interface{}
+	h, ok := s.handlers[method]
+	if failed {
+		err = &goca_errors.ResponseError{
+			Code: goca_errors.OneActionError,
+			Msg:  fmt.Sprintf("[%s] Call failed by request", method),
+		}
+	} else if !ok {
+		err = &goca_errors.ResponseError{
+			Code: goca_errors.OneXMLRPCAPIError,
+			Msg:  fmt.Sprintf("[%s] Method is not supported by fake server", method),
+		}
+	} else {
+		result, err = h(&params{method: method, args: args})
+	}
+	if err != nil {
+		s.log.Debug("Call failed", zap.String("method", method), zap.Error(err))
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(encodeResponse(result, err))
+}
+
+// RoundTrip serves the request in-process, so Server can be used as http.Client transport
+func (s *Server) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w.Result(), nil
+}
+
+func (s *Server) vmInfo(p *params) (interface{}, error) {
+	id := p.int(0)
+	if p.err != nil {
+		return nil, p.err
+	}
+	v, err := s.c.getVM(id)
+	if err != nil {
+		return nil, err
+	}
+	body, err := marshal(escapeVM(v))
+	if err != nil {
+		return nil, err
+	}
+
+	// goca VM schema has no BACKUPS section, so it's appended to the body
+	backups, err := s.c.getVMBackups(id)
+	if err != nil {
+		return nil, err
+	}
+	section, err := marshal(struct {
+		XMLName xml.Name `xml:"BACKUPS"`
+		*one.VMBackups
+	}{VMBackups: backups})
+	if err != nil {
+		return nil, err
+	}
+	return strings.TrimSuffix(body, "</VM>") + section + "</VM>", nil
+}
+
+func (s *Server) vmAction(p *params) (interface{}, error) {
+	action, id := p.str(0), p.int(1)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	var err error
+	switch action {
+	case "terminate", "terminate-hard":
+		err = s.c.terminate(id, action == "terminate-hard")
+	case "poweroff", "poweroff-hard":
+		err = s.c.poweroff(id, action == "poweroff-hard")
+	case "reboot", "reboot-hard":
+		err = s.c.reboot(id, action == "reboot-hard")
+	case "suspend":
+		err = s.c.suspend(id)
+	case "resume":
+		err = s.c.resume(id)
+	default:
+		err = actionError("action", id, fmt.Sprintf("Action %s is not supported by fake server", action))
+	}
+	return id, err
+}
+
+func (s *Server) vmRecover(p *params) (interface{}, error) {
+	id, op := p.int(0), p.int(1)
+	if p.err != nil {
+		return nil, p.err
+	}
+	// 4 is delete-recreate, the only operation used by the driver
+	if op != 4 {
+		return nil, actionError("recover", id, fmt.Sprintf("Recover operation %d is not supported by fake server", op))
+	}
+	return id, s.c.recreate(id)
+}
+
+func (s *Server) vmMonitoring(p *params) (interface{}, error) {
+	id := p.int(0)
+	if p.err != nil {
+		return nil, p.err
+	}
+	mon, err := s.c.monitoring(id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range mon.Records {
+		mon.Records[i] = copyTemplate(&mon.Records[i])
+		escape(&mon.Records[i])
+	}
+	return marshal(mon)
+}
+
+func (s *Server) vmAttachNIC(p *params) (interface{}, error) {
+	id, template := p.int(0), p.str(1)
+	if p.err != nil {
+		return nil, p.err
+	}
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	nic, err := t.GetVector(string(shared.NICVec))
+	if err != nil {
+		return nil, actionError("attachnic", id, "NIC is not defined")
+	}
+	if _, err := nic.GetInt(string(shared.NetworkID)); err != nil {
+		return nil, actionError("attachnic", id, "Only NICs with NETWORK_ID are supported by fake server")
+	}
+	return id, s.c.attachNIC(id, nic)
+}
+
+func (s *Server) vmDetachNIC(p *params) (interface{}, error) {
+	id, nicID := p.int(0), p.int(1)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return id, s.c.detachNIC(id, nicID)
+}
+
+// Only QoS attributes are updated, like ONe does; append mode merges them with the current ones
+func (s *Server) vmUpdateNIC(p *params) (interface{}, error) {
+	id, nicID, template, merge := p.int(0), p.int(1), p.str(2), p.int(3)
+	if p.err != nil {
+		return nil, p.err
+	}
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	vec, err := t.GetVector(string(shared.NICVec))
+	if err != nil {
+		return nil, actionError("updatenic", id, "NIC is not defined")
+	}
+
+	limits := one.BandwidthLimits{}
+	if merge == 1 {
+		v, err := s.c.getVM(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, nic := range v.Template.GetNICs() {
+			if nid, _ := nic.ID(); nid == nicID {
+				limits = one.NICBandwidthLimits(&nic)
+			}
+		}
+	}
+	maps.Copy(limits, one.NICBandwidthLimits(&shared.NIC{Vector: *vec}))
+	return id, s.c.updateNICBandwidth(id, nicID, limits)
+}
+
+func (s *Server) vmResize(p *params) (interface{}, error) {
+	id, template := p.int(0), p.str(1)
+	if p.err != nil {
+		return nil, p.err
+	}
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	// Missing values are left untouched
+	vcpu, _ := t.GetInt("VCPU")
+	memory, _ := t.GetInt("MEMORY")
+	return id, s.c.resize(id, vcpu, memory)
+}
+
+func (s *Server) vmDiskResize(p *params) (interface{}, error) {
+	id, disk, size := p.int(0), p.int(1), p.str(2)
+	if p.err != nil {
+		return nil, p.err
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil {
+		return nil, actionError("diskresize", id, fmt.Sprintf("Invalid size %q", size))
+	}
+	return id, s.c.diskResize(id, disk, n)
+}
+
+// Args are: filter flag, start ID, end ID, state; state -1 stands for any but DONE, -2 for any
+func (s *Server) vmPoolInfo(p *params) (interface{}, error) {
+	who, start, end, state := p.int(0), p.int(1), p.int(2), p.int(3)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	s.c.mu.Lock()
+	pool := &vm.Pool{}
+	for _, id := range sortedKeys(s.c.vms) {
+		v := s.c.vms[id]
+		if !owned(v.UID, v.GID, who) || !inRange(id, start, end) {
+			continue
+		}
+		switch {
+		case state == -1 && v.StateRaw == int(vm.Done):
+			continue
+		case state >= 0 && v.StateRaw != state:
+			continue
+		}
+		pool.VMs = append(pool.VMs, *escapeVM(copyVM(v)))
+	}
+	s.c.mu.Unlock()
+
+	return marshal(pool)
+}
+
+func (s *Server) templateInfo(p *params) (interface{}, error) {
+	id := p.int(0)
+	if p.err != nil {
+		return nil, p.err
+	}
+	t, err := s.c.getTemplate(id)
+	if err != nil {
+		return nil, err
+	}
+	escape(&t.Template.Template)
+	return marshal(t)
+}
+
+func (s *Server) templatePoolInfo(p *params) (interface{}, error) {
+	who, start, end := p.int(0), p.int(1), p.int(2)
+	if p.err != nil {
+		return nil, p.err
+	}
+	templates, err := s.c.listTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &tmpl.Pool{}
+	for _, t := range templates {
+		if owned(t.UID, t.GID, who) && inRange(t.ID, start, end) {
+			escape(&t.Template.Template)
+			pool.Templates = append(pool.Templates, t)
+		}
+	}
+	return marshal(pool)
+}
+
+func (s *Server) templateInstantiate(p *params) (interface{}, error) {
+	id, name, pending, extra := p.int(0), p.str(1), p.bool(2), p.str(3)
+	if p.err != nil {
+		return nil, p.err
+	}
+	vmid, err := s.c.instantiateTemplate(id, name, extra, pending)
+	if err != nil {
+		return nil, err
+	}
+	return vmid, nil
+}
+
+func (s *Server) imageInfo(p *params) (interface{}, error) {
+	id := p.int(0)
+	if p.err != nil {
+		return nil, p.err
+	}
+	i, err := s.c.getImage(id)
+	if err != nil {
+		return nil, err
+	}
+	return marshal(i)
+}
+
+func (s *Server) imagePoolInfo(p *params) (interface{}, error) {
+	who, start, end := p.int(0), p.int(1), p.int(2)
+	if p.err != nil {
+		return nil, p.err
+	}
+	images, err := s.c.listImages()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &img.Pool{}
+	for _, i := range images {
+		if owned(i.UID, i.GID, who) && inRange(i.ID, start, end) {
+			pool.Images = append(pool.Images, i)
+		}
+	}
+	return marshal(pool)
+}
+
+func (s *Server) vnInfo(p *params) (interface{}, error) {
+	id := p.int(0)
+	if p.err != nil {
+		return nil, p.err
+	}
+	vn, err := s.c.getVNet(id)
+	if err != nil {
+		return nil, err
+	}
+	escape(&vn.Template.Template)
+	return marshal(vn)
+}
+
+func (s *Server) vnPoolInfo(p *params) (interface{}, error) {
+	who, start, end := p.int(0), p.int(1), p.int(2)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	s.c.mu.Lock()
+	pool := &vnet.Pool{}
+	for _, id := range sortedKeys(s.c.vnets) {
+		vn := s.c.vnets[id]
+		if owned(vn.UID, vn.GID, who) && inRange(id, start, end) {
+			res := copyVNet(vn)
+			escape(&res.Template.Template)
+			pool.VirtualNetworks = append(pool.VirtualNetworks, *res)
+		}
+	}
+	s.c.mu.Unlock()
+
+	return marshal(pool)
+}
+
+func (s *Server) vnReserve(p *params) (interface{}, error) {
+	id, template := p.int(0), p.str(1)
+	if p.err != nil {
+		return nil, p.err
+	}
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := t.GetInt("SIZE")
+	if err != nil {
+		return nil, errors.New("[one.vn.reserve] SIZE attribute is not defined")
+	}
+	name, _ := t.GetStr("NAME")
+	to, err := t.GetInt("NETWORK_ID")
+	if err != nil {
+		to = -1
+	}
+	arID, _ := t.GetStr("AR_ID")
+	return s.c.reserveVNet(id, arID, size, to, name)
+}
+
+func (s *Server) vnUpdate(p *params) (interface{}, error) {
+	id, template, uType := p.int(0), p.str(1), p.int(2)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return id, s.c.updateVNet(id, template, parameters.UpdateType(uType))
+}
+
+func (s *Server) vnRename(p *params) (interface{}, error) {
+	id, name := p.int(0), p.str(1)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+
+	vn, ok := s.c.vnets[id]
+	if !ok {
+		return nil, noExists("vn", id)
+	}
+	for _, other := range s.c.vnets {
+		if other.ID != id && other.Name == name && other.UID == vn.UID {
+			return nil, fmt.Errorf("[one.vn.rename] NAME is already taken by NET %d", other.ID)
+		}
+	}
+	vn.Name = name
+	return id, nil
+}
+
+func (s *Server) secgroupInfo(p *params) (interface{}, error) {
+	id := p.int(0)
+	if p.err != nil {
+		return nil, p.err
+	}
+	sg, err := s.c.getSecurityGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	escape(&sg.Template.Template)
+	return marshal(sg)
+}
+
+func (s *Server) secgroupPoolInfo(p *params) (interface{}, error) {
+	who, start, end := p.int(0), p.int(1), p.int(2)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	s.c.mu.Lock()
+	pool := &securitygroup.Pool{}
+	for _, id := range sortedKeys(s.c.secgroups) {
+		sg := s.c.secgroups[id]
+		if owned(sg.UID, sg.GID, who) && inRange(id, start, end) {
+			res := copySecGroup(sg)
+			escape(&res.Template.Template)
+			pool.SecurityGroups = append(pool.SecurityGroups, *res)
+		}
+	}
+	s.c.mu.Unlock()
+
+	return marshal(pool)
+}
+
+func (s *Server) vnTemplateInfo(p *params) (interface{}, error) {
+	id := p.int(0)
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	s.c.mu.Lock()
+	t, ok := s.c.vnTemplates[id]
+	if !ok {
+		s.c.mu.Unlock()
+		return nil, noExists("vntemplate", id)
+	}
+	res := &vntemplate.VNTemplate{
+		ID: id, Name: fmt.Sprintf("vntemplate-%d", id),
+		UName: "oneadmin", GName: "oneadmin",
+		Template: copyTemplate(t),
+	}
+	s.c.mu.Unlock()
+
+	escape(&res.Template)
+	return marshal(res)
+}
+
+func (s *Server) vnTemplateInstantiate(p *params) (interface{}, error) {
+	id, name, extra := p.int(0), p.str(1), p.str(2)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return s.c.instantiateVNTemplate(id, name, extra)
+}
+
+func (s *Server) userInfo(p *params) (interface{}, error) {
+	id := p.int(0)
+	if p.err != nil {
+		return nil, p.err
+	}
+	u, err := s.c.getUser(id)
+	if err != nil {
+		return nil, err
+	}
+	escape(&u.Template)
+	return marshal(u)
+}
+
+func (s *Server) userPoolInfo(p *params) (interface{}, error) {
+	pool, err := s.c.getUsers()
+	if err != nil {
+		return nil, err
+	}
+	for i := range pool.Users {
+		escape(&pool.Users[i].Template)
+	}
+	return marshal(pool)
+}
+
+func (s *Server) userAllocate(p *params) (interface{}, error) {
+	name, pass, groups := p.str(0), p.str(1), p.ints(3)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return s.c.createUser(name, pass, groups)
+}
+
+func (s *Server) userUpdate(p *params) (interface{}, error) {
+	id, template, uType := p.int(0), p.str(1), p.int(2)
+	if p.err != nil {
+		return nil, p.err
+	}
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+
+	u, ok := s.c.users[id]
+	if !ok {
+		return nil, noExists("user", id)
+	}
+	if parameters.UpdateType(uType) == parameters.Replace {
+		u.Template = *t
+	} else {
+		mergeTemplate(&u.Template, t)
+	}
+	return id, nil
+}
+
+func (s *Server) userQuota(p *params) (interface{}, error) {
+	id, template := p.int(0), p.str(1)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return id, s.c.setQuota(id, template)
+}
+
+func (s *Server) hostPoolInfo(p *params) (interface{}, error) {
+	pool, err := s.c.getHosts()
+	if err != nil {
+		return nil, err
+	}
+	return marshal(pool)
+}
+
+func (s *Server) hostMonitoring(p *params) (interface{}, error) {
+	id := p.int(0)
+	if p.err != nil {
+		return nil, p.err
+	}
+	mon, err := s.c.hostMonitoring(id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range mon.Records {
+		mon.Records[i] = copyTemplate(&mon.Records[i])
+		escape(&mon.Records[i])
+	}
+	return marshal(&host.Monitoring{Records: mon.Records})
+}
+
+// Mirrors pools filter flag: -2 all, -1 mine and my group, -3 mine, otherwise User ID; requests are made by oneadmin
+func owned(uid, gid, who int) bool {
+	switch {
+	case who >= 0:
+		return uid == who
+	case who == -3:
+		return uid == ADMIN_USER
+	case who == -1:
+		return uid == ADMIN_USER || gid == ADMIN_GROUP
+	default:
+		return true
+	}
+}
+
+func inRange(id, start, end int) bool {
+	if start >= 0 && id < start {
+		return false
+	}
+	if end >= 0 && id > end {
+		return false
+	}
+	return true
+}
+
+// params gives typed access to the call arguments, the first conversion error is kept
+type params struct {
+	method string
+	args   []interface{}
+	err    error
+}
+
+func (p *params) arg(i int) interface{} {
+	if i >= len(p.args) {
+		p.fail(i, "missing")
+		return nil
+	}
+	return p.args[i]
+}
+
+func (p *params) fail(i int, reason string) {
+	if p.err == nil {
+		p.err = &goca_errors.ResponseError{
+			Code: goca_errors.OneXMLRPCAPIError,
+			Msg:  fmt.Sprintf("[%s] Argument %d is %s", p.method, i+1, reason),
+		}
+	}
+}
+
+func (p *params) int(i int) int {
+	v, ok := p.arg(i).(int64)
+	if !ok {
+		p.fail(i, "not an int")
+	}
+	return int(v)
+}
+
+func (p *params) int8(i int) int8 {
+	return int8(p.int(i))
+}
+
+func (p *params) str(i int) string {
+	v, ok := p.arg(i).(string)
+	if !ok {
+		p.fail(i, "not a string")
+	}
+	return v
+}
+
+func (p *params) bool(i int) bool {
+	v, ok := p.arg(i).(bool)
+	if !ok {
+		p.fail(i, "not a boolean")
+	}
+	return v
+}
+
+func (p *params) ints(i int) []int {
+	list, ok := p.arg(i).([]interface{})
+	if !ok {
+		p.fail(i, "not an array")
+		return nil
+	}
+	res := make([]int, 0, len(list))
+	for _, el := range list {
+		n, ok := el.(int64)
+		if !ok {
+			p.fail(i, "not an array of ints")
+			return nil
+		}
+		res = append(res, int(n))
+	}
+	return res
+}
+
+// Pair values are marshalled as inner XML, so they have to be escaped beforehand
+func escape(t *dynamic.Template) {
+	for _, el := range t.Elements {
+		switch el := el.(type) {
+		case *dynamic.Pair:
+			el.Value = escapeText(el.Value)
+		case *dynamic.Vector:
+			for i := range el.Pairs {
+				el.Pairs[i].Value = escapeText(el.Pairs[i].Value)
+			}
+		}
+	}
+}
+
+func escapeVM(v *vm.VM) *vm.VM {
+	escape(&v.Template.Template)
+	escape(&v.UserTemplate.Template)
+	return v
+}
+
+func escapeText(s string) string {
+	buf := &bytes.Buffer{}
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+func marshal(v interface{}) (string, error) {
+	res, err := xml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
+
+// XML-RPC wire format, limited to the types goca sends and expects
+
+type xmlMethodCall struct {
+	XMLName xml.Name   `xml:"methodCall"`
+	Method  string     `xml:"methodName"`
+	Params  []xmlValue `xml:"params>param>value"`
+}
+
+type xmlValue struct {
+	String  *string   `xml:"string"`
+	Int     *string   `xml:"int"`
+	I4      *string   `xml:"i4"`
+	I8      *string   `xml:"i8"`
+	Boolean *string   `xml:"boolean"`
+	Double  *string   `xml:"double"`
+	Array   *xmlArray `xml:"array"`
+	Text    string    `xml:",chardata"`
+}
+
+type xmlArray struct {
+	Values []xmlValue `xml:"data>value"`
+}
+
+func (v *xmlValue) decode() (interface{}, error) {
+	switch {
+	case v.String != nil:
+		return *v.String, nil
+	case v.Int != nil, v.I4 != nil, v.I8 != nil:
+		raw := v.Int
+		if raw == nil {
+			raw = v.I4
+		}
+		if raw == nil {
+			raw = v.I8
+		}
+		return strconv.ParseInt(strings.TrimSpace(*raw), 10, 64)
+	case v.Boolean != nil:
+		return strings.TrimSpace(*v.Boolean) == "1", nil
+	case v.Double != nil:
+		return strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+	case v.Array != nil:
+		res := make([]interface{}, 0, len(v.Array.Values))
+		for _, el := range v.Array.Values {
+			d, err := el.decode()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, d)
+		}
+		return res, nil
+	default:
+		// Value without type is a string
+		return v.Text, nil
+	}
+}
+
+func decodeCall(body []byte) (string, []interface{}, error) {
+	call := xmlMethodCall{}
+	if err := xml.Unmarshal(body, &call); err != nil {
+		return "", nil, err
+	}
+	if call.Method == "" {
+		return "", nil, errors.New("methodName is empty")
+	}
+
+	args := make([]interface{}, 0, len(call.Params))
+	for _, param := range call.Params {
+		arg, err := param.decode()
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, arg)
+	}
+	return call.Method, args, nil
+}
+
+// ONe responds with array of success flag, body (string or int) and error code
+func encodeResponse(result interface{}, err error) []byte {
+	success, code := true, goca_errors.OneErrCode(goca_errors.OneSuccess)
+	if err != nil {
+		success, code, result = false, goca_errors.OneActionError, err.Error()
+		if respErr, ok := err.(*goca_errors.ResponseError); ok {
+			code, result = respErr.Code, respErr.Msg
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(`<?xml version="1.0"?><methodResponse><params><param><value><array><data>`)
+	if success {
+		buf.WriteString(`<value><boolean>1</boolean></value>`)
+	} else {
+		buf.WriteString(`<value><boolean>0</boolean></value>`)
+	}
+	switch r := result.(type) {
+	case int:
+		fmt.Fprintf(buf, `<value><i4>%d</i4></value>`, r)
+	case string:
+		buf.WriteString(`<value><string>`)
+		xml.EscapeText(buf, []byte(r))
+		buf.WriteString(`</string></value>`)
+	default:
+		buf.WriteString(`<value><string></string></value>`)
+	}
+	fmt.Fprintf(buf, `<value><i4>%d</i4></value>`, int(code))
+	buf.WriteString(`</data></array></value></param></params></methodResponse>`)
+	return buf.Bytes()
+}
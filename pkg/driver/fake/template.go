@@ -0,0 +1,174 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	tmpl "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/template"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+)
+
+// AddTemplate registers VM Template given in ONe syntax, returns its ID
+func (c *Cloud) AddTemplate(name, template string) (int, error) {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return -1, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextID("template")
+	c.templates[id] = &tmpl.Template{
+		ID: id, Name: name, UID: ADMIN_USER, GID: ADMIN_GROUP,
+		UName: "oneadmin", GName: "oneadmin",
+		RegTime:  c.now(),
+		Template: vm.Template{Template: *t},
+	}
+	return id, nil
+}
+
+// createTemplate allocates Template named by its NAME, like one.template.allocate
+func (c *Cloud) createTemplate(template string) (int, error) {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return -1, err
+	}
+	name, err := t.GetStr("NAME")
+	if err != nil {
+		return -1, errors.New("[one.template.allocate] NAME is not set")
+	}
+	t.Del("NAME")
+	return c.AddTemplate(name, t.String())
+}
+
+func (c *Cloud) getTemplate(id int) (*tmpl.Template, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.templates[id]
+	if !ok {
+		return nil, noExists("template", id)
+	}
+	res := *t
+	res.Template = vm.Template{Template: copyTemplate(&t.Template.Template)}
+	return &res, nil
+}
+
+func (c *Cloud) listTemplates() ([]tmpl.Template, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := make([]tmpl.Template, 0, len(c.templates))
+	for _, id := range sortedKeys(c.templates) {
+		t := *c.templates[id]
+		t.Template = vm.Template{Template: copyTemplate(&t.Template.Template)}
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+func (c *Cloud) instantiateTemplate(id int, vmname, template string, pending bool) (vmid int, err error) {
+	extra, err := ParseTemplate(template)
+	if err != nil {
+		return -1, fmt.Errorf("[one.template.instantiate] Error parsing template: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.templates[id]
+	if !ok {
+		return -1, noExists("template", id)
+	}
+
+	for _, vmc := range c.vms {
+		if vmc.Name == vmname && vmc.StateRaw != int(vm.Done) {
+			return -1, fmt.Errorf("[one.template.instantiate] NAME is already taken by VM %d", vmc.ID)
+		}
+	}
+
+	vmt := copyTemplate(&t.Template.Template)
+	mergeTemplate(&vmt, extra)
+
+	vmid = c.nextID("vm")
+	vmt.Del("TEMPLATE_ID")
+	vmt.Del("VMID")
+	vmt.AddPair("TEMPLATE_ID", strconv.Itoa(id))
+	vmt.AddPair("VMID", strconv.Itoa(vmid))
+
+	utmpl := dynamic.Template{}
+	for _, key := range []string{"PASSWORD", "USERNAME", "NOCLOUD", "NOCLOUD_VM", "NOCLOUD_VM_TOKEN", "NOCLOUD_INST_TITLE", "NOCLOUD_IG_TITLE"} {
+		if pair, err := vmt.GetPair(key); err == nil {
+			utmpl.AddPair(key, pair.Value)
+			vmt.Del(key)
+		}
+	}
+
+	now := c.now()
+	v := &vm.VM{
+		ID: vmid, Name: vmname,
+		UID: ADMIN_USER, GID: ADMIN_GROUP, UName: "oneadmin", GName: "oneadmin",
+		Permissions:  &shared.Permissions{OwnerU: 1, OwnerM: 1, OwnerA: 0},
+		STime:        now,
+		Template:     vm.Template{Template: vmt},
+		UserTemplate: vm.UserTemplate{Template: utmpl},
+	}
+
+	for i, disk := range v.Template.GetVectors(string(shared.DiskVec)) {
+		disk.Del(string(shared.DiskID))
+		disk.AddPair(string(shared.DiskID), i)
+	}
+
+	nics := v.Template.GetVectors(string(shared.NICVec))
+	for i, nic := range nics {
+		if err := c.leaseNIC(v, nic, i); err != nil {
+			c.releaseLeases(v)
+			return -1, fmt.Errorf("[one.template.instantiate] Error allocating a new virtual machine. %w", err)
+		}
+	}
+
+	if pending {
+		v.StateRaw = int(vm.Hold)
+	} else {
+		v.StateRaw, v.LCMStateRaw = int(vm.Active), int(vm.Running)
+		c.openHistory(v, now)
+	}
+
+	c.vms[vmid] = v
+	c.recordAction(vmid, "instantiate")
+	return vmid, nil
+}
+
+func copyTemplate(t *dynamic.Template) dynamic.Template {
+	res := dynamic.Template{Elements: make([]dynamic.Element, 0, len(t.Elements))}
+	for _, el := range t.Elements {
+		switch el := el.(type) {
+		case *dynamic.Pair:
+			p := *el
+			res.Elements = append(res.Elements, &p)
+		case *dynamic.Vector:
+			v := &dynamic.Vector{XMLName: el.XMLName, Pairs: append(dynamic.Pairs{}, el.Pairs...)}
+			res.Elements = append(res.Elements, v)
+		}
+	}
+	return res
+}
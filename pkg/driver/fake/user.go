@@ -0,0 +1,279 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/group"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/user"
+)
+
+// AddGroup registers ONe Group, returns its ID
+func (c *Cloud) AddGroup(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addGroup(name)
+}
+
+func (c *Cloud) addGroup(name string) int {
+	id := c.nextID("group")
+	c.groups[id] = &group.Group{GroupShort: group.GroupShort{ID: id, Name: name}}
+	return id
+}
+
+func (c *Cloud) getGroup(id int) (*group.Group, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, ok := c.groups[id]
+	if !ok {
+		return nil, noExists("group", id)
+	}
+	res := *g
+	return &res, nil
+}
+
+// getUser returns User by ID, -1 stands for the connected User like in ONe, which is always oneadmin here
+func (c *Cloud) getUser(id int) (*user.User, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id == -1 {
+		id = ADMIN_USER
+	}
+	u, ok := c.users[id]
+	if !ok {
+		return nil, noExists("user", id)
+	}
+	return copyUser(u), nil
+}
+
+func (c *Cloud) getUsers() (*user.Pool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pool := &user.Pool{}
+	for _, id := range sortedKeys(c.users) {
+		pool.Users = append(pool.Users, *copyUser(c.users[id]))
+	}
+	return pool, nil
+}
+
+func (c *Cloud) createUser(name, pass string, groups []int) (id int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if name == "" {
+		return -1, errors.New("[one.user.allocate] Invalid NAME, it cannot be empty")
+	}
+	for _, u := range c.users {
+		if u.Name == name {
+			return -1, fmt.Errorf("[one.user.allocate] NAME is already taken by USER %d", u.ID)
+		}
+	}
+	if len(groups) == 0 {
+		groups = []int{USERS_GROUP}
+	}
+	g, ok := c.groups[groups[0]]
+	if !ok {
+		return -1, noExists("group", groups[0])
+	}
+
+	id = c.nextID("user")
+	c.users[id] = &user.User{UserShort: user.UserShort{
+		ID: id, Name: name, Password: pass, AuthDriver: "core", Enabled: 1,
+		GID: g.ID, GName: g.Name, Groups: sharedIDs(groups...),
+	}}
+	g.Users.ID = append(g.Users.ID, id)
+	return id, nil
+}
+
+func (c *Cloud) deleteUser(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.users[id]; !ok {
+		return noExists("user", id)
+	}
+	if id == ADMIN_USER {
+		return authorizationError("user.delete", "oneadmin cannot be deleted")
+	}
+	delete(c.users, id)
+	delete(c.quotas, id)
+	return nil
+}
+
+func (c *Cloud) setQuota(id int, quota string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.users[id]; !ok {
+		return noExists("user", id)
+	}
+	c.quotas[id] = append(c.quotas[id], quota)
+	return nil
+}
+
+// Quotas returns quotas templates set to the User in order
+func (c *Cloud) Quotas(id int) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.quotas[id]...)
+}
+
+func (c *Cloud) chown(class string, oid, uid, gid int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var owner, ownerGroup *int
+	switch class {
+	case "vm":
+		v, ok := c.vms[oid]
+		if !ok {
+			return noExists(class, oid)
+		}
+		owner, ownerGroup = &v.UID, &v.GID
+	case "vn":
+		vn, ok := c.vnets[oid]
+		if !ok {
+			return noExists(class, oid)
+		}
+		owner, ownerGroup = &vn.UID, &vn.GID
+	case "template":
+		t, ok := c.templates[oid]
+		if !ok {
+			return noExists(class, oid)
+		}
+		owner, ownerGroup = &t.UID, &t.GID
+	case "image":
+		i, ok := c.images[oid]
+		if !ok {
+			return noExists(class, oid)
+		}
+		owner, ownerGroup = &i.UID, &i.GID
+	case "secgroup":
+		sg, ok := c.secgroups[oid]
+		if !ok {
+			return noExists(class, oid)
+		}
+		owner, ownerGroup = &sg.UID, &sg.GID
+	default:
+		return fmt.Errorf("[one.%s.chown] unsupported class", class)
+	}
+
+	if uid != -1 {
+		if _, ok := c.users[uid]; !ok {
+			return noExists("user", uid)
+		}
+		*owner = uid
+	}
+	if gid != -1 {
+		if _, ok := c.groups[gid]; !ok {
+			return noExists("group", gid)
+		}
+		*ownerGroup = gid
+	}
+	c.syncNames(class, oid)
+	return nil
+}
+
+func (c *Cloud) chmod(class string, oid int, perm *shared.Permissions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := *perm
+	switch class {
+	case "vm":
+		v, ok := c.vms[oid]
+		if !ok {
+			return noExists(class, oid)
+		}
+		v.Permissions = &p
+	case "vn":
+		vn, ok := c.vnets[oid]
+		if !ok {
+			return noExists(class, oid)
+		}
+		vn.Permissions = &p
+	case "template":
+		t, ok := c.templates[oid]
+		if !ok {
+			return noExists(class, oid)
+		}
+		t.Permissions = &p
+	case "image":
+		i, ok := c.images[oid]
+		if !ok {
+			return noExists(class, oid)
+		}
+		i.Permissions = &p
+	case "secgroup":
+		sg, ok := c.secgroups[oid]
+		if !ok {
+			return noExists(class, oid)
+		}
+		sg.Permissions = &p
+	default:
+		return fmt.Errorf("[one.%s.chmod] unsupported class", class)
+	}
+	return nil
+}
+
+// Keeps UNAME and GNAME of the object consistent with its owner
+func (c *Cloud) syncNames(class string, oid int) {
+	name := func(uid, gid int) (string, string) {
+		var uname, gname string
+		if u, ok := c.users[uid]; ok {
+			uname = u.Name
+		}
+		if g, ok := c.groups[gid]; ok {
+			gname = g.Name
+		}
+		return uname, gname
+	}
+
+	switch class {
+	case "vm":
+		v := c.vms[oid]
+		v.UName, v.GName = name(v.UID, v.GID)
+	case "vn":
+		vn := c.vnets[oid]
+		vn.UName, vn.GName = name(vn.UID, vn.GID)
+	case "template":
+		t := c.templates[oid]
+		t.UName, t.GName = name(t.UID, t.GID)
+	case "image":
+		i := c.images[oid]
+		i.UName, i.GName = name(i.UID, i.GID)
+	case "secgroup":
+		sg := c.secgroups[oid]
+		sg.UName, sg.GName = name(sg.UID, sg.GID)
+	}
+}
+
+func copyUser(u *user.User) *user.User {
+	res := *u
+	res.Template = copyTemplate(&u.Template)
+	res.Groups.ID = append([]int{}, u.Groups.ID...)
+	return &res
+}
+
+func sharedIDs(ids ...int) shared.EntitiesID {
+	return shared.EntitiesID{ID: append([]int{}, ids...)}
+}
@@ -0,0 +1,591 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/parameters"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+)
+
+// History records actions, as used by one.MakeTimelineRecords
+const (
+	HISTORY_ACTION_NONE          = 0
+	HISTORY_ACTION_SUSPEND       = 9
+	HISTORY_ACTION_POWEROFF      = 20
+	HISTORY_ACTION_TERMINATE     = 27
+	HISTORY_ACTION_TERMINATE_HRD = 28
+)
+
+// updateVM updates VM USER_TEMPLATE, same as one.vm.update
+func (c *Cloud) updateVM(vmid int, template string, uType parameters.UpdateType) error {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return actionError("update", vmid, err.Error())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+	if uType == parameters.Replace {
+		v.UserTemplate.Template = *t
+	} else {
+		mergeTemplate(&v.UserTemplate.Template, t)
+	}
+	return nil
+}
+
+// MergeVMTemplate merges the given pairs and vectors into VM TEMPLATE, e.g. to set what Hypervisor would
+func (c *Cloud) MergeVMTemplate(vmid int, template string) error {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+	mergeTemplate(&v.Template.Template, t)
+	return nil
+}
+
+func (c *Cloud) getVM(vmid int) (*vm.VM, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return nil, noExists("vm", vmid)
+	}
+	return copyVM(v), nil
+}
+
+// SetVMState forces VM state, e.g. to emulate failures or transitional states
+func (c *Cloud) SetVMState(id int, state vm.State, lcm vm.LCMState) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[id]
+	if !ok {
+		return noExists("vm", id)
+	}
+	v.StateRaw, v.LCMStateRaw = int(state), int(lcm)
+	return nil
+}
+
+func (c *Cloud) poweroff(id int, hard bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, err := c.running(id, "action")
+	if err != nil {
+		return err
+	}
+	now := c.now()
+	c.closeHistory(v, now, HISTORY_ACTION_POWEROFF)
+	v.StateRaw, v.LCMStateRaw = int(vm.Poweroff), int(vm.LcmInit)
+	c.recordAction(id, map[bool]string{false: "poweroff", true: "poweroff-hard"}[hard])
+	return nil
+}
+
+func (c *Cloud) suspend(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, err := c.running(id, "action")
+	if err != nil {
+		return err
+	}
+	c.closeHistory(v, c.now(), HISTORY_ACTION_SUSPEND)
+	v.StateRaw, v.LCMStateRaw = int(vm.Suspended), int(vm.LcmInit)
+	c.recordAction(id, "suspend")
+	return nil
+}
+
+func (c *Cloud) reboot(id int, hard bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.running(id, "action"); err != nil {
+		return err
+	}
+	c.recordAction(id, map[bool]string{false: "reboot", true: "reboot-hard"}[hard])
+	return nil
+}
+
+func (c *Cloud) resume(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[id]
+	if !ok {
+		return noExists("vm", id)
+	}
+	switch vm.State(v.StateRaw) {
+	case vm.Poweroff, vm.Suspended, vm.Stopped, vm.Undeployed:
+	default:
+		return actionError("action", id, fmt.Sprintf("Wrong state to perform action resume: %s", vm.State(v.StateRaw)))
+	}
+
+	now := c.now()
+	if n := len(v.HistoryRecords); n > 0 {
+		v.HistoryRecords[n-1].ETime = now
+	}
+	v.StateRaw, v.LCMStateRaw = int(vm.Active), int(vm.Running)
+	c.openHistory(v, now)
+	c.recordAction(id, "resume")
+	return nil
+}
+
+func (c *Cloud) terminate(id int, hard bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[id]
+	if !ok {
+		return noExists("vm", id)
+	}
+	if v.StateRaw == int(vm.Done) {
+		return actionError("action", id, "Virtual machine is already terminated")
+	}
+
+	now := c.now()
+	action := HISTORY_ACTION_TERMINATE
+	if hard {
+		action = HISTORY_ACTION_TERMINATE_HRD
+	}
+	if v.StateRaw == int(vm.Active) {
+		c.closeHistory(v, now, action)
+	}
+	if n := len(v.HistoryRecords); n > 0 {
+		v.HistoryRecords[n-1].ETime = now
+	}
+
+	c.releaseLeases(v)
+	v.StateRaw, v.LCMStateRaw = int(vm.Done), int(vm.LcmInit)
+	v.ETime = now
+	c.recordAction(id, map[bool]string{false: "terminate", true: "terminate-hard"}[hard])
+	return nil
+}
+
+// Mirrors one.vm.recover with delete-recreate: VM is booted again from the Template
+func (c *Cloud) recreate(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[id]
+	if !ok {
+		return noExists("vm", id)
+	}
+	if v.StateRaw == int(vm.Done) {
+		return actionError("recover", id, "Virtual machine is already terminated")
+	}
+
+	now := c.now()
+	if v.StateRaw == int(vm.Active) {
+		c.closeHistory(v, now, HISTORY_ACTION_NONE)
+	}
+	if n := len(v.HistoryRecords); n > 0 {
+		v.HistoryRecords[n-1].ETime = now
+	}
+	v.Template.Del("SNAPSHOT")
+	v.StateRaw, v.LCMStateRaw = int(vm.Active), int(vm.Running)
+	c.openHistory(v, now)
+	c.recordAction(id, "recover-recreate")
+	return nil
+}
+
+func (c *Cloud) monitoring(id int) (*vm.Monitoring, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.vms[id]; !ok {
+		return nil, noExists("vm", id)
+	}
+	mon, ok := c.vmsMonitoring[id]
+	if !ok {
+		return &vm.Monitoring{}, nil
+	}
+	return &vm.Monitoring{Records: append([]dynamic.Template{}, mon.Records...)}, nil
+}
+
+// AddVMMonitoring appends VM monitoring record in ONe syntax, e.g. `CPU="10"\nNETTX="1024"`
+func (c *Cloud) AddVMMonitoring(id int, record string) error {
+	t, err := ParseTemplate(record)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.vms[id]; !ok {
+		return noExists("vm", id)
+	}
+	if _, err := t.GetInt("TIMESTAMP"); err != nil {
+		t.AddPair("TIMESTAMP", c.now())
+	}
+	if _, ok := c.vmsMonitoring[id]; !ok {
+		c.vmsMonitoring[id] = &vm.Monitoring{}
+	}
+	c.vmsMonitoring[id].Records = append(c.vmsMonitoring[id].Records, *t)
+	return nil
+}
+
+// AddVM registers VM with the template and history records, e.g. to replay billing of the known timeline.
+// VM is running if the last record isn't closed, otherwise its state is the one the record action leads to
+func (c *Cloud) AddVM(name, template string, history []vm.HistoryRecord) (int, error) {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return -1, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextID("vm")
+	// ONe keeps VM ID in the template as well
+	t.Del("VMID")
+	t.AddPair("VMID", strconv.Itoa(id))
+	v := &vm.VM{
+		ID: id, Name: name,
+		UID: ADMIN_USER, GID: ADMIN_GROUP, UName: "oneadmin", GName: "oneadmin",
+		Permissions:    &shared.Permissions{OwnerU: 1, OwnerM: 1, OwnerA: 0},
+		STime:          c.now(),
+		Template:       vm.Template{Template: *t},
+		HistoryRecords: append([]vm.HistoryRecord{}, history...),
+	}
+	for i := range v.HistoryRecords {
+		v.HistoryRecords[i].OID, v.HistoryRecords[i].SEQ = id, i
+	}
+
+	v.StateRaw, v.LCMStateRaw = int(vm.Active), int(vm.Running)
+	if n := len(history); n > 0 {
+		v.STime = history[0].RSTime
+		if last := history[n-1]; last.RETime != 0 {
+			switch last.Action {
+			case 9, 10:
+				v.StateRaw, v.LCMStateRaw = int(vm.Suspended), int(vm.LcmInit)
+			case 20:
+				v.StateRaw, v.LCMStateRaw = int(vm.Poweroff), int(vm.LcmInit)
+			case 27, 28:
+				v.StateRaw, v.LCMStateRaw = int(vm.Done), int(vm.LcmInit)
+			}
+		}
+	}
+
+	c.vms[id] = v
+	return id, nil
+}
+
+func (c *Cloud) snapshotCreate(name string, vmid int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, err := c.running(vmid, "snapshotcreate")
+	if err != nil {
+		return err
+	}
+
+	id := 0
+	for _, snap := range v.Template.GetVectors("SNAPSHOT") {
+		if sid, err := snap.GetInt("SNAPSHOT_ID"); err == nil && sid >= id {
+			id = sid + 1
+		}
+	}
+
+	snap := v.Template.AddVector("SNAPSHOT")
+	snap.AddPair("SNAPSHOT_ID", id)
+	snap.AddPair("NAME", name)
+	snap.AddPair("TIME", c.now())
+	c.recordAction(vmid, "snapshot-create")
+	return nil
+}
+
+func (c *Cloud) snapshotDelete(snapId, vmid int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+
+	for i, el := range v.Template.Elements {
+		if snap, ok := el.(*dynamic.Vector); ok && snap.Key() == "SNAPSHOT" {
+			if sid, err := snap.GetInt("SNAPSHOT_ID"); err == nil && sid == snapId {
+				v.Template.Elements = append(v.Template.Elements[:i], v.Template.Elements[i+1:]...)
+				c.recordAction(vmid, "snapshot-delete")
+				return nil
+			}
+		}
+	}
+	return actionError("snapshotdelete", vmid, fmt.Sprintf("Snapshot %d does not exist", snapId))
+}
+
+func (c *Cloud) snapshotRevert(snapId, vmid int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, err := c.running(vmid, "snapshotrevert")
+	if err != nil {
+		return err
+	}
+
+	for _, snap := range v.Template.GetVectors("SNAPSHOT") {
+		if sid, err := snap.GetInt("SNAPSHOT_ID"); err == nil && sid == snapId {
+			c.recordAction(vmid, "snapshot-revert")
+			return nil
+		}
+	}
+	return actionError("snapshotrevert", vmid, fmt.Sprintf("Snapshot %d does not exist", snapId))
+}
+
+// Attaches NIC leasing address from its NETWORK_ID, or the given IP if set
+func (c *Cloud) attachNIC(vmid int, nic *dynamic.Vector) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+	if v.StateRaw != int(vm.Active) && v.StateRaw != int(vm.Poweroff) {
+		return actionError("attachnic", vmid, "Wrong state to perform action nic-attach")
+	}
+
+	id := 0
+	for _, nic := range v.Template.GetVectors(string(shared.NICVec)) {
+		if nid, err := nic.GetInt(string(shared.NICID)); err == nil && nid >= id {
+			id = nid + 1
+		}
+	}
+
+	if err := c.leaseNIC(v, nic, id); err != nil {
+		return err
+	}
+	v.Template.Elements = append(v.Template.Elements, nic)
+	c.recordAction(vmid, "nic-attach")
+	return nil
+}
+
+// detachNIC detaches NIC from the VM, releasing its address
+func (c *Cloud) detachNIC(vmid, nicID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+
+	for i, el := range v.Template.Elements {
+		nic, ok := el.(*dynamic.Vector)
+		if !ok || nic.Key() != string(shared.NICVec) {
+			continue
+		}
+		if id, err := nic.GetInt(string(shared.NICID)); err != nil || id != nicID {
+			continue
+		}
+
+		vnID, _ := nic.GetInt(string(shared.NetworkID))
+		if vn, ok := c.vnets[vnID]; ok {
+			c.freeLease(vn, nicAddr(nic))
+		}
+		v.Template.Elements = append(v.Template.Elements[:i], v.Template.Elements[i+1:]...)
+		c.recordAction(vmid, "nic-detach")
+		return nil
+	}
+	return actionError("detachnic", vmid, fmt.Sprintf("NIC %d does not exist", nicID))
+}
+
+// Resize sets VCPU and MEMORY of the VM, like one.vm.resize with enforce.
+// Running VM is resized live only within VCPU_MAX/MEMORY_MAX
+func (c *Cloud) resize(vmid, vcpu, memory int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+	switch vm.State(v.StateRaw) {
+	case vm.Poweroff, vm.Undeployed:
+	case vm.Active:
+		if vm.LCMState(v.LCMStateRaw) != vm.Running || !one.CanHotResize(v, vcpu, memory) {
+			return actionError("resize", vmid, "Wrong state to perform action resize")
+		}
+	default:
+		return actionError("resize", vmid, "Wrong state to perform action resize")
+	}
+
+	if vcpu > 0 {
+		v.Template.Del("VCPU")
+		v.Template.AddPair("VCPU", vcpu)
+	}
+	if memory > 0 {
+		v.Template.Del("MEMORY")
+		v.Template.AddPair("MEMORY", memory)
+	}
+	c.recordAction(vmid, "resize")
+	return nil
+}
+
+// diskResize grows the VM disk, shrinking is not allowed by ONe
+func (c *Cloud) diskResize(vmid, diskID, size int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+
+	for _, disk := range v.Template.GetVectors(string(shared.DiskVec)) {
+		if id, err := disk.GetInt(string(shared.DiskID)); err != nil || id != diskID {
+			continue
+		}
+		if current, err := disk.GetInt(string(shared.Size)); err == nil && size < current {
+			return actionError("diskresize", vmid, "New disk size has to be greater than current one")
+		}
+		disk.Del(string(shared.Size))
+		disk.AddPair(string(shared.Size), size)
+		c.recordAction(vmid, "disk-resize")
+		return nil
+	}
+	return actionError("diskresize", vmid, fmt.Sprintf("Disk %d does not exist", diskID))
+}
+
+// attachDisk attaches DISK from the given template to the VM, like one.vm.attach
+func (c *Cloud) attachDisk(vmid int, template string) error {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return actionError("attach", vmid, err.Error())
+	}
+	disks := t.GetVectors(string(shared.DiskVec))
+	if len(disks) != 1 {
+		return actionError("attach", vmid, "Template must have exactly one DISK")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+	if v.StateRaw != int(vm.Active) && v.StateRaw != int(vm.Poweroff) {
+		return actionError("attach", vmid, "Wrong state to perform action disk-attach")
+	}
+
+	id := 0
+	for _, disk := range v.Template.GetVectors(string(shared.DiskVec)) {
+		if did, err := disk.GetInt(string(shared.DiskID)); err == nil && did >= id {
+			id = did + 1
+		}
+	}
+
+	disk := &dynamic.Vector{XMLName: disks[0].XMLName, Pairs: append(dynamic.Pairs{}, disks[0].Pairs...)}
+	disk.Del(string(shared.DiskID))
+	disk.AddPair(string(shared.DiskID), id)
+	v.Template.Elements = append(v.Template.Elements, disk)
+	c.recordAction(vmid, "disk-attach")
+	return nil
+}
+
+// detachDisk detaches disk from the VM, like one.vm.detach
+func (c *Cloud) detachDisk(vmid, diskID int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.vms[vmid]
+	if !ok {
+		return noExists("vm", vmid)
+	}
+
+	for i, el := range v.Template.Elements {
+		disk, ok := el.(*dynamic.Vector)
+		if !ok || disk.Key() != string(shared.DiskVec) {
+			continue
+		}
+		if id, err := disk.GetInt(string(shared.DiskID)); err != nil || id != diskID {
+			continue
+		}
+		v.Template.Elements = append(v.Template.Elements[:i], v.Template.Elements[i+1:]...)
+		c.recordAction(vmid, "disk-detach")
+		return nil
+	}
+	return actionError("detach", vmid, fmt.Sprintf("Disk %d does not exist", diskID))
+}
+
+func (c *Cloud) running(id int, method string) (*vm.VM, error) {
+	v, ok := c.vms[id]
+	if !ok {
+		return nil, noExists("vm", id)
+	}
+	if v.StateRaw != int(vm.Active) || v.LCMStateRaw != int(vm.Running) {
+		st, lcm, _ := v.State()
+		return nil, actionError(method, id, fmt.Sprintf("Wrong state to perform action: %s %s", st, lcm))
+	}
+	return v, nil
+}
+
+func (c *Cloud) openHistory(v *vm.VM, now int) {
+	v.HistoryRecords = append(v.HistoryRecords, vm.HistoryRecord{
+		OID: v.ID, SEQ: len(v.HistoryRecords), Hostname: "fake", VMMad: "kvm",
+		STime: now, PSTime: now, PETime: now, RSTime: now, UID: v.UID, GID: v.GID,
+	})
+}
+
+func (c *Cloud) closeHistory(v *vm.VM, now, action int) {
+	n := len(v.HistoryRecords)
+	if n == 0 || v.HistoryRecords[n-1].RETime != 0 {
+		return
+	}
+	v.HistoryRecords[n-1].RETime = now
+	v.HistoryRecords[n-1].Action = action
+}
+
+func copyVM(v *vm.VM) *vm.VM {
+	res := *v
+	res.Template = vm.Template{Template: copyTemplate(&v.Template.Template)}
+	res.UserTemplate = vm.UserTemplate{Template: copyTemplate(&v.UserTemplate.Template)}
+	res.HistoryRecords = append([]vm.HistoryRecord{}, v.HistoryRecords...)
+	return &res
+}
+
+func sortedKeys[T any](m map[int]T) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
@@ -0,0 +1,511 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fake
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/parameters"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	vnet "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/virtualnetwork"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+)
+
+// AddVNet registers VNet with single IPv4 Address Range, e.g. super VNet for PUBLIC_IP_POOL
+func (c *Cloud) AddVNet(name, vnMad, firstIP string, size int) (int, error) {
+	if net.ParseIP(firstIP).To4() == nil {
+		return -1, fmt.Errorf("%s is not IPv4 address", firstIP)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextID("vn")
+	c.vnets[id] = &vnet.VirtualNetwork{
+		ID: id, Name: name, VNMad: vnMad,
+		UID: ADMIN_USER, GID: ADMIN_GROUP, UName: "oneadmin", GName: "oneadmin",
+		Permissions: &shared.Permissions{OwnerU: 1, OwnerM: 1, OwnerA: 1},
+		ARs: []vnet.AR{{
+			ID: "0", IP: firstIP, Size: size, Type: "IP4",
+			IPEnd: ipAdd(firstIP, size-1), UsedLeases: "0",
+		}},
+	}
+	return id, nil
+}
+
+// AddAR appends Address Range of the given type (IP4, IP6 or IP6_STATIC) to the VNet, returns its ID
+func (c *Cloud) AddAR(vnID int, arType, first string, size int) (string, error) {
+	parsed := net.ParseIP(first)
+	if parsed == nil || (parsed.To4() == nil) != strings.HasPrefix(arType, "IP6") {
+		return "", fmt.Errorf("%s is not valid address for %s Address Range", first, arType)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vn, ok := c.vnets[vnID]
+	if !ok {
+		return "", noExists("vn", vnID)
+	}
+	ar := newAR(strconv.Itoa(nextARID(vn)), arType, first, size)
+	vn.ARs = append(vn.ARs, ar)
+	return ar.ID, nil
+}
+
+// AddVNTemplate registers VNet Template, used as PRIVATE_VN_TEMPLATE
+func (c *Cloud) AddVNTemplate(vnMad string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextID("vntemplate")
+	t := dynamic.NewTemplate()
+	t.AddPair("VN_MAD", vnMad)
+	c.vnTemplates[id] = t
+	return id
+}
+
+func (c *Cloud) getVNet(id int) (*vnet.VirtualNetwork, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vn, ok := c.vnets[id]
+	if !ok {
+		return nil, noExists("vn", id)
+	}
+	return copyVNet(vn), nil
+}
+
+func (c *Cloud) deleteVNet(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vn, ok := c.vnets[id]
+	if !ok {
+		return noExists("vn", id)
+	}
+	if usedLeases(vn) > 0 {
+		return fmt.Errorf("[one.vn.delete] Can not remove a virtual network with leases in use")
+	}
+
+	// Reserved addresses are returned to the parent VNet
+	if parent, ok := c.vnets[atoi(vn.ParentNetworkID)]; ok && vn.ParentNetworkID != "" {
+		for _, ar := range vn.ARs {
+			for i := 0; i < ar.Size; i++ {
+				c.freeLease(parent, ipAdd(arAddr(&ar), i))
+			}
+		}
+	}
+
+	delete(c.vnets, id)
+	return nil
+}
+
+func (c *Cloud) updateVNet(id int, template string, uType parameters.UpdateType) error {
+	t, err := ParseTemplate(template)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vn, ok := c.vnets[id]
+	if !ok {
+		return noExists("vn", id)
+	}
+	if uType == parameters.Replace {
+		vn.Template = vnet.Template{Template: *t}
+		return nil
+	}
+	mergeTemplate(&vn.Template.Template, t)
+	return nil
+}
+
+// reserveVNet reserves addresses like one.vn.reserve, they are taken from the given AR only if arID isn't empty
+func (c *Cloud) reserveVNet(id int, arID string, size, to int, name string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	parent, ok := c.vnets[id]
+	if !ok {
+		return -1, noExists("vn", id)
+	}
+
+	var child *vnet.VirtualNetwork
+	if to != -1 {
+		child, ok = c.vnets[to]
+		if !ok {
+			return -1, noExists("vn", to)
+		}
+		if child.ParentNetworkID != strconv.Itoa(id) {
+			return -1, fmt.Errorf("[one.vn.reserve] Cannot reserve addresses from a different parent network")
+		}
+	}
+
+	var ips []string
+	for i := 0; i < size; i++ {
+		ip, err := c.allocateLeaseAR(parent, arID, func(l *vnet.Lease) {})
+		if err != nil {
+			for _, ip := range ips {
+				c.freeLease(parent, ip)
+			}
+			return -1, err
+		}
+		ips = append(ips, ip)
+	}
+
+	if child == nil {
+		if name == "" {
+			name = fmt.Sprintf("%s-reservation", parent.Name)
+		}
+		child = &vnet.VirtualNetwork{
+			ID: c.nextID("vn"), Name: name, VNMad: parent.VNMad,
+			UID: ADMIN_USER, GID: ADMIN_GROUP, UName: "oneadmin", GName: "oneadmin",
+			Permissions:     &shared.Permissions{OwnerU: 1, OwnerM: 1, OwnerA: 1},
+			ParentNetworkID: strconv.Itoa(id),
+		}
+		c.vnets[child.ID] = child
+	}
+
+	for _, ip := range ips {
+		parentAR := arOf(parent, ip)
+		ar := newAR(strconv.Itoa(nextARID(child)), parentAR.Type, ip, 1)
+		ar.ParentNetworkARID = parentAR.ID
+		child.ARs = append(child.ARs, ar)
+	}
+
+	// Reservation is leased by the child VNet in the parent one
+	for i := range parent.ARs {
+		for j := range parent.ARs[i].Leases {
+			if l := &parent.ARs[i].Leases[j]; l.VM == 0 && l.VNet == 0 && contains(ips, leaseAddr(l)) {
+				l.VNet = child.ID
+			}
+		}
+	}
+
+	return child.ID, nil
+}
+
+// Mirrors one.vntemplate.instantiate: VNet is created from VN_MAD of the Template and ARs, VLAN and bridge from extra
+func (c *Cloud) instantiateVNTemplate(id int, name, extra string) (int, error) {
+	t, err := ParseTemplate(extra)
+	if err != nil {
+		return -1, fmt.Errorf("[one.vntemplate.instantiate] Error parsing template: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vnt, ok := c.vnTemplates[id]
+	if !ok {
+		return -1, noExists("vntemplate", id)
+	}
+	if name == "" {
+		return -1, errors.New("[one.vntemplate.instantiate] Invalid NAME, it cannot be empty")
+	}
+
+	vn := &vnet.VirtualNetwork{
+		ID: c.nextID("vn"), Name: name,
+		UID: ADMIN_USER, GID: ADMIN_GROUP, UName: "oneadmin", GName: "oneadmin",
+		Permissions: &shared.Permissions{OwnerU: 1, OwnerM: 1, OwnerA: 1},
+	}
+	vn.VNMad, _ = vnt.GetStr("VN_MAD")
+	if vnMad, err := t.GetStr("VN_MAD"); err == nil {
+		vn.VNMad = vnMad
+	}
+	vn.VlanID, _ = t.GetStr("VLAN_ID")
+	vn.Bridge, _ = t.GetStr("BRIDGE")
+
+	for _, ar := range t.GetVectors("AR") {
+		arType, _ := ar.GetStr("TYPE")
+		key := "IP"
+		if arType == "IP6_STATIC" {
+			key = "IP6"
+		} else {
+			arType = "IP4"
+		}
+		ip, err := ar.GetStr(key)
+		if err != nil || net.ParseIP(ip) == nil || (net.ParseIP(ip).To4() == nil) != (key == "IP6") {
+			return -1, errors.New("[one.vntemplate.instantiate] Only IP4 and IP6_STATIC Address Ranges are supported")
+		}
+		size, err := ar.GetInt("SIZE")
+		if err != nil || size <= 0 {
+			return -1, errors.New("[one.vntemplate.instantiate] Invalid SIZE of Address Range")
+		}
+		vn.ARs = append(vn.ARs, newAR(strconv.Itoa(nextARID(vn)), arType, ip, size))
+	}
+
+	c.vnets[vn.ID] = vn
+	return vn.ID, nil
+}
+
+// Leases address for the NIC from its NETWORK_ID, filling NIC attributes like ONe does
+func (c *Cloud) leaseNIC(v *vm.VM, nic *dynamic.Vector, nicID int) error {
+	vnID, err := nic.GetInt(string(shared.NetworkID))
+	if err != nil {
+		return fmt.Errorf("NIC has no NETWORK_ID")
+	}
+	vn, ok := c.vnets[vnID]
+	if !ok {
+		return noExists("vn", vnID)
+	}
+
+	fill := func(l *vnet.Lease) { l.VM = v.ID }
+	ip, err := nic.GetStr(string(shared.IP))
+	if err == nil && ip != "" {
+		err = c.allocateIP(vn, ip, fill)
+	} else {
+		ip, err = c.allocateLease(vn, fill)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, key := range []shared.NICKeys{shared.NICID, shared.Network, shared.IP, "IP6", shared.MAC} {
+		nic.Del(string(key))
+	}
+	nic.AddPair(string(shared.NICID), nicID)
+	nic.AddPair(string(shared.Network), vn.Name)
+	if isIPv6(ip) {
+		nic.AddPair("IP6", ip)
+	} else {
+		nic.AddPair(string(shared.IP), ip)
+	}
+	nic.AddPair(string(shared.MAC), macFromIP(ip))
+	return nil
+}
+
+func (c *Cloud) releaseLeases(v *vm.VM) {
+	for _, nic := range v.Template.GetVectors(string(shared.NICVec)) {
+		vnID, err := nic.GetInt(string(shared.NetworkID))
+		if err != nil {
+			continue
+		}
+		ip := nicAddr(nic)
+		if ip == "" {
+			continue
+		}
+		if vn, ok := c.vnets[vnID]; ok {
+			c.freeLease(vn, ip)
+		}
+	}
+}
+
+func (c *Cloud) allocateLease(vn *vnet.VirtualNetwork, fill func(l *vnet.Lease)) (string, error) {
+	return c.allocateLeaseAR(vn, "", fill)
+}
+
+// Leases the first free address from the given AR, or from any AR if arID is empty
+func (c *Cloud) allocateLeaseAR(vn *vnet.VirtualNetwork, arID string, fill func(l *vnet.Lease)) (string, error) {
+	for i := range vn.ARs {
+		ar := &vn.ARs[i]
+		if arID != "" && ar.ID != arID {
+			continue
+		}
+		for k := 0; k < ar.Size; k++ {
+			ip := ipAdd(arAddr(ar), k)
+			if leased(ar, ip) {
+				continue
+			}
+			lease := newLease(ip)
+			fill(&lease)
+			ar.Leases = append(ar.Leases, lease)
+			ar.UsedLeases = strconv.Itoa(len(ar.Leases))
+			vn.UsedLeases++
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("no free addresses in virtual network %d", vn.ID)
+}
+
+// Leases the given address, as ONe does for NIC with IP set
+func (c *Cloud) allocateIP(vn *vnet.VirtualNetwork, ip string, fill func(l *vnet.Lease)) error {
+	for i := range vn.ARs {
+		ar := &vn.ARs[i]
+		for k := 0; k < ar.Size; k++ {
+			if ipAdd(arAddr(ar), k) != ip {
+				continue
+			}
+			if leased(ar, ip) {
+				return fmt.Errorf("IP %s is already in use in virtual network %d", ip, vn.ID)
+			}
+			lease := newLease(ip)
+			fill(&lease)
+			ar.Leases = append(ar.Leases, lease)
+			ar.UsedLeases = strconv.Itoa(len(ar.Leases))
+			vn.UsedLeases++
+			return nil
+		}
+	}
+	return fmt.Errorf("IP %s isn't in address ranges of virtual network %d", ip, vn.ID)
+}
+
+func (c *Cloud) freeLease(vn *vnet.VirtualNetwork, ip string) {
+	for i := range vn.ARs {
+		ar := &vn.ARs[i]
+		for j, l := range ar.Leases {
+			if leaseAddr(&l) != ip {
+				continue
+			}
+			ar.Leases = append(ar.Leases[:j], ar.Leases[j+1:]...)
+			ar.UsedLeases = strconv.Itoa(len(ar.Leases))
+			vn.UsedLeases--
+			return
+		}
+	}
+}
+
+func leased(ar *vnet.AR, ip string) bool {
+	for _, l := range ar.Leases {
+		if leaseAddr(&l) == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts leases held by VMs, addresses reserved to the child VNets are not counted
+func usedLeases(vn *vnet.VirtualNetwork) int {
+	used := 0
+	for _, ar := range vn.ARs {
+		for _, l := range ar.Leases {
+			if l.VNet == 0 {
+				used++
+			}
+		}
+	}
+	return used
+}
+
+func nextARID(vn *vnet.VirtualNetwork) int {
+	id := 0
+	for _, ar := range vn.ARs {
+		if n := atoi(ar.ID); n >= id {
+			id = n + 1
+		}
+	}
+	return id
+}
+
+func copyVNet(vn *vnet.VirtualNetwork) *vnet.VirtualNetwork {
+	res := *vn
+	res.Template = vnet.Template{Template: copyTemplate(&vn.Template.Template)}
+	res.ARs = make([]vnet.AR, len(vn.ARs))
+	for i, ar := range vn.ARs {
+		ar.Leases = append([]vnet.Lease{}, ar.Leases...)
+		res.ARs[i] = ar
+	}
+	return &res
+}
+
+// Returns the AR the address belongs to
+func arOf(vn *vnet.VirtualNetwork, ip string) *vnet.AR {
+	for i := range vn.ARs {
+		ar := &vn.ARs[i]
+		for k := 0; k < ar.Size; k++ {
+			if ipAdd(arAddr(ar), k) == ip {
+				return ar
+			}
+		}
+	}
+	return nil
+}
+
+func newAR(id, arType, first string, size int) vnet.AR {
+	ar := vnet.AR{ID: id, Type: arType, Size: size, UsedLeases: "0"}
+	if isIPv6(first) {
+		ar.IP6, ar.IP6End = first, ipAdd(first, size-1)
+	} else {
+		ar.IP, ar.IPEnd = first, ipAdd(first, size-1)
+	}
+	return ar
+}
+
+func newLease(ip string) vnet.Lease {
+	if isIPv6(ip) {
+		return vnet.Lease{IP6: ip, MAC: macFromIP(ip)}
+	}
+	return vnet.Lease{IP: ip, MAC: macFromIP(ip)}
+}
+
+// First address of the AR, IPv6 one for IP6 ARs
+func arAddr(ar *vnet.AR) string {
+	if ar.IP == "" {
+		return ar.IP6
+	}
+	return ar.IP
+}
+
+func leaseAddr(l *vnet.Lease) string {
+	if l.IP == "" {
+		return l.IP6
+	}
+	return l.IP
+}
+
+// Address leased by the NIC, either IPv4 or IPv6
+func nicAddr(nic *dynamic.Vector) string {
+	if ip, err := nic.GetStr(string(shared.IP)); err == nil && ip != "" {
+		return ip
+	}
+	ip, _ := nic.GetStr("IP6")
+	return ip
+}
+
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+func ipAdd(ip string, n int) string {
+	parsed := net.ParseIP(ip)
+	if v4 := parsed.To4(); v4 != nil {
+		v := binary.BigEndian.Uint32(v4)
+		res := make(net.IP, 4)
+		binary.BigEndian.PutUint32(res, v+uint32(n))
+		return res.String()
+	}
+	v := new(big.Int).SetBytes(parsed.To16())
+	res := make(net.IP, 16)
+	v.Add(v, big.NewInt(int64(n))).FillBytes(res)
+	return res.String()
+}
+
+func macFromIP(ip string) string {
+	b := net.ParseIP(ip).To16()
+	return fmt.Sprintf("02:00:%02x:%02x:%02x:%02x", b[12], b[13], b[14], b[15])
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func contains(list []string, s string) bool {
+	for _, el := range list {
+		if el == s {
+			return true
+		}
+	}
+	return false
+}
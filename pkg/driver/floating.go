@@ -0,0 +1,158 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"fmt"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	vnet "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/virtualnetwork"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	driver_shared "github.com/slntopp/nocloud-driver-ione/pkg/shared"
+	"go.uber.org/zap"
+)
+
+// Lease template used to hold and release a single address
+func leaseTemplate(ip string) string {
+	return fmt.Sprintf("LEASES=[IP=\"%s\"]", ip)
+}
+
+// Returns whether NIC is a floating IP attached by ip_assign, such NICs aren't counted in ips_public
+func IsFloatingNIC(nic *shared.NIC) bool {
+	value, _ := nic.Get(driver_shared.NOCLOUD_FLOATING)
+	return value == "YES"
+}
+
+// Returns leases of VM floating NICs by NIC ID
+func FloatingNICs(VM *vm.VM) map[int]NICLease {
+	nics := make(map[int]NICLease)
+	for _, nic := range VM.Template.GetNICs() {
+		if !IsFloatingNIC(&nic) {
+			continue
+		}
+		id, err := nic.ID()
+		if err != nil {
+			continue
+		}
+		vnID, _ := nic.GetI(shared.NetworkID)
+		ip, _ := nic.Get(shared.IP)
+		nics[id] = NICLease{NetworkID: vnID, IP: ip, Floating: true}
+	}
+	return nics
+}
+
+// Returns VNet lease of the address if there is one
+func VNetLease(vn *vnet.VirtualNetwork, ip string) (*vnet.Lease, bool) {
+	for _, ar := range vn.ARs {
+		for i := range ar.Leases {
+			if ar.Leases[i].IP == ip {
+				return &ar.Leases[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Returns addresses leased from the User public VNet by VM ID, addresses on hold(not assigned floating IPs) have -1
+func (c *ONeClient) IPLeases(uid int) (map[string]int, error) {
+	vnID, err := c.GetUserPublicVNet(uid)
+	if err != nil {
+		return nil, err
+	}
+	vn, err := c.GetVNet(vnID)
+	if err != nil {
+		return nil, err
+	}
+	leases := make(map[string]int)
+	for _, ar := range vn.ARs {
+		for _, lease := range ar.Leases {
+			leases[lease.IP] = lease.VM
+		}
+	}
+	return leases, nil
+}
+
+// Attaches address from the VM owner public VNet to the VM as floating IP.
+// Address must be free or on hold, e.g. unassigned from another VM of the same User
+func (c *ONeClient) AssignIP(vmid int, ip string) error {
+	log := c.log.Named("AssignIP").With(zap.Int("vmid", vmid), zap.String("ip", ip))
+
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return err
+	}
+	vnID, err := c.GetUserPublicVNet(VM.UID)
+	if err != nil {
+		return fmt.Errorf("user has no public network: %w", err)
+	}
+	vn, err := c.GetVNet(vnID)
+	if err != nil {
+		return err
+	}
+
+	vnc := c.ctrl.VirtualNetwork(vnID)
+	lease, held := VNetLease(vn, ip)
+	if held {
+		if lease.VM != -1 {
+			return fmt.Errorf("IP %s is in use by VM %d", ip, lease.VM)
+		}
+		if err := vnc.Release(leaseTemplate(ip)); err != nil {
+			return err
+		}
+	}
+
+	template := vm.NewTemplate()
+	nic := template.AddNIC()
+	nic.Add(shared.NetworkID, vnID)
+	nic.Add(shared.IP, ip)
+	nic.Add(driver_shared.NOCLOUD_FLOATING, "YES")
+	addVMSecurityGroups(nic, VM)
+	AddBandwidthLimits(nic, VMBandwidthLimits(VM))
+	if err := c.ctrl.VM(vmid).AttachNIC(template.String()); err != nil {
+		if held {
+			// Putting address back, so it isn't leased by the next NIC attached
+			if err := vnc.Hold(leaseTemplate(ip)); err != nil {
+				log.Error("Error holding IP back", zap.Error(err))
+			}
+		}
+		return err
+	}
+	return c.waitForHotplugFinish(vmid)
+}
+
+// Detaches floating IP from the VM, address is put on hold so it's kept by the User until assigned again
+func (c *ONeClient) UnassignIP(vmid int, ip string) error {
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return err
+	}
+	for id, lease := range FloatingNICs(VM) {
+		if lease.IP == ip {
+			return c.unassignNIC(vmid, id, lease)
+		}
+	}
+	return fmt.Errorf("IP %s isn't assigned to VM %d", ip, vmid)
+}
+
+func (c *ONeClient) unassignNIC(vmid, nicID int, lease NICLease) error {
+	if err := c.ctrl.VM(vmid).DetachNIC(nicID); err != nil {
+		return err
+	}
+	if err := c.waitForHotplugFinish(vmid); err != nil {
+		return err
+	}
+	return c.ctrl.VirtualNetwork(lease.NetworkID).Hold(leaseTemplate(lease.IP))
+}
@@ -0,0 +1,81 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"testing"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+)
+
+func TestFloatingIPs(t *testing.T) {
+	c, _, ig := setup(t)
+	vmid := deploy(t, c, ig)
+	s := c.Server
+
+	uid := int(ig.Data["userid"].GetNumberValue())
+	pub, err := c.ReservePublicIP(uid, 1)
+	if err != nil {
+		t.Fatalf("ReservePublicIP() => %v", err)
+	}
+	vn, _ := c.GetVNet(pub)
+	ip := vn.ARs[len(vn.ARs)-1].IP
+
+	if err := c.AssignIP(vmid, ip); err != nil {
+		t.Fatalf("AssignIP() => %v", err)
+	}
+	v, _ := c.GetVM(vmid)
+	if floating := one.FloatingNICs(v); len(floating) != 1 || len(v.Template.GetNICs()) != 2 {
+		t.Fatalf("Expected floating NIC to be attached, got %+v", floating)
+	}
+	inst, _ := c.VMToInstance(vmid)
+	if public := inst.Resources["ips_public"].GetNumberValue(); public != 1 {
+		t.Fatalf("Floating IP mustn't be counted in ips_public, got %v", public)
+	}
+	if err := c.AssignIP(vmid, ip); err == nil {
+		t.Fatal("Expected error assigning IP in use")
+	}
+
+	if err := c.UnassignIP(vmid, ip); err != nil {
+		t.Fatalf("UnassignIP() => %v", err)
+	}
+	leases, err := c.IPLeases(uid)
+	if err != nil {
+		t.Fatalf("IPLeases() => %v", err)
+	}
+	if len(leases) != 2 || leases[ip] != -1 {
+		t.Fatalf("Expected unassigned IP to be on hold, got %v", leases)
+	}
+	// Address on hold isn't leased to ordinary NICs
+	nic := shared.NewNIC()
+	nic.Add(shared.NetworkID, pub)
+	if err := goca.NewController(c.Client).VM(vmid).AttachNIC(nic.String()); err == nil {
+		t.Fatal("Expected no free addresses")
+	}
+
+	s.Reset()
+	if err := c.AssignIP(vmid, ip); err != nil {
+		t.Fatalf("AssignIP() => %v", err)
+	}
+	if len(s.CallsTo("one.vn.release")) != 1 {
+		t.Fatalf("Expected IP to be released from hold: %v", s.Methods())
+	}
+	if leases, _ := c.IPLeases(uid); leases[ip] != vmid {
+		t.Fatalf("Expected IP to be leased by VM %d, got %v", vmid, leases)
+	}
+}
@@ -0,0 +1,28 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/host"
+)
+
+func (c *ONeClient) GetHosts() (*host.Pool, error) {
+	return c.ctrl.Hosts().Info()
+}
+
+func (c *ONeClient) HostMonitoring(id int) (*host.Monitoring, error) {
+	return c.ctrl.Host(id).Monitoring()
+}
@@ -0,0 +1,270 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	"github.com/slntopp/nocloud-driver-ione/pkg/rdns"
+	"github.com/slntopp/nocloud-proto/hasher"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	stpb "github.com/slntopp/nocloud-proto/states"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestInstanceLifecycle(t *testing.T) {
+	c, clock, ig := setup(t)
+	inst := ig.Instances[0]
+	vmid := deploy(t, c, ig)
+
+	v, err := c.GetVM(vmid)
+	if err != nil {
+		t.Fatalf("GetVM() => %v", err)
+	}
+	if v.UID != int(ig.Data["userid"].GetNumberValue()) || v.GID != fake.USERS_GROUP {
+		t.Fatalf("VM isn't owned by IG user: %d:%d", v.UID, v.GID)
+	}
+
+	networking, err := c.NetworkingVM(vmid)
+	if err != nil {
+		t.Fatalf("NetworkingVM() => %v", err)
+	}
+	if public := networking["public"].([]interface{}); len(public) != 1 || public[0] != "192.0.2.1" {
+		t.Fatalf("Unexpected public IPs: %v", public)
+	}
+
+	res, err := c.VMToInstance(vmid)
+	if err != nil {
+		t.Fatalf("VMToInstance() => %v", err)
+	}
+	for _, key := range []string{"cpu", "ram", "drive_size", "ips_public"} {
+		if res.Resources[key].GetNumberValue() != inst.Resources[key].GetNumberValue() {
+			t.Errorf("Resource %s mismatch: %v != %v", key, res.Resources[key], inst.Resources[key])
+		}
+	}
+	if res.Config["password"].GetStringValue() != "secret" {
+		t.Errorf("Password isn't stored in VM user template")
+	}
+
+	// Hash is calculated the same way Monitoring does, so unchanged Instance must be Valid
+	res.Uuid, res.Title, res.BillingPlan, res.Data, res.State = "", inst.Title, inst.BillingPlan, nil, nil
+	if err := hasher.SetHash(res.ProtoReflect()); err != nil {
+		t.Fatalf("SetHash() => %v", err)
+	}
+	inst.Hash = res.Hash
+	resp, err := c.CheckInstancesGroup(ig)
+	if err != nil {
+		t.Fatalf("CheckInstancesGroup() => %v", err)
+	}
+	if len(resp.Valid) != 1 {
+		t.Fatalf("Expected instance to be valid, got %+v", resp)
+	}
+
+	clock.Add(time.Hour)
+	if err := c.PoweroffVM(vmid, false); err != nil {
+		t.Fatalf("PoweroffVM() => %v", err)
+	}
+	if err := c.SuspendVM(vmid); err == nil {
+		t.Fatal("Expected error suspending powered off VM")
+	}
+	clock.Add(time.Hour)
+	if err := c.ResumeVM(vmid); err != nil {
+		t.Fatalf("ResumeVM() => %v", err)
+	}
+	clock.Add(time.Hour)
+
+	v, _ = c.GetVM(vmid)
+	start := clock.Now().Add(-3 * time.Hour).Unix()
+	timeline := one.FilterTimeline(one.MakeTimeline(v), start, clock.Now().Unix())
+	expected := []one.Record{
+		{Start: start, End: start + 3600, State: stpb.NoCloudState_RUNNING},
+		{Start: start + 3600, End: start + 7200, State: stpb.NoCloudState_STOPPED},
+		{Start: start + 7200, End: start + 10800, State: stpb.NoCloudState_RUNNING},
+	}
+	if len(timeline) != len(expected) {
+		t.Fatalf("Unexpected timeline: %+v", timeline)
+	}
+	for i := range expected {
+		if timeline[i] != expected[i] {
+			t.Errorf("Record %d: expected %+v, got %+v", i, expected[i], timeline[i])
+		}
+	}
+
+	if err := c.SnapCreate("before-update", vmid); err != nil {
+		t.Fatalf("SnapCreate() => %v", err)
+	}
+	snaps, err := c.GetInstSnapshots(inst)
+	if err != nil || len(snaps) != 1 {
+		t.Fatalf("GetInstSnapshots() => %v, %v", snaps, err)
+	}
+	if err := c.SnapDelete(0, vmid); err != nil {
+		t.Fatalf("SnapDelete() => %v", err)
+	}
+
+	if err := c.TerminateVM(vmid, true); err != nil {
+		t.Fatalf("TerminateVM() => %v", err)
+	}
+	public_vn := int(ig.Data["public_vn"].GetNumberValue())
+	vn, _ := c.GetVNet(public_vn)
+	if vn.UsedLeases != 0 {
+		t.Fatalf("Leases weren't released, used: %d", vn.UsedLeases)
+	}
+	if _, err := c.FindVMByInstance(inst); err == nil {
+		t.Fatal("Terminated VM must not be found")
+	}
+}
+
+func TestUpdateResources(t *testing.T) {
+	c, _, ig := setup(t)
+	inst := ig.Instances[0]
+	vmid := deploy(t, c, ig)
+
+	inst.Resources["cpu"] = structpb.NewNumberValue(4)
+	inst.Resources["drive_size"] = structpb.NewNumberValue(30720)
+	inst.Resources["ips_public"] = structpb.NewNumberValue(2)
+
+	diff := c.GetVmResourcesDiff(inst)
+	if len(diff) != 3 || diff[0].ResName != "cpu" || diff[0].NewResCount != 4 {
+		t.Fatalf("Expected cpu, ips_public and drive diff, got %+v", diff)
+	}
+
+	c.CheckInstancesGroupResponseProcess(&one.CheckInstancesGroupResponse{ToBeUpdated: []*pb.Instance{inst}}, ig, fake.USERS_GROUP, nil)
+
+	updated := inst.State.Meta["updated"].GetListValue().AsSlice()
+	if len(updated) != 3 || updated[0] != "cpu" || updated[1] != "resize_cold" || updated[2] != "drive_size" {
+		t.Fatalf("Unexpected updated resources: %v", updated)
+	}
+
+	res, _ := c.VMToInstance(vmid)
+	for _, key := range []string{"cpu", "drive_size", "ips_public"} {
+		if res.Resources[key].GetNumberValue() != inst.Resources[key].GetNumberValue() {
+			t.Errorf("Resource %s wasn't applied: %v", key, res.Resources[key])
+		}
+	}
+	if !hasAction(c, vmid, "poweroff") {
+		t.Errorf("VM must be powered off for resize")
+	}
+	if _, _, lcm, _, _ := c.StateVM(vmid); lcm != int(vm.Running) {
+		t.Errorf("VM must be resumed after resize, got lcm state %d", lcm)
+	}
+}
+
+func TestCheckOrphanInstanceGroup(t *testing.T) {
+	c, _, ig := setup(t)
+	uid := int(ig.Data["userid"].GetNumberValue())
+
+	c.SetVars(vars(map[string]*sppb.Var{
+		one.PRIVATE_VN_TEMPLATE: defaultVar(structpb.NewNumberValue(float64(c.AddVNTemplate("vxlan")))),
+	}))
+	private_vn, err := c.ReservePrivateIP(uid, "vxlan", 10)
+	if err != nil {
+		t.Fatalf("ReservePrivateIP() => %v", err)
+	}
+	ig.Data["private_vn"] = structpb.NewNumberValue(float64(private_vn))
+	vmid := deploy(t, c, ig)
+	s := c.Server
+
+	// User exists, nothing to do
+	if err := c.CheckOrphanInstanceGroup(ig, fake.USERS_GROUP); err != nil {
+		t.Fatalf("CheckOrphanInstanceGroup() => %v", err)
+	}
+	if methods := s.Methods(); !reflect.DeepEqual(methods, []string{"one.vm.info", "one.userpool.info"}) {
+		t.Fatalf("Unexpected calls: %v", methods)
+	}
+	s.Reset()
+
+	// IG is known under the other UUID now, so its User is considered gone
+	ig.Uuid = "new-ig-uuid"
+	ig.Resources = map[string]*structpb.Value{
+		"ips_public":  structpb.NewNumberValue(1),
+		"ips_private": structpb.NewNumberValue(0),
+	}
+	if err := c.CheckOrphanInstanceGroup(ig, fake.USERS_GROUP); err != nil {
+		t.Fatalf("CheckOrphanInstanceGroup() => %v", err)
+	}
+
+	for _, expected := range []string{
+		"one.user.allocate", "one.vn.chown", "one.vm.detachnic",
+		"one.vn.rename", "one.vm.chown", "one.vm.attachnic",
+	} {
+		if len(s.CallsTo(expected)) == 0 {
+			t.Errorf("%s wasn't called: %v", expected, s.Methods())
+		}
+	}
+	renames := s.CallsTo("one.vn.rename")
+	if len(renames) != 2 || renames[0].Args[1] != "user-2-private-vnet" || renames[1].Args[1] != "user-2-pub-vnet" {
+		t.Fatalf("Unexpected renames: %+v", renames)
+	}
+
+	newUID := int(ig.Data["userid"].GetNumberValue())
+	if newUID == uid {
+		t.Fatal("User ID isn't updated in IG data")
+	}
+	v, _ := c.GetVM(vmid)
+	if v.UID != newUID || len(v.Template.GetNICs()) != 1 {
+		t.Fatalf("VM isn't moved to the new User: uid %d, NICs %d", v.UID, len(v.Template.GetNICs()))
+	}
+	if pub, err := c.GetUserPublicVNet(newUID); err != nil || pub != int(ig.Data["public_vn"].GetNumberValue()) {
+		t.Fatalf("Public VNet isn't moved to the new User: %d, %v", pub, err)
+	}
+}
+
+func TestReleasePTR(t *testing.T) {
+	c, _, ig := setup(t)
+	inst := ig.Instances[0]
+	vmid := deploy(t, c, ig)
+
+	provider := rdns.NewMemory()
+	rdns.Configure(provider)
+	t.Cleanup(func() { rdns.Configure(nil) })
+
+	publicIPs := func() []string {
+		networking, _ := c.NetworkingVM(vmid)
+		var ips []string
+		for _, ip := range networking["public"].([]interface{}) {
+			ips = append(ips, ip.(string))
+		}
+		return ips
+	}
+
+	// Addresses detached on ips_public shrink lose their PTR
+	inst.Resources["ips_public"] = structpb.NewNumberValue(2)
+	c.CheckInstancesGroupResponseProcess(&one.CheckInstancesGroupResponse{ToBeUpdated: []*pb.Instance{inst}}, ig, fake.USERS_GROUP, nil)
+	ips := publicIPs()
+	if len(ips) != 2 {
+		t.Fatalf("Expected 2 public addresses, got %v", ips)
+	}
+	for _, ip := range ips {
+		provider.SetPTR(context.Background(), ip, "mail.example.com")
+	}
+
+	inst.Resources["ips_public"] = structpb.NewNumberValue(1)
+	c.CheckInstancesGroupResponseProcess(&one.CheckInstancesGroupResponse{ToBeUpdated: []*pb.Instance{inst}}, ig, fake.USERS_GROUP, nil)
+	if left := publicIPs(); len(left) != 1 || left[0] != ips[0] {
+		t.Fatalf("Expected %s left, got %v", ips[0], left)
+	}
+	records, _ := provider.LookupPTR(context.Background(), ips)
+	if _, ok := records[ips[1]]; ok || len(records) != 1 {
+		t.Fatalf("Only PTR of the detached address must be removed, got %v", records)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/parameters"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	vnet "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/virtualnetwork"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	"github.com/slntopp/nocloud-driver-ione/pkg/rdns"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// AR types IPv6 addresses are reserved from, IP4_6 ones are skipped as they would lease IPv4 addresses as well
+var IPV6_AR_TYPES = []string{"IP6", "IP6_STATIC"}
+
+// NIC attributes holding IPv6 address in order of preference
+var NIC_IPV6_KEYS = []string{"IP6_GLOBAL", "IP6", "IP6_ULA"}
+
+// Returns ID of the first IPv6 Address Range of the VNet
+func IPv6AR(vn *vnet.VirtualNetwork) (string, bool) {
+	for _, ar := range vn.ARs {
+		if slices.Contains(IPV6_AR_TYPES, strings.ToUpper(ar.Type)) {
+			return ar.ID, true
+		}
+	}
+	return "", false
+}
+
+// Returns IPv6 address leased by the NIC, empty if there is none
+func NICIPv6(nic *shared.NIC) string {
+	for _, key := range NIC_IPV6_KEYS {
+		if ip, err := nic.GetStr(key); err == nil && ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+// Removes PTR records of the detached public NIC addresses, as they go back to the pool
+func ReleaseNICPTRs(log *zap.Logger, nic *shared.NIC) {
+	var ips []string
+	if ip, _ := nic.GetStr("IP"); ip != "" {
+		ips = append(ips, ip)
+	}
+	if ip := NICIPv6(nic); ip != "" {
+		ips = append(ips, ip)
+	}
+	if err := rdns.Release(ips...); err != nil {
+		log.Warn("Can't release PTR records", zap.Strings("ips", ips), zap.Error(err))
+	}
+}
+
+func (c *ONeClient) GetUserPublicVNet6(user int) (id int, err error) {
+	vnsc := c.ctrl.VirtualNetworks()
+	return vnsc.ByName(fmt.Sprintf(USER_PUBLIC_VNET6_NAME_PATTERN, user), user)
+}
+
+func (c *ONeClient) GetUserPrivateVNet6(user int) (id int, err error) {
+	vnsc := c.ctrl.VirtualNetworks()
+	return vnsc.ByName(fmt.Sprintf(USER_PRIVATE_VNET6_NAME_PATTERN, user), user)
+}
+
+// Reserves IPv6 addresses from the PUBLIC_IP_POOL IPv6 AR to the User public IPv6 VNet
+func (c *ONeClient) ReservePublicIPv6(u, n int) (pool_id int, err error) {
+	public_pool_id, ok := c.vars[PUBLIC_IP_POOL]
+	if !ok {
+		return -1, errors.New("VNet ID is not set")
+	}
+
+	id, err := GetVarValue(public_pool_id, "default")
+	if err != nil {
+		return -1, err
+	}
+	public_pool, err := c.GetVNet(int(id.GetNumberValue()))
+	if err != nil {
+		return -1, err
+	}
+	arID, ok := IPv6AR(public_pool)
+	if !ok {
+		return -1, fmt.Errorf("VNet %d has no IPv6 Address Range", public_pool.ID)
+	}
+
+	user_pub_net_id, err := c.GetUserPublicVNet6(u)
+	if err != nil {
+		user_pub_net_id = -1
+	}
+	user_pub_net_id, err = c.reserveVNetAR(
+		public_pool.ID, arID, n, user_pub_net_id,
+		fmt.Sprintf(USER_PUBLIC_VNET6_NAME_PATTERN, u))
+	if err != nil {
+		return -1, err
+	}
+
+	c.Chown(
+		"vn", user_pub_net_id,
+		u, int(c.secrets["group"].GetNumberValue()))
+	c.Chmod(
+		"vn", user_pub_net_id,
+		&shared.Permissions{
+			OwnerU: 1, OwnerM: 1, OwnerA: 0,
+			GroupU: 0, GroupM: 0, GroupA: 0,
+			OtherU: 0, OtherM: 0, OtherA: 0,
+		},
+	)
+	c.UpdateVNet(user_pub_net_id, "TYPE=\"PUBLIC\"", parameters.Merge)
+
+	return user_pub_net_id, nil
+}
+
+// Makes User private IPv6 VNet with ULA addresses, it's meant to share VLAN with the private IPv4 one
+func (c *ONeClient) ReservePrivateIPv6(u int, vnMad string, vlanID int) (pool_id int, err error) {
+	private_ar := "AR = [\n	IP6 = \"fd00::1\",\n	PREFIX_LENGTH = \"64\",\n	SIZE = \"255\",\n	TYPE = \"IP6_STATIC\" ]"
+	return c.reservePrivateVNet(u, fmt.Sprintf(USER_PRIVATE_VNET6_NAME_PATTERN, u), private_ar, vnMad, vlanID)
+}
+
+// Attaches or detaches IPv6 NICs, so VM has as many of them as public_ipv6 and private_ipv6 resources require
+func (c *ONeClient) updateIPv6NICs(VM *vm.VM, vmInst, inst *pb.Instance, data map[string]*structpb.Value) {
+	vmc := c.ctrl.VM(VM.ID)
+	for _, res := range []struct {
+		key, suffix, vn string
+	}{
+		{"public_ipv6", "pub6-vnet", "public_vn6"},
+		{"private_ipv6", "private6-vnet", "private_vn6"},
+	} {
+		current := int(vmInst.GetResources()[res.key].GetNumberValue())
+		requested := int(inst.GetResources()[res.key].GetNumberValue())
+		if current == requested {
+			continue
+		}
+		if current < requested {
+			if res.key == "public_ipv6" {
+				vn, err := c.ReservePublicIPv6(VM.UID, requested-current)
+				if err != nil {
+					c.log.Error("Wrong IPv6 reserve", zap.Error(err))
+					continue
+				}
+				data[res.vn] = structpb.NewNumberValue(float64(vn))
+			} else if data[res.vn] == nil {
+				c.log.Error("No private IPv6 network", zap.Int("user", VM.UID))
+				continue
+			}
+			for i := current; i < requested; i++ {
+				template := vm.NewTemplate()
+				nic := template.AddNIC()
+				nic.Add(shared.NetworkID, int(data[res.vn].GetNumberValue()))
+				AddSecurityGroup(nic, data)
+				AddBandwidthLimits(nic, InstanceBandwidthLimits(inst))
+				if err := vmc.AttachNIC(template.String()); err != nil {
+					c.log.Error("Wrong IPv6 attach", zap.Error(err))
+					break
+				}
+				if err := c.waitForHotplugFinish(VM.ID); err != nil {
+					break
+				}
+			}
+			continue
+		}
+
+		nics := VM.Template.GetNICs()
+		for i := len(nics) - 1; i >= 0 && current > requested; i-- {
+			network, _ := nics[i].Get(shared.Network)
+			if !strings.HasSuffix(network, res.suffix) {
+				continue
+			}
+			id, _ := nics[i].ID()
+			if err := vmc.DetachNIC(id); err != nil {
+				c.log.Error("Wrong IPv6 detach", zap.Int("id", id), zap.Error(err))
+				break
+			}
+			if res.key == "public_ipv6" {
+				ReleaseNICPTRs(c.log, &nics[i])
+			}
+			if err := c.waitForHotplugFinish(VM.ID); err != nil {
+				break
+			}
+			current--
+		}
+	}
+}
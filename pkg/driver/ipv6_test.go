@@ -0,0 +1,78 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestIPv6(t *testing.T) {
+	c, _, ig := setup(t)
+	uid := int(ig.Data["userid"].GetNumberValue())
+	s := c.Server
+
+	if _, err := c.ReservePublicIPv6(uid, 1); err == nil {
+		t.Fatal("Expected error without IPv6 Address Range in PUBLIC_IP_POOL")
+	}
+	arID, err := c.AddAR(0, "IP6", "2001:db8::1", 8)
+	if err != nil {
+		t.Fatalf("AddAR() => %v", err)
+	}
+
+	s.Reset()
+	vn6, err := c.ReservePublicIPv6(uid, 2)
+	if err != nil {
+		t.Fatalf("ReservePublicIPv6() => %v", err)
+	}
+	calls := s.CallsTo("one.vn.reserve")
+	if len(calls) != 1 || !strings.Contains(calls[0].Args[1].(string), "AR_ID="+arID) {
+		t.Fatalf("Addresses must be reserved from IPv6 AR: %+v", calls)
+	}
+	vn, _ := c.GetVNet(vn6)
+	if len(vn.ARs) != 2 || vn.ARs[0].IP6 != "2001:db8::1" || vn.ARs[1].IP6 != "2001:db8::2" ||
+		vn.ARs[0].ParentNetworkARID != arID || vn.UID != uid {
+		t.Fatalf("Unexpected User IPv6 VNet: %+v", vn)
+	}
+
+	ig.Data["public_vn6"] = structpb.NewNumberValue(float64(vn6))
+	ig.Instances[0].Resources["public_ipv6"] = structpb.NewNumberValue(1)
+	vmid := deploy(t, c, ig)
+
+	networking, err := c.NetworkingVM(vmid)
+	if err != nil {
+		t.Fatalf("NetworkingVM() => %v", err)
+	}
+	if public := networking["public_ipv6"]; !reflect.DeepEqual(public, []interface{}{"2001:db8::1"}) {
+		t.Fatalf("Unexpected public IPv6 addresses: %v", networking)
+	}
+	inst, _ := c.VMToInstance(vmid)
+	if inst.Resources["public_ipv6"].GetNumberValue() != 1 || inst.Resources["ips_public"].GetNumberValue() != 1 {
+		t.Fatalf("Unexpected resources: %v", inst.Resources)
+	}
+
+	ig.Instances[0].Resources["public_ipv6"] = structpb.NewNumberValue(0)
+	c.CheckInstancesGroupResponseProcess(&one.CheckInstancesGroupResponse{ToBeUpdated: []*pb.Instance{ig.Instances[0]}}, ig, fake.USERS_GROUP, nil)
+	if networking, _ := c.NetworkingVM(vmid); networking["public_ipv6"] != nil {
+		t.Fatalf("IPv6 NIC must be detached: %v", networking)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	driver_shared "github.com/slntopp/nocloud-driver-ione/pkg/shared"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Reads IDs of ISO Images allowed by iso_images var, set either as list or as comma separated string
+func AllowedISOs(v *sppb.Var) []int {
+	value, err := GetVarValue(v, "default")
+	if err != nil {
+		return nil
+	}
+
+	var items []string
+	if list := value.GetListValue(); list != nil {
+		for _, item := range list.GetValues() {
+			if _, ok := item.GetKind().(*structpb.Value_NumberValue); ok {
+				items = append(items, strconv.Itoa(int(item.GetNumberValue())))
+			} else {
+				items = append(items, item.GetStringValue())
+			}
+		}
+	} else {
+		items = strings.Split(value.GetStringValue(), ",")
+	}
+
+	var ids []int
+	for _, item := range items {
+		id, err := strconv.Atoi(strings.TrimSpace(item))
+		if err == nil && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Returns ID of the attached ISO disk
+func ISODiskID(VM *vm.VM) (int, bool) {
+	return markedDiskID(VM, driver_shared.NOCLOUD_ISO)
+}
+
+// Attaches allowed ISO Image as CDROM, optionally booting from it. VM is powered off for attach and resumed if it was running
+func (c *ONeClient) AttachISO(vmid, imageID int, boot bool) error {
+	log := c.log.Named("AttachISO").With(zap.Int("vmid", vmid), zap.Int("image", imageID))
+
+	if !slices.Contains(AllowedISOs(c.vars[ISO_IMAGES]), imageID) {
+		return fmt.Errorf("image %d isn't allowed", imageID)
+	}
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return err
+	}
+	if _, ok := ISODiskID(VM); ok {
+		return errors.New("VM already has ISO attached")
+	}
+
+	running := VM.StateRaw != int(vm.Poweroff)
+	if err := c.ensurePoweroff(vmid); err != nil {
+		return err
+	}
+	id, err := c.attachMarkedImage(vmid, imageID, driver_shared.NOCLOUD_ISO, boot, nil)
+	if err != nil {
+		return err
+	}
+	log.Info("ISO attached", zap.Int("disk", id), zap.Bool("boot", boot))
+
+	if running {
+		return c.ResumeVM(vmid)
+	}
+	return nil
+}
+
+// Detaches ISO, VM is powered off for detach and resumed if it was running
+func (c *ONeClient) DetachISO(vmid int) error {
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return err
+	}
+	id, ok := ISODiskID(VM)
+	if !ok {
+		return errors.New("VM has no ISO attached")
+	}
+
+	running := VM.StateRaw != int(vm.Poweroff)
+	if err := c.ensurePoweroff(vmid); err != nil {
+		return err
+	}
+	if err := c.detachBootDisk(VM, id, nil); err != nil {
+		return err
+	}
+
+	if running {
+		return c.ResumeVM(vmid)
+	}
+	return nil
+}
+
+// Lists allowed ISO Images with name, description and size(MB) for SP public data
+func MonitorISOs(log *zap.Logger, c IClient, allowed []int) (*structpb.Value, error) {
+	isos := make(map[string]interface{}, len(allowed))
+	for _, id := range allowed {
+		img, err := c.GetImage(id)
+		if err != nil {
+			log.Warn("Error getting ISO Image", zap.Int("image", id), zap.Error(err))
+			isos[strconv.Itoa(id)] = map[string]interface{}{"warning": fmt.Sprintf("error getting image %d: %s", id, err)}
+			continue
+		}
+		desc, _ := img.Template.GetStr("DESCRIPTION")
+		isos[strconv.Itoa(id)] = map[string]interface{}{
+			"name": img.Name,
+			"desc": desc,
+			"size": img.Size,
+		}
+	}
+	return structpb.NewValue(isos)
+}
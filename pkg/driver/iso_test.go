@@ -0,0 +1,83 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestISO(t *testing.T) {
+	c, _, ig := setup(t)
+	vmid := deploy(t, c, ig)
+	s := c.Server
+
+	iso := c.AddImage("installer", 700)
+	other := c.AddImage("other", 700)
+	isos, _ := structpb.NewList([]interface{}{float64(iso), "100"})
+	vars := map[string]*sppb.Var{
+		one.ISO_IMAGES: {Value: map[string]*structpb.Value{"default": structpb.NewListValue(isos)}},
+	}
+	c.SetVars(vars)
+
+	if err := c.AttachISO(vmid, other, true); err == nil {
+		t.Fatal("Expected error attaching not allowed Image")
+	}
+	if err := c.AttachISO(vmid, iso, true); err != nil {
+		t.Fatalf("AttachISO() => %v", err)
+	}
+	v, _ := c.GetVM(vmid)
+	id, ok := one.ISODiskID(v)
+	if !ok {
+		t.Fatal("ISO must be attached")
+	}
+	if boot, _ := v.Template.GetStrFromVec("OS", "BOOT"); !strings.HasPrefix(boot, fmt.Sprintf("disk%d,", id)) {
+		t.Fatalf("ISO must boot first, got %q", boot)
+	}
+	if state, _, _, _, _ := c.StateVM(vmid); state != 3 {
+		t.Fatalf("Running VM must be resumed, got state %d", state)
+	}
+
+	if err := c.DetachISO(vmid); err != nil {
+		t.Fatalf("DetachISO() => %v", err)
+	}
+	v, _ = c.GetVM(vmid)
+	if _, ok := one.ISODiskID(v); ok {
+		t.Fatal("ISO must be detached")
+	}
+	if calls := s.CallsTo("one.vm.detach"); len(calls) != 1 || calls[0].Args[1] != int64(id) {
+		t.Fatalf("Unexpected detach calls: %+v", calls)
+	}
+
+	if !reflect.DeepEqual(one.AllowedISOs(&sppb.Var{Value: map[string]*structpb.Value{"default": structpb.NewStringValue(" 3, 1,3")}}), []int{3, 1}) {
+		t.Fatal("Comma separated allowlist must be parsed")
+	}
+	_, pd, err := c.MonitorLocation(&sppb.ServicesProvider{Vars: vars})
+	if err != nil {
+		t.Fatalf("MonitorLocation() => %v", err)
+	}
+	published := pd.PublicData["isos"].GetStructValue().AsMap()
+	if len(published) != 2 || published[strconv.Itoa(iso)].(map[string]interface{})["name"] != "installer" {
+		t.Fatalf("Unexpected ISOs: %v", published)
+	}
+}
@@ -26,7 +26,7 @@ import (
 
 	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
 	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/host"
-	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/image"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/template"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/types/known/structpb"
 )
@@ -97,16 +97,14 @@ func ispRecordHelper(state map[string]interface{}, rec dynamic.Template, host ho
 	}
 }
 
-func MonitorHostsPool(log *zap.Logger, c *ONeClient) (res *structpb.Value, err error) {
-	hsc := c.ctrl.Hosts()
-	pool, err := hsc.Info()
+func MonitorHostsPool(log *zap.Logger, c IClient) (res *structpb.Value, err error) {
+	pool, err := c.GetHosts()
 	if err != nil {
 		return nil, err
 	}
 
 	hosts := make(map[string]interface{})
 	for _, host := range pool.Hosts {
-		hc := c.ctrl.Host(host.ID)
 		state := make(map[string]interface{})
 		state["name"] = host.Name
 
@@ -121,7 +119,7 @@ func MonitorHostsPool(log *zap.Logger, c *ONeClient) (res *structpb.Value, err e
 
 		var rec dynamic.Template
 		var recLen int
-		mon, err := hc.Monitoring()
+		mon, err := c.HostMonitoring(host.ID)
 		helper, ok := VMMsRecordHelpers[host.VMMAD]
 		if !ok {
 			state["error"] = fmt.Sprintf("Host VM MAD %s unsupported", host.VMMAD)
@@ -259,7 +257,7 @@ func MonitorNetworks(log *zap.Logger, c *ONeClient) (res *structpb.Value, err er
 	return structpb.NewValue(state)
 }
 
-func MonitorTemplates(log *zap.Logger, c *ONeClient) (res *structpb.Value, err error) {
+func MonitorTemplates(log *zap.Logger, c IClient) (res *structpb.Value, err error) {
 	pool, err := c.ListTemplates()
 	if err != nil {
 		return nil, err
@@ -267,59 +265,87 @@ func MonitorTemplates(log *zap.Logger, c *ONeClient) (res *structpb.Value, err e
 
 	templates := make(map[string]interface{})
 	for _, tmpl := range pool {
+		if IsPrivateTemplate(&tmpl) {
+			continue
+		}
+		templates[strconv.Itoa(tmpl.ID)] = templateState(c, &tmpl)
+	}
 
-		state := make(map[string]interface{})
-
-		state["name"] = tmpl.Name
+	result, err := structpb.NewValue(templates)
+	if err != nil {
+		log.Warn("Error Marshaling TemplatesMonitoring", zap.Any("templates", templates), zap.Error(err))
+		return nil, errors.New("JSON generate error")
+	}
+	return result, nil
+}
 
-		desc, _ := tmpl.Template.GetStr("DESCRIPTION")
-		state["desc"] = desc
+// Lists private templates by owner(ONe user ID), so each user is offered own ones
+func MonitorPrivateTemplates(log *zap.Logger, c IClient) (res *structpb.Value, err error) {
+	pool, err := c.ListTemplates()
+	if err != nil {
+		return nil, err
+	}
 
-		state["is_public"] = true
-		nocloud_enable, e := tmpl.Template.GetStr("NOCLOUD_ENABLED")
-		if e == nil && strings.ToLower(nocloud_enable) == "false" {
-			state["is_public"] = false
+	users := make(map[string]interface{})
+	for _, tmpl := range pool {
+		if !IsPrivateTemplate(&tmpl) {
+			continue
 		}
+		uid := strconv.Itoa(tmpl.UID)
+		if _, ok := users[uid]; !ok {
+			users[uid] = make(map[string]interface{})
+		}
+		users[uid].(map[string]interface{})[strconv.Itoa(tmpl.ID)] = templateState(c, &tmpl)
+	}
 
-		userInputs, _ := tmpl.Template.GetVector("USER_INPUTS")
-		var inputs []interface{}
+	result, err := structpb.NewValue(users)
+	if err != nil {
+		log.Warn("Error Marshaling PrivateTemplatesMonitoring", zap.Any("templates", users), zap.Error(err))
+		return nil, errors.New("JSON generate error")
+	}
+	return result, nil
+}
 
-		for _, input := range userInputs.Pairs {
-			inputs = append(inputs, input.Key())
-		}
+func templateState(c IClient, tmpl *template.Template) map[string]interface{} {
+	state := make(map[string]interface{})
 
-		state["inputs"] = inputs
+	state["name"] = tmpl.Name
 
-		var img *image.Image
-		var img_id int
-		var err error
+	desc, _ := tmpl.Template.GetStr("DESCRIPTION")
+	state["desc"] = desc
 
-		if len(tmpl.Template.GetDisks()) == 0 {
-			state["warning"] = "Template has no disks"
-			goto store
-		}
+	state["is_public"] = true
+	nocloud_enable, e := tmpl.Template.GetStr("NOCLOUD_ENABLED")
+	if e == nil && strings.ToLower(nocloud_enable) == "false" {
+		state["is_public"] = false
+	}
 
-		if _, err := tmpl.Template.GetDisks()[0].GetInt("IMAGE_ID"); err != nil {
-			state["warning"] = "Template has no image"
-			goto store
+	var inputs []interface{}
+	if userInputs, err := tmpl.Template.GetVector("USER_INPUTS"); err == nil {
+		for _, input := range userInputs.Pairs {
+			inputs = append(inputs, input.Key())
 		}
+	}
 
-		img_id, _ = tmpl.Template.GetDisks()[0].GetInt("IMAGE_ID")
-		img, err = c.GetImage(img_id)
-		if err != nil {
-			state["warning"] = fmt.Sprintf("error getting image %d: %s", img_id, err)
-			goto store
-		}
+	state["inputs"] = inputs
 
-		state["min_size"] = img.Size
-	store:
-		templates[strconv.Itoa(tmpl.ID)] = state
+	if len(tmpl.Template.GetDisks()) == 0 {
+		state["warning"] = "Template has no disks"
+		return state
 	}
 
-	result, err := structpb.NewValue(templates)
+	img_id, err := tmpl.Template.GetDisks()[0].GetInt("IMAGE_ID")
 	if err != nil {
-		log.Warn("Error Marshaling TemplatesMonitoring", zap.Any("templates", templates), zap.Error(err))
-		return nil, errors.New("JSON generate error")
+		state["warning"] = "Template has no image"
+		return state
 	}
-	return result, nil
+
+	img, err := c.GetImage(img_id)
+	if err != nil {
+		state["warning"] = fmt.Sprintf("error getting image %d: %s", img_id, err)
+		return state
+	}
+
+	state["min_size"] = img.Size
+	return state
 }
@@ -0,0 +1,246 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	vnet "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/virtualnetwork"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	driver_shared "github.com/slntopp/nocloud-driver-ione/pkg/shared"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Returns IDs of VM NICs leased from the given VNet, floating IPs aren't included
+func NICsFrom(VM *vm.VM, vnID int) []int {
+	var ids []int
+	for _, nic := range VM.Template.GetNICs() {
+		if id, err := nic.GetI(shared.NetworkID); err != nil || id != vnID || IsFloatingNIC(&nic) {
+			continue
+		}
+		if id, err := nic.ID(); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Returns amount of VNet addresses which aren't leased yet
+func FreeLeases(vn *vnet.VirtualNetwork) int {
+	free := 0
+	for _, ar := range vn.ARs {
+		used, _ := strconv.Atoi(ar.UsedLeases)
+		free += ar.Size - used
+	}
+	return free
+}
+
+// Returns ID of the User VNet with at least n free addresses, missing ones are reserved with the given function.
+// vnID is the current User VNet, -1 if User has none yet
+func (c *ONeClient) reserveFreeLeases(vnID, n int, reserve func(n int) (int, error)) (int, error) {
+	free := 0
+	if vnID != -1 {
+		if vn, err := c.GetVNet(vnID); err == nil {
+			free = FreeLeases(vn)
+		}
+	}
+	if free >= n {
+		return vnID, nil
+	}
+	return reserve(n - free)
+}
+
+// Moves VM to the ONe User of another Instances Group, given by its data with userid.
+// NICs leased from the current owner VNets are detached and leased again from the target User VNets,
+// public addresses are reserved for the target User if there are not enough free ones.
+// New NICs get the target Instances Group security group.
+// If anything fails after NICs are detached, VM gets its original NICs and owner back
+func (c *ONeClient) MoveVM(vmid int, target map[string]*structpb.Value) error {
+	uid := int(target["userid"].GetNumberValue())
+	log := c.log.Named("MoveVM").With(zap.Int("vmid", vmid), zap.Int("user", uid))
+
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return err
+	}
+	if VM.UID == uid {
+		return fmt.Errorf("VM %d is already owned by user %d", vmid, uid)
+	}
+	owner, err := c.GetUser(uid)
+	if err != nil {
+		return fmt.Errorf("can't get target user: %w", err)
+	}
+
+	var public, private []int
+	if vn, err := c.GetUserPublicVNet(VM.UID); err == nil {
+		public = NICsFrom(VM, vn)
+	}
+	if vn, err := c.GetUserPrivateVNet(VM.UID); err == nil {
+		private = NICsFrom(VM, vn)
+	}
+
+	// Target VNets are checked before anything is detached, so VM stays intact if addresses can't be leased
+	publicVN, err := c.GetUserPublicVNet(uid)
+	if err != nil {
+		publicVN = -1
+	}
+	if len(public) > 0 {
+		publicVN, err = c.reserveFreeLeases(publicVN, len(public), func(n int) (int, error) {
+			return c.ReservePublicIP(uid, n)
+		})
+		if err != nil {
+			return fmt.Errorf("can't reserve public addresses: %w", err)
+		}
+	}
+	privateVN, err := c.GetUserPrivateVNet(uid)
+	if len(private) > 0 && err != nil {
+		return fmt.Errorf("target user has no private network: %w", err)
+	}
+
+	// Any failure from now on puts VM original NICs and owner back, so it isn't left without networking
+	chowned := false
+	rollback := func(cause error) error {
+		log.Error("Error moving VM, rolling back", zap.Error(cause))
+		if err := c.restoreVM(VM, chowned); err != nil {
+			log.Error("Error rolling back VM", zap.Error(err))
+		}
+		return cause
+	}
+
+	// Floating IPs stay with the current owner
+	for id, lease := range FloatingNICs(VM) {
+		if err := c.unassignNIC(vmid, id, lease); err != nil {
+			return rollback(err)
+		}
+	}
+
+	vmc := c.ctrl.VM(vmid)
+	for _, id := range append(private, public...) {
+		if err := vmc.DetachNIC(id); err != nil {
+			return rollback(err)
+		}
+		if err := c.waitForHotplugFinish(vmid); err != nil {
+			return rollback(err)
+		}
+	}
+
+	if err := c.Chown("vm", vmid, uid, owner.GID); err != nil {
+		return rollback(fmt.Errorf("can't change ownership of the vm: %w", err))
+	}
+	chowned = true
+
+	limits := VMBandwidthLimits(VM)
+	attach := func(vn, n int) error {
+		for i := 0; i < n; i++ {
+			template := vm.NewTemplate()
+			nic := template.AddNIC()
+			nic.Add(shared.NetworkID, vn)
+			AddSecurityGroup(nic, target)
+			AddBandwidthLimits(nic, limits)
+			if err := vmc.AttachNIC(template.String()); err != nil {
+				return err
+			}
+			if err := c.waitForHotplugFinish(vmid); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := attach(privateVN, len(private)); err != nil {
+		return rollback(err)
+	}
+	if err := attach(publicVN, len(public)); err != nil {
+		return rollback(err)
+	}
+
+	log.Info("VM moved", zap.Int("from", VM.UID), zap.Int("public", len(public)), zap.Int("private", len(private)))
+	return nil
+}
+
+// Puts VM back to the state it had before MoveVM: NICs attached while moving are detached,
+// ownership is returned and the original NICs are attached again with their addresses.
+// Floating IPs put on hold are released first, so they can be leased again
+func (c *ONeClient) restoreVM(VM *vm.VM, chowned bool) error {
+	vmc := c.ctrl.VM(VM.ID)
+	current, err := c.GetVM(VM.ID)
+	if err != nil {
+		return err
+	}
+
+	original := make(map[int]shared.NIC)
+	for _, nic := range VM.Template.GetNICs() {
+		if id, err := nic.ID(); err == nil {
+			original[id] = nic
+		}
+	}
+	for _, nic := range current.Template.GetNICs() {
+		id, err := nic.ID()
+		if err != nil {
+			continue
+		}
+		if _, ok := original[id]; ok {
+			delete(original, id)
+			continue
+		}
+		if err := vmc.DetachNIC(id); err != nil {
+			return err
+		}
+		if err := c.waitForHotplugFinish(VM.ID); err != nil {
+			return err
+		}
+	}
+
+	if chowned {
+		if err := c.Chown("vm", VM.ID, VM.UID, VM.GID); err != nil {
+			return fmt.Errorf("can't return ownership of the vm: %w", err)
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(original)) {
+		nic := original[id]
+		vnID, _ := nic.GetI(shared.NetworkID)
+		ip, _ := nic.Get(shared.IP)
+
+		template := vm.NewTemplate()
+		restored := template.AddNIC()
+		restored.Add(shared.NetworkID, vnID)
+		if ip != "" {
+			restored.Add(shared.IP, ip)
+		}
+		if groups, err := nic.GetStr(string(shared.SecurityGroups)); err == nil {
+			restored.Add(shared.SecurityGroups, groups)
+		}
+		if IsFloatingNIC(&nic) {
+			if err := c.ctrl.VirtualNetwork(vnID).Release(leaseTemplate(ip)); err != nil {
+				c.log.Warn("Couldn't release floating IP", zap.String("ip", ip), zap.Error(err))
+			}
+			restored.Add(driver_shared.NOCLOUD_FLOATING, "YES")
+		}
+		AddBandwidthLimits(restored, NICBandwidthLimits(&nic))
+		if err := vmc.AttachNIC(template.String()); err != nil {
+			return err
+		}
+		if err := c.waitForHotplugFinish(VM.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"testing"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestMoveVM(t *testing.T) {
+	c, _, ig := setup(t)
+	vmid := deploy(t, c, ig)
+	s := c.Server
+
+	if err := c.MoveVM(vmid, ig.Data); err == nil {
+		t.Fatal("Expected error moving VM to its owner")
+	}
+
+	target, err := c.CreateUser("target-ig-uuid", "pass", []int{fake.USERS_GROUP})
+	if err != nil {
+		t.Fatalf("CreateUser() => %v", err)
+	}
+	sg, err := c.CreateIGSecurityGroup("target-ig-uuid", target, nil)
+	if err != nil {
+		t.Fatalf("CreateIGSecurityGroup() => %v", err)
+	}
+	targetData := map[string]*structpb.Value{
+		"userid":         structpb.NewNumberValue(float64(target)),
+		"security_group": structpb.NewNumberValue(float64(sg)),
+	}
+	if err := c.MoveVM(vmid, targetData); err != nil {
+		t.Fatalf("MoveVM() => %v", err)
+	}
+	for _, expected := range []string{"one.vm.detachnic", "one.vn.reserve", "one.vm.chown", "one.vm.attachnic"} {
+		if len(s.CallsTo(expected)) != 1 {
+			t.Errorf("%s must be called once: %v", expected, s.Methods())
+		}
+	}
+
+	v, _ := c.GetVM(vmid)
+	if v.UID != target || v.GID != fake.USERS_GROUP {
+		t.Fatalf("VM isn't moved to the target User: owner %d:%d", v.UID, v.GID)
+	}
+	pub, err := c.GetUserPublicVNet(target)
+	if err != nil {
+		t.Fatalf("Public VNet isn't reserved for the target User: %v", err)
+	}
+	if nics := one.NICsFrom(v, pub); len(nics) != 1 || len(v.Template.GetNICs()) != 1 {
+		t.Fatalf("Expected single NIC in the target User public VNet, got %d of %d", len(nics), len(v.Template.GetNICs()))
+	}
+	if groups := one.VMSecurityGroups(v); len(groups) != 1 || groups[0] != sg {
+		t.Fatalf("NIC must reference the target IG security group %d, got %v", sg, groups)
+	}
+	old, _ := c.GetVNet(int(ig.Data["public_vn"].GetNumberValue()))
+	if free := one.FreeLeases(old); free != 1 {
+		t.Fatalf("Expected old address to be released, %d free", free)
+	}
+}
+
+func TestMoveVMRollback(t *testing.T) {
+	c, _, ig := setup(t)
+	vmid := deploy(t, c, ig)
+	s := c.Server
+
+	before, _ := c.GetVM(vmid)
+	ip, _ := before.Template.GetNICs()[0].Get(shared.IP)
+
+	target, err := c.CreateUser("target-ig-uuid", "pass", []int{fake.USERS_GROUP})
+	if err != nil {
+		t.Fatalf("CreateUser() => %v", err)
+	}
+	s.FailNext("one.vm.attachnic", 1)
+	if err := c.MoveVM(vmid, map[string]*structpb.Value{"userid": structpb.NewNumberValue(float64(target))}); err == nil {
+		t.Fatal("Expected error when NIC can't be attached")
+	}
+
+	v, _ := c.GetVM(vmid)
+	if v.UID != before.UID || v.GID != before.GID {
+		t.Fatalf("VM ownership isn't returned: owner %d:%d", v.UID, v.GID)
+	}
+	nics := v.Template.GetNICs()
+	if len(nics) != 1 {
+		t.Fatalf("Expected original NIC to be attached back, got %d NICs", len(nics))
+	}
+	if restored, _ := nics[0].Get(shared.IP); restored != ip {
+		t.Fatalf("Expected NIC to get address %s back, got %s", ip, restored)
+	}
+	if pub := int(ig.Data["public_vn"].GetNumberValue()); len(one.NICsFrom(v, pub)) != 1 {
+		t.Fatalf("NIC must be leased from the original public VNet %d", pub)
+	}
+}
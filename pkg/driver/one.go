@@ -17,12 +17,15 @@ package one
 
 import (
 	"errors"
+	"net/http"
 	"time"
 
 	goca "github.com/OpenNebula/one/src/oca/go/src/goca"
 	"github.com/OpenNebula/one/src/oca/go/src/goca/parameters"
 	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/group"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/host"
 	img "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/image"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/securitygroup"
 	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
 	tmpl "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/template"
 	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/user"
@@ -36,20 +39,29 @@ import (
 )
 
 type IClient interface {
+	BackupVM(vmid int, mode string, keep int, reset bool) error
 	CheckInstancesGroup(IG *pb.InstancesGroup) (*CheckInstancesGroupResponse, error)
 	CheckInstancesGroupResponseProcess(resp *CheckInstancesGroupResponse, ig *pb.InstancesGroup, group int, balance map[string]float64) *CheckInstancesGroupResponse
+	CloneVM(inst *pb.Instance, name, token string) (vmid, imageID int, err error)
+	CheckOrphanInstanceGroup(instanceGroup *pb.InstancesGroup, userGroup float64) error
 	Chmod(class string, oid int, perm *shared.Permissions) error
 	Chown(class string, oid, uid, gid int) error
 	CreateUser(name, pass string, groups []int) (id int, err error)
+	DeleteBackup(vmid, imageID int) error
+	DiskSaveAs(vmid, diskID int, name string) (int, error)
 	DeleteUser(id int) error
 	DeleteUserAndVNets(id int) error
 	DeleteVNet(id int) error
 	FindFreeVlan(sp *sppb.ServicesProvider) (vnMad string, freeVlan int, err error)
 	FindVMByInstance(inst *pb.Instance) (*vm.VM, error)
 	GetGroup(id int) (*group.Group, error)
+	GetHosts() (*host.Pool, error)
 	GetImage(id int) (*img.Image, error)
+	GetInstBackups(inst *pb.Instance) (map[string]interface{}, error)
 	GetInstSnapshots(inst *pb.Instance) (map[string]interface{}, error)
+	GetFirewallRules(id int) ([]FirewallRule, error)
 	GetSecrets() map[string]*structpb.Value
+	GetSecurityGroup(id int) (*securitygroup.SecurityGroup, error)
 	GetTemplate(id int) (*tmpl.Template, error)
 	GetUser(id int) (*user.User, error)
 	GetUsers() (*user.Pool, error)
@@ -57,25 +69,49 @@ type IClient interface {
 	GetUserVNets(user int) (*vnet.Pool, error)
 	GetUserPrivateVNet(user int) (id int, err error)
 	GetUserPublicVNet(user int) (id int, err error)
+	GetUserPrivateVNet6(user int) (id int, err error)
+	GetUserPublicVNet6(user int) (id int, err error)
+	GetIGSecurityGroup(ig string, user int) (int, error)
+	GetVMSecurityGroup(VM *vm.VM) (int, error)
+	CreateIGSecurityGroup(ig string, user int, rules []FirewallRule) (int, error)
 	GetUserVMsInstancesGroup(userId int) (*pb.InstancesGroup, error)
 	GetVM(vmid int) (*vm.VM, error)
+	GetVmResourcesDiff(inst *pb.Instance) []*VmResourceDiff
 	GetVMByName(name string) (id int, err error)
 	GetVNet(id int) (*vnet.VirtualNetwork, error)
+	HandleDeletedInstances(deleted []*pb.Instance) []*pb.Instance
+	HostMonitoring(id int) (*host.Monitoring, error)
+	IPLeases(uid int) (map[string]int, error)
 	InstantiateTemplate(id int, vmname, tmpl string, pending bool) (vmid int, err error)
 	InstantiateTemplateHelper(instance *pb.Instance, ig *pb.InstancesGroup, token string) (vmid int, err error)
 	ListImages() ([]img.Image, error)
 	ListTemplates() ([]tmpl.Template, error)
 	Logger(n string) *zap.Logger
 	MonitorLocation(sp *sppb.ServicesProvider) (st *LocationState, pd *LocationPublicData, err error)
+	MoveVM(vmid int, target map[string]*structpb.Value) error
 	NetworkingVM(id int) (map[string]interface{}, error)
 	PoweroffVM(id int, hard bool) error
 	RebootVM(id int, hard bool) error
 	ReservePrivateIP(u int, vnMad string, vlanID int) (pool_id int, err error)
 	ReservePublicIP(u, n int) (pool_id int, err error)
+	ReservePrivateIPv6(u int, vnMad string, vlanID int) (pool_id int, err error)
+	ReservePublicIPv6(u, n int) (pool_id int, err error)
 	ReserveVNet(id, size, to int, name string) (int, error)
+	RestoreBackup(vmid, imageID, incrementID int) error
+	RescueEnter(vmid int, password string) error
+	RescueExit(vmid int) error
+	AttachISO(vmid, imageID int, boot bool) error
+	AssignIP(vmid int, ip string) error
+	DetachISO(vmid int) error
 	ResumeVM(id int) error
+	SaveAsTemplate(vmid int, name string) (templateID, imageID int, err error)
 	Reinstall(id int) error
+	ReinstallTemplate(inst *pb.Instance) (int, error)
+	ResetPassword(vmid int, password string, reboot bool) error
+	SetSSHKeys(vmid int, sshKeys string, reboot bool) error
 	Monitoring(id int) (*vm.Monitoring, error)
+	SetFirewallRules(id int, rules []FirewallRule) error
+	UpdateNICBandwidth(vmid, nicID int, limits BandwidthLimits) error
 	SetSecrets(secrets map[string]*structpb.Value)
 	SetVars(vars map[string]*sppb.Var)
 	SnapCreate(name string, vmid int) error
@@ -84,6 +120,7 @@ type IClient interface {
 	StateVM(id int) (state int, state_str string, lcm_state int, lcm_state_str string, err error)
 	SuspendVM(id int) error
 	TerminateVM(id int, hard bool) error
+	UnassignIP(vmid int, ip string) error
 	UpdateVNet(id int, tmpl string, uType parameters.UpdateType) error
 	UserAddAttribute(id int, data map[string]interface{}) error
 	VMToInstance(id int) (*pb.Instance, error)
@@ -101,8 +138,13 @@ type ONeClient struct {
 }
 
 func NewClient(user, password, endpoint string, log *zap.Logger) *ONeClient {
+	return NewClientWithHTTP(user, password, endpoint, nil, log)
+}
+
+// NewClientWithHTTP makes ONeClient sending XML-RPC calls through the given http.Client, default one is used if nil
+func NewClientWithHTTP(user, password, endpoint string, httpClient *http.Client, log *zap.Logger) *ONeClient {
 	conf := goca.NewConfig(user, password, endpoint)
-	c := goca.NewClient(conf, nil)
+	c := goca.NewClient(conf, httpClient)
 	ctrl := goca.NewController(c)
 	return &ONeClient{
 		Client: c,
@@ -199,6 +241,20 @@ func (c *ONeClient) MonitorLocation(sp *sppb.ServicesProvider) (st *LocationStat
 	}
 	pd.PublicData["templates"] = templatesState
 
+	privateTemplates, err := MonitorPrivateTemplates(log.Named("MonitorPrivateTemplates"), c)
+	if err != nil {
+		log.Warn("Error retrieving private Templates", zap.Error(err))
+	} else {
+		pd.PublicData["private_templates"] = privateTemplates
+	}
+
+	isosState, err := MonitorISOs(log.Named("MonitorISOs"), c, AllowedISOs(sp.GetVars()[ISO_IMAGES]))
+	if err != nil {
+		log.Warn("Error retrieving ISOs", zap.Error(err))
+	} else {
+		pd.PublicData["isos"] = isosState
+	}
+
 	st.Meta["ts"] = structpb.NewNumberValue(float64(time.Now().Unix()))
 	return st, pd, nil
 }
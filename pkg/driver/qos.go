@@ -0,0 +1,131 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	"go.uber.org/zap"
+)
+
+// Instance resources (or billing plan meta) keys of NIC bandwidth limits, values are in KBytes/s as ONe takes them
+var BANDWIDTH_KEYS = map[string]shared.NICKeys{
+	"inbound_avg_bw":   shared.InboundAvgBw,
+	"inbound_peak_bw":  shared.InboundPeakBw,
+	"inbound_peak_kb":  shared.InboundPeakK,
+	"outbound_avg_bw":  shared.OutboundAvgBw,
+	"outbound_peak_bw": shared.OutboundPeakBw,
+	"outbound_peak_kb": shared.OutboundPeakKb,
+}
+
+// Bandwidth limits of NIC by ONe attribute, empty means unlimited
+type BandwidthLimits map[shared.NICKeys]int
+
+// Returns bandwidth limits of the Instance, resources take precedence over billing plan meta
+func InstanceBandwidthLimits(inst *pb.Instance) BandwidthLimits {
+	limits := BandwidthLimits{}
+	meta := inst.GetBillingPlan().GetMeta()
+	resources := inst.GetResources()
+	for key, attr := range BANDWIDTH_KEYS {
+		value := meta[key].GetNumberValue()
+		if res, ok := resources[key]; ok {
+			value = res.GetNumberValue()
+		}
+		if value > 0 {
+			limits[attr] = int(value)
+		}
+	}
+	return limits
+}
+
+// Returns bandwidth limits set on the NIC
+func NICBandwidthLimits(nic *shared.NIC) BandwidthLimits {
+	limits := BandwidthLimits{}
+	for _, attr := range BANDWIDTH_KEYS {
+		if value, err := nic.GetInt(string(attr)); err == nil && value > 0 {
+			limits[attr] = value
+		}
+	}
+	return limits
+}
+
+// Returns limits of the first VM NIC having any, for attaches made without Instance at hand
+func VMBandwidthLimits(VM *vm.VM) BandwidthLimits {
+	for _, nic := range VM.Template.GetNICs() {
+		if limits := NICBandwidthLimits(&nic); len(limits) > 0 {
+			return limits
+		}
+	}
+	return BandwidthLimits{}
+}
+
+// Tells whether any VM NIC has other limits than given, so they must be updated
+func BandwidthOutdated(VM *vm.VM, limits BandwidthLimits) bool {
+	for _, nic := range VM.Template.GetNICs() {
+		if !maps.Equal(NICBandwidthLimits(&nic), limits) {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the limits to the NIC being created or attached
+func AddBandwidthLimits(nic *shared.NIC, limits BandwidthLimits) {
+	for _, attr := range slices.Sorted(maps.Keys(limits)) {
+		nic.Add(attr, limits[attr])
+	}
+}
+
+// Replaces QoS attributes of the NIC with the limits, ones not given are removed.
+// Uses one.vm.updatenic, which is available since ONe 6.2
+func (c *ONeClient) UpdateNICBandwidth(vmid, nicID int, limits BandwidthLimits) error {
+	attrs := make([]string, 0, len(limits))
+	for _, attr := range slices.Sorted(maps.Keys(limits)) {
+		attrs = append(attrs, fmt.Sprintf("%s=\"%d\"", attr, limits[attr]))
+	}
+	template := fmt.Sprintf("NIC=[%s]", strings.Join(attrs, ","))
+	_, err := c.Client.Call("one.vm.updatenic", vmid, nicID, template, 0)
+	return err
+}
+
+// Updates VM NICs having other limits than requested, returns whether any was updated
+func (c *ONeClient) updateNICsBandwidth(VM *vm.VM, limits BandwidthLimits) (updated bool) {
+	for _, nic := range VM.Template.GetNICs() {
+		if maps.Equal(NICBandwidthLimits(&nic), limits) {
+			continue
+		}
+		id, err := nic.ID()
+		if err != nil {
+			continue
+		}
+		if err := c.UpdateNICBandwidth(VM.ID, id, limits); err != nil {
+			c.log.Error("Error updating NIC bandwidth", zap.Int("vm", VM.ID), zap.Int("nic", id), zap.Error(err))
+			continue
+		}
+		if err := c.waitForHotplugFinish(VM.ID); err != nil {
+			c.log.Error("Error waiting for NIC update", zap.Int("vm", VM.ID), zap.Error(err))
+			return true
+		}
+		updated = true
+	}
+	return updated
+}
@@ -0,0 +1,93 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestBandwidth(t *testing.T) {
+	c, _, ig := setup(t)
+	inst := ig.Instances[0]
+	inst.BillingPlan = &billingpb.Plan{Meta: map[string]*structpb.Value{
+		"inbound_avg_bw":  structpb.NewNumberValue(2048),
+		"outbound_avg_bw": structpb.NewNumberValue(2048),
+	}}
+	inst.Resources["outbound_avg_bw"] = structpb.NewNumberValue(1024)
+	inst.Resources["outbound_peak_bw"] = structpb.NewNumberValue(4096)
+	s := c.Server
+
+	limits := one.InstanceBandwidthLimits(inst)
+	expected := one.BandwidthLimits{
+		shared.InboundAvgBw: 2048, shared.OutboundAvgBw: 1024, shared.OutboundPeakBw: 4096,
+	}
+	if !reflect.DeepEqual(limits, expected) {
+		t.Fatalf("Resources must take precedence over billing plan meta: %v", limits)
+	}
+
+	vmid, err := c.InstantiateTemplateHelper(inst, ig, "token")
+	if err != nil {
+		t.Fatalf("InstantiateTemplateHelper() => %v", err)
+	}
+	inst.Data[one.DATA_VM_ID] = structpb.NewNumberValue(float64(vmid))
+	v, _ := c.GetVM(vmid)
+	if len(v.Template.GetNICs()) == 0 || one.BandwidthOutdated(v, limits) {
+		t.Fatalf("NICs must be created with the limits: %s", v.Template.String())
+	}
+
+	inst.Resources["outbound_avg_bw"] = structpb.NewNumberValue(512)
+	delete(inst.Resources, "outbound_peak_bw")
+	if v, _ := c.GetVM(vmid); !one.BandwidthOutdated(v, one.InstanceBandwidthLimits(inst)) {
+		t.Fatal("Changed limits must be noticed")
+	}
+
+	s.Reset()
+	c.CheckInstancesGroupResponseProcess(&one.CheckInstancesGroupResponse{ToBeUpdated: []*pb.Instance{inst}}, ig, fake.USERS_GROUP, nil)
+	if updated := inst.State.Meta["updated"].GetListValue().AsSlice(); !slices.Contains(updated, "bandwidth") {
+		t.Fatalf("Unexpected updated resources: %v", updated)
+	}
+	calls := s.CallsTo("one.vm.updatenic")
+	if len(calls) != len(v.Template.GetNICs()) || calls[0].Args[2] != `NIC=[INBOUND_AVG_BW="2048",OUTBOUND_AVG_BW="512"]` {
+		t.Fatalf("Unexpected NIC update calls: %+v", calls)
+	}
+	v, _ = c.GetVM(vmid)
+	nics := v.Template.GetNICs()
+	if got := one.NICBandwidthLimits(&nics[0]); !reflect.DeepEqual(got, one.InstanceBandwidthLimits(inst)) {
+		t.Fatalf("Unexpected NIC limits after update: %v", got)
+	}
+
+	// Attached NICs get the limits right away
+	inst.Resources["ips_public"] = structpb.NewNumberValue(inst.Resources["ips_public"].GetNumberValue() + 1)
+	s.Reset()
+	c.CheckInstancesGroupResponseProcess(&one.CheckInstancesGroupResponse{ToBeUpdated: []*pb.Instance{inst}}, ig, fake.USERS_GROUP, nil)
+	attach := s.CallsTo("one.vm.attachnic")
+	if len(attach) != 1 || !strings.Contains(attach[0].Args[1].(string), `OUTBOUND_AVG_BW="512"`) {
+		t.Fatalf("Unexpected NIC attach calls: %+v", attach)
+	}
+	if calls := s.CallsTo("one.vm.updatenic"); len(calls) != 0 {
+		t.Fatalf("Up to date NICs must not be updated: %+v", calls)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"testing"
+
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestUsersAndQuotas(t *testing.T) {
+	c, _, ig := setup(t)
+	uid := int(ig.Data["userid"].GetNumberValue())
+
+	me, err := c.GetUser(-1)
+	if err != nil || me.GID != fake.ADMIN_GROUP {
+		t.Fatalf("GetUser(-1) => %v, %v", me, err)
+	}
+	if _, err := c.CreateUser("ig-uuid", "pass", nil); err == nil {
+		t.Fatal("Expected error creating User with taken name")
+	}
+
+	ig.Resources = map[string]*structpb.Value{"cpu": structpb.NewNumberValue(2), "ram": structpb.NewNumberValue(2048)}
+	if err := c.SetQuotaFromConfig(uid, ig, &sppb.ServicesProvider{}); err != nil {
+		t.Fatalf("SetQuotaFromConfig() => %v", err)
+	}
+	if quotas := c.Quotas(uid); len(quotas) == 0 || quotas[0] != "<VM_QUOTA><VM><CPU>2</CPU><MEMORY>2048</MEMORY></VM></VM_QUOTA>" {
+		t.Fatalf("Unexpected quotas: %v", quotas)
+	}
+
+	if err := c.DeleteUserAndVNets(uid); err != nil {
+		t.Fatalf("DeleteUserAndVNets() => %v", err)
+	}
+	if _, err := c.GetUserPublicVNet(uid); err == nil {
+		t.Fatal("User public VNet must be deleted")
+	}
+	super, _ := c.GetVNet(0)
+	if super.UsedLeases != 0 {
+		t.Fatalf("Reserved addresses weren't returned to super VNet, used: %d", super.UsedLeases)
+	}
+}
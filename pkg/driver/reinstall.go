@@ -0,0 +1,104 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	"github.com/slntopp/nocloud/pkg/nocloud/auth"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Address leased by VM NIC, used to get the same addresses for the new VM
+type NICLease struct {
+	NetworkID int
+	IP        string
+	Floating  bool
+}
+
+// Returns leases of the VM NICs in the NICs order
+func NICLeases(VM *vm.VM) []NICLease {
+	leases := make([]NICLease, 0)
+	for _, nic := range VM.Template.GetNICs() {
+		vnID, err := nic.GetInt(string(shared.NetworkID))
+		if err != nil {
+			continue
+		}
+		ip, _ := nic.GetStr(string(shared.IP))
+		leases = append(leases, NICLease{NetworkID: vnID, IP: ip, Floating: IsFloatingNIC(&nic)})
+	}
+	return leases
+}
+
+// Recreates Instance VM from the template set in config, e.g. to change OS. Password and SSH key are taken from config as well.
+// New VM keeps the resources, NIC leases, name and owner of the old one. VM ID is updated in Instance data
+func (c *ONeClient) ReinstallTemplate(inst *pb.Instance) (int, error) {
+	log := c.log.Named("ReinstallTemplate").With(zap.String("instance", inst.GetUuid()))
+
+	vmid, err := GetVMIDFromData(c, inst)
+	if err != nil {
+		return -1, err
+	}
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return -1, err
+	}
+
+	token, err := auth.MakeTokenInstance(inst.GetUuid())
+	if err != nil {
+		return -1, err
+	}
+	// Template is made before the VM is gone, so wrong config or disabled template leave VM intact
+	ig := &pb.InstancesGroup{Data: map[string]*structpb.Value{
+		"userid": structpb.NewNumberValue(float64(VM.UID)),
+	}}
+	template_id, tmpl, data, err := c.vmTemplateFromInstance(inst, ig, token, NICLeases(VM))
+	if err != nil {
+		return -1, err
+	}
+	data[DATA_VM_NAME] = structpb.NewStringValue(VM.Name)
+
+	if err := c.TerminateVM(vmid, true); err != nil {
+		return -1, err
+	}
+	// Leases are released once VM is done
+	err = c.waitForState(vmid, func(state, _ int) bool {
+		return state == int(vm.Done)
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	newID, err := c.InstantiateTemplate(template_id, VM.Name, tmpl.String(), false)
+	if err != nil {
+		return -1, err
+	}
+	if err := c.Chown("vm", newID, VM.UID, VM.GID); err != nil {
+		log.Error("Error changing VM owner", zap.Int("vmid", newID), zap.Error(err))
+	}
+	log.Info("VM reinstalled", zap.Int("old", vmid), zap.Int("vmid", newID), zap.Int("template", template_id))
+
+	data[DATA_VM_ID] = structpb.NewNumberValue(float64(newID))
+	if inst.Data == nil {
+		inst.Data = make(map[string]*structpb.Value)
+	}
+	for key, value := range data {
+		inst.Data[key] = value
+	}
+	return newID, nil
+}
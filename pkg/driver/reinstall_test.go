@@ -0,0 +1,74 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestReinstallTemplate(t *testing.T) {
+	c, _, ig := setup(t)
+	vmid := deploy(t, c, ig)
+
+	img := c.AddImage("debian", 2048)
+	debian, _ := c.AddTemplate("debian", fmt.Sprintf("LOGO=\"debian.png\"\nDISK=[\n  IMAGE_ID=\"%d\",\n  SIZE=\"2048\" ]", img))
+	disabled, _ := c.AddTemplate("disabled", "NOCLOUD_ENABLED=\"FALSE\"")
+
+	old, _ := c.GetVM(vmid)
+	oldIP, _ := old.Template.GetNICs()[0].GetStr("IP")
+
+	inst := ig.Instances[0]
+	inst.Data["backups"] = structpb.NewBoolValue(true)
+	inst.Config["template_id"] = structpb.NewNumberValue(float64(disabled))
+	if _, err := c.ReinstallTemplate(inst); err == nil {
+		t.Fatal("Expected error reinstalling from disabled Template")
+	}
+	if state, _, _, _, _ := c.StateVM(vmid); state != int(vm.Active) {
+		t.Fatalf("VM must be kept when reinstall fails, got state %d", state)
+	}
+
+	inst.Config["template_id"] = structpb.NewNumberValue(float64(debian))
+	inst.Config["password"] = structpb.NewStringValue("new-secret")
+	newID, err := c.ReinstallTemplate(inst)
+	if err != nil {
+		t.Fatalf("ReinstallTemplate() => %v", err)
+	}
+	if newID == vmid || int(inst.Data[one.DATA_VM_ID].GetNumberValue()) != newID {
+		t.Fatalf("Expected new VM ID in data, got %d(data %v)", newID, inst.Data)
+	}
+	if inst.Data[one.DATA_LOGO].GetStringValue() != "debian.png" || !inst.Data["backups"].GetBoolValue() {
+		t.Fatalf("Data must be updated keeping other keys, got %v", inst.Data)
+	}
+	if state, _, _, _, _ := c.StateVM(vmid); state != int(vm.Done) {
+		t.Fatalf("Old VM must be terminated, got state %d", state)
+	}
+
+	v, _ := c.GetVM(newID)
+	if tid, _ := v.Template.GetInt("TEMPLATE_ID"); v.Name != old.Name || v.UID != old.UID || v.GID != old.GID || tid != debian {
+		t.Fatalf("Unexpected VM: name %s, owner %d:%d, template %d", v.Name, v.UID, v.GID, tid)
+	}
+	if ip, _ := v.Template.GetNICs()[0].GetStr("IP"); ip != oldIP {
+		t.Fatalf("Expected IP %s to be kept, got %s", oldIP, ip)
+	}
+	if pass, _ := v.Template.GetStrFromVec("CONTEXT", "PASSWORD"); pass != "new-secret" {
+		t.Fatalf("Expected new password in context, got %q", pass)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	driver_shared "github.com/slntopp/nocloud-driver-ione/pkg/shared"
+	"go.uber.org/zap"
+)
+
+// Returns ID of the first VM disk marked with the given key
+func markedDiskID(VM *vm.VM, marker shared.DiskKeys) (int, bool) {
+	for _, disk := range VM.Template.GetDisks() {
+		if value, _ := disk.Get(marker); value == "YES" {
+			id, err := disk.ID()
+			return id, err == nil
+		}
+	}
+	return -1, false
+}
+
+// Returns ID of the rescue disk if VM is in rescue mode
+func RescueDiskID(VM *vm.VM) (int, bool) {
+	return markedDiskID(VM, driver_shared.NOCLOUD_RESCUE)
+}
+
+// Returns copy of the VM OS section with BOOT order changed by the given func
+func bootWith(VM *vm.VM, change func(boot []string) []string) *dynamic.Vector {
+	os := dynamic.NewVector("OS")
+	var boot []string
+	if current, err := VM.Template.GetVector("OS"); err == nil {
+		for _, pair := range current.Pairs {
+			if pair.Key() == "BOOT" {
+				if pair.Value != "" {
+					boot = strings.Split(pair.Value, ",")
+				}
+				continue
+			}
+			os.AddPair(pair.Key(), pair.Value)
+		}
+	}
+	if boot = change(boot); len(boot) > 0 {
+		os.AddPair("BOOT", strings.Join(boot, ","))
+	}
+	return os
+}
+
+// Powers off VM if it's not yet, hard since VM in trouble may ignore ACPI
+func (c *ONeClient) ensurePoweroff(vmid int) error {
+	state, _, _, _, err := c.StateVM(vmid)
+	if err != nil {
+		return err
+	}
+	if state == int(vm.Poweroff) {
+		return nil
+	}
+	if err := c.PoweroffVM(vmid, true); err != nil {
+		return err
+	}
+	return c.WaitForPoweroff(vmid)
+}
+
+// Attaches Image marked with the given key to the VM, which must be powered off. Disk is put first to boot if asked,
+// context keys are set as well(see contextWith). Returns ID of the attached disk
+func (c *ONeClient) attachMarkedImage(vmid, imageID int, marker shared.DiskKeys, boot bool, context map[string]string) (int, error) {
+	tmpl := vm.NewTemplate()
+	disk := tmpl.AddDisk()
+	disk.Add(shared.ImageID, imageID)
+	disk.Add(marker, "YES")
+	if err := c.ctrl.VM(vmid).DiskAttach(tmpl.String()); err != nil {
+		return -1, err
+	}
+	if err := c.WaitForPoweroff(vmid); err != nil {
+		return -1, err
+	}
+
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return -1, err
+	}
+	id, ok := markedDiskID(VM, marker)
+	if !ok {
+		return -1, fmt.Errorf("%s disk isn't attached", marker)
+	}
+
+	var vectors []*dynamic.Vector
+	if boot {
+		system := systemDiskID(VM)
+		vectors = append(vectors, bootWith(VM, func(boot []string) []string {
+			if len(boot) == 0 {
+				boot = []string{fmt.Sprintf("disk%d", system)}
+			}
+			return append([]string{fmt.Sprintf("disk%d", id)}, boot...)
+		}))
+	}
+	if context != nil {
+		vectors = append(vectors, contextWith(VM, context))
+	}
+	if len(vectors) > 0 {
+		if err := c.updateConf(vmid, vectors...); err != nil {
+			return id, err
+		}
+	}
+	return id, nil
+}
+
+// Detaches disk from the VM, which must be powered off, and removes it from boot order.
+// Context keys are set as well(see contextWith)
+func (c *ONeClient) detachBootDisk(VM *vm.VM, id int, context map[string]string) error {
+	vectors := []*dynamic.Vector{bootWith(VM, func(boot []string) []string {
+		return slices.DeleteFunc(boot, func(dev string) bool { return dev == fmt.Sprintf("disk%d", id) })
+	})}
+	if context != nil {
+		vectors = append(vectors, contextWith(VM, context))
+	}
+	if err := c.updateConf(VM.ID, vectors...); err != nil {
+		return err
+	}
+
+	if err := c.ctrl.VM(VM.ID).Disk(id).Detach(); err != nil {
+		return err
+	}
+	return c.WaitForPoweroff(VM.ID)
+}
+
+// Boots VM from the rescue_image Image with the given temporary password set in CONTEXT
+func (c *ONeClient) RescueEnter(vmid int, password string) error {
+	log := c.log.Named("RescueEnter").With(zap.Int("vmid", vmid))
+
+	image, err := GetVarValue(c.vars[RESCUE_IMAGE], "default")
+	if err != nil {
+		return fmt.Errorf("rescue image isn't set: %w", err)
+	}
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return err
+	}
+	if _, ok := RescueDiskID(VM); ok {
+		return errors.New("VM is already in rescue mode")
+	}
+
+	if err := c.ensurePoweroff(vmid); err != nil {
+		return err
+	}
+	id, err := c.attachMarkedImage(vmid, int(image.GetNumberValue()), driver_shared.NOCLOUD_RESCUE, true, map[string]string{"PASSWORD": password})
+	if err != nil {
+		return err
+	}
+
+	log.Info("Booting into rescue mode", zap.Int("disk", id))
+	return c.ResumeVM(vmid)
+}
+
+// Boots VM back from its own disks: boot order and password are reverted and rescue disk is detached
+func (c *ONeClient) RescueExit(vmid int) error {
+	log := c.log.Named("RescueExit").With(zap.Int("vmid", vmid))
+
+	VM, err := c.GetVM(vmid)
+	if err != nil {
+		return err
+	}
+	id, ok := RescueDiskID(VM)
+	if !ok {
+		return errors.New("VM isn't in rescue mode")
+	}
+
+	if err := c.ensurePoweroff(vmid); err != nil {
+		return err
+	}
+	// Original password is kept in USER_TEMPLATE
+	password, _ := VM.UserTemplate.GetStr("PASSWORD")
+	if err := c.detachBootDisk(VM, id, map[string]string{"PASSWORD": password}); err != nil {
+		return err
+	}
+
+	log.Info("Leaving rescue mode", zap.Int("disk", id))
+	return c.ResumeVM(vmid)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestRescue(t *testing.T) {
+	c, _, ig := setup(t)
+	vmid := deploy(t, c, ig)
+	s := c.Server
+
+	if err := c.RescueEnter(vmid, "temp"); err == nil {
+		t.Fatal("Expected error without rescue image set")
+	}
+
+	image := c.AddImage("rescue", 1)
+	c.SetVars(vars(map[string]*sppb.Var{
+		one.RESCUE_IMAGE: {Value: map[string]*structpb.Value{"default": structpb.NewNumberValue(float64(image))}},
+	}))
+	if err := c.RescueEnter(vmid, "temp"); err != nil {
+		t.Fatalf("RescueEnter() => %v", err)
+	}
+
+	v, _ := c.GetVM(vmid)
+	id, ok := one.RescueDiskID(v)
+	if !ok {
+		t.Fatal("Rescue disk must be attached")
+	}
+	if boot, _ := v.Template.GetStrFromVec("OS", "BOOT"); !strings.HasPrefix(boot, fmt.Sprintf("disk%d,", id)) {
+		t.Fatalf("Rescue disk must boot first, got %q", boot)
+	}
+	if pass, _ := v.Template.GetStrFromVec("CONTEXT", "PASSWORD"); pass != "temp" {
+		t.Fatalf("Temporary password must be set, got %q", pass)
+	}
+	if _, err := v.Template.GetStrFromVec("CONTEXT", "NETWORK"); err != nil {
+		t.Fatal("The rest of CONTEXT must be kept")
+	}
+	actions := s.CallsTo("one.vm.action")
+	if len(actions) != 2 || actions[0].Args[0] != "poweroff-hard" || actions[1].Args[0] != "resume" {
+		t.Fatalf("Unexpected actions: %+v", actions)
+	}
+	if err := c.RescueEnter(vmid, "temp"); err == nil {
+		t.Fatal("Expected error entering rescue twice")
+	}
+
+	if err := c.RescueExit(vmid); err != nil {
+		t.Fatalf("RescueExit() => %v", err)
+	}
+	v, _ = c.GetVM(vmid)
+	if _, ok := one.RescueDiskID(v); ok {
+		t.Fatal("Rescue disk must be detached")
+	}
+	if boot, _ := v.Template.GetStrFromVec("OS", "BOOT"); strings.Contains(boot, fmt.Sprintf("disk%d", id)) {
+		t.Fatalf("Rescue disk must be removed from boot, got %q", boot)
+	}
+	original, _ := v.UserTemplate.GetStr("PASSWORD")
+	if pass, _ := v.Template.GetStrFromVec("CONTEXT", "PASSWORD"); pass != original {
+		t.Fatalf("Password must be reverted to %q, got %q", original, pass)
+	}
+	if err := c.RescueExit(vmid); err == nil {
+		t.Fatal("Expected error exiting rescue twice")
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Resize outcomes reported to Instance State Meta "updated" as resize_<outcome>
+const (
+	// Resized live, within VCPU_MAX/MEMORY_MAX
+	RESIZE_HOTPLUG = "hotplug"
+	// Resized while powered off
+	RESIZE_COLD = "cold"
+	// Postponed till the maintenance window
+	RESIZE_SCHEDULED = "scheduled"
+	// Resize attempt failed, it isn't retried until another resize is requested
+	RESIZE_FAILED = "failed"
+)
+
+// Instance data keys of the resize which isn't applied: {"cpu", "ram", "window"} postponed till the maintenance window
+// and {"cpu", "ram", "error"} failed one. Instances aren't updated for such resize until the window or other resources are requested
+const (
+	DATA_SCHEDULED_RESIZE = "scheduled_resize"
+	DATA_FAILED_RESIZE    = "failed_resize"
+)
+
+var (
+	// Maximum time to wait for VM to reach the expected state
+	StateWaitTimeout = 5 * time.Minute
+	// Interval between VM state checks
+	StateWaitInterval = time.Second
+
+	clock utils.IClock = &utils.Clock{}
+)
+
+// Polls VM state until cond is met, gives up after StateWaitTimeout
+func (c *ONeClient) waitForState(vmid int, cond func(state, lcm int) bool) error {
+	deadline := clock.Now().Add(StateWaitTimeout)
+	for {
+		state, _, lcm, _, err := c.StateVM(vmid)
+		if err == nil && cond(state, lcm) {
+			return nil
+		}
+		if clock.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("VM %d state isn't reached in %v: %w", vmid, StateWaitTimeout, err)
+			}
+			return fmt.Errorf("VM %d state isn't reached in %v, current state %d, lcm state %d", vmid, StateWaitTimeout, state, lcm)
+		}
+		time.Sleep(StateWaitInterval)
+	}
+}
+
+// Checks whether VM is able to take the given VCPU and MEMORY(0 if unchanged) without poweroff.
+// Both must fit into VCPU_MAX/MEMORY_MAX and hot add must be enabled in HOT_RESIZE
+func CanHotResize(VM *vm.VM, vcpu, memory int) bool {
+	hotAdd := func(key string) bool {
+		value, err := VM.Template.GetStrFromVec("HOT_RESIZE", key)
+		return err == nil && strings.EqualFold(value, "YES")
+	}
+	if vcpu > 0 {
+		max, err := VM.Template.GetInt("VCPU_MAX")
+		if err != nil || vcpu > max || !hotAdd("CPU_HOT_ADD_ENABLED") {
+			return false
+		}
+	}
+	if memory > 0 {
+		max, err := VM.Template.GetInt("MEMORY_MAX")
+		if err != nil || memory > max || !hotAdd("MEMORY_HOT_ADD_ENABLED") {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks whether now is within the maintenance window set as "HH:MM-HH:MM"(UTC) in the given var.
+// Window can wrap over midnight, no window means VM can be powered off any time
+func InMaintenanceWindow(window *sppb.Var, now time.Time) (bool, error) {
+	value, err := GetVarValue(window, "default")
+	if err != nil {
+		return true, nil
+	}
+	bounds := strings.Split(value.GetStringValue(), "-")
+	if len(bounds) != 2 {
+		return false, fmt.Errorf("maintenance window must be set as HH:MM-HH:MM, got %q", value.GetStringValue())
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return false, err
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(bounds[1]))
+	if err != nil {
+		return false, err
+	}
+
+	now = now.UTC()
+	minutes := now.Hour()*60 + now.Minute()
+	from, till := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	if from <= till {
+		return minutes >= from && minutes < till, nil
+	}
+	return minutes >= from || minutes < till, nil
+}
+
+// Sets VCPU and MEMORY(0 if unchanged) of the VM. Running VM is resized live if values fit into hotplug limits,
+// otherwise it's powered off within the maintenance window, resized and resumed back
+func (c *ONeClient) ResizeVM(VM *vm.VM, vcpu, memory int) (string, error) {
+	log := c.log.Named("ResizeVM").With(zap.Int("vmid", VM.ID), zap.Int("vcpu", vcpu), zap.Int("memory", memory))
+	vmc := c.ctrl.VM(VM.ID)
+
+	tmpl := vm.NewTemplate()
+	if vcpu > 0 {
+		tmpl.VCPU(vcpu)
+	}
+	if memory > 0 {
+		tmpl.Memory(memory)
+	}
+
+	// NICs and disks might be being hotplugged right before
+	if err := c.waitForHotplugFinish(VM.ID); err != nil {
+		return RESIZE_FAILED, err
+	}
+	_, _, lcmState, _, err := c.StateVM(VM.ID)
+	if err != nil {
+		return RESIZE_FAILED, err
+	}
+	running := lcmState == int(vm.Running)
+
+	if running && CanHotResize(VM, vcpu, memory) {
+		err = vmc.Resize(tmpl.String(), true)
+		if err == nil {
+			err = c.waitForHotplugFinish(VM.ID)
+			if err != nil {
+				return RESIZE_FAILED, err
+			}
+			return RESIZE_HOTPLUG, nil
+		}
+		log.Warn("Hotplug resize failed, falling back to poweroff", zap.Error(err))
+	}
+
+	if running {
+		ok, err := InMaintenanceWindow(c.vars[MAINTENANCE_WINDOW], clock.Now())
+		if err != nil {
+			return RESIZE_FAILED, err
+		}
+		if !ok {
+			log.Info("Resize is postponed till the maintenance window")
+			return RESIZE_SCHEDULED, nil
+		}
+
+		if err = c.PoweroffVM(VM.ID, false); err != nil {
+			return RESIZE_FAILED, err
+		}
+		if err = c.WaitForPoweroff(VM.ID); err != nil {
+			return RESIZE_FAILED, err
+		}
+	}
+
+	err = vmc.Resize(tmpl.String(), true)
+	if running {
+		if err := c.ResumeVM(VM.ID); err != nil {
+			log.Error("Error resuming VM after resize", zap.Error(err))
+		}
+	}
+	if err != nil {
+		return RESIZE_FAILED, err
+	}
+	return RESIZE_COLD, nil
+}
+
+// Tells whether resize recorded in Instance data under the key is the one Instance resources request
+func resizeRecorded(inst *pb.Instance, key string) bool {
+	record := inst.GetData()[key].GetStructValue().GetFields()
+	resources := inst.GetResources()
+	return record != nil &&
+		record["cpu"].GetNumberValue() == resources["cpu"].GetNumberValue() &&
+		record["ram"].GetNumberValue() == resources["ram"].GetNumberValue()
+}
+
+// Tells whether Instance CPU and RAM must be left as they are for now:
+// requested resize failed already or it's postponed and the maintenance window isn't there yet
+func (c *ONeClient) ResizePending(inst *pb.Instance) bool {
+	if resizeRecorded(inst, DATA_FAILED_RESIZE) {
+		return true
+	}
+	if !resizeRecorded(inst, DATA_SCHEDULED_RESIZE) {
+		return false
+	}
+	ok, err := InMaintenanceWindow(c.vars[MAINTENANCE_WINDOW], clock.Now())
+	return err == nil && !ok
+}
+
+// Records resize outcome in Instance data: scheduled and failed resizes are saved, applied one clears them.
+// Returns whether data has been changed, scheduled or failed resize is to be reported only then
+func (c *ONeClient) recordResize(inst *pb.Instance, outcome string, resizeErr error) bool {
+	if inst.Data == nil {
+		inst.Data = make(map[string]*structpb.Value)
+	}
+
+	var key string
+	record := map[string]interface{}{
+		"cpu": inst.GetResources()["cpu"].GetNumberValue(),
+		"ram": inst.GetResources()["ram"].GetNumberValue(),
+	}
+	switch outcome {
+	case RESIZE_SCHEDULED:
+		key = DATA_SCHEDULED_RESIZE
+		if window, err := GetVarValue(c.vars[MAINTENANCE_WINDOW], "default"); err == nil {
+			record["window"] = window.GetStringValue()
+		}
+	case RESIZE_FAILED:
+		key = DATA_FAILED_RESIZE
+		if resizeErr != nil {
+			record["error"] = resizeErr.Error()
+		}
+	default:
+		_, scheduled := inst.Data[DATA_SCHEDULED_RESIZE]
+		_, failed := inst.Data[DATA_FAILED_RESIZE]
+		delete(inst.Data, DATA_SCHEDULED_RESIZE)
+		delete(inst.Data, DATA_FAILED_RESIZE)
+		return scheduled || failed
+	}
+
+	if resizeRecorded(inst, key) {
+		return false
+	}
+	value, err := structpb.NewStruct(record)
+	if err != nil {
+		c.log.Error("Error Converting Resize record", zap.Error(err))
+		return false
+	}
+	delete(inst.Data, DATA_SCHEDULED_RESIZE)
+	delete(inst.Data, DATA_FAILED_RESIZE)
+	inst.Data[key] = structpb.NewStructValue(value)
+	return true
+}
@@ -0,0 +1,227 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"testing"
+	"time"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	"github.com/slntopp/nocloud-proto/hasher"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestResizeVM(t *testing.T) {
+	// Test clock is at 22:13 UTC
+	cases := []struct {
+		name     string
+		window   string
+		poweroff bool
+		vcpu     int
+		outcome  string
+		applied  bool
+	}{
+		{name: "hotplug", vcpu: 4, outcome: one.RESIZE_HOTPLUG, applied: true},
+		{name: "over VCPU_MAX without window", vcpu: 16, outcome: one.RESIZE_COLD, applied: true},
+		{name: "over VCPU_MAX within window", window: "22:00-23:00", vcpu: 16, outcome: one.RESIZE_COLD, applied: true},
+		{name: "over VCPU_MAX within window over midnight", window: "22:00-01:00", vcpu: 16, outcome: one.RESIZE_COLD, applied: true},
+		{name: "over VCPU_MAX out of window", window: "02:00-04:00", vcpu: 16, outcome: one.RESIZE_SCHEDULED},
+		{name: "powered off out of window", window: "02:00-04:00", poweroff: true, vcpu: 16, outcome: one.RESIZE_COLD, applied: true},
+		{name: "broken window", window: "2am", vcpu: 16, outcome: one.RESIZE_FAILED},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, clock, ig := setup(t)
+			one.SetClock(t, clock)
+			vmid := deploy(t, c, ig)
+			hotResizable(t, c, vmid)
+			if tc.window != "" {
+				c.SetVars(vars(map[string]*sppb.Var{one.MAINTENANCE_WINDOW: defaultVar(structpb.NewStringValue(tc.window))}))
+			}
+			if tc.poweroff {
+				if err := c.PoweroffVM(vmid, false); err != nil {
+					t.Fatalf("PoweroffVM() => %v", err)
+				}
+			}
+			_, _, lcmBefore, _, _ := c.StateVM(vmid)
+
+			v, _ := c.GetVM(vmid)
+			outcome, err := c.ResizeVM(v, tc.vcpu, 0)
+			if outcome != tc.outcome || (err != nil) != (tc.outcome == one.RESIZE_FAILED) {
+				t.Fatalf("ResizeVM() => %s, %v, want %s", outcome, err, tc.outcome)
+			}
+
+			res, _ := c.VMToInstance(vmid)
+			if applied := res.Resources["cpu"].GetNumberValue() == float64(tc.vcpu); applied != tc.applied {
+				t.Fatalf("Expected VCPU to be applied: %v, got %v", tc.applied, res.Resources["cpu"])
+			}
+			if tc.outcome == one.RESIZE_HOTPLUG && hasAction(c, vmid, "poweroff") {
+				t.Fatal("VM must not be powered off on hotplug resize")
+			}
+			if _, _, lcm, _, _ := c.StateVM(vmid); lcm != lcmBefore {
+				t.Fatalf("VM state must be kept, was %d, got %d", lcmBefore, lcm)
+			}
+		})
+	}
+}
+
+func TestResizeVMCalls(t *testing.T) {
+	c, _, ig := setup(t)
+	vmid := deploy(t, c, ig)
+	hotResizable(t, c, vmid)
+	s := c.Server
+
+	v, _ := c.GetVM(vmid)
+	outcome, err := c.ResizeVM(v, 4, 4096)
+	if err != nil || outcome != one.RESIZE_HOTPLUG {
+		t.Fatalf("ResizeVM() => %s, %v", outcome, err)
+	}
+	if calls := s.CallsTo("one.vm.action"); len(calls) != 0 {
+		t.Fatalf("VM must not be powered off on hotplug resize: %+v", calls)
+	}
+	s.Reset()
+
+	// Out of VCPU_MAX, there is no maintenance window, so VM is resized right away
+	v, _ = c.GetVM(vmid)
+	outcome, err = c.ResizeVM(v, 16, 0)
+	if err != nil || outcome != one.RESIZE_COLD {
+		t.Fatalf("ResizeVM() => %s, %v", outcome, err)
+	}
+	actions := s.CallsTo("one.vm.action")
+	if len(actions) != 2 || actions[0].Args[0] != "poweroff" || actions[1].Args[0] != "resume" {
+		t.Fatalf("Unexpected actions: %+v", actions)
+	}
+	if res, _ := c.VMToInstance(vmid); res.Resources["cpu"].GetNumberValue() != 16 || res.Resources["ram"].GetNumberValue() != 4096 {
+		t.Fatalf("Resize isn't applied: %v", res.Resources)
+	}
+
+	// Waits are bounded
+	timeout := one.StateWaitTimeout
+	one.StateWaitTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { one.StateWaitTimeout = timeout })
+	if err := c.WaitForPoweroff(vmid); err == nil {
+		t.Fatal("Expected timeout waiting for running VM to poweroff")
+	}
+}
+
+// Resize which can't be applied is recorded in Instance data and reported once, Instance isn't updated until the window
+func TestResizeRecorded(t *testing.T) {
+	cases := []struct {
+		name    string
+		window  string
+		key     string
+		outcome string
+	}{
+		{name: "scheduled", window: "02:00-04:00", key: one.DATA_SCHEDULED_RESIZE, outcome: "resize_" + one.RESIZE_SCHEDULED},
+		{name: "failed", window: "2am", key: one.DATA_FAILED_RESIZE, outcome: "resize_" + one.RESIZE_FAILED},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, clock, ig := setup(t)
+			one.SetClock(t, clock)
+			inst := ig.Instances[0]
+			vmid := deploy(t, c, ig)
+			hotResizable(t, c, vmid)
+			c.SetVars(vars(map[string]*sppb.Var{one.MAINTENANCE_WINDOW: defaultVar(structpb.NewStringValue(tc.window))}))
+
+			// Instance hash as Monitoring gets it from core, once 16 VCPU are requested
+			inst.Resources["cpu"] = structpb.NewNumberValue(16)
+			res, _ := c.VMToInstance(vmid)
+			res.Uuid, res.Title, res.BillingPlan, res.Data, res.State = "", inst.Title, inst.BillingPlan, nil, nil
+			res.Resources["cpu"] = inst.Resources["cpu"]
+			if err := hasher.SetHash(res.ProtoReflect()); err != nil {
+				t.Fatalf("SetHash() => %v", err)
+			}
+			inst.Hash = res.Hash
+
+			check := func() *one.CheckInstancesGroupResponse {
+				t.Helper()
+				resp, err := c.CheckInstancesGroup(ig)
+				if err != nil {
+					t.Fatalf("CheckInstancesGroup() => %v", err)
+				}
+				return resp
+			}
+			process := func(resp *one.CheckInstancesGroupResponse) []interface{} {
+				t.Helper()
+				inst.State = nil
+				c.CheckInstancesGroupResponseProcess(resp, ig, fake.USERS_GROUP, nil)
+				return inst.GetState().GetMeta()["updated"].GetListValue().AsSlice()
+			}
+
+			resp := check()
+			if len(resp.ToBeUpdated) != 1 {
+				t.Fatalf("Expected Instance to be updated, got %+v", resp)
+			}
+			if updated := process(resp); len(updated) != 1 || updated[0] != tc.outcome {
+				t.Fatalf("Expected %s to be reported, got %v", tc.outcome, updated)
+			}
+			record := inst.Data[tc.key].GetStructValue().GetFields()
+			if record["cpu"].GetNumberValue() != 16 || record["ram"].GetNumberValue() != 2048 {
+				t.Fatalf("Expected resize to be recorded in %s, got %v", tc.key, inst.Data)
+			}
+
+			// Nothing is done on the next passes
+			for i := 0; i < 2; i++ {
+				if resp := check(); len(resp.ToBeUpdated) != 0 || len(resp.Valid) != 1 {
+					t.Fatalf("Recorded resize mustn't be an update, got %+v", resp)
+				}
+			}
+			c.Server.Reset()
+			if updated := process(&one.CheckInstancesGroupResponse{ToBeUpdated: []*pb.Instance{inst}}); len(updated) != 0 {
+				t.Fatalf("Recorded resize must be reported once, got %v", updated)
+			}
+			if calls := c.Server.CallsTo("one.vm.resize"); len(calls) != 0 {
+				t.Fatalf("Recorded resize mustn't be retried: %+v", calls)
+			}
+		})
+	}
+}
+
+func TestScheduledResizeApplied(t *testing.T) {
+	c, clock, ig := setup(t)
+	one.SetClock(t, clock)
+	inst := ig.Instances[0]
+	vmid := deploy(t, c, ig)
+	hotResizable(t, c, vmid)
+	// Test clock is at 22:13 UTC
+	c.SetVars(vars(map[string]*sppb.Var{one.MAINTENANCE_WINDOW: defaultVar(structpb.NewStringValue("23:00-01:00"))}))
+
+	inst.Resources["cpu"] = structpb.NewNumberValue(16)
+	update := &one.CheckInstancesGroupResponse{ToBeUpdated: []*pb.Instance{inst}}
+	c.CheckInstancesGroupResponseProcess(update, ig, fake.USERS_GROUP, nil)
+	if _, ok := inst.Data[one.DATA_SCHEDULED_RESIZE]; !ok || !c.ResizePending(inst) {
+		t.Fatalf("Expected resize to be scheduled, got %v", inst.Data)
+	}
+
+	clock.Add(time.Hour)
+	if c.ResizePending(inst) {
+		t.Fatal("Scheduled resize must be applied within the window")
+	}
+	c.CheckInstancesGroupResponseProcess(update, ig, fake.USERS_GROUP, nil)
+	if updated := inst.State.Meta["updated"].GetListValue().AsSlice(); len(updated) != 2 || updated[1] != "resize_"+one.RESIZE_COLD {
+		t.Fatalf("Expected cold resize, got %v", updated)
+	}
+	if _, ok := inst.Data[one.DATA_SCHEDULED_RESIZE]; ok {
+		t.Fatal("Applied resize must be removed from data")
+	}
+	if res, _ := c.VMToInstance(vmid); res.Resources["cpu"].GetNumberValue() != 16 {
+		t.Fatalf("Resize isn't applied: %v", res.Resources)
+	}
+}
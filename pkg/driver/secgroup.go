@@ -0,0 +1,317 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/parameters"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/securitygroup"
+	sgkeys "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/securitygroup/keys"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Security group is made per Instances Group, since firewall is set in its config, and owned by its ONe User
+var IG_SECURITY_GROUP_NAME_PATTERN = "ig-%s-secgroup"
+
+var (
+	FIREWALL_PROTOCOLS  = []string{"TCP", "UDP", "ICMP", "ICMPV6", "IPSEC", "ALL"}
+	FIREWALL_DIRECTIONS = []string{"inbound", "outbound"}
+)
+
+var portRangeRe = regexp.MustCompile(`^\d{1,5}(:\d{1,5})?(,\d{1,5}(:\d{1,5})?)*$`)
+
+// FirewallRule is a single rule of the Instances Group security group, as it's given in the Instances Group config
+type FirewallRule struct {
+	Protocol  string `json:"protocol"`
+	PortRange string `json:"port_range,omitempty"` // e.g. 22 or 8000:8080,8443, TCP and UDP only
+	CIDR      string `json:"cidr,omitempty"`       // any address if empty
+	Size      int    `json:"size,omitempty"`       // set with plain IP in CIDR, when range isn't a network
+	Direction string `json:"direction"`            // inbound or outbound
+}
+
+// Normalize validates the rule and returns it in canonical form, protocol upper-cased and CIDR as network address
+func (r FirewallRule) Normalize() (FirewallRule, error) {
+	r.Protocol = strings.ToUpper(r.Protocol)
+	if !slices.Contains(FIREWALL_PROTOCOLS, r.Protocol) {
+		return r, fmt.Errorf("protocol must be one of %v, got %q", FIREWALL_PROTOCOLS, r.Protocol)
+	}
+
+	r.Direction = strings.ToLower(r.Direction)
+	if r.Direction == "" {
+		r.Direction = "inbound"
+	}
+	if !slices.Contains(FIREWALL_DIRECTIONS, r.Direction) {
+		return r, fmt.Errorf("direction must be one of %v, got %q", FIREWALL_DIRECTIONS, r.Direction)
+	}
+
+	r.PortRange = strings.ReplaceAll(r.PortRange, " ", "")
+	if r.PortRange != "" {
+		if r.Protocol != "TCP" && r.Protocol != "UDP" {
+			return r, fmt.Errorf("port range is supported for TCP and UDP only")
+		}
+		if !portRangeRe.MatchString(r.PortRange) {
+			return r, fmt.Errorf("invalid port range %q", r.PortRange)
+		}
+	}
+
+	if r.CIDR == "" {
+		return r, nil
+	}
+	if r.Size > 0 {
+		if net.ParseIP(r.CIDR) == nil {
+			return r, fmt.Errorf("%q is not an IP address", r.CIDR)
+		}
+		return r, nil
+	}
+	_, ipnet, err := net.ParseCIDR(r.CIDR)
+	if err != nil {
+		if ip := net.ParseIP(r.CIDR); ip != nil {
+			addrBits := 128
+			if ip.To4() != nil {
+				ip, addrBits = ip.To4(), 32
+			}
+			r.CIDR = (&net.IPNet{IP: ip, Mask: net.CIDRMask(addrBits, addrBits)}).String()
+			return r, nil
+		}
+		return r, fmt.Errorf("%q is neither CIDR nor IP address", r.CIDR)
+	}
+	ones, size := ipnet.Mask.Size()
+	if ones == 0 {
+		r.CIDR = ""
+		return r, nil
+	}
+	// ONe rules keep addresses as first IP and SIZE, so wider IPv6 networks don't fit
+	if size-ones > 31 {
+		return r, fmt.Errorf("network %s is too wide, /%d is the widest supported", r.CIDR, size-31)
+	}
+	r.CIDR = ipnet.String()
+	return r, nil
+}
+
+// Appends ONe RULE vector of the rule to the security group template, rule must be normalized
+func (r FirewallRule) addTo(t *securitygroup.Template) {
+	rule := t.AddRule()
+	rule.Add(sgkeys.Protocol, r.Protocol)
+	rule.Add(sgkeys.RuleType, r.Direction)
+	if r.PortRange != "" {
+		rule.Add(sgkeys.Range, r.PortRange)
+	}
+	if r.CIDR == "" {
+		return
+	}
+	if r.Size > 0 {
+		rule.Add(sgkeys.IP, r.CIDR)
+		rule.Add(sgkeys.Size, r.Size)
+		return
+	}
+	ip, ipnet, _ := net.ParseCIDR(r.CIDR)
+	ones, size := ipnet.Mask.Size()
+	rule.Add(sgkeys.IP, ip.Mask(ipnet.Mask).String())
+	rule.Add(sgkeys.Size, 1<<(size-ones))
+}
+
+// Reads rules from the list value, like firewall key of the Instances Group config
+func FirewallRulesFromValue(v *structpb.Value) ([]FirewallRule, error) {
+	list := v.GetListValue()
+	if list == nil {
+		return nil, errors.New("firewall rules must be a list")
+	}
+
+	str := func(fields map[string]*structpb.Value, key string) string {
+		if n, ok := fields[key].GetKind().(*structpb.Value_NumberValue); ok {
+			return fmt.Sprint(n.NumberValue)
+		}
+		return fields[key].GetStringValue()
+	}
+
+	rules := make([]FirewallRule, 0, len(list.GetValues()))
+	for i, val := range list.GetValues() {
+		fields := val.GetStructValue().GetFields()
+		if fields == nil {
+			return nil, fmt.Errorf("rule %d must be an object", i)
+		}
+		rule, err := FirewallRule{
+			Protocol:  str(fields, "protocol"),
+			PortRange: str(fields, "port_range"),
+			CIDR:      str(fields, "cidr"),
+			Size:      int(fields["size"].GetNumberValue()),
+			Direction: str(fields, "direction"),
+		}.Normalize()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Converts rules to the list value, e.g. for the action response
+func FirewallRulesValue(rules []FirewallRule) *structpb.Value {
+	values := make([]*structpb.Value, 0, len(rules))
+	for _, r := range rules {
+		fields := map[string]*structpb.Value{
+			"protocol":  structpb.NewStringValue(r.Protocol),
+			"direction": structpb.NewStringValue(r.Direction),
+		}
+		if r.PortRange != "" {
+			fields["port_range"] = structpb.NewStringValue(r.PortRange)
+		}
+		if r.CIDR != "" {
+			fields["cidr"] = structpb.NewStringValue(r.CIDR)
+		}
+		if r.Size > 0 {
+			fields["size"] = structpb.NewNumberValue(float64(r.Size))
+		}
+		values = append(values, structpb.NewStructValue(&structpb.Struct{Fields: fields}))
+	}
+	return structpb.NewListValue(&structpb.ListValue{Values: values})
+}
+
+// Makes security group template with the rules, they must be normalized
+func FirewallTemplate(rules []FirewallRule) *securitygroup.Template {
+	t := securitygroup.NewTemplate()
+	for _, r := range rules {
+		r.addTo(t)
+	}
+	return t
+}
+
+// Reads rules of the security group, IP and SIZE are turned into CIDR when they make up a network
+func FirewallRulesFromSG(sg *securitygroup.SecurityGroup) []FirewallRule {
+	rules := make([]FirewallRule, 0)
+	for _, rule := range sg.Template.GetVectors(string(sgkeys.RuleVec)) {
+		r := FirewallRule{}
+		r.Protocol, _ = rule.GetStr(string(sgkeys.Protocol))
+		r.Direction, _ = rule.GetStr(string(sgkeys.RuleType))
+		r.PortRange, _ = rule.GetStr(string(sgkeys.Range))
+
+		ip, _ := rule.GetStr(string(sgkeys.IP))
+		size, _ := rule.GetInt(string(sgkeys.Size))
+		if parsed := net.ParseIP(ip); parsed != nil && size > 0 {
+			r.CIDR, r.Size = ip, size
+			addrBits := 128
+			if parsed.To4() != nil {
+				parsed, addrBits = parsed.To4(), 32
+			}
+			hostBits := bits.Len(uint(size)) - 1
+			mask := net.CIDRMask(addrBits-hostBits, addrBits)
+			if size == 1<<hostBits && parsed.Mask(mask).Equal(parsed) {
+				r.CIDR, r.Size = (&net.IPNet{IP: parsed, Mask: mask}).String(), 0
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// Adds the Instances Group security group to the NIC, if it's set in the Instances Group data
+func AddSecurityGroup(nic *shared.NIC, data map[string]*structpb.Value) {
+	if sg, ok := data["security_group"]; ok {
+		nic.Add(shared.SecurityGroups, int(sg.GetNumberValue()))
+	}
+}
+
+// Returns security groups referenced by VM NICs, without duplicates
+func VMSecurityGroups(VM *vm.VM) []int {
+	var ids []int
+	for _, nic := range VM.Template.GetNICs() {
+		groups, err := nic.GetStr(string(shared.SecurityGroups))
+		if err != nil {
+			continue
+		}
+		for _, group := range strings.Split(groups, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(group))
+			if err == nil && !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// Adds security groups of the VM to the NIC, for callers without Instances Group data
+func addVMSecurityGroups(nic *shared.NIC, VM *vm.VM) {
+	groups := VMSecurityGroups(VM)
+	if len(groups) == 0 {
+		return
+	}
+	ids := make([]string, len(groups))
+	for i, id := range groups {
+		ids[i] = strconv.Itoa(id)
+	}
+	nic.Add(shared.SecurityGroups, strings.Join(ids, ","))
+}
+
+func (c *ONeClient) GetIGSecurityGroup(ig string, user int) (int, error) {
+	sgc := c.ctrl.SecurityGroups()
+	return sgc.ByName(fmt.Sprintf(IG_SECURITY_GROUP_NAME_PATTERN, ig), user)
+}
+
+// Returns the Instances Group security group the VM NICs reference, that's the one owned by the VM owner
+func (c *ONeClient) GetVMSecurityGroup(VM *vm.VM) (int, error) {
+	for _, id := range VMSecurityGroups(VM) {
+		sg, err := c.GetSecurityGroup(id)
+		if err == nil && sg.UID == VM.UID {
+			return id, nil
+		}
+	}
+	return -1, fmt.Errorf("VM %d NICs don't reference any security group of user %d", VM.ID, VM.UID)
+}
+
+func (c *ONeClient) GetSecurityGroup(id int) (*securitygroup.SecurityGroup, error) {
+	return c.ctrl.SecurityGroup(id).Info(false)
+}
+
+// Creates the Instances Group security group with the rules, owned by the given User
+func (c *ONeClient) CreateIGSecurityGroup(ig string, user int, rules []FirewallRule) (int, error) {
+	t := FirewallTemplate(rules)
+	t.Add(sgkeys.Name, fmt.Sprintf(IG_SECURITY_GROUP_NAME_PATTERN, ig))
+	id, err := c.ctrl.SecurityGroups().Create(t.String())
+	if err != nil {
+		return -1, err
+	}
+	if err := c.Chown("secgroup", id, user, int(c.secrets["group"].GetNumberValue())); err != nil {
+		return id, err
+	}
+	return id, c.Chmod("secgroup", id, &shared.Permissions{
+		OwnerU: 1, OwnerM: 1, OwnerA: 0,
+		GroupU: 0, GroupM: 0, GroupA: 0,
+		OtherU: 0, OtherM: 0, OtherA: 0,
+	})
+}
+
+// Replaces rules of the security group, ONe updates rules of the VMs using the group on its own
+func (c *ONeClient) SetFirewallRules(id int, rules []FirewallRule) error {
+	return c.ctrl.SecurityGroup(id).Update(FirewallTemplate(rules).String(), parameters.Replace)
+}
+
+func (c *ONeClient) GetFirewallRules(id int) ([]FirewallRule, error) {
+	sg, err := c.GetSecurityGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	return FirewallRulesFromSG(sg), nil
+}
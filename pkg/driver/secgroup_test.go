@@ -0,0 +1,122 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestFirewall(t *testing.T) {
+	c, _, ig := setup(t)
+	uid := int(ig.Data["userid"].GetNumberValue())
+
+	if id, err := c.GetIGSecurityGroup(ig.Uuid, uid); err == nil {
+		t.Fatalf("Expected error without security group, got %d", id)
+	}
+
+	rules, err := one.FirewallRulesFromValue(structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{
+		structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+			"protocol": structpb.NewStringValue("tcp"), "port_range": structpb.NewNumberValue(22),
+			"cidr": structpb.NewStringValue("198.51.100.7/24"),
+		}}),
+		structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+			"protocol": structpb.NewStringValue("all"), "direction": structpb.NewStringValue("outbound"),
+		}}),
+	}}))
+	if err != nil {
+		t.Fatalf("FirewallRulesFromValue() => %v", err)
+	}
+	expected := []one.FirewallRule{
+		{Protocol: "TCP", PortRange: "22", CIDR: "198.51.100.0/24", Direction: "inbound"},
+		{Protocol: "ALL", Direction: "outbound"},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("Unexpected normalized rules: %+v", rules)
+	}
+
+	sgID, err := c.CreateIGSecurityGroup(ig.Uuid, uid, rules)
+	if err != nil {
+		t.Fatalf("CreateIGSecurityGroup() => %v", err)
+	}
+	sg, _ := c.GetSecurityGroup(sgID)
+	if sg.UID != uid || sg.Name != fmt.Sprintf(one.IG_SECURITY_GROUP_NAME_PATTERN, ig.Uuid) {
+		t.Fatalf("Security group must be named by the IG and owned by its User: %+v", sg)
+	}
+	if id, err := c.GetIGSecurityGroup(ig.Uuid, uid); err != nil || id != sgID {
+		t.Fatalf("GetIGSecurityGroup() => %d, %v", id, err)
+	}
+	if got, err := c.GetFirewallRules(sgID); err != nil || !reflect.DeepEqual(got, expected) {
+		t.Fatalf("GetFirewallRules() => %+v, %v", got, err)
+	}
+
+	if err := c.SetFirewallRules(sgID, expected[1:]); err != nil {
+		t.Fatalf("SetFirewallRules() => %v", err)
+	}
+	if got, _ := c.GetFirewallRules(sgID); !reflect.DeepEqual(got, expected[1:]) {
+		t.Fatalf("Unexpected rules after update: %+v", got)
+	}
+
+	// Another IG of the same User gets its own group
+	other, err := c.CreateIGSecurityGroup("other-ig-uuid", uid, rules)
+	if err != nil || other == sgID {
+		t.Fatalf("CreateIGSecurityGroup() => %d, %v", other, err)
+	}
+	if got, _ := c.GetFirewallRules(sgID); !reflect.DeepEqual(got, expected[1:]) {
+		t.Fatalf("Rules of the other IG group must be kept: %+v", got)
+	}
+
+	ig.Data["security_group"] = structpb.NewNumberValue(float64(sgID))
+	vmid, err := c.InstantiateTemplateHelper(ig.Instances[0], ig, "token")
+	if err != nil {
+		t.Fatalf("InstantiateTemplateHelper() => %v", err)
+	}
+	v, _ := c.GetVM(vmid)
+	if len(v.Template.GetNICs()) == 0 {
+		t.Fatal("Expected VM to have NICs")
+	}
+	for _, nic := range v.Template.GetNICs() {
+		if groups, _ := nic.GetStr("SECURITY_GROUPS"); groups != strconv.Itoa(sgID) {
+			t.Fatalf("NIC must reference the security group: %s", nic.String())
+		}
+	}
+	// Group is found by VM owner once VM is given to the IG User
+	if err := c.Chown("vm", vmid, uid, fake.USERS_GROUP); err != nil {
+		t.Fatalf("Chown() => %v", err)
+	}
+	v, _ = c.GetVM(vmid)
+	if id, err := c.GetVMSecurityGroup(v); err != nil || id != sgID {
+		t.Fatalf("GetVMSecurityGroup() => %d, %v", id, err)
+	}
+
+	for _, bad := range []one.FirewallRule{
+		{Protocol: "SCTP"},
+		{Protocol: "ICMP", PortRange: "22"},
+		{Protocol: "TCP", PortRange: "22-80"},
+		{Protocol: "TCP", Direction: "sideways"},
+		{Protocol: "TCP", CIDR: "2001:db8::/64"},
+	} {
+		if _, err := bad.Normalize(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", bad)
+		}
+	}
+}
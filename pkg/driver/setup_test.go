@@ -0,0 +1,169 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"maps"
+	"strconv"
+	"testing"
+	"time"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	pb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type TestClock struct {
+	time time.Time
+}
+
+func (c *TestClock) Now() time.Time { return c.time }
+
+func (c *TestClock) Add(d time.Duration) { c.time = c.time.Add(d) }
+
+func defaultVar(v *structpb.Value) *sppb.Var {
+	return &sppb.Var{Value: map[string]*structpb.Value{"default": v}}
+}
+
+// SP vars set by setup with the extra ones on top, super VNet is always the first one
+func vars(extra map[string]*sppb.Var) map[string]*sppb.Var {
+	res := map[string]*sppb.Var{
+		one.SCHED:          defaultVar(structpb.NewStringValue("ID=\"0\"")),
+		one.SCHED_DS:       defaultVar(structpb.NewStringValue("ID=\"100\"")),
+		one.PUBLIC_IP_POOL: defaultVar(structpb.NewNumberValue(0)),
+	}
+	maps.Copy(res, extra)
+	return res
+}
+
+// Prepares fake ONe with single Template and super VNet, like SP configured for the driver, and IG User with public VNet.
+// Calls made meanwhile are forgotten
+func setup(t *testing.T) (*fake.Client, *TestClock, *pb.InstancesGroup) {
+	t.Helper()
+
+	interval := one.StateWaitInterval
+	one.StateWaitInterval = 10 * time.Millisecond
+	t.Cleanup(func() { one.StateWaitInterval = interval })
+
+	clock := &TestClock{time: time.Unix(1700000000, 0)}
+	c := fake.NewClient(zap.NewNop())
+	c.Clock = clock
+
+	img := c.AddImage("ubuntu", 2048)
+	tmplID, err := c.AddTemplate("ubuntu", `DESCRIPTION="Ubuntu 22.04"
+DISK=[
+    IMAGE_ID="`+strconv.Itoa(img)+`",
+    SIZE="2048" ]
+CONTEXT=[
+    NETWORK="YES" ]`)
+	if err != nil {
+		t.Fatalf("AddTemplate() => %v", err)
+	}
+	if _, err := c.AddVNet("public", "bridge", "192.0.2.1", 16); err != nil {
+		t.Fatalf("AddVNet() => %v", err)
+	}
+
+	c.SetSecrets(map[string]*structpb.Value{"group": structpb.NewNumberValue(fake.USERS_GROUP)})
+	c.SetVars(vars(nil))
+
+	uid, err := c.CreateUser("ig-uuid", "pass", []int{fake.USERS_GROUP})
+	if err != nil {
+		t.Fatalf("CreateUser() => %v", err)
+	}
+	public_vn, err := c.ReservePublicIP(uid, 1)
+	if err != nil {
+		t.Fatalf("ReservePublicIP() => %v", err)
+	}
+
+	ig := &pb.InstancesGroup{
+		Uuid: "ig-uuid",
+		Data: map[string]*structpb.Value{
+			"userid":    structpb.NewNumberValue(float64(uid)),
+			"public_vn": structpb.NewNumberValue(float64(public_vn)),
+		},
+		Instances: []*pb.Instance{{
+			Uuid:  "inst-uuid",
+			Title: "instance",
+			Config: map[string]*structpb.Value{
+				"template_id": structpb.NewNumberValue(float64(tmplID)),
+				"password":    structpb.NewStringValue("secret"),
+				"auto_start":  structpb.NewBoolValue(true),
+			},
+			Resources: map[string]*structpb.Value{
+				"cpu":         structpb.NewNumberValue(2),
+				"ram":         structpb.NewNumberValue(2048),
+				"drive_size":  structpb.NewNumberValue(20480),
+				"drive_type":  structpb.NewStringValue("SSD"),
+				"ips_public":  structpb.NewNumberValue(1),
+				"ips_private": structpb.NewNumberValue(0),
+			},
+			Data: map[string]*structpb.Value{},
+		}},
+	}
+
+	c.Server.Reset()
+	return c, clock, ig
+}
+
+// Deploys the first IG Instance the way Monitoring does, calls made meanwhile are forgotten
+func deploy(t *testing.T, c *fake.Client, ig *pb.InstancesGroup) int {
+	t.Helper()
+
+	resp, err := c.CheckInstancesGroup(ig)
+	if err != nil {
+		t.Fatalf("CheckInstancesGroup() => %v", err)
+	}
+	if len(resp.ToBeCreated) != 1 {
+		t.Fatalf("Expected instance to be created, got %+v", resp)
+	}
+	created := c.CheckInstancesGroupResponseProcess(resp, ig, fake.USERS_GROUP, nil)
+	if len(created.ToBeCreated) != 1 {
+		t.Fatalf("Instance wasn't deployed")
+	}
+
+	vmid, err := one.GetVMIDFromData(c, ig.Instances[0])
+	if err != nil {
+		t.Fatalf("GetVMIDFromData() => %v", err)
+	}
+	c.Server.Reset()
+	return vmid
+}
+
+// Enables live resize for the VM up to 8 VCPU and 8G RAM
+func hotResizable(t *testing.T, c *fake.Client, vmid int) {
+	t.Helper()
+
+	err := c.MergeVMTemplate(vmid, `VCPU_MAX="8"
+MEMORY_MAX="8192"
+HOT_RESIZE=[
+    CPU_HOT_ADD_ENABLED="YES",
+    MEMORY_HOT_ADD_ENABLED="YES" ]`)
+	if err != nil {
+		t.Fatalf("MergeVMTemplate() => %v", err)
+	}
+}
+
+func hasAction(c *fake.Client, vmid int, action string) bool {
+	for _, a := range c.Actions(vmid) {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
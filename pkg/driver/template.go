@@ -45,10 +45,30 @@ func (c *ONeClient) ListTemplates() ([]tmpl.Template, error) {
 }
 
 func (c *ONeClient) InstantiateTemplateHelper(instance *pb.Instance, ig *pb.InstancesGroup, token string) (vmid int, err error) {
+	template_id, tmpl, data, err := c.vmTemplateFromInstance(instance, ig, token, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	tmpl_string := tmpl.String()
+	c.log.Debug("Resulting Template", zap.String("template", tmpl_string))
+	vmid, err = c.InstantiateTemplate(template_id, data[DATA_VM_NAME].GetStringValue(), tmpl_string, false)
+	if err != nil {
+		return -1, err
+	}
+	data[DATA_VM_ID] = structpb.NewNumberValue(float64(vmid))
+
+	instance.Data = data
+	return vmid, nil
+}
+
+// Makes VM template out of Instance config and resources along with Instance data to be set once VM is created.
+// NICs are made either by ips_public/ips_private of the IG networks or, if given, from leases
+func (c *ONeClient) vmTemplateFromInstance(instance *pb.Instance, ig *pb.InstancesGroup, token string, leases []NICLease) (template_id int, tmpl *vm.Template, data map[string]*structpb.Value, err error) {
 	group_data := ig.GetData()
 	resources := instance.GetResources()
-	tmpl := vm.NewTemplate()
-	data := make(map[string]*structpb.Value)
+	tmpl = vm.NewTemplate()
+	data = make(map[string]*structpb.Value)
 	conf := instance.GetConfig()
 	bp := instance.GetBillingPlan()
 
@@ -74,19 +94,21 @@ func (c *ONeClient) InstantiateTemplateHelper(instance *pb.Instance, ig *pb.Inst
 		tmpl.AddCtx(keys.SSHPubKey, ssh_key)
 	}
 
-	var template_id int
 	if conf["template_id"] != nil {
 		template_id = int(conf["template_id"].GetNumberValue())
 	} else {
-		return 0, errors.New("template ID isn't given")
+		return 0, nil, nil, errors.New("template ID isn't given")
 	}
 	vm_tmpl, err := c.GetTemplate(template_id)
 	if err != nil {
-		return 0, err
+		return 0, nil, nil, err
 	}
 
 	if pair, err := vm_tmpl.Template.GetPair("NOCLOUD_ENABLED"); err == nil && pair.Value == "FALSE" {
-		return -1, errors.New("cannot instantiate VM for template disabled by Nocloud")
+		return 0, nil, nil, errors.New("cannot instantiate VM for template disabled by Nocloud")
+	}
+	if IsPrivateTemplate(vm_tmpl) && vm_tmpl.UID != int(group_data["userid"].GetNumberValue()) {
+		return 0, nil, nil, errors.New("cannot instantiate VM for private template of other user")
 	}
 
 	if pair, err := vm_tmpl.Template.GetPair("LOGO"); err == nil {
@@ -107,13 +129,13 @@ func (c *ONeClient) InstantiateTemplateHelper(instance *pb.Instance, ig *pb.Inst
 
 	// Set CPU, must be provided by instance resources config
 	if resources["cpu"] == nil {
-		return 0, errors.New("amount of CPU is not given")
+		return 0, nil, nil, errors.New("amount of CPU is not given")
 	}
 	tmpl.VCPU(int(resources["cpu"].GetNumberValue()))
 
 	// Set RAM, must be provided by instance resources config
 	if resources["ram"] == nil {
-		return 0, errors.New("amount of RAM is not given")
+		return 0, nil, nil, errors.New("amount of RAM is not given")
 	}
 	tmpl.Memory(int(resources["ram"].GetNumberValue()))
 
@@ -138,13 +160,20 @@ func (c *ONeClient) InstantiateTemplateHelper(instance *pb.Instance, ig *pb.Inst
 		}
 	}
 
+	// Additional data volumes
+	for _, disk := range DataDisksFromResources(resources) {
+		if err := c.AddDataDisk(tmpl, disk); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+
 	key := "default"
 	if isHighCPU {
 		key = "HCPU"
 	}
 	sched, err := GetVarValue(c.vars[SCHED], key)
 	if err != nil {
-		return -1, err
+		return 0, nil, nil, err
 	}
 	req := sched.GetStringValue()
 	//req = strings.ReplaceAll(req, "\"", "\\\"")
@@ -156,9 +185,10 @@ func (c *ONeClient) InstantiateTemplateHelper(instance *pb.Instance, ig *pb.Inst
 	if resources["drive_type"] != nil {
 		ds_type = resources["drive_type"].GetStringValue()
 	}
+	// Data disks are placed to their Datastores separately, so the System one is chosen by the system drive type
 	sched_ds, err := GetVarValue(c.vars[SCHED_DS], ds_type)
 	if err != nil {
-		return -1, err
+		return 0, nil, nil, err
 	}
 	// Getting Datastores scheduler requirements
 	ds_req := sched_ds.GetStringValue()
@@ -166,33 +196,63 @@ func (c *ONeClient) InstantiateTemplateHelper(instance *pb.Instance, ig *pb.Inst
 	// Setting Datastore(s) to deploy Instance to
 	tmpl.Placement(keys.SchedDSRequirements, ds_req)
 
-	public_vn := int(group_data["public_vn"].GetNumberValue())
-	for i := 0; i < int(resources["ips_public"].GetNumberValue()); i++ {
-		nic := tmpl.AddNIC()
-		nic.Add(shared.NetworkID, public_vn)
-	}
+	limits := InstanceBandwidthLimits(instance)
+	nics := len(leases)
+	if leases != nil {
+		for _, lease := range leases {
+			nic := tmpl.AddNIC()
+			nic.Add(shared.NetworkID, lease.NetworkID)
+			AddSecurityGroup(nic, group_data)
+			AddBandwidthLimits(nic, limits)
+			if lease.IP != "" {
+				nic.Add(shared.IP, lease.IP)
+			}
+			if lease.Floating {
+				nic.Add(driver_shared.NOCLOUD_FLOATING, "YES")
+			}
+		}
+	} else {
+		public_vn := int(group_data["public_vn"].GetNumberValue())
+		for i := 0; i < int(resources["ips_public"].GetNumberValue()); i++ {
+			nic := tmpl.AddNIC()
+			nic.Add(shared.NetworkID, public_vn)
+			AddSecurityGroup(nic, group_data)
+			AddBandwidthLimits(nic, limits)
+		}
+
+		private_vn := int(group_data["private_vn"].GetNumberValue())
+		for i := 0; i < int(resources["ips_private"].GetNumberValue()); i++ {
+			nic := tmpl.AddNIC()
+			nic.Add(shared.NetworkID, private_vn)
+			AddSecurityGroup(nic, group_data)
+			AddBandwidthLimits(nic, limits)
+		}
+		nics = int(resources["ips_public"].GetNumberValue()) + int(resources["ips_private"].GetNumberValue())
+
+		public_vn6 := int(group_data["public_vn6"].GetNumberValue())
+		for i := 0; i < int(resources["public_ipv6"].GetNumberValue()); i++ {
+			nic := tmpl.AddNIC()
+			nic.Add(shared.NetworkID, public_vn6)
+			AddSecurityGroup(nic, group_data)
+			AddBandwidthLimits(nic, limits)
+		}
 
-	private_vn := int(group_data["private_vn"].GetNumberValue())
-	for i := 0; i < int(resources["ips_private"].GetNumberValue()); i++ {
-		nic := tmpl.AddNIC()
-		nic.Add(shared.NetworkID, private_vn)
+		private_vn6 := int(group_data["private_vn6"].GetNumberValue())
+		for i := 0; i < int(resources["private_ipv6"].GetNumberValue()); i++ {
+			nic := tmpl.AddNIC()
+			nic.Add(shared.NetworkID, private_vn6)
+			AddSecurityGroup(nic, group_data)
+			AddBandwidthLimits(nic, limits)
+		}
+		nics += int(resources["public_ipv6"].GetNumberValue()) + int(resources["private_ipv6"].GetNumberValue())
 	}
 	// OpenNebula won't generate Networking context without this key set to YES
 	// so most templates won't generate network interfaces inside the VM
-	if int(resources["ips_public"].GetNumberValue())+int(resources["ips_private"].GetNumberValue()) > 0 {
+	if nics > 0 {
 		tmpl.AddCtx(keys.NetworkCtx, "YES")
 	}
 
-	tmpl_string := tmpl.String()
-	c.log.Debug("Resulting Template", zap.String("template", tmpl_string))
-	vmid, err = c.InstantiateTemplate(template_id, vmname, tmpl_string, false)
-	if err != nil {
-		return -1, err
-	}
-	data[DATA_VM_ID] = structpb.NewNumberValue(float64(vmid))
-
-	instance.Data = data
-	return vmid, nil
+	return template_id, tmpl, data, nil
 }
 
 func (c *ONeClient) InstantiateTemplate(id int, vmname, tmpl string, pending bool) (vmid int, err error) {
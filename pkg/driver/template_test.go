@@ -0,0 +1,88 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+)
+
+func TestInstantiateTemplateHelper(t *testing.T) {
+	c, _, ig := setup(t)
+	inst := ig.Instances[0]
+	s := c.Server
+
+	vmid, err := c.InstantiateTemplateHelper(inst, ig, "token")
+	if err != nil {
+		t.Fatalf("InstantiateTemplateHelper() => %v", err)
+	}
+
+	if methods := s.Methods(); !reflect.DeepEqual(methods, []string{"one.template.info", "one.template.instantiate"}) {
+		t.Fatalf("Unexpected calls: %v", methods)
+	}
+	call := s.CallsTo("one.template.instantiate")[0]
+	if call.Args[0] != int64(0) || call.Args[1] != inst.Uuid || call.Args[2] != false {
+		t.Fatalf("Unexpected instantiate args: %v", call.Args)
+	}
+	extra := call.Args[3].(string)
+	for _, expected := range []string{
+		`SCHED_REQUIREMENTS="ID=\"0\""`,
+		`SCHED_DS_REQUIREMENTS="ID=\"100\""`,
+		`NOCLOUD_VM_TOKEN="token"`,
+		`VCPU="2"`,
+		`MEMORY="2048"`,
+		`SIZE="20480"`,
+		`NETWORK_ID="1"`,
+	} {
+		if !strings.Contains(extra, expected) {
+			t.Errorf("Template misses %s:\n%s", expected, extra)
+		}
+	}
+
+	v, err := c.GetVM(vmid)
+	if err != nil {
+		t.Fatalf("GetVM() => %v", err)
+	}
+	if v.Name != inst.Uuid {
+		t.Fatalf("Unexpected VM name: %s", v.Name)
+	}
+	if int(inst.Data[one.DATA_VM_ID].GetNumberValue()) != vmid {
+		t.Fatalf("VM ID isn't set to data")
+	}
+
+	// VM is read back through the wire the same way Monitoring does, once it's owned by the IG User
+	if err := c.Chown("vm", vmid, int(ig.Data["userid"].GetNumberValue()), fake.USERS_GROUP); err != nil {
+		t.Fatalf("Chown() => %v", err)
+	}
+	networking, err := c.NetworkingVM(vmid)
+	if err != nil {
+		t.Fatalf("NetworkingVM() => %v", err)
+	}
+	if public := networking["public"].([]interface{}); len(public) != 1 || public[0] != "192.0.2.1" {
+		t.Fatalf("Unexpected public IPs: %v", public)
+	}
+	res, err := c.VMToInstance(vmid)
+	if err != nil {
+		t.Fatalf("VMToInstance() => %v", err)
+	}
+	if res.Config["password"].GetStringValue() != "secret" || res.Resources["cpu"].GetNumberValue() != 2 {
+		t.Fatalf("Unexpected Instance: %v", res)
+	}
+}
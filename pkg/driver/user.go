@@ -66,25 +66,20 @@ func (c *ONeClient) UserAddAttribute(id int, data map[string]interface{}) error
 	return uc.Update(tmpl.String(), parameters.Merge)
 }
 
-func (c *ONeClient) waitForHotplugFinish(vmid int) {
-	for {
-		_, _, lcmState, _, _ := c.StateVM(vmid)
-		if lcmState == int(vm.HotplugNic) {
-			time.Sleep(time.Second * 1)
-		} else {
-			return
+func (c *ONeClient) waitForHotplugFinish(vmid int) error {
+	return c.waitForState(vmid, func(_, lcm int) bool {
+		switch vm.LCMState(lcm) {
+		case vm.HotplugNic, vm.Hotplug, vm.HotplugResize, vm.DiskResize:
+			return false
 		}
-	}
+		return true
+	})
 }
 
-func (c *ONeClient) WaitForPoweroff(vmid int) {
-	for {
-		vmState, _, _, _, _ := c.StateVM(vmid)
-		if vmState == int(vm.Poweroff) {
-			return
-		}
-		time.Sleep(1 * time.Second)
-	}
+func (c *ONeClient) WaitForPoweroff(vmid int) error {
+	return c.waitForState(vmid, func(state, _ int) bool {
+		return state == int(vm.Poweroff)
+	})
 }
 
 // Check if user related to the Instance Group exists.
@@ -159,7 +154,9 @@ func (c *ONeClient) CheckOrphanInstanceGroup(instanceGroup *pb.InstancesGroup, u
 			if err := vmc.DetachNIC(id); err != nil {
 				return err
 			}
-			c.waitForHotplugFinish(vmid)
+			if err := c.waitForHotplugFinish(vmid); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -195,7 +192,9 @@ func (c *ONeClient) CheckOrphanInstanceGroup(instanceGroup *pb.InstancesGroup, u
 			if err := vmc.AttachNIC(template.String()); err != nil {
 				return err
 			}
-			c.waitForHotplugFinish(vmid)
+			if err := c.waitForHotplugFinish(vmid); err != nil {
+				return err
+			}
 		}
 
 		for i := 0; i < int(resources["ips_public"].GetNumberValue()); i++ {
@@ -205,7 +204,9 @@ func (c *ONeClient) CheckOrphanInstanceGroup(instanceGroup *pb.InstancesGroup, u
 			if err := vmc.AttachNIC(template.String()); err != nil {
 				return err
 			}
-			c.waitForHotplugFinish(vmid)
+			if err := c.waitForHotplugFinish(vmid); err != nil {
+				return err
+			}
 		}
 	}
 
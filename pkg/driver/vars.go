@@ -27,12 +27,28 @@ var (
 	SCHED = "sched"
 	// OpenNebula DataStore Scheduler Requirements (datastores provisioning rules for VMs deploy)
 	SCHED_DS = "sched_ds"
+	// OpenNebula Image Datastores data volumes are made in by drive type, e.g. {"SSD": 1, "HDD": 101}
+	IMAGE_DS = "image_ds"
 	// OpenNebula Super VNet public IP addresses to be reserved from
 	PUBLIC_IP_POOL = "public_ip_pool"
 	// OpenNebula Super VNet private IP addresses to be reserved from
 	PRIVATE_VN_TEMPLATE = "private_vnet_tmpl"
 	// OpenNebula Super VNet private IP addresses to be reserved from
 	PRIVATE_VN_BAN = "private_vnet_ban"
+	// Time window(HH:MM-HH:MM, UTC) when VMs can be powered off to apply resize which can't be done live
+	MAINTENANCE_WINDOW = "maintenance_window"
+	// OpenNebula Backup Datastore ID
+	BACKUP_DS = "backup_ds"
+	// Default backup mode, FULL or INCREMENT
+	BACKUP_MODE = "backup_mode"
+	// Default number of backups to retain
+	BACKUP_KEEP = "backup_keep"
+	// OpenNebula Image(ISO or disk) booted in rescue mode
+	RESCUE_IMAGE = "rescue_image"
+	// OpenNebula ISO Images allowed to be attached to VMs, list or comma separated IDs
+	ISO_IMAGES = "iso_images"
+	// Plan resource keys billed by VM template attributes, e.g. {"gpu": "PCI"} or {"gpu": {"attribute": "PCI", "divisor": 1}}
+	BILLING_ATTRIBUTES = "billing_attributes"
 
 	// OpenNebula VM Name Data Key
 	DATA_VM_NAME = "vm_name"
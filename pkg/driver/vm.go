@@ -18,6 +18,7 @@ package one
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -27,6 +28,7 @@ import (
 	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
 	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm/keys"
 	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
+	driver_shared "github.com/slntopp/nocloud-driver-ione/pkg/shared"
 	"github.com/slntopp/nocloud-proto/hasher"
 	pb "github.com/slntopp/nocloud-proto/instances"
 	stpb "github.com/slntopp/nocloud-proto/states"
@@ -48,6 +50,11 @@ func (c *ONeClient) GetInstSnapshots(inst *pb.Instance) (map[string]interface{},
 		return nil, err
 	}
 
+	return SnapshotsFromVM(vm)
+}
+
+// Lists VM snapshots as map of SNAPSHOT_ID to its name and creation timestamp
+func SnapshotsFromVM(vm *vm.VM) (map[string]interface{}, error) {
 	snaps := make(map[string]interface{}, 0)
 
 	snapsV := vm.Template.GetVectors("SNAPSHOT")
@@ -168,33 +175,52 @@ func (c *ONeClient) NetworkingVM(id int) (map[string]interface{}, error) {
 		return nil, err
 	}
 
+	return NetworkingFromVM(c.log, vm), nil
+}
+
+// Collects public and private IPs of the VM NICs, grouped by the User VNets they were leased from.
+// IPv6 addresses are put to public_ipv6 and private_ipv6
+func NetworkingFromVM(log *zap.Logger, vm *vm.VM) map[string]interface{} {
 	networking := make(map[string]interface{})
 
 	publicIps := make([]interface{}, 0)
 	privateIps := make([]interface{}, 0)
+	publicIps6 := make([]interface{}, 0)
+	privateIps6 := make([]interface{}, 0)
 
 	nics := vm.Template.GetNICs()
 	for _, nic := range nics {
-		ip, err := nic.GetStr("IP")
-		if err != nil {
-			c.log.Error("Couldn't get IP", zap.Any("nic", nic))
+		ip, _ := nic.GetStr("IP")
+		ip6 := NICIPv6(&nic)
+		if ip == "" && ip6 == "" {
+			log.Error("Couldn't get IP", zap.Any("nic", nic))
 			continue
 		}
 
 		vnet, err := nic.GetStr("NETWORK")
 		if err != nil {
-			c.log.Error("Couldn't get Network", zap.Any("nic", nic))
+			log.Error("Couldn't get Network", zap.Any("nic", nic))
 			continue
 		}
 
 		switch vnet {
-		case fmt.Sprintf(USER_PUBLIC_VNET_NAME_PATTERN, vm.UID):
-			publicIps = append(publicIps, ip)
-		case fmt.Sprintf(USER_PRIVATE_VNET_NAME_PATTERN, vm.UID):
-			privateIps = append(privateIps, ip)
+		case fmt.Sprintf(USER_PUBLIC_VNET_NAME_PATTERN, vm.UID), fmt.Sprintf(USER_PUBLIC_VNET6_NAME_PATTERN, vm.UID):
+			if ip != "" {
+				publicIps = append(publicIps, ip)
+			}
+			if ip6 != "" {
+				publicIps6 = append(publicIps6, ip6)
+			}
+		case fmt.Sprintf(USER_PRIVATE_VNET_NAME_PATTERN, vm.UID), fmt.Sprintf(USER_PRIVATE_VNET6_NAME_PATTERN, vm.UID):
+			if ip != "" {
+				privateIps = append(privateIps, ip)
+			}
+			if ip6 != "" {
+				privateIps6 = append(privateIps6, ip6)
+			}
 		default:
 			{
-				c.log.Error("Invalid VNet Name", zap.Any("vnet", vnet))
+				log.Error("Invalid VNet Name", zap.Any("vnet", vnet))
 				continue
 			}
 		}
@@ -202,8 +228,14 @@ func (c *ONeClient) NetworkingVM(id int) (map[string]interface{}, error) {
 
 	networking["public"] = publicIps
 	networking["private"] = privateIps
+	if len(publicIps6) > 0 {
+		networking["public_ipv6"] = publicIps6
+	}
+	if len(privateIps6) > 0 {
+		networking["private_ipv6"] = privateIps6
+	}
 
-	return networking, nil
+	return networking
 }
 
 func (c *ONeClient) VMToInstance(id int) (*pb.Instance, error) {
@@ -212,6 +244,11 @@ func (c *ONeClient) VMToInstance(id int) (*pb.Instance, error) {
 	if err != nil {
 		return nil, err
 	}
+	return InstanceFromVM(c.log, vm)
+}
+
+// Builds Instance Config, Resources and Data from the VM Template
+func InstanceFromVM(log *zap.Logger, vm *vm.VM) (*pb.Instance, error) {
 	inst := pb.Instance{
 		Uuid:      "",
 		Title:     "",
@@ -273,44 +310,75 @@ cpu:
 		inst.Data["vm_name"] = structpb.NewStringValue(vm.Name)
 	}
 	{
-		diskInfo, err := tmpl.GetVector("DISK")
-		if err != nil {
-			return nil, err
+		// the first disk is the system one, data disks are attached after it
+		disks := tmpl.GetDisks()
+		if len(disks) == 0 {
+			return nil, errors.New("VM has no disks")
 		}
+		diskInfo := disks[0]
 		// if instance does not exist its template doesn't have DRIVE_TYPE & SIZE
 		// that's why we don't return error
 		driveType, err := diskInfo.GetStr("DRIVE_TYPE")
 		if err != nil {
-			c.log.Warn("Error getting Drive Type", zap.Error(err))
+			log.Warn("Error getting Drive Type", zap.Error(err))
 			driveType = "NOT FOUND"
 		}
 		driveSize, err := diskInfo.GetFloat("SIZE")
 		if err != nil {
-			c.log.Warn("Error getting Drive Size", zap.Error(err))
+			log.Warn("Error getting Drive Size", zap.Error(err))
 			driveSize = -1
 		}
 		inst.Resources["drive_type"] = structpb.NewStringValue(driveType)
 		inst.Resources["drive_size"] = structpb.NewNumberValue(float64(driveSize))
 	}
+	{
+		dataDisks := DataDisksFromVM(&tmpl)
+		if len(dataDisks) > 0 {
+			disks := make([]interface{}, 0, len(dataDisks))
+			for i, disk := range dataDisks {
+				driveType, _ := disk.Get(driver_shared.DRIVE_TYPE)
+				size, _ := disk.GetI(shared.Size)
+				disks = append(disks, map[string]interface{}{"id": DataDiskID(&disk, i), "size": size, "type": driveType})
+			}
+			value, err := structpb.NewList(disks)
+			if err != nil {
+				return nil, err
+			}
+			inst.Resources["disks"] = structpb.NewListValue(value)
+		}
+	}
 	{
 		ips_public, ips_private := 0, 0
+		public_ipv6, private_ipv6 := 0, 0
 		NICs := tmpl.GetNICs()
 		for _, nic := range NICs {
+			if IsFloatingNIC(&nic) {
+				continue
+			}
 			vn_name, err := nic.GetStr("NETWORK")
 			if err != nil {
 				return nil, err
 			}
-			if strings.HasSuffix(vn_name, "pub-vnet") {
+			switch {
+			case strings.HasSuffix(vn_name, "pub-vnet"):
 				ips_public++
-				continue
-			}
-			if strings.HasSuffix(vn_name, "private-vnet") {
+			case strings.HasSuffix(vn_name, "private-vnet"):
 				ips_private++
-				continue
+			case strings.HasSuffix(vn_name, "pub6-vnet"):
+				public_ipv6++
+			case strings.HasSuffix(vn_name, "private6-vnet"):
+				private_ipv6++
 			}
 		}
 		inst.Resources["ips_public"] = structpb.NewNumberValue(float64(ips_public))
 		inst.Resources["ips_private"] = structpb.NewNumberValue(float64(ips_private))
+		// Set only if there are any, so hashes of IPv4-only Instances aren't changed
+		if public_ipv6 > 0 {
+			inst.Resources["public_ipv6"] = structpb.NewNumberValue(float64(public_ipv6))
+		}
+		if private_ipv6 > 0 {
+			inst.Resources["private_ipv6"] = structpb.NewNumberValue(float64(private_ipv6))
+		}
 	}
 
 	return &inst, nil
@@ -504,6 +572,11 @@ func (c *ONeClient) CheckInstancesGroup(IG *pb.InstancesGroup) (*CheckInstancesG
 		res.BillingPlan = inst.BillingPlan
 		res.Data = nil
 		res.State = nil
+		// Resize which can't be applied now isn't an update, it's recorded in data
+		if c.ResizePending(inst) {
+			res.Resources["cpu"] = inst.GetResources()["cpu"]
+			res.Resources["ram"] = inst.GetResources()["ram"]
+		}
 
 		err = hasher.SetHash(res.ProtoReflect())
 		if err != nil {
@@ -515,7 +588,8 @@ func (c *ONeClient) CheckInstancesGroup(IG *pb.InstancesGroup) (*CheckInstancesG
 		c.log.Debug("res.Hash", zap.String("hash", res.Hash))
 		c.log.Debug("inst.Hash", zap.String("hash", inst.Hash))
 
-		if res.Hash != inst.Hash {
+		// Bandwidth limits aren't part of the VM Instance, as they may come from billing plan meta
+		if res.Hash != inst.Hash || BandwidthOutdated(vm, InstanceBandwidthLimits(inst)) {
 			resp.ToBeUpdated = append(resp.ToBeUpdated, inst)
 		} else {
 			resp.Valid = append(resp.Valid, inst)
@@ -620,20 +694,16 @@ func (c *ONeClient) CheckInstancesGroupResponseProcess(resp *CheckInstancesGroup
 		}
 		updated := make([]interface{}, 0)
 
-		// Resizing using template
-		_, lcmState, err := VM.State()
-		if err != nil {
-			c.log.Error("Error Recieving VM State", zap.Error(err))
-			continue
-		}
-		tmpl := vm.NewTemplate()
-		if vmInst.Resources["cpu"].GetNumberValue() != inst.Resources["cpu"].GetNumberValue() {
-			tmpl.VCPU(int(inst.Resources["cpu"].GetNumberValue()))
+		// Resizing using template, 0 stands for unchanged
+		vcpu, memory := 0, 0
+		pending := c.ResizePending(inst)
+		if !pending && vmInst.Resources["cpu"].GetNumberValue() != inst.Resources["cpu"].GetNumberValue() {
+			vcpu = int(inst.Resources["cpu"].GetNumberValue())
 			updated = append(updated, "cpu")
 		}
 
-		if vmInst.Resources["ram"].GetNumberValue() != inst.Resources["ram"].GetNumberValue() {
-			tmpl.Memory(int(inst.Resources["ram"].GetNumberValue()))
+		if !pending && vmInst.Resources["ram"].GetNumberValue() != inst.Resources["ram"].GetNumberValue() {
+			memory = int(inst.Resources["ram"].GetNumberValue())
 			updated = append(updated, "ram")
 		}
 
@@ -673,6 +743,8 @@ func (c *ONeClient) CheckInstancesGroupResponseProcess(resp *CheckInstancesGroup
 				networkTemplate := vm.NewTemplate()
 				nic := networkTemplate.AddNIC()
 				nic.Add(shared.NetworkID, public_vn)
+				AddSecurityGroup(nic, data)
+				AddBandwidthLimits(nic, InstanceBandwidthLimits(inst))
 				err = vmc.AttachNIC(networkTemplate.String())
 				if err != nil {
 					c.log.Error("Wrong ip attach")
@@ -683,13 +755,16 @@ func (c *ONeClient) CheckInstancesGroupResponseProcess(resp *CheckInstancesGroup
 			} else {
 				nics := VM.Template.GetNICs()
 				for i := len(nics) - 1; i > 0; i-- {
+					if IsFloatingNIC(&nics[i]) {
+						continue
+					}
 					nicId, netType := -1, ""
 					pairs := nics[i].Vector.Pairs
 					for j := 0; j < len(pairs); j++ {
 						if pairs[j].XMLName.Local == "NETWORK" {
 							if strings.Contains(pairs[j].Value, "pub-vnet") {
 								netType = "pub-vnet"
-							} else {
+							} else if strings.Contains(pairs[j].Value, "private-vnet") {
 								netType = "private-vnet"
 							}
 							continue
@@ -704,6 +779,8 @@ func (c *ONeClient) CheckInstancesGroupResponseProcess(resp *CheckInstancesGroup
 						if err != nil {
 							c.log.Error("id", zap.Int("id", nicId))
 							c.log.Error("Wrong ip detach")
+						} else {
+							ReleaseNICPTRs(c.log, &nics[i])
 						}
 
 						go igDatasPublisher(ig.Uuid, data)
@@ -727,6 +804,8 @@ func (c *ONeClient) CheckInstancesGroupResponseProcess(resp *CheckInstancesGroup
 					networkTemplate := vm.NewTemplate()
 					nic := networkTemplate.AddNIC()
 					nic.Add(shared.NetworkID, private_vn)
+					AddSecurityGroup(nic, data)
+					AddBandwidthLimits(nic, InstanceBandwidthLimits(inst))
 					err = vmc.AttachNIC(networkTemplate.String())
 					if err != nil {
 						c.log.Error("Wrong ip attach")
@@ -741,7 +820,7 @@ func (c *ONeClient) CheckInstancesGroupResponseProcess(resp *CheckInstancesGroup
 							if pairs[j].XMLName.Local == "NETWORK" {
 								if strings.Contains(pairs[j].Value, "pub-vnet") {
 									netType = "pub-vnet"
-								} else {
+								} else if strings.Contains(pairs[j].Value, "private-vnet") {
 									netType = "private-vnet"
 								}
 								continue
@@ -764,42 +843,31 @@ func (c *ONeClient) CheckInstancesGroupResponseProcess(resp *CheckInstancesGroup
 			}
 		}
 
+		c.updateIPv6NICs(VM, vmInst, inst, data)
+
 		if len(updated) > 0 {
-			if lcmState == vm.Running {
-				err = vmc.Poweroff()
-				if err != nil {
-					c.log.Error("Error VM Poweroff()", zap.Error(err))
-					continue
-				}
-				for {
-					VM, err = vmc.Info(true)
-					if err != nil {
-						c.log.Error("Error Getting VM Info", zap.Error(err))
-						continue
-					}
-					state, _, err := VM.State()
-					if err != nil {
-						c.log.Error("Error Recieving VM State", zap.Error(err))
-						continue
-					}
-					if state == vm.Poweroff {
-						break
-					} else {
-						t := time.NewTimer(1 * time.Second)
-						<-t.C
-					}
-				}
-			}
-			err = vmc.Resize(tmpl.String(), true)
+			outcome, err := c.ResizeVM(VM, vcpu, memory)
 			if err != nil {
 				c.log.Error("Error Resizing using template", zap.Error(err))
+			}
+			recorded := c.recordResize(inst, outcome, err)
+			if recorded {
+				instDatasPublisher(inst.GetUuid(), inst.GetData())
+			}
+			if outcome != RESIZE_HOTPLUG && outcome != RESIZE_COLD {
 				updated = make([]interface{}, 0)
+				// Scheduled or failed resize is reported once, when it's recorded
+				if recorded {
+					updated = append(updated, "resize_"+outcome)
+				}
+			} else {
+				updated = append(updated, "resize_"+outcome)
 			}
 		}
 
 		// Resizing without template
 		if vmInst.Resources["drive_size"].GetNumberValue() != inst.Resources["drive_size"].GetNumberValue() {
-			err = vmc.Disk(0).Resize(strconv.Itoa(int(inst.Resources["drive_size"].GetNumberValue())))
+			err = vmc.Disk(systemDiskID(VM)).Resize(strconv.Itoa(int(inst.Resources["drive_size"].GetNumberValue())))
 			if err != nil {
 				c.log.Error("Error Disk Resizing", zap.Error(err))
 			} else {
@@ -807,6 +875,15 @@ func (c *ONeClient) CheckInstancesGroupResponseProcess(resp *CheckInstancesGroup
 			}
 		}
 
+		if c.updateDataDisks(vmid, VM, DataDisksFromResources(inst.Resources)) {
+			updated = append(updated, "disks")
+		}
+
+		// NICs attached above already have the limits, detached ones must not be updated, so taking fresh info
+		if VM, err := vmc.Info(true); err == nil && c.updateNICsBandwidth(VM, InstanceBandwidthLimits(inst)) {
+			updated = append(updated, "bandwidth")
+		}
+
 		updlist, err := structpb.NewValue(updated)
 		if err != nil {
 			c.log.Error("Error Converting Updated To Structpb.List", zap.Error(err))
@@ -938,6 +1015,39 @@ func (c *ONeClient) GetVmResourcesDiff(inst *pb.Instance) []*VmResourceDiff {
 		return res
 	}
 
+	return VmResourcesDiff(vmInst, inst)
+}
+
+// Returns billable resources of the Instance in the counts billing handlers use, see VmResourcesDiff
+func BillableResources(inst *pb.Instance) map[string]float64 {
+	res := make(map[string]float64)
+	for _, diff := range VmResourcesDiff(&pb.Instance{}, inst) {
+		res[diff.ResName] = diff.NewResCount
+	}
+	return res
+}
+
+// Compares billable resources of the Instance built from VM with the requested Instance resources.
+// Counts are the ones billing handlers use, so RAM and drives are in GB
+func VmResourcesDiff(vmInst, inst *pb.Instance) []*VmResourceDiff {
+	var res []*VmResourceDiff
+
+	// RAM is billed in GB
+	for _, r := range []struct {
+		key  string
+		unit float64
+	}{{"cpu", 1}, {"ram", 1024}} {
+		vmValue, instValue := vmInst.Resources[r.key].GetNumberValue(), inst.Resources[r.key].GetNumberValue()
+		if _, ok := inst.Resources[r.key]; !ok || vmValue == instValue {
+			continue
+		}
+		res = append(res, &VmResourceDiff{
+			ResName:     r.key,
+			OldResCount: vmValue / r.unit,
+			NewResCount: instValue / r.unit,
+		})
+	}
+
 	vmInstIpsPublic := int(vmInst.Resources["ips_public"].GetNumberValue())
 	instIpsPublic := int(inst.Resources["ips_public"].GetNumberValue())
 
@@ -949,16 +1059,28 @@ func (c *ONeClient) GetVmResourcesDiff(inst *pb.Instance) []*VmResourceDiff {
 		})
 	}
 
-	vmInstDriveSize := vmInst.Resources["drive_size"].GetNumberValue()
-	instDriveSize := inst.Resources["drive_size"].GetNumberValue()
+	vmInstDrives := DrivesByType(vmInst.Resources)
+	instDrives := DrivesByType(inst.Resources)
 
-	if vmInstDriveSize != instDriveSize {
-		driveType := inst.Resources["drive_type"].GetStringValue()
+	driveTypes := make([]string, 0, len(instDrives))
+	for driveType := range instDrives {
+		driveTypes = append(driveTypes, driveType)
+	}
+	for driveType := range vmInstDrives {
+		if _, ok := instDrives[driveType]; !ok {
+			driveTypes = append(driveTypes, driveType)
+		}
+	}
+	sort.Strings(driveTypes)
 
+	for _, driveType := range driveTypes {
+		if vmInstDrives[driveType] == instDrives[driveType] {
+			continue
+		}
 		res = append(res, &VmResourceDiff{
-			ResName:     strings.ToLower(fmt.Sprintf("drive_%s", driveType)),
-			OldResCount: vmInstDriveSize / 1024.0,
-			NewResCount: instDriveSize / 1024.0,
+			ResName:     fmt.Sprintf("drive_%s", driveType),
+			OldResCount: vmInstDrives[driveType] / 1024.0,
+			NewResCount: instDrives[driveType] / 1024.0,
 		})
 	}
 
@@ -32,8 +32,10 @@ import (
 )
 
 var (
-	USER_PUBLIC_VNET_NAME_PATTERN  = "user-%d-pub-vnet"
-	USER_PRIVATE_VNET_NAME_PATTERN = "user-%d-private-vnet"
+	USER_PUBLIC_VNET_NAME_PATTERN   = "user-%d-pub-vnet"
+	USER_PRIVATE_VNET_NAME_PATTERN  = "user-%d-private-vnet"
+	USER_PUBLIC_VNET6_NAME_PATTERN  = "user-%d-pub6-vnet"
+	USER_PRIVATE_VNET6_NAME_PATTERN = "user-%d-private6-vnet"
 )
 
 func (c *ONeClient) ReservePublicIP(u, n int) (pool_id int, err error) {
@@ -194,6 +196,12 @@ func (c *ONeClient) FindFreeVlan(sp *sppb.ServicesProvider) (vnMad string, freeV
 }
 
 func (c *ONeClient) ReservePrivateIP(u int, vnMad string, vlanID int) (pool_id int, err error) {
+	private_ar := "AR = [\n	IP = \"10.0.0.0\",\n	SIZE = \"255\",\n	TYPE = \"IP4\" ]"
+	return c.reservePrivateVNet(u, fmt.Sprintf(USER_PRIVATE_VNET_NAME_PATTERN, u), private_ar, vnMad, vlanID)
+}
+
+// Instantiates User private VNet with the given AR from PRIVATE_VN_TEMPLATE
+func (c *ONeClient) reservePrivateVNet(u int, private_vnet_name, private_ar, vnMad string, vlanID int) (pool_id int, err error) {
 	private_tmpl_id, ok := c.vars[PRIVATE_VN_TEMPLATE]
 	if !ok {
 		return -1, errors.New("VNet Tmpl ID is not set")
@@ -204,8 +212,6 @@ func (c *ONeClient) ReservePrivateIP(u int, vnMad string, vlanID int) (pool_id i
 		return -1, err
 	}
 
-	private_vnet_name := fmt.Sprintf(USER_PRIVATE_VNET_NAME_PATTERN, u)
-	private_ar := "AR = [\n	IP = \"10.0.0.0\",\n	SIZE = \"255\",\n	TYPE = \"IP4\" ]"
 	private_vlan := fmt.Sprintf("VLAN_ID = %d\nAUTOMATIC_VLAN_ID = \"NO\"", vlanID)
 	private_vn_mad := fmt.Sprintf("VN_MAD = \"%s\"", vnMad)
 	private_bridge := fmt.Sprintf("BRIDGE = user-%d-vlan-%d", u, vlanID)
@@ -258,6 +264,23 @@ func (c *ONeClient) DeleteUserAndVNets(id int) error {
 		}
 	}
 
+	for _, getVNet := range []func(int) (int, error){c.GetUserPublicVNet6, c.GetUserPrivateVNet6} {
+		if vn, err := getVNet(id); err == nil {
+			if err := c.DeleteVNet(vn); err != nil {
+				c.log.Debug("Couldn't Delete IPv6 VNet", zap.Error(err), zap.Int("user", id), zap.Int("vnet_id", vn))
+			}
+		}
+	}
+
+	// Security groups of the User Instances Groups
+	if pool, err := c.ctrl.SecurityGroups().Info(id); err == nil {
+		for _, sg := range pool.SecurityGroups {
+			if err := c.ctrl.SecurityGroup(sg.ID).Delete(); err != nil {
+				c.log.Debug("Couldn't Delete Security Group", zap.Error(err), zap.Int("user", id), zap.Int("sg_id", sg.ID))
+			}
+		}
+	}
+
 	err := c.DeleteUser(id)
 	if err != nil {
 		c.log.Debug("Couldn't Delete User", zap.Error(err), zap.Int("user", id))
@@ -292,8 +315,16 @@ func (c *ONeClient) UpdateVNet(id int, tmpl string, uType parameters.UpdateType)
 //	to - VNet ID to reserve to, if set to -1 new will be created
 //	name - name of the new VNet, if set to "", either existing will be used or new - generated
 func (c *ONeClient) ReserveVNet(id, size, to int, name string) (int, error) {
+	return c.reserveVNetAR(id, "", size, to, name)
+}
+
+// Same as ReserveVNet, but addresses are taken from the given AR only, if arID isn't empty
+func (c *ONeClient) reserveVNetAR(id int, arID string, size, to int, name string) (int, error) {
 	vnc := c.ctrl.VirtualNetwork(id)
 	tmpl := fmt.Sprintf("SIZE=%d\n", size)
+	if arID != "" {
+		tmpl += fmt.Sprintf("AR_ID=%s\n", arID)
+	}
 	if name != "" {
 		tmpl += fmt.Sprintf("NAME=%s\n", name)
 	}
@@ -0,0 +1,101 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package one_test
+
+import (
+	"reflect"
+	"testing"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	stpb "github.com/slntopp/nocloud-proto/states"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestReservePublicIP(t *testing.T) {
+	c, _, ig := setup(t)
+	uid := int(ig.Data["userid"].GetNumberValue())
+	public_vn := int(ig.Data["public_vn"].GetNumberValue())
+	s := c.Server
+
+	id, err := c.ReservePublicIP(uid, 2)
+	if err != nil {
+		t.Fatalf("ReservePublicIP() => %v", err)
+	}
+	if id != public_vn {
+		t.Fatalf("Addresses must be reserved to the existing User VNet %d, got %d", public_vn, id)
+	}
+
+	expected := []string{
+		"one.vnpool.info", "one.vn.info", "one.vn.info",
+		"one.vn.reserve", "one.vn.reserve",
+		"one.vn.chown", "one.vn.chmod", "one.vn.update",
+	}
+	if methods := s.Methods(); !reflect.DeepEqual(methods, expected) {
+		t.Fatalf("Unexpected calls: %v", methods)
+	}
+	for _, call := range s.CallsTo("one.vn.reserve") {
+		if call.Args[0] != int64(0) || call.Args[1] != "SIZE=1\nNAME=user-1-pub-vnet\nNETWORK_ID=1" {
+			t.Fatalf("Unexpected reserve args: %v", call.Args)
+		}
+	}
+
+	vn, _ := c.GetVNet(public_vn)
+	if len(vn.ARs) != 3 || vn.UID != uid || vn.Permissions.GroupU != 0 {
+		t.Fatalf("Unexpected User VNet: %+v", vn)
+	}
+}
+
+func TestFindFreeVlan(t *testing.T) {
+	c, _, _ := setup(t)
+	vnt := c.AddVNTemplate("vxlan")
+	s := c.Server
+
+	meta, _ := structpb.NewValue(map[string]interface{}{
+		"private_vnet": map[string]interface{}{
+			// VLANs 10 and 11 are taken
+			"free_vlans": map[string]interface{}{"vxlan": "3072"},
+		},
+	})
+	sp := &sppb.ServicesProvider{
+		Uuid: "sp-uuid",
+		Secrets: map[string]*structpb.Value{
+			"vlans": structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+				"vxlan": structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+					"start": structpb.NewNumberValue(10),
+					"size":  structpb.NewNumberValue(5),
+				}}),
+			}}),
+		},
+		Vars: map[string]*sppb.Var{
+			one.PRIVATE_VN_TEMPLATE: {Value: map[string]*structpb.Value{"default": structpb.NewNumberValue(float64(vnt))}},
+		},
+		State: &stpb.State{Meta: map[string]*structpb.Value{"networking": meta}},
+	}
+
+	vnMad, vlan, err := c.FindFreeVlan(sp)
+	if err != nil {
+		t.Fatalf("FindFreeVlan() => %v", err)
+	}
+	if vnMad != "vxlan" || vlan != 12 {
+		t.Fatalf("Expected vxlan VLAN 12, got %s %d", vnMad, vlan)
+	}
+
+	calls := s.Calls()
+	if len(calls) != 1 || calls[0].Method != "one.vntemplate.info" || calls[0].Args[0] != int64(vnt) {
+		t.Fatalf("Unexpected calls: %+v", calls)
+	}
+}
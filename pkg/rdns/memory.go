@@ -0,0 +1,75 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rdns
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory keeps PTR records in memory, it's a stand-in for the real DNS server in tests and dev setups
+type Memory struct {
+	mu      sync.Mutex
+	records map[string]string
+}
+
+func NewMemory() *Memory {
+	return &Memory{records: map[string]string{}}
+}
+
+func (m *Memory) SetPTR(ctx context.Context, ip, ptr string) error {
+	name, err := ReverseName(ip)
+	if err != nil {
+		return err
+	}
+	if ptr, err = Canonical(ptr); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records[name] = ptr
+	return nil
+}
+
+func (m *Memory) DeletePTR(ctx context.Context, ip string) error {
+	name, err := ReverseName(ip)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, name)
+	return nil
+}
+
+func (m *Memory) LookupPTR(ctx context.Context, ips []string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := map[string]string{}
+	for _, ip := range ips {
+		name, err := ReverseName(ip)
+		if err != nil {
+			return nil, err
+		}
+		if ptr, ok := m.records[name]; ok {
+			res[ip] = ptr
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,205 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rdns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const DEFAULT_PTR_TTL = 3600
+
+// PowerDNS manages PTR records via PowerDNS HTTP API, reverse zones must already exist on the server
+type PowerDNS struct {
+	url      string
+	apiKey   string
+	serverID string
+	ttl      int
+
+	client *http.Client
+}
+
+type pdnsZone struct {
+	ID     string      `json:"id"`
+	Name   string      `json:"name"`
+	RRSets []pdnsRRSet `json:"rrsets,omitempty"`
+}
+
+type pdnsRRSet struct {
+	Name       string       `json:"name"`
+	Type       string       `json:"type"`
+	TTL        int          `json:"ttl,omitempty"`
+	ChangeType string       `json:"changetype,omitempty"`
+	Records    []pdnsRecord `json:"records"`
+}
+
+type pdnsRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+func NewPowerDNS(conf Config) (*PowerDNS, error) {
+	if conf.URL == "" {
+		return nil, errors.New("PowerDNS API URL is not set")
+	}
+	if conf.ServerID == "" {
+		conf.ServerID = "localhost"
+	}
+	if conf.TTL <= 0 {
+		conf.TTL = DEFAULT_PTR_TTL
+	}
+	return &PowerDNS{
+		url: strings.TrimSuffix(conf.URL, "/"), apiKey: conf.APIKey,
+		serverID: conf.ServerID, ttl: conf.TTL,
+		client: &http.Client{},
+	}, nil
+}
+
+func (p *PowerDNS) SetPTR(ctx context.Context, ip, ptr string) error {
+	ptr, err := Canonical(ptr)
+	if err != nil {
+		return err
+	}
+	return p.patch(ctx, ip, pdnsRRSet{
+		Type: "PTR", TTL: p.ttl, ChangeType: "REPLACE",
+		Records: []pdnsRecord{{Content: ptr}},
+	})
+}
+
+func (p *PowerDNS) DeletePTR(ctx context.Context, ip string) error {
+	return p.patch(ctx, ip, pdnsRRSet{Type: "PTR", ChangeType: "DELETE", Records: []pdnsRecord{}})
+}
+
+func (p *PowerDNS) LookupPTR(ctx context.Context, ips []string) (map[string]string, error) {
+	zones, err := p.zones(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each zone is fetched once, no matter how many addresses it has
+	byZone := map[string]map[string]string{}
+	for _, ip := range ips {
+		name, err := ReverseName(ip)
+		if err != nil {
+			return nil, err
+		}
+		zone, ok := zoneOf(zones, name)
+		if !ok {
+			continue
+		}
+		if byZone[zone.ID] == nil {
+			byZone[zone.ID] = map[string]string{}
+		}
+		byZone[zone.ID][name] = ip
+	}
+
+	res := map[string]string{}
+	for id, names := range byZone {
+		var zone pdnsZone
+		if err := p.do(ctx, http.MethodGet, "/zones/"+url.PathEscape(id), nil, &zone); err != nil {
+			return nil, err
+		}
+		for _, rrset := range zone.RRSets {
+			ip, ok := names[rrset.Name]
+			if !ok || rrset.Type != "PTR" || len(rrset.Records) == 0 {
+				continue
+			}
+			res[ip] = rrset.Records[0].Content
+		}
+	}
+	return res, nil
+}
+
+// Applies the RRSet change to the reverse zone of the address
+func (p *PowerDNS) patch(ctx context.Context, ip string, rrset pdnsRRSet) error {
+	name, err := ReverseName(ip)
+	if err != nil {
+		return err
+	}
+	zones, err := p.zones(ctx)
+	if err != nil {
+		return err
+	}
+	zone, ok := zoneOf(zones, name)
+	if !ok {
+		return fmt.Errorf("no reverse zone for %s on PowerDNS server", ip)
+	}
+
+	rrset.Name = name
+	body := pdnsZone{RRSets: []pdnsRRSet{rrset}}
+	return p.do(ctx, http.MethodPatch, "/zones/"+url.PathEscape(zone.ID), body, nil)
+}
+
+func (p *PowerDNS) zones(ctx context.Context) ([]pdnsZone, error) {
+	var zones []pdnsZone
+	return zones, p.do(ctx, http.MethodGet, "/zones", nil, &zones)
+}
+
+// Returns the most specific zone name belongs to
+func zoneOf(zones []pdnsZone, name string) (pdnsZone, bool) {
+	var match pdnsZone
+	for _, zone := range zones {
+		if (name == zone.Name || strings.HasSuffix(name, "."+zone.Name)) && len(zone.Name) > len(match.Name) {
+			match = zone
+		}
+	}
+	return match, match.Name != ""
+}
+
+func (p *PowerDNS) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.url+"/api/v1/servers/"+url.PathEscape(p.serverID)+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", p.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("PowerDNS %s %s: %s %s", method, path, resp.Status, apiErr.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
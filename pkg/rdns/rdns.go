@@ -0,0 +1,144 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider manages PTR records of IP addresses
+type Provider interface {
+	// Sets PTR record of the address to the given domain name
+	SetPTR(ctx context.Context, ip, ptr string) error
+	// Removes PTR record of the address, no error if there is none
+	DeletePTR(ctx context.Context, ip string) error
+	// Returns PTR records of the addresses, ones without record are omitted
+	LookupPTR(ctx context.Context, ips []string) (map[string]string, error)
+}
+
+// Config is shared by all providers, each one uses what it needs
+type Config struct {
+	URL      string
+	APIKey   string
+	ServerID string
+	TTL      int
+}
+
+type ProviderFactory func(conf Config) (Provider, error)
+
+// Timeout of a single provider request made by the driver
+var Timeout = 10 * time.Second
+
+var (
+	mu        sync.RWMutex
+	provider  Provider
+	factories = map[string]ProviderFactory{
+		"powerdns": func(conf Config) (Provider, error) { return NewPowerDNS(conf) },
+		"memory":   func(conf Config) (Provider, error) { return NewMemory(), nil },
+	}
+)
+
+// Register makes provider kind available for New, e.g. for a DNS hosting API
+func Register(kind string, factory ProviderFactory) {
+	mu.Lock()
+	defer mu.Unlock()
+	factories[kind] = factory
+}
+
+// New makes Provider of the registered kind
+func New(kind string, conf Config) (Provider, error) {
+	mu.RLock()
+	factory, ok := factories[kind]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown rDNS provider %q", kind)
+	}
+	return factory(conf)
+}
+
+// Configure sets Provider used by the driver, nil disables rDNS management
+func Configure(p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	provider = p
+}
+
+// Get returns configured Provider, false if rDNS management is disabled
+func Get() (Provider, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return provider, provider != nil
+}
+
+// Release removes PTR records of the addresses going back to the pool, nothing is done if rDNS management is disabled
+func Release(ips ...string) error {
+	p, ok := Get()
+	if !ok || len(ips) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	var errs []error
+	for _, ip := range ips {
+		if err := p.DeletePTR(ctx, ip); err != nil {
+			errs = append(errs, fmt.Errorf("can't delete PTR of %s: %w", ip, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name of the address, e.g. 1.2.0.192.in-addr.arpa.
+func ReverseName(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("%q is not an IP address", ip)
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0]), nil
+	}
+
+	var b strings.Builder
+	v6 := parsed.To16()
+	for i := len(v6) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", v6[i]&0x0f, v6[i]>>4)
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String(), nil
+}
+
+var hostnameRe = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]([a-z0-9-]{0,61}[a-z0-9])?\.$`)
+
+// Canonical returns lower-cased fully qualified domain name, error if it's not a valid hostname
+func Canonical(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	if len(name) > 254 || !hostnameRe.MatchString(name) {
+		return "", fmt.Errorf("%q is not a valid hostname", strings.TrimSuffix(name, "."))
+	}
+	return name, nil
+}
@@ -0,0 +1,145 @@
+package rdns
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		ip, want string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa."},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+	for _, tc := range tests {
+		if got, err := ReverseName(tc.ip); err != nil || got != tc.want {
+			t.Errorf("ReverseName(%q) = %q, %v, want %q", tc.ip, got, err, tc.want)
+		}
+	}
+	if _, err := ReverseName("mail.example.com"); err == nil {
+		t.Error("ReverseName() expected error for hostname")
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	if got, err := Canonical(" Mail.Example.com "); err != nil || got != "mail.example.com." {
+		t.Errorf("Canonical() = %q, %v", got, err)
+	}
+	for _, name := range []string{"", "localhost", "-mail.example.com", "mail..example.com", "mail_1.example.com"} {
+		if _, err := Canonical(name); err == nil {
+			t.Errorf("Canonical(%q) expected error", name)
+		}
+	}
+}
+
+// Stand-in for PowerDNS HTTP API, serving zones list, zone and rrsets patch
+func pdnsServer(t *testing.T, zones ...string) *httptest.Server {
+	t.Helper()
+
+	var mu sync.Mutex
+	rrsets := map[string]map[string]pdnsRRSet{}
+	for _, zone := range zones {
+		rrsets[zone] = map[string]pdnsRRSet{}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+
+		path := strings.TrimPrefix(r.URL.Path, "/api/v1/servers/localhost/zones")
+		if path == "" {
+			list := []pdnsZone{}
+			for _, zone := range zones {
+				list = append(list, pdnsZone{ID: zone, Name: zone})
+			}
+			json.NewEncoder(w).Encode(list)
+			return
+		}
+		zone := strings.TrimPrefix(path, "/")
+		records, ok := rrsets[zone]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			res := pdnsZone{ID: zone, Name: zone}
+			for _, rrset := range records {
+				res.RRSets = append(res.RRSets, rrset)
+			}
+			json.NewEncoder(w).Encode(res)
+		case http.MethodPatch:
+			var req pdnsZone
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			for _, rrset := range req.RRSets {
+				if !strings.HasSuffix(rrset.Name, zone) {
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					return
+				}
+				if rrset.ChangeType == "DELETE" {
+					delete(records, rrset.Name)
+				} else {
+					records[rrset.Name] = rrset
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPowerDNS(t *testing.T) {
+	srv := pdnsServer(t, "0.192.in-addr.arpa.", "2.0.192.in-addr.arpa.", "8.b.d.0.1.0.0.2.ip6.arpa.")
+	ctx := context.Background()
+
+	p, err := New("powerdns", Config{URL: srv.URL + "/", APIKey: "secret"})
+	if err != nil {
+		t.Fatalf("New() => %v", err)
+	}
+
+	if err := p.SetPTR(ctx, "192.0.2.1", "mail.example.com"); err != nil {
+		t.Fatalf("SetPTR() => %v", err)
+	}
+	if err := p.SetPTR(ctx, "2001:db8::1", "mail6.example.com."); err != nil {
+		t.Fatalf("SetPTR() => %v", err)
+	}
+	if err := p.SetPTR(ctx, "198.51.100.1", "mail.example.com"); err == nil {
+		t.Fatal("Expected error setting PTR without reverse zone")
+	}
+
+	ptr, err := p.LookupPTR(ctx, []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "198.51.100.1"})
+	if err != nil {
+		t.Fatalf("LookupPTR() => %v", err)
+	}
+	if len(ptr) != 2 || ptr["192.0.2.1"] != "mail.example.com." || ptr["2001:db8::1"] != "mail6.example.com." {
+		t.Fatalf("Unexpected PTRs: %v", ptr)
+	}
+
+	if err := p.DeletePTR(ctx, "192.0.2.1"); err != nil {
+		t.Fatalf("DeletePTR() => %v", err)
+	}
+	if ptr, _ := p.LookupPTR(ctx, []string{"192.0.2.1"}); len(ptr) != 0 {
+		t.Fatalf("PTR must be deleted, got %v", ptr)
+	}
+
+	unauthorized, _ := NewPowerDNS(Config{URL: srv.URL})
+	if err := unauthorized.DeletePTR(ctx, "192.0.2.1"); err == nil || !strings.Contains(err.Error(), "Unauthorized") {
+		t.Fatalf("Expected API error, got %v", err)
+	}
+}
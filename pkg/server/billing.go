@@ -5,6 +5,7 @@ import (
 	"fmt"
 	sppb "github.com/slntopp/nocloud-proto/services_providers"
 	"github.com/slntopp/nocloud/pkg/nocloud/suspend_rules"
+	"maps"
 	"math"
 	"regexp"
 	"strings"
@@ -86,7 +87,53 @@ type RecordsPublisherFunc func(context.Context, []*billingpb.Record)
 
 type EventsPublisherFunc func(context.Context, *epb.Event)
 
-func handleNonRegularInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, events EventsPublisherFunc, client *one.ONeClient,
+// Time Instances are billed at and where billing outcome goes to
+type billingEnv struct {
+	clock   utils.IClock
+	records RecordsPublisherFunc
+	events  EventsPublisherFunc
+	data    func(string, map[string]*structpb.Value)
+	status  func(string, *statuspb.Status)
+	// Publishing is run in background unless set
+	sync bool
+}
+
+// Monitoring billing: current time, records and events go to the given publishers, data and statuses to datas
+func newBillingEnv(records RecordsPublisherFunc, events EventsPublisherFunc) *billingEnv {
+	return &billingEnv{
+		clock:   clock,
+		records: records,
+		events:  events,
+		data:    datas.DataPublisher(datas.POST_INST_DATA),
+		status:  datas.PostInstanceStatus,
+	}
+}
+
+func (e *billingEnv) run(f func()) {
+	if e.sync {
+		f()
+		return
+	}
+	go f()
+}
+
+func (e *billingEnv) publishRecords(records []*billingpb.Record) {
+	e.run(func() { e.records(context.Background(), records) })
+}
+
+func (e *billingEnv) publishEvent(event *epb.Event) {
+	e.run(func() { e.events(context.Background(), event) })
+}
+
+func (e *billingEnv) publishData(i *ipb.Instance) {
+	e.run(func() { utils.SendActualMonitoringData(i.Data, i.Data, i.Uuid, e.data) })
+}
+
+func (e *billingEnv) publishStatus(uuid string, status *statuspb.Status) {
+	e.run(func() { e.status(uuid, status) })
+}
+
+func handleNonRegularInstanceBilling(logger *zap.Logger, env *billingEnv, client one.IClient,
 	i *ipb.Instance, status statuspb.NoCloudStatus, addons map[string]*apb.Addon, sp *sppb.ServicesProvider) {
 	log := logger.Named("NonRegularInstanceBillingHandler").Named(i.GetUuid())
 	if i.GetStatus() == statuspb.NoCloudStatus_DEL {
@@ -102,7 +149,7 @@ func handleNonRegularInstanceBilling(logger *zap.Logger, records RecordsPublishe
 	}
 
 	if lastMonitoring, ok := data["last_monitoring"]; ok {
-		now := time.Now().Unix()
+		now := env.clock.Now().Unix()
 		lastMonitoringValue := int64(lastMonitoring.GetNumberValue())
 		freeze := data["freeze"].GetBoolValue()
 		var immune_date_val int64
@@ -128,13 +175,13 @@ func handleNonRegularInstanceBilling(logger *zap.Logger, records RecordsPublishe
 
 		if now > lastMonitoringValue && state != "SUSPENDED" && !freeze && now >= immune_date_val {
 
-			if suspend_rules.SuspendAllowed(sp.GetSuspendRules(), time.Now().UTC()) {
+			if suspend_rules.SuspendAllowed(sp.GetSuspendRules(), env.clock.Now().UTC()) {
 				err := client.SuspendVM(vmid)
 				if err != nil {
 					log.Error("Failed to suspend vm", zap.Error(err))
 					return
 				}
-				go events(context.Background(), &epb.Event{
+				env.publishEvent(&epb.Event{
 					Uuid: i.GetUuid(),
 					Key:  "instance_suspended",
 					Data: map[string]*structpb.Value{},
@@ -149,7 +196,7 @@ func handleNonRegularInstanceBilling(logger *zap.Logger, records RecordsPublishe
 				log.Error("Failed to resume vm", zap.Error(err))
 				return
 			}
-			go events(context.Background(), &epb.Event{
+			env.publishEvent(&epb.Event{
 				Uuid: i.GetUuid(),
 				Key:  "instance_unsuspended",
 				Data: map[string]*structpb.Value{},
@@ -186,7 +233,7 @@ func handleNonRegularInstanceBilling(logger *zap.Logger, records RecordsPublishe
 				i.Data["next_payment_date"] = structpb.NewNumberValue(float64(last))
 			}
 		}
-		go utils.SendActualMonitoringData(i.Data, i.Data, i.Uuid, datas.DataPublisher(datas.POST_INST_DATA))
+		env.publishData(i)
 
 	} else {
 		plan := i.BillingPlan
@@ -194,6 +241,9 @@ func handleNonRegularInstanceBilling(logger *zap.Logger, records RecordsPublishe
 			log.Warn("Instance has no Billing Plan", zap.Any("instance", i))
 			return
 		}
+		if _, ok := i.Data[BILLED_PRODUCT]; !ok {
+			rememberBilledConfig(i)
+		}
 
 		vmid, err := one.GetVMIDFromData(client, i)
 		if err != nil {
@@ -223,7 +273,7 @@ func handleNonRegularInstanceBilling(logger *zap.Logger, records RecordsPublishe
 
 		product, ok := i.BillingPlan.Products[i.GetProduct()]
 		if !ok {
-			log.Warn("Product not found", zap.String("product", *i.Product))
+			log.Warn("Product not found", zap.String("product", i.GetProduct()))
 		}
 		for _, addonId := range i.GetAddons() {
 			addon, ok := addons[addonId]
@@ -245,7 +295,7 @@ func handleNonRegularInstanceBilling(logger *zap.Logger, records RecordsPublishe
 				priority = billingpb.Priority_NORMAL
 			}
 
-			recs, last := handleAddonBilling(log, i, lm, priority, addon)
+			recs, last := handleAddonBilling(log, i, lm, priority, addon, env.clock)
 			if len(recs) > 0 {
 				if product.GetPeriod() == 0 {
 					if !ok {
@@ -269,13 +319,13 @@ func handleNonRegularInstanceBilling(logger *zap.Logger, records RecordsPublishe
 				last = created
 			}
 
-			handler, ok := handlers.Get(resource.Key)
+			handler, ok := handlers.Lookup(resource.Key, sp)
 			if !ok {
 				log.Warn("Handler not found", zap.String("resource", resource.Key))
 				continue
 			}
 			log.Debug("Handling", zap.String("resource", resource.Key), zap.Int64("last", last), zap.Int64("created", created), zap.Any("kind", resource.Kind))
-			new, last := handler(log, timeline, i, vm, resource, client, last, clock)
+			new, last := handler(log, timeline, i, vm, resource, client, last, env.clock)
 
 			if resource.GetPeriod() == 0 {
 				if !ok {
@@ -336,7 +386,7 @@ func handleNonRegularInstanceBilling(logger *zap.Logger, records RecordsPublishe
 						i.Data["last_monitoring"] = structpb.NewNumberValue(float64(last))
 					}
 				} else {
-					new, last := handleStaticBilling(log, i, last, priority)
+					new, last := handleStaticBilling(log, i, last, priority, env.clock)
 
 					if len(new) != 0 {
 						productRecords = append(productRecords, new...)
@@ -354,24 +404,24 @@ func handleNonRegularInstanceBilling(logger *zap.Logger, records RecordsPublishe
 
 		}
 
-		go records(context.Background(), append(resourceRecords, productRecords...))
+		env.publishRecords(append(resourceRecords, productRecords...))
 		price := getInstancePrice(i)
-		go events(context.Background(), &epb.Event{
+		env.publishEvent(&epb.Event{
 			Uuid: i.GetUuid(),
 			Key:  "instance_renew",
 			Data: map[string]*structpb.Value{
 				"price": structpb.NewNumberValue(price),
 			},
 		})
-		go utils.SendActualMonitoringData(i.Data, i.Data, i.Uuid, datas.DataPublisher(datas.POST_INST_DATA))
+		env.publishData(i)
 	}
 }
 
-func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, events EventsPublisherFunc, client one.IClient, i *ipb.Instance,
+func handleInstanceBilling(logger *zap.Logger, env *billingEnv, client one.IClient, i *ipb.Instance,
 	status statuspb.NoCloudStatus, balance *float64, addons map[string]*apb.Addon, sp *sppb.ServicesProvider) {
 	log := logger.Named("InstanceBillingHandler").Named(i.GetUuid())
 
-	now := time.Now().Unix()
+	now := env.clock.Now().Unix()
 	var immune_date_val int64
 	immune_date, ok := i.GetData()["immune_date"]
 	if !ok {
@@ -392,6 +442,9 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 		log.Warn("Instance has no Billing Plan", zap.Any("instance", i))
 		return
 	}
+	if _, ok := i.Data[BILLED_PRODUCT]; !ok {
+		rememberBilledConfig(i)
+	}
 
 	vmid, err := one.GetVMIDFromData(client, i)
 	if err != nil {
@@ -434,13 +487,13 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 			last = created
 		}
 
-		handler, hOk := handlers.Get(resource.Key)
+		handler, hOk := handlers.Lookup(resource.Key, sp)
 		if !hOk {
 			log.Warn("Handler not found", zap.String("resource", resource.Key))
 			continue
 		}
 		log.Debug("Handling", zap.String("resource", resource.Key), zap.Int64("last", last), zap.Int64("created", created), zap.Any("kind", resource.Kind))
-		new, last := handler(log, timeline, i, vm, resource, client, last, clock)
+		new, last := handler(log, timeline, i, vm, resource, client, last, env.clock)
 
 		if resource.GetPeriod() == 0 {
 			if !ok {
@@ -481,7 +534,7 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 
 	product, ok := i.BillingPlan.Products[i.GetProduct()]
 	if !ok {
-		log.Warn("Product not found", zap.String("product", *i.Product))
+		log.Warn("Product not found", zap.String("product", i.GetProduct()))
 	}
 	for _, addonId := range i.GetAddons() {
 		addon, ok := addons[addonId]
@@ -503,7 +556,7 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 			priority = billingpb.Priority_NORMAL
 		}
 
-		recs, last := handleAddonBilling(log, i, lm, priority, addon)
+		recs, last := handleAddonBilling(log, i, lm, priority, addon, env.clock)
 		if len(recs) > 0 {
 			if product.GetPeriod() == 0 {
 				if !ok {
@@ -545,7 +598,7 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 				i.Data["last_monitoring"] = structpb.NewNumberValue(float64(last))
 			}
 		} else {
-			new, last := handleStaticBilling(log, i, last, priority)
+			new, last := handleStaticBilling(log, i, last, priority, env.clock)
 
 			if len(new) != 0 {
 				productRecords = append(productRecords, new...)
@@ -576,11 +629,11 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 	if sum > 0 && sum > *balance {
 		if state != "SUSPENDED" {
 
-			if suspend_rules.SuspendAllowed(sp.GetSuspendRules(), time.Now().UTC()) {
+			if suspend_rules.SuspendAllowed(sp.GetSuspendRules(), env.clock.Now().UTC()) {
 				if err := client.SuspendVM(vmid); err != nil {
 					log.Warn("Could not suspend VM with VMID", zap.Int("vmid", vmid))
 				}
-				go events(context.Background(), &epb.Event{
+				env.publishEvent(&epb.Event{
 					Uuid: i.GetUuid(),
 					Key:  "instance_suspended",
 					Data: map[string]*structpb.Value{},
@@ -595,11 +648,11 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 
 	*balance -= sum
 
-	go records(context.Background(), append(resourceRecords, productRecords...))
+	env.publishRecords(append(resourceRecords, productRecords...))
 	if len(productRecords) != 0 && state != "SUSPENDED" {
 		if !first_payment {
 			price := getInstancePrice(i)
-			go events(context.Background(), &epb.Event{
+			env.publishEvent(&epb.Event{
 				Uuid: i.GetUuid(),
 				Key:  "instance_renew",
 				Data: map[string]*structpb.Value{
@@ -616,13 +669,13 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 		if status == statuspb.NoCloudStatus_SUS && i.GetStatus() != statuspb.NoCloudStatus_DEL && now >= immune_date_val {
 			if (len(productRecords) != 0 || (len(productRecords) == 0 && len(resourceRecords) != 0 && !isStatic)) && state != "SUSPENDED" {
 
-				if suspend_rules.SuspendAllowed(sp.GetSuspendRules(), time.Now().UTC()) {
+				if suspend_rules.SuspendAllowed(sp.GetSuspendRules(), env.clock.Now().UTC()) {
 					if err := client.SuspendVM(vmid); err != nil {
 						log.Warn("Could not suspend VM with VMID", zap.Int("vmid", vmid))
 					}
-					suspendTime := structpb.NewNumberValue(float64(time.Now().Unix()))
+					suspendTime := structpb.NewNumberValue(float64(env.clock.Now().Unix()))
 					i.Data["suspend_time"] = suspendTime
-					go events(context.Background(), &epb.Event{
+					env.publishEvent(&epb.Event{
 						Uuid: i.GetUuid(),
 						Key:  "instance_suspended",
 						Data: map[string]*structpb.Value{},
@@ -635,7 +688,7 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 
 			if state == "SUSPENDED" {
 				if _, ok := i.Data["last_monitoring"]; ok {
-					now := time.Now().Unix()
+					now := env.clock.Now().Unix()
 					nowPb := structpb.NewNumberValue(float64(now))
 					i.Data["last_monitoring"] = nowPb
 					i.Data["next_payment_date"] = nextPaymentDate
@@ -649,7 +702,7 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 
 				delete(i.Data, "suspend_time")
 
-				go events(context.Background(), &epb.Event{
+				env.publishEvent(&epb.Event{
 					Uuid: i.GetUuid(),
 					Key:  "instance_unsuspended",
 					Data: map[string]*structpb.Value{},
@@ -658,7 +711,7 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 		}
 
 		if status == statuspb.NoCloudStatus_DETACHED {
-			now := time.Now().Unix()
+			now := env.clock.Now().Unix()
 			nowPb := structpb.NewNumberValue(float64(now))
 			i.Data["last_monitoring"] = nowPb
 		}
@@ -666,9 +719,9 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 		log.Debug("Next payment", zap.Any("p", i.Data["next_payment_date"]))
 
 		if state == "SUSPENDED" && !i.GetData()["suspended_manually"].GetBoolValue() {
-			handleSuspendEvent(i, events)
+			handleSuspendEvent(i, env)
 		} else {
-			handleBillingEvent(i, events)
+			handleBillingEvent(i, env)
 		}
 
 		canceled_renew, ok := i.Data["canceled_renew"]
@@ -678,13 +731,13 @@ func handleInstanceBilling(logger *zap.Logger, records RecordsPublisherFunc, eve
 		thirdCondition := ok && status == statuspb.NoCloudStatus_SUS
 
 		if firstCondition || secondCondition || thirdCondition {
-			go datas.PostInstanceStatus(i.GetUuid(), &statuspb.Status{
+			env.publishStatus(i.GetUuid(), &statuspb.Status{
 				Status: statuspb.NoCloudStatus_DEL,
 			})
 		}
 	}
 
-	go utils.SendActualMonitoringData(i.Data, i.Data, i.Uuid, datas.DataPublisher(datas.POST_INST_DATA))
+	env.publishData(i)
 }
 
 func calculateResourcePrice(i *ipb.Instance, res string) float64 {
@@ -692,7 +745,10 @@ func calculateResourcePrice(i *ipb.Instance, res string) float64 {
 		return 0
 	}
 	count := i.Resources[res].GetNumberValue()
-	if res == "ram" || res == "drive_ssd" || res == "drive_hdd" {
+	if strings.HasPrefix(res, "drive_") {
+		count = one.DrivesByType(i.Resources)[strings.TrimPrefix(res, "drive_")]
+	}
+	if res == "ram" || strings.HasPrefix(res, "drive_") {
 		count /= 1024
 	}
 	for _, bpRes := range i.BillingPlan.Resources {
@@ -729,13 +785,13 @@ func calculateAddonPrice(addons map[string]*apb.Addon, i *ipb.Instance, id strin
 	return addon.Periods[period]
 }
 
-func handleSuspendEvent(i *ipb.Instance, events EventsPublisherFunc) {
+func handleSuspendEvent(i *ipb.Instance, env *billingEnv) {
 	if i.GetStatus() == statuspb.NoCloudStatus_DEL {
 		return
 	}
 
 	data := i.GetData()
-	now := time.Now().Unix()
+	now := env.clock.Now().Unix()
 
 	suspend_time, ok := data["suspend_time"]
 	if !ok {
@@ -752,7 +808,7 @@ func handleSuspendEvent(i *ipb.Instance, events EventsPublisherFunc) {
 
 			if !ok {
 				data["suspend_notification_period"] = structpb.NewNumberValue(float64(val.Days))
-				go events(context.Background(), &epb.Event{
+				env.publishEvent(&epb.Event{
 					Uuid: i.GetUuid(),
 					Key:  "suspend_expiry_notification",
 					Data: map[string]*structpb.Value{
@@ -763,7 +819,7 @@ func handleSuspendEvent(i *ipb.Instance, events EventsPublisherFunc) {
 
 			if val.Days != int64(suspend_notification_period.GetNumberValue()) {
 				data["suspend_notification_period"] = structpb.NewNumberValue(float64(val.Days))
-				go events(context.Background(), &epb.Event{
+				env.publishEvent(&epb.Event{
 					Uuid: i.GetUuid(),
 					Key:  "suspend_expiry_notification",
 					Data: map[string]*structpb.Value{
@@ -776,11 +832,11 @@ func handleSuspendEvent(i *ipb.Instance, events EventsPublisherFunc) {
 	}
 
 	/*if int64(data["suspend_notification_period"].GetNumberValue()) == 7 {
-		go datas.PostInstanceStatus(i.GetUuid(), &statuspb.Status{
+		env.publishStatus(i.GetUuid(), &statuspb.Status{
 			Status: statuspb.NoCloudStatus_DEL,
 		})
 
-		go events(context.Background(), &epb.Event{
+		env.publishEvent(&epb.Event{
 			Uuid: i.GetUuid(),
 			Key:  "suspend_delete_instance",
 			Data: map[string]*structpb.Value{},
@@ -790,13 +846,13 @@ func handleSuspendEvent(i *ipb.Instance, events EventsPublisherFunc) {
 	i.Data = data
 }
 
-func handleBillingEvent(i *ipb.Instance, events EventsPublisherFunc) {
+func handleBillingEvent(i *ipb.Instance, env *billingEnv) {
 	if i.GetStatus() == statuspb.NoCloudStatus_DEL {
 		return
 	}
 
 	data := i.GetData()
-	now := time.Now().Unix()
+	now := env.clock.Now().Unix()
 
 	last_monitoring, ok := data["last_monitoring"]
 	if !ok {
@@ -840,7 +896,7 @@ func handleBillingEvent(i *ipb.Instance, events EventsPublisherFunc) {
 			notification_period, ok := data["notification_period"]
 			if !ok {
 				data["notification_period"] = structpb.NewNumberValue(float64(val.Days))
-				go events(context.Background(), &epb.Event{
+				env.publishEvent(&epb.Event{
 					Uuid: i.GetUuid(),
 					Key:  "expiry_notification",
 					Data: map[string]*structpb.Value{
@@ -854,7 +910,7 @@ func handleBillingEvent(i *ipb.Instance, events EventsPublisherFunc) {
 
 			if val.Days != int64(notification_period.GetNumberValue()) {
 				data["notification_period"] = structpb.NewNumberValue(float64(val.Days))
-				go events(context.Background(), &epb.Event{
+				env.publishEvent(&epb.Event{
 					Uuid: i.GetUuid(),
 					Key:  "expiry_notification",
 					Data: map[string]*structpb.Value{
@@ -899,7 +955,7 @@ func handleManualRenewBilling(logger *zap.Logger, records RecordsPublisherFunc,
 		recs = append(recs, &billingpb.Record{
 			Start:    start,
 			End:      end,
-			Exec:     time.Now().Unix(),
+			Exec:     clock.Now().Unix(),
 			Priority: billingpb.Priority_URGENT,
 			Instance: i.GetUuid(),
 			Product:  product,
@@ -925,13 +981,12 @@ func handleManualRenewBilling(logger *zap.Logger, records RecordsPublisherFunc,
 		}
 
 		if strings.Contains(resource.GetKey(), "drive") {
-			driveType := resources["drive_type"].GetStringValue()
-
-			if resource.GetKey() != "drive_"+strings.ToLower(driveType) {
+			size, ok := one.DrivesByType(resources)[strings.TrimPrefix(resource.GetKey(), "drive_")]
+			if !ok {
 				continue
 			}
 
-			value := resources["drive_size"].GetNumberValue() / 1024
+			value := size / 1024
 
 			log.Debug("Temp", zap.Any("price", resource.GetPrice()), zap.Any("val", value))
 
@@ -941,7 +996,7 @@ func handleManualRenewBilling(logger *zap.Logger, records RecordsPublisherFunc,
 			recs = append(recs, &billingpb.Record{
 				Start:    start,
 				End:      end,
-				Exec:     time.Now().Unix(),
+				Exec:     clock.Now().Unix(),
 				Priority: billingpb.Priority_URGENT,
 				Instance: i.GetUuid(),
 				Resource: resource.GetKey(),
@@ -962,7 +1017,7 @@ func handleManualRenewBilling(logger *zap.Logger, records RecordsPublisherFunc,
 			recs = append(recs, &billingpb.Record{
 				Start:    start,
 				End:      end,
-				Exec:     time.Now().Unix(),
+				Exec:     clock.Now().Unix(),
 				Priority: billingpb.Priority_URGENT,
 				Instance: i.GetUuid(),
 				Resource: resource.GetKey(),
@@ -974,7 +1029,7 @@ func handleManualRenewBilling(logger *zap.Logger, records RecordsPublisherFunc,
 
 	prod, ok := i.BillingPlan.Products[i.GetProduct()]
 	if !ok {
-		log.Warn("Product not found", zap.String("product", *i.Product))
+		log.Warn("Product not found", zap.String("product", i.GetProduct()))
 	}
 	for _, addonId := range i.GetAddons() {
 		if prod.GetPeriod() == 0 {
@@ -999,7 +1054,7 @@ func handleManualRenewBilling(logger *zap.Logger, records RecordsPublisherFunc,
 		recs = append(recs, &billingpb.Record{
 			Start:    lm,
 			End:      end,
-			Exec:     time.Now().Unix(),
+			Exec:     clock.Now().Unix(),
 			Priority: billingpb.Priority_URGENT,
 			Instance: i.GetUuid(),
 			Addon:    addonId,
@@ -1014,39 +1069,6 @@ func handleManualRenewBilling(logger *zap.Logger, records RecordsPublisherFunc,
 	go utils.SendActualMonitoringData(i.Data, i.Data, i.Uuid, datas.DataPublisher(datas.POST_INST_DATA))
 }
 
-type BillingHandlerFunc func(
-	*zap.Logger,
-	LazyTimeline,
-	*ipb.Instance,
-	LazyVM,
-	*billingpb.ResourceConf,
-	one.IClient,
-	int64,
-	utils.IClock,
-) ([]*billingpb.Record, int64)
-
-var handlers = BillingMap{
-	handlers: map[string]BillingHandlerFunc{
-		"cpu":        handleCPUBilling,
-		"ram":        handleRAMBilling,
-		"ips_public": handleIPBilling,
-		// See BillingMap.Get for other handlers
-		// e.g. drive_${driveKind}
-	},
-}
-
-type BillingMap struct {
-	handlers map[string]BillingHandlerFunc
-}
-
-func (m *BillingMap) Get(key string) (BillingHandlerFunc, bool) {
-	if strings.Contains(key, "drive_") {
-		return handleDriveBilling, true
-	}
-	handler, ok := m.handlers[key]
-	return handler, ok
-}
-
 func resourceKeyToDriveKind(key string) (string, error) {
 	r, err := regexp.Compile(`drive.*_([A-Za-z]+)`)
 	if err != nil {
@@ -1073,7 +1095,7 @@ func handleDriveBilling(log *zap.Logger, ltl LazyTimeline, i *ipb.Instance, vm L
 			capacity, _ := disk.GetFloat("SIZE")
 			driveType, _ := disk.GetStr("DRIVE_TYPE")
 
-			if driveType == driveKind {
+			if strings.EqualFold(driveType, driveKind) {
 				total += capacity / 1024
 			}
 		}
@@ -1090,39 +1112,66 @@ func handleDriveBilling(log *zap.Logger, ltl LazyTimeline, i *ipb.Instance, vm L
 func handleIPBilling(log *zap.Logger, ltl LazyTimeline, i *ipb.Instance, vm LazyVM, res *billingpb.ResourceConf, c one.IClient, last int64, clock utils.IClock) ([]*billingpb.Record, int64) {
 	o, _ := vm()
 	ip := Lazy(func() float64 {
-		publicNetworks := 0.0
-		nics := o.Template.GetNICs()
-		for _, nic := range nics {
-			id, err := nic.GetInt(string(oneshared.NetworkID))
-			if err != nil {
-				log.Warn("Can't get NETWORK_ID from VM template", zap.String("Instance id", i.GetUuid()), zap.Int("VM id", o.ID))
-				continue
-			}
+		// IPv6 only NICs are billed by public_ipv6
+		return countPublicNICs(log, i, o, c, func(nic *oneshared.NIC) bool {
+			ip, _ := nic.GetStr(string(oneshared.IP))
+			return ip != "" || one.NICIPv6(nic) == ""
+		})
+	})
 
-			vnet, err := c.GetVNet(id)
-			if err != nil {
-				log.Warn("Can't get vnet by id", zap.String("Instance id", i.GetUuid()), zap.Int("vnet id", id))
-				continue
-			}
+	if res.GetPeriod() == 0 {
+		return handleCapacityZeroBilling(log.Named("IP"), ip, ltl, i, res, last, clock)
+	}
 
-			vnetType, err := vnet.Template.GetStr("TYPE")
-			if err != nil {
-				log.Warn("Can't get vnet type from vnet attributes", zap.String("Instance id", i.GetUuid()), zap.Int("vnet id", id))
-				continue
-			}
+	return handleCapacityBilling(log.Named("IP"), ip, ltl, i, res, last, clock)
+}
 
-			if vnetType == "PUBLIC" {
-				publicNetworks += 1.0
-			}
-		}
-		return publicNetworks
+func handleIPv6Billing(log *zap.Logger, ltl LazyTimeline, i *ipb.Instance, vm LazyVM, res *billingpb.ResourceConf, c one.IClient, last int64, clock utils.IClock) ([]*billingpb.Record, int64) {
+	o, _ := vm()
+	ip := Lazy(func() float64 {
+		return countPublicNICs(log, i, o, c, func(nic *oneshared.NIC) bool {
+			return one.NICIPv6(nic) != ""
+		})
 	})
 
 	if res.GetPeriod() == 0 {
-		return handleCapacityZeroBilling(log.Named("IP"), ip, ltl, i, res, last, clock)
+		return handleCapacityZeroBilling(log.Named("IPv6"), ip, ltl, i, res, last, clock)
 	}
 
-	return handleCapacityBilling(log.Named("IP"), ip, ltl, i, res, last, clock)
+	return handleCapacityBilling(log.Named("IPv6"), ip, ltl, i, res, last, clock)
+}
+
+// Counts VM NICs matching filter, which are leased from PUBLIC VNets
+func countPublicNICs(log *zap.Logger, i *ipb.Instance, o *onevm.VM, c one.IClient, filter func(nic *oneshared.NIC) bool) float64 {
+	publicNetworks := 0.0
+	nics := o.Template.GetNICs()
+	for _, nic := range nics {
+		if !filter(&nic) {
+			continue
+		}
+		id, err := nic.GetInt(string(oneshared.NetworkID))
+		if err != nil {
+			log.Warn("Can't get NETWORK_ID from VM template", zap.String("Instance id", i.GetUuid()), zap.Int("VM id", o.ID))
+			continue
+		}
+
+		vnet, err := c.GetVNet(id)
+		if err != nil {
+			log.Warn("Can't get vnet by id", zap.String("Instance id", i.GetUuid()), zap.Int("vnet id", id))
+			continue
+		}
+
+		vnetType, err := vnet.Template.GetStr("TYPE")
+		if err != nil {
+			log.Warn("Can't get vnet type from vnet attributes", zap.String("Instance id", i.GetUuid()), zap.Int("vnet id", id))
+			continue
+		}
+
+		if vnetType == "PUBLIC" {
+			publicNetworks += 1.0
+		}
+	}
+	return publicNetworks
 }
 
 func handleCPUBilling(log *zap.Logger, ltl LazyTimeline, i *ipb.Instance, vm LazyVM, res *billingpb.ResourceConf, c one.IClient, last int64, clock utils.IClock) ([]*billingpb.Record, int64) {
@@ -1204,11 +1253,11 @@ func handleCapacityBilling(log *zap.Logger, amount func() float64, ltl LazyTimel
 	return records, last
 }
 
-func handleAddonBilling(log *zap.Logger, i *ipb.Instance, last int64, priority billingpb.Priority, addon *apb.Addon) ([]*billingpb.Record, int64) {
+func handleAddonBilling(log *zap.Logger, i *ipb.Instance, last int64, priority billingpb.Priority, addon *apb.Addon, clock utils.IClock) ([]*billingpb.Record, int64) {
 	log.Debug("Handling Addon Billing", zap.Int64("last", last))
 	product, ok := i.BillingPlan.Products[i.GetProduct()]
 	if !ok {
-		log.Warn("Product not found", zap.String("product", *i.Product), zap.String("addon", addon.GetUuid()))
+		log.Warn("Product not found", zap.String("product", i.GetProduct()), zap.String("addon", addon.GetUuid()))
 		return nil, last
 	}
 	period := product.Period
@@ -1230,7 +1279,7 @@ func handleAddonBilling(log *zap.Logger, i *ipb.Instance, last int64, priority b
 	// Handle periodic addon payment
 	if addon.Kind == apb.Kind_POSTPAID {
 		log.Debug("Handling Postpaid Billing", zap.Any("addon", addon.GetUuid()))
-		for end := last + period; end <= time.Now().Unix(); end += period {
+		for end := last + period; end <= clock.Now().Unix(); end += period {
 
 			if product.GetPeriodKind() != billingpb.PeriodKind_DEFAULT {
 				end = utils.AlignPaymentDate(last, end, period, i)
@@ -1246,8 +1295,8 @@ func handleAddonBilling(log *zap.Logger, i *ipb.Instance, last int64, priority b
 		}
 	} else {
 		end := last + period
-		log.Debug("Handling Prepaid Billing", zap.Any("addon", addon.GetUuid()), zap.Int64("end", end), zap.Int64("now", time.Now().Unix()))
-		for ; last <= time.Now().Unix(); end += period {
+		log.Debug("Handling Prepaid Billing", zap.Any("addon", addon.GetUuid()), zap.Int64("end", end), zap.Int64("now", clock.Now().Unix()))
+		for ; last <= clock.Now().Unix(); end += period {
 			if product.GetPeriodKind() != billingpb.PeriodKind_DEFAULT {
 				end = utils.AlignPaymentDate(last, end, product.Period, i)
 			}
@@ -1265,18 +1314,18 @@ func handleAddonBilling(log *zap.Logger, i *ipb.Instance, last int64, priority b
 	return records, last
 }
 
-func handleStaticBilling(log *zap.Logger, i *ipb.Instance, last int64, priority billingpb.Priority) ([]*billingpb.Record, int64) {
+func handleStaticBilling(log *zap.Logger, i *ipb.Instance, last int64, priority billingpb.Priority, clock utils.IClock) ([]*billingpb.Record, int64) {
 	log.Debug("Handling Static Billing", zap.Int64("last", last))
 	product, ok := i.BillingPlan.Products[*i.Product]
 	if !ok {
-		log.Warn("Product not found", zap.String("product", *i.Product))
+		log.Warn("Product not found", zap.String("product", i.GetProduct()))
 		return nil, last
 	}
 
 	var records []*billingpb.Record
 	if product.Kind == billingpb.Kind_POSTPAID {
 		log.Debug("Handling Postpaid Billing", zap.Any("product", product))
-		for end := last + product.Period; end <= time.Now().Unix(); end += product.Period {
+		for end := last + product.Period; end <= clock.Now().Unix(); end += product.Period {
 
 			if product.GetPeriodKind() != billingpb.PeriodKind_DEFAULT {
 				end = utils.AlignPaymentDate(last, end, product.Period, i)
@@ -1292,8 +1341,8 @@ func handleStaticBilling(log *zap.Logger, i *ipb.Instance, last int64, priority
 		}
 	} else {
 		end := last + product.Period
-		log.Debug("Handling Prepaid Billing", zap.Any("product", product), zap.Int64("end", end), zap.Int64("now", time.Now().Unix()))
-		for ; last <= time.Now().Unix(); end += product.Period {
+		log.Debug("Handling Prepaid Billing", zap.Any("product", product), zap.Int64("end", end), zap.Int64("now", clock.Now().Unix()))
+		for ; last <= clock.Now().Unix(); end += product.Period {
 			if product.GetPeriodKind() != billingpb.PeriodKind_DEFAULT {
 				end = utils.AlignPaymentDate(last, end, product.Period, i)
 			}
@@ -1331,7 +1380,7 @@ func handleStaticZeroBilling(log *zap.Logger, i *ipb.Instance, last int64, prior
 	log.Debug("Handling Static Billing", zap.Int64("last", last))
 	_, ok := i.BillingPlan.Products[*i.Product]
 	if !ok {
-		log.Warn("Product not found", zap.String("product", *i.Product))
+		log.Warn("Product not found", zap.String("product", i.GetProduct()))
 		return nil, last
 	}
 
@@ -1347,65 +1396,63 @@ func handleStaticZeroBilling(log *zap.Logger, i *ipb.Instance, last int64, prior
 	return records, last
 }
 
-func handleUpgradeBilling(log *zap.Logger, instances []*ipb.Instance, c *one.ONeClient, publish RecordsPublisherFunc) {
-	now := time.Now().Unix()
-
+// Prorates billing of updated Instances. Must be called before the update is applied, since old resources are taken from VMs
+func handleUpgradeBilling(log *zap.Logger, instances []*ipb.Instance, c one.IClient, addons map[string]*apb.Addon, publish RecordsPublisherFunc, clock utils.IClock) {
 	var records []*billingpb.Record
 
 	for _, inst := range instances {
-		plan := inst.GetBillingPlan()
-		if plan == nil {
-			break
+		if inst.GetBillingPlan() == nil {
+			continue
 		}
-		resources := plan.GetResources()
-
-		diffSlice := c.GetVmResourcesDiff(inst)
-
-		for _, diff := range diffSlice {
-			for _, res := range resources {
-				if diff.ResName == res.GetKey() {
-					log.Info("Billing res", zap.String("res", diff.ResName), zap.Float64("diff", diff.OldResCount))
-					instData := inst.GetData()
-					if instData == nil {
-						log.Info("Data is empty", zap.String("uuid", inst.GetUuid()))
-						continue
-					}
 
-					key := fmt.Sprintf("%s_last_monitoring", diff.ResName)
-
-					lastMonitoring, ok := instData[key]
-					if !ok {
-						log.Info("No param ins data", zap.String("uuid", inst.GetUuid()), zap.String("param", key))
-						continue
-					}
-
-					if res.Kind == billingpb.Kind_PREPAID {
-						timeDiff := int64(lastMonitoring.GetNumberValue()) - now
-
-						total := (float64(timeDiff) / float64(res.GetPeriod())) * (diff.NewResCount - diff.OldResCount)
-						total = math.Round(total*100) / 100.0
-
-						if diff.ResName == "ips_public" {
-							total /= diff.NewResCount - diff.OldResCount
-							if diff.NewResCount-diff.OldResCount < 0 {
-								total *= -1
-							}
-						}
+		// Prorated from the resources billed last time, so change which isn't applied to VM yet is prorated once.
+		// VM ones are taken if they weren't remembered yet
+		old, new := billedConfig(inst), BillingConfig{Product: inst.GetProduct(), Addons: inst.GetAddons(), Resources: one.BillableResources(inst)}
+		if old.Resources == nil {
+			old.Resources = maps.Clone(new.Resources)
+			for _, diff := range c.GetVmResourcesDiff(inst) {
+				old.Resources[diff.ResName] = diff.OldResCount
+			}
+		}
+		for key, value := range new.Resources {
+			if old.Resources[key] != value {
+				log.Info("Billing res", zap.String("res", key), zap.Float64("old", old.Resources[key]), zap.Float64("new", value))
+			}
+		}
 
-						records = append(records, &billingpb.Record{
-							Start: now, End: int64(lastMonitoring.GetNumberValue()), Exec: now,
-							Priority: billingpb.Priority_ADDITIONAL,
-							Instance: inst.GetUuid(),
-							Resource: diff.ResName,
-							Total:    total,
-						})
-					}
+		timeline := Lazy(func() []one.Record {
+			vmid, err := one.GetVMIDFromData(c, inst)
+			if err != nil {
+				return nil
+			}
+			o, err := c.GetVM(vmid)
+			if err != nil {
+				return nil
+			}
+			return one.MakeTimeline(o)
+		})
+		proration := &Proration{Clock: clock, Billable: func(res *billingpb.ResourceConf, start, end int64) int64 {
+			on := make(map[stpb.NoCloudState]bool)
+			for _, s := range res.On {
+				on[s] = true
+			}
+			var billable int64
+			for _, rec := range one.FilterTimeline(timeline(), start, end) {
+				if _, ok := on[rec.State]; ok != res.Except {
+					billable += rec.End - rec.Start
 				}
 			}
-		}
+			return billable
+		}}
+
+		records = append(records, proration.Prorate(inst, old, new, addons)...)
+		rememberBilledConfig(inst)
+		go datas.DataPublisher(datas.POST_INST_DATA)(inst.GetUuid(), inst.GetData())
 	}
 
-	publish(context.Background(), records)
+	if len(records) != 0 {
+		go publish(context.Background(), records)
+	}
 }
 
 func getInstancePrice(i *ipb.Instance) float64 {
@@ -1418,11 +1465,11 @@ func getInstancePrice(i *ipb.Instance) float64 {
 
 	for _, resource := range plan.GetResources() {
 		if strings.Contains(resource.GetKey(), "drive") {
-			driveType := resources["drive_type"].GetStringValue()
-			if resource.GetKey() != "drive_"+strings.ToLower(driveType) {
+			size, ok := one.DrivesByType(resources)[strings.TrimPrefix(resource.GetKey(), "drive_")]
+			if !ok {
 				continue
 			}
-			value := resources["drive_size"].GetNumberValue() / 1024
+			value := size / 1024
 			total := math.Round(resource.GetPrice()*value*100) / 100.0
 			price += total
 
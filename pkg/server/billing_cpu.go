@@ -0,0 +1,185 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"math"
+	"sort"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Longest time single CPU sample is taken for, so power off gaps aren't billed by the first sample after boot
+const cpuSampleMaxGap = 15 * 60
+
+// Bills actual CPU usage in vCPU-hours above the baseline share, once per complete period, always POSTPAID.
+// Resource meta keys:
+//   - baseline: share of each vCPU included into plan, e.g. 0.2
+//   - max_credits: credits (vCPU-hours) cap, a day of baseline by default
+//
+// Usage under the baseline earns credits, usage above spends them first, the rest is billed.
+// Baseline is given for the time covered by samples only, so VM earns nothing while it's powered off.
+// Monitoring keeps records for a few hours only, so samples are counted on every pass: usage and covered time of
+// the open period are kept in <key>_usage_seconds and <key>_covered_seconds, the last counted sample time in
+// <key>_last_sample_ts. Counting starts when there is no such time yet.
+// Credits balance is kept in <key>_credits instance data
+func handleCPUUsageBilling(log *zap.Logger, ltl LazyTimeline, i *ipb.Instance, vm LazyVM, res *billingpb.ResourceConf, c one.IClient, last int64, clock utils.IClock) ([]*billingpb.Record, int64) {
+	log = log.Named("CPU_USAGE")
+	if res.GetPeriod() == 0 {
+		log.Warn("CPU usage can't be billed without period", zap.String("resource", res.GetKey()))
+		return nil, last
+	}
+	now := clock.Now().Unix()
+
+	o, err := vm()
+	if err != nil || o == nil {
+		log.Warn("Can't get VM to bill CPU usage", zap.Error(err))
+		return nil, last
+	}
+	mon, err := c.Monitoring(o.ID)
+	if err != nil {
+		log.Warn("Can't get VM monitoring records", zap.Int("vm", o.ID), zap.Error(err))
+		return nil, last
+	}
+	samples := CPUSamples(mon.Records)
+
+	if i.Data == nil {
+		i.Data = make(map[string]*structpb.Value)
+	}
+	key := res.GetKey()
+	sinceValue, ok := i.Data[key+"_last_sample_ts"]
+	if !ok {
+		since := now
+		if len(samples) > 0 {
+			since = samples[len(samples)-1].Timestamp
+		}
+		log.Debug("Starting to count CPU usage", zap.Int64("since", since))
+		i.Data[key+"_last_sample_ts"] = structpb.NewNumberValue(float64(since))
+		i.Data[key+"_usage_seconds"] = structpb.NewNumberValue(0)
+		i.Data[key+"_covered_seconds"] = structpb.NewNumberValue(0)
+		i.Data[key+"_last_monitoring"] = structpb.NewNumberValue(float64(now))
+		return nil, now
+	}
+	since := int64(sinceValue.GetNumberValue())
+	usage := i.Data[key+"_usage_seconds"].GetNumberValue()
+	covered := i.Data[key+"_covered_seconds"].GetNumberValue()
+
+	vcpu, err := o.Template.GetVCPU()
+	if err != nil || vcpu < 1 {
+		vcpu = 1
+	}
+	meta := res.GetMeta()
+	baseline := meta["baseline"].GetNumberValue() * float64(vcpu)
+	maxCredits := baseline * 24
+	if value, ok := meta["max_credits"]; ok {
+		maxCredits = value.GetNumberValue()
+	}
+	credits := i.Data[key+"_credits"].GetNumberValue()
+
+	var records []*billingpb.Record
+	for end := last + res.GetPeriod(); end <= now; end += res.GetPeriod() {
+		var u, cov float64
+		u, cov, since = CPUSeconds(samples, since, end)
+		used := (usage + u) / 3600
+		included := baseline * (covered + cov) / 3600
+		usage, covered = 0, 0
+
+		over, spent := used-included, 0.0
+		if over < 0 {
+			credits = math.Min(credits-over, maxCredits)
+			over = 0
+		} else {
+			spent = math.Min(credits, over)
+			credits -= spent
+			over -= spent
+		}
+
+		records = append(records, &billingpb.Record{
+			Resource: key,
+			Instance: i.GetUuid(),
+			Start:    last, End: end,
+			Exec:  end,
+			Total: math.Round(over*100) / 100.0,
+			Meta: map[string]*structpb.Value{
+				"instance_title": structpb.NewStringValue(i.GetTitle()),
+				"usage_hours":    structpb.NewNumberValue(math.Round(used*100) / 100.0),
+				"baseline_hours": structpb.NewNumberValue(math.Round(included*100) / 100.0),
+				"credits_spent":  structpb.NewNumberValue(math.Round(spent*100) / 100.0),
+				"credits":        structpb.NewNumberValue(math.Round(credits*100) / 100.0),
+			},
+		})
+		last = end
+	}
+
+	u, cov, since := CPUSeconds(samples, since, now)
+	i.Data[key+"_last_sample_ts"] = structpb.NewNumberValue(float64(since))
+	i.Data[key+"_usage_seconds"] = structpb.NewNumberValue(usage + u)
+	i.Data[key+"_covered_seconds"] = structpb.NewNumberValue(covered + cov)
+	i.Data[key+"_credits"] = structpb.NewNumberValue(credits)
+	return records, last
+}
+
+// CPU usage of VM monitoring record, 100 stands for one vCPU fully used
+type CPUSample struct {
+	Timestamp int64
+	Percent   float64
+}
+
+// Returns CPU samples from VM monitoring records, ordered by time
+func CPUSamples(records []dynamic.Template) []CPUSample {
+	samples := make([]CPUSample, 0, len(records))
+	for _, rec := range records {
+		ts, err := rec.GetInt("TIMESTAMP")
+		if err != nil {
+			continue
+		}
+		cpu, err := rec.GetFloat("CPU")
+		if err != nil {
+			continue
+		}
+		samples = append(samples, CPUSample{int64(ts), cpu})
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+	return samples
+}
+
+// Integrates CPU samples taken after since till to into vCPU-seconds and seconds covered by the samples.
+// Sample stands for usage since the previous one (or since), within cpuSampleMaxGap.
+// Returns the last counted sample time to count the next samples from
+func CPUSeconds(samples []CPUSample, since, to int64) (usage, covered float64, last int64) {
+	last = since
+	prev := since
+	for _, s := range samples {
+		if s.Timestamp <= since {
+			prev = s.Timestamp
+			continue
+		}
+		if s.Timestamp > to {
+			break
+		}
+		start := max(prev, s.Timestamp-cpuSampleMaxGap, since)
+		covered += float64(s.Timestamp - start)
+		usage += float64(s.Timestamp-start) * s.Percent / 100
+		prev, last = s.Timestamp, s.Timestamp
+	}
+	return usage, covered, last
+}
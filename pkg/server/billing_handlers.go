@@ -0,0 +1,183 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	onevm "github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"go.uber.org/zap"
+)
+
+type BillingHandlerFunc func(
+	*zap.Logger,
+	LazyTimeline,
+	*ipb.Instance,
+	LazyVM,
+	*billingpb.ResourceConf,
+	one.IClient,
+	int64,
+	utils.IClock,
+) ([]*billingpb.Record, int64)
+
+// Extracts amount of the resource to be billed from the VM, e.g. number of vCPUs
+type AmountFunc func(log *zap.Logger, i *ipb.Instance, vm *onevm.VM, c one.IClient) float64
+
+type patternHandler struct {
+	re      *regexp.Regexp
+	handler BillingHandlerFunc
+}
+
+// BillingMap is a registry of billing handlers by resource key.
+// Exact keys are looked up first, then patterns in order of registration
+type BillingMap struct {
+	mu       sync.RWMutex
+	handlers map[string]BillingHandlerFunc
+	patterns []patternHandler
+}
+
+var handlers = &BillingMap{
+	handlers: map[string]BillingHandlerFunc{
+		"cpu":         handleCPUBilling,
+		"ram":         handleRAMBilling,
+		"ips_public":  handleIPBilling,
+		"public_ipv6": handleIPv6Billing,
+		"traffic_out": handleTrafficOutBilling,
+		"traffic_in":  handleTrafficInBilling,
+		"cpu_usage":   handleCPUUsageBilling,
+	},
+	patterns: []patternHandler{
+		// e.g. drive_${driveKind}
+		{regexp.MustCompile(`^drive_`), handleDriveBilling},
+	},
+}
+
+func (m *BillingMap) Get(key string) (BillingHandlerFunc, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if handler, ok := m.handlers[key]; ok {
+		return handler, true
+	}
+	for _, p := range m.patterns {
+		if p.re.MatchString(key) {
+			return p.handler, true
+		}
+	}
+	return nil, false
+}
+
+// Registers handler of the resource key, replacing the one registered before
+func (m *BillingMap) Register(key string, handler BillingHandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[key] = handler
+}
+
+// Registers handler of the resource keys matching the pattern, it's checked after the ones registered before.
+// Pattern is anchored to the key start, so gpu_ doesn't match e.g. backup_gpu_count
+func (m *BillingMap) RegisterPattern(pattern string, handler BillingHandlerFunc) error {
+	re, err := regexp.Compile(`^(?:` + pattern + `)`)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.patterns = append(m.patterns, patternHandler{re, handler})
+	return nil
+}
+
+// Returns handler of the resource key, falling back to VM attribute configured by billing_attributes SP var
+func (m *BillingMap) Lookup(key string, sp *sppb.ServicesProvider) (BillingHandlerFunc, bool) {
+	if handler, ok := m.Get(key); ok {
+		return handler, true
+	}
+	return attributeBillingHandler(sp, key)
+}
+
+// Registers billing handler of the resource key, so new resource types don't need changes in the server package
+func RegisterBillingHandler(key string, handler BillingHandlerFunc) {
+	handlers.Register(key, handler)
+}
+
+// Registers billing handler of the resource keys matching the pattern
+func RegisterBillingPattern(pattern string, handler BillingHandlerFunc) error {
+	return handlers.RegisterPattern(pattern, handler)
+}
+
+// Makes handler billing the amount as capacity, once per period or right away for zero period resources
+func CapacityBilling(name string, amount AmountFunc) BillingHandlerFunc {
+	return func(log *zap.Logger, ltl LazyTimeline, i *ipb.Instance, vm LazyVM, res *billingpb.ResourceConf, c one.IClient, last int64, clock utils.IClock) ([]*billingpb.Record, int64) {
+		log = log.Named(name)
+		value := Lazy(func() float64 {
+			o, err := vm()
+			if err != nil || o == nil {
+				log.Warn("Can't get VM to count amount", zap.String("resource", res.GetKey()), zap.Error(err))
+				return 0
+			}
+			return amount(log, i, o, c)
+		})
+
+		if res.GetPeriod() == 0 {
+			return handleCapacityZeroBilling(log, value, ltl, i, res, last, clock)
+		}
+		return handleCapacityBilling(log, value, ltl, i, res, last, clock)
+	}
+}
+
+// Makes handler of the resource billed by VM attribute, if it's mapped in billing_attributes SP var
+func attributeBillingHandler(sp *sppb.ServicesProvider, key string) (BillingHandlerFunc, bool) {
+	conf, ok := sp.GetVars()[one.BILLING_ATTRIBUTES].GetValue()[key]
+	if !ok {
+		return nil, false
+	}
+
+	attr, divisor := conf.GetStringValue(), 1.0
+	if fields := conf.GetStructValue().GetFields(); fields != nil {
+		attr = fields["attribute"].GetStringValue()
+		if d := fields["divisor"].GetNumberValue(); d > 0 {
+			divisor = d
+		}
+	}
+	if attr == "" {
+		return nil, false
+	}
+
+	return CapacityBilling(strings.ToUpper(key), func(_ *zap.Logger, _ *ipb.Instance, o *onevm.VM, _ one.IClient) float64 {
+		return TemplateAttributeAmount(o, attr) / divisor
+	}), true
+}
+
+// Returns numeric value of VM template (or user template) attribute, or number of vectors named so, e.g. PCI devices
+func TemplateAttributeAmount(o *onevm.VM, attr string) float64 {
+	for _, t := range []*dynamic.Template{&o.Template.Template, &o.UserTemplate.Template} {
+		if vectors := t.GetVectors(attr); len(vectors) > 0 {
+			return float64(len(vectors))
+		}
+		if value, err := t.GetFloat(attr); err == nil {
+			return value
+		}
+	}
+	return 0
+}
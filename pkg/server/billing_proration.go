@@ -0,0 +1,260 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"math"
+	"slices"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	apb "github.com/slntopp/nocloud-proto/billing/addons"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// Instance data keys with the product, addons and resources billing was last done for
+	BILLED_PRODUCT   = "billed_product"
+	BILLED_ADDONS    = "billed_addons"
+	BILLED_RESOURCES = "billed_resources"
+)
+
+// Instance configuration billing is done for
+type BillingConfig struct {
+	Product string
+	Addons  []string
+	// Resource amounts as billing handlers count them, e.g. RAM and drives in GB
+	Resources map[string]float64
+}
+
+// Configuration the Instance was billed for, current product and addons are used if it wasn't remembered yet.
+// Resources are nil if they weren't remembered
+func billedConfig(i *ipb.Instance) BillingConfig {
+	conf := BillingConfig{Product: i.GetProduct(), Addons: i.GetAddons()}
+	if product, ok := i.GetData()[BILLED_PRODUCT]; ok {
+		conf.Product = product.GetStringValue()
+	}
+	if addons, ok := i.GetData()[BILLED_ADDONS]; ok {
+		conf.Addons = nil
+		for _, addon := range addons.GetListValue().GetValues() {
+			conf.Addons = append(conf.Addons, addon.GetStringValue())
+		}
+	}
+	if resources, ok := i.GetData()[BILLED_RESOURCES]; ok {
+		conf.Resources = make(map[string]float64)
+		for key, value := range resources.GetStructValue().GetFields() {
+			conf.Resources[key] = value.GetNumberValue()
+		}
+	}
+	return conf
+}
+
+// Remembers Instance product, addons and resources, so their change could be prorated
+func rememberBilledConfig(i *ipb.Instance) {
+	if i.Data == nil {
+		i.Data = make(map[string]*structpb.Value)
+	}
+	i.Data[BILLED_PRODUCT] = structpb.NewStringValue(i.GetProduct())
+	addons := make([]*structpb.Value, 0, len(i.GetAddons()))
+	for _, addon := range i.GetAddons() {
+		addons = append(addons, structpb.NewStringValue(addon))
+	}
+	i.Data[BILLED_ADDONS] = structpb.NewListValue(&structpb.ListValue{Values: addons})
+	resources := &structpb.Struct{Fields: make(map[string]*structpb.Value)}
+	for key, value := range one.BillableResources(i) {
+		resources.Fields[key] = structpb.NewNumberValue(value)
+	}
+	i.Data[BILLED_RESOURCES] = structpb.NewStructValue(resources)
+}
+
+// Prorates Instance billing when its configuration changes mid-period.
+// PREPAID product, resources and addons are credited for the remaining part of the paid period at the old
+// configuration and charged for it at the new one. POSTPAID ones are settled for the elapsed part of the period at
+// the old configuration and the period restarts from now
+type Proration struct {
+	Clock utils.IClock
+	// Seconds of [start, end) the resource is billed for, e.g. the ones VM was in resource states. Whole interval if nil
+	Billable func(res *billingpb.ResourceConf, start, end int64) int64
+}
+
+// Returns proration records for the configuration change and moves Instance last_monitoring data of settled POSTPAID items
+func (p *Proration) Prorate(i *ipb.Instance, old, new BillingConfig, addons map[string]*apb.Addon) []*billingpb.Record {
+	var records []*billingpb.Record
+	plan := i.GetBillingPlan()
+	if i.Data == nil {
+		i.Data = make(map[string]*structpb.Value)
+	}
+
+	for _, res := range plan.GetResources() {
+		from, to := old.Resources[res.GetKey()], new.Resources[res.GetKey()]
+		if from == to {
+			continue
+		}
+		period := billingPeriod{Period: res.GetPeriod(), Aligned: res.GetPeriodKind() != billingpb.PeriodKind_DEFAULT}
+		key := res.GetKey() + "_last_monitoring"
+		var billable func(start, end int64) int64
+		if p.Billable != nil {
+			billable = func(start, end int64) int64 { return p.Billable(res, start, end) }
+		}
+		records = append(records, p.prorate(i, key, res.GetKind() == billingpb.Kind_POSTPAID, period, from, to, billable, func(r *billingpb.Record) {
+			r.Resource = res.GetKey()
+		})...)
+	}
+
+	products := plan.GetProducts()
+	if old.Product != new.Product {
+		if product := products[old.Product]; product.GetPeriod() > 0 {
+			period := billingPeriod{Period: product.GetPeriod(), Aligned: product.GetPeriodKind() != billingpb.PeriodKind_DEFAULT}
+			records = append(records, p.prorate(i, "last_monitoring", product.GetKind() == billingpb.Kind_POSTPAID, period, 1, 0, nil, func(r *billingpb.Record) {
+				r.Product = old.Product
+			})...)
+		}
+		if product := products[new.Product]; product.GetPeriod() > 0 {
+			if product.GetKind() == billingpb.Kind_POSTPAID {
+				// Paid time is credited, so POSTPAID billing starts now
+				if lm, ok := i.Data["last_monitoring"]; ok && int64(lm.GetNumberValue()) > p.Clock.Now().Unix() {
+					i.Data["last_monitoring"] = structpb.NewNumberValue(float64(p.Clock.Now().Unix()))
+				}
+			} else {
+				// Charged till the date the old product is paid for, renewal happens at the new product period then
+				period := billingPeriod{Period: product.GetPeriod(), Aligned: product.GetPeriodKind() != billingpb.PeriodKind_DEFAULT}
+				records = append(records, p.prorate(i, "last_monitoring", false, period, 0, 1, nil, func(r *billingpb.Record) {
+					r.Product = new.Product
+				})...)
+			}
+		}
+	}
+
+	// Addons are billed for product periods
+	for _, id := range old.Addons {
+		addon := addons[id]
+		product := products[old.Product]
+		if addon == nil || product.GetPeriod() == 0 || slices.Contains(new.Addons, id) {
+			continue
+		}
+		key := "addon_" + id + "_last_monitoring"
+		period := billingPeriod{Period: product.GetPeriod(), Aligned: product.GetPeriodKind() != billingpb.PeriodKind_DEFAULT}
+		records = append(records, p.prorate(i, key, addon.GetKind() == apb.Kind_POSTPAID, period, 1, 0, nil, func(r *billingpb.Record) {
+			r.Addon = id
+		})...)
+		delete(i.Data, key)
+	}
+	for _, id := range new.Addons {
+		addon := addons[id]
+		product := products[new.Product]
+		if addon == nil || product.GetPeriod() == 0 || slices.Contains(old.Addons, id) {
+			continue
+		}
+		key := "addon_" + id + "_last_monitoring"
+		if _, ok := i.Data[key]; ok {
+			continue
+		}
+		lm, ok := i.Data["last_monitoring"]
+		if addon.GetKind() == apb.Kind_POSTPAID || !ok || int64(lm.GetNumberValue()) <= p.Clock.Now().Unix() {
+			i.Data[key] = structpb.NewNumberValue(float64(p.Clock.Now().Unix()))
+			continue
+		}
+		// Paid till the product is, so it's renewed along with it
+		i.Data[key] = lm
+		period := billingPeriod{Period: product.GetPeriod(), Aligned: product.GetPeriodKind() != billingpb.PeriodKind_DEFAULT}
+		records = append(records, p.prorate(i, key, false, period, 0, 1, nil, func(r *billingpb.Record) {
+			r.Addon = id
+		})...)
+	}
+
+	for _, r := range records {
+		r.Instance = i.GetUuid()
+	}
+	return records
+}
+
+type billingPeriod struct {
+	Period int64
+	// Month periods are aligned to calendar or billing months
+	Aligned bool
+}
+
+// Start of the period ending at end
+func (p billingPeriod) Start(end int64, i *ipb.Instance) int64 {
+	if p.Aligned {
+		return utils.AlignPaymentDate(end, end-p.Period, p.Period, i)
+	}
+	return end - p.Period
+}
+
+// End of the period starting at start
+func (p billingPeriod) End(start int64, i *ipb.Instance) int64 {
+	if p.Aligned {
+		return utils.AlignPaymentDate(start, start+p.Period, p.Period, i)
+	}
+	return start + p.Period
+}
+
+// Prorates the item billed with key last_monitoring data from amount to new one
+func (p *Proration) prorate(i *ipb.Instance, key string, postpaid bool, period billingPeriod, from, to float64,
+	billable func(start, end int64) int64, set func(*billingpb.Record)) []*billingpb.Record {
+
+	lmValue, ok := i.Data[key]
+	if !ok || period.Period == 0 {
+		return nil
+	}
+	now := p.Clock.Now().Unix()
+	last := int64(lmValue.GetNumberValue())
+
+	var records []*billingpb.Record
+	record := func(start, end int64, total float64, kind string, priority billingpb.Priority) {
+		r := &billingpb.Record{
+			Start: start, End: end, Exec: now,
+			Priority: priority,
+			Total:    math.Round(total*100) / 100.0,
+			Meta: map[string]*structpb.Value{
+				"proration": structpb.NewStringValue(kind),
+			},
+		}
+		set(r)
+		records = append(records, r)
+	}
+
+	if postpaid {
+		if now <= last {
+			return nil
+		}
+		seconds := now - last
+		if billable != nil {
+			seconds = billable(last, now)
+		}
+		if from != 0 && seconds > 0 {
+			fraction := float64(seconds) / float64(period.End(last, i)-last)
+			record(last, now, from*fraction, "settle", billingpb.Priority_NORMAL)
+		}
+		i.Data[key] = structpb.NewNumberValue(float64(now))
+		return records
+	}
+
+	if last <= now {
+		return nil
+	}
+	fraction := math.Min(float64(last-now)/float64(last-period.Start(last, i)), 1)
+	if from != 0 {
+		record(now, last, -from*fraction, "credit", billingpb.Priority_ADDITIONAL)
+	}
+	if to != 0 {
+		record(now, last, to*fraction, "charge", billingpb.Priority_ADDITIONAL)
+	}
+	return records
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	apb "github.com/slntopp/nocloud-proto/billing/addons"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestProration(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	hour := int64(3600)
+	resource := func(key string, kind billingpb.Kind) *billingpb.ResourceConf {
+		return &billingpb.ResourceConf{Key: key, Kind: kind, Period: hour}
+	}
+	products := map[string]*billingpb.Product{
+		"small":   {Kind: billingpb.Kind_PREPAID, Period: hour},
+		"medium":  {Kind: billingpb.Kind_PREPAID, Period: hour},
+		"metered": {Kind: billingpb.Kind_POSTPAID, Period: hour},
+	}
+	addons := map[string]*apb.Addon{
+		"backup":  {Uuid: "backup", Kind: apb.Kind_PREPAID},
+		"support": {Uuid: "support", Kind: apb.Kind_POSTPAID},
+	}
+
+	type record struct {
+		item  string
+		kind  string
+		total float64
+	}
+	cases := []struct {
+		name      string
+		now       time.Time
+		resources []*billingpb.ResourceConf
+		data      map[string]float64
+		old, new  BillingConfig
+		billable  func(res *billingpb.ResourceConf, start, end int64) int64
+		want      []record
+		wantData  map[string]float64
+		deleted   []string
+	}{
+		{
+			name:      "prepaid upgrade mid-period",
+			resources: []*billingpb.ResourceConf{resource("cpu", billingpb.Kind_PREPAID)},
+			data:      map[string]float64{"cpu_last_monitoring": 1700001800},
+			old:       BillingConfig{Resources: map[string]float64{"cpu": 2}},
+			new:       BillingConfig{Resources: map[string]float64{"cpu": 4}},
+			want:      []record{{"cpu", "credit", -1}, {"cpu", "charge", 2}},
+			wantData:  map[string]float64{"cpu_last_monitoring": 1700001800},
+		},
+		{
+			name:      "prepaid downgrade to zero",
+			resources: []*billingpb.ResourceConf{resource("ips_public", billingpb.Kind_PREPAID)},
+			data:      map[string]float64{"ips_public_last_monitoring": 1700000900},
+			old:       BillingConfig{Resources: map[string]float64{"ips_public": 2}},
+			new:       BillingConfig{Resources: map[string]float64{"ips_public": 0}},
+			want:      []record{{"ips_public", "credit", -0.5}},
+		},
+		{
+			name:      "prepaid period is over",
+			resources: []*billingpb.ResourceConf{resource("ram", billingpb.Kind_PREPAID)},
+			data:      map[string]float64{"ram_last_monitoring": 1699999000},
+			old:       BillingConfig{Resources: map[string]float64{"ram": 2}},
+			new:       BillingConfig{Resources: map[string]float64{"ram": 4}},
+		},
+		{
+			name:      "unchanged resource",
+			resources: []*billingpb.ResourceConf{resource("cpu", billingpb.Kind_PREPAID)},
+			data:      map[string]float64{"cpu_last_monitoring": 1700001800},
+			old:       BillingConfig{Resources: map[string]float64{"cpu": 2}},
+			new:       BillingConfig{Resources: map[string]float64{"cpu": 2}},
+		},
+		{
+			name:      "postpaid is settled at the old amount",
+			resources: []*billingpb.ResourceConf{resource("ram", billingpb.Kind_POSTPAID)},
+			data:      map[string]float64{"ram_last_monitoring": 1699998200},
+			old:       BillingConfig{Resources: map[string]float64{"ram": 2}},
+			new:       BillingConfig{Resources: map[string]float64{"ram": 8}},
+			want:      []record{{"ram", "settle", 1}},
+			wantData:  map[string]float64{"ram_last_monitoring": 1700000000},
+		},
+		{
+			name:      "postpaid counts billable time only",
+			resources: []*billingpb.ResourceConf{resource("cpu", billingpb.Kind_POSTPAID)},
+			data:      map[string]float64{"cpu_last_monitoring": 1699998200},
+			old:       BillingConfig{Resources: map[string]float64{"cpu": 4}},
+			new:       BillingConfig{Resources: map[string]float64{"cpu": 2}},
+			billable: func(res *billingpb.ResourceConf, start, end int64) int64 {
+				return (end - start) / 2
+			},
+			want:     []record{{"cpu", "settle", 1}},
+			wantData: map[string]float64{"cpu_last_monitoring": 1700000000},
+		},
+		{
+			name: "month period aligned to calendar",
+			now:  time.Date(2024, time.February, 15, 0, 0, 0, 0, time.UTC),
+			resources: []*billingpb.ResourceConf{{
+				Key: "cpu", Kind: billingpb.Kind_PREPAID, Period: 30 * 86400, PeriodKind: billingpb.PeriodKind_CALENDAR_MONTH,
+			}},
+			data: map[string]float64{"cpu_last_monitoring": float64(time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC).Unix())},
+			old:  BillingConfig{Resources: map[string]float64{"cpu": 29}},
+			new:  BillingConfig{Resources: map[string]float64{"cpu": 58}},
+			// 15 days of 29 in February are left
+			want: []record{{"cpu", "credit", -15}, {"cpu", "charge", 30}},
+		},
+		{
+			name:     "product change",
+			data:     map[string]float64{"last_monitoring": 1700001800},
+			old:      BillingConfig{Product: "small"},
+			new:      BillingConfig{Product: "medium"},
+			want:     []record{{"small", "credit", -0.5}, {"medium", "charge", 0.5}},
+			wantData: map[string]float64{"last_monitoring": 1700001800},
+		},
+		{
+			name:     "product change to postpaid",
+			data:     map[string]float64{"last_monitoring": 1700001800},
+			old:      BillingConfig{Product: "small"},
+			new:      BillingConfig{Product: "metered"},
+			want:     []record{{"small", "credit", -0.5}},
+			wantData: map[string]float64{"last_monitoring": 1700000000},
+		},
+		{
+			name:     "product change from postpaid",
+			data:     map[string]float64{"last_monitoring": 1699998200},
+			old:      BillingConfig{Product: "metered"},
+			new:      BillingConfig{Product: "small"},
+			want:     []record{{"metered", "settle", 0.5}},
+			wantData: map[string]float64{"last_monitoring": 1700000000},
+		},
+		{
+			name:     "addon added",
+			data:     map[string]float64{"last_monitoring": 1700000900},
+			old:      BillingConfig{Product: "small"},
+			new:      BillingConfig{Product: "small", Addons: []string{"backup", "support"}},
+			want:     []record{{"backup", "charge", 0.25}},
+			wantData: map[string]float64{"addon_backup_last_monitoring": 1700000900, "addon_support_last_monitoring": 1700000000},
+		},
+		{
+			name: "addon removed",
+			data: map[string]float64{
+				"last_monitoring":               1700001800,
+				"addon_backup_last_monitoring":  1700001800,
+				"addon_support_last_monitoring": 1699998200,
+			},
+			old:     BillingConfig{Product: "small", Addons: []string{"backup", "support"}},
+			new:     BillingConfig{Product: "small"},
+			want:    []record{{"backup", "credit", -0.5}, {"support", "settle", 0.5}},
+			deleted: []string{"addon_backup_last_monitoring", "addon_support_last_monitoring"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			at := now
+			if !tc.now.IsZero() {
+				at = tc.now
+			}
+			inst := &ipb.Instance{
+				Uuid:        "inst",
+				BillingPlan: &billingpb.Plan{Resources: tc.resources, Products: products},
+				Data:        map[string]*structpb.Value{},
+			}
+			for key, value := range tc.data {
+				inst.Data[key] = structpb.NewNumberValue(value)
+			}
+
+			p := &Proration{Clock: &TestClock{time: at}, Billable: tc.billable}
+			records := p.Prorate(inst, tc.old, tc.new, addons)
+
+			if len(records) != len(tc.want) {
+				t.Fatalf("expected %d records, got %d: %v", len(tc.want), len(records), records)
+			}
+			for i, want := range tc.want {
+				r := records[i]
+				if item := r.Resource + r.Product + r.Addon; item != want.item {
+					t.Errorf("record %d is for %s, want %s", i, item, want.item)
+				}
+				if kind := r.Meta["proration"].GetStringValue(); kind != want.kind {
+					t.Errorf("record %d is %s, want %s", i, kind, want.kind)
+				}
+				if math.Abs(r.Total-want.total) > 0.01 {
+					t.Errorf("record %d total = %v, want %v", i, r.Total, want.total)
+				}
+				if r.Instance != "inst" || r.Exec != at.Unix() {
+					t.Errorf("record %d = %v", i, r)
+				}
+			}
+			for key, want := range tc.wantData {
+				if got := inst.Data[key].GetNumberValue(); got != want {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+			for _, key := range tc.deleted {
+				if _, ok := inst.Data[key]; ok {
+					t.Errorf("%s must be deleted", key)
+				}
+			}
+		})
+	}
+}
+
+func TestBilledConfig(t *testing.T) {
+	product := "small"
+	inst := &ipb.Instance{Product: &product, Addons: []string{"backup"}}
+	if conf := billedConfig(inst); conf.Product != "small" || len(conf.Addons) != 1 {
+		t.Fatalf("current configuration expected when not remembered, got %+v", conf)
+	}
+
+	rememberBilledConfig(inst)
+	product = "medium"
+	inst.Addons = nil
+	if conf := billedConfig(inst); conf.Product != "small" || len(conf.Addons) != 1 || conf.Addons[0] != "backup" {
+		t.Fatalf("remembered configuration expected, got %+v", conf)
+	}
+}
+
+// Resize which isn't applied to VM keeps the diff, it must be prorated on the first Monitoring pass only
+func TestUpgradeBillingProratedOnce(t *testing.T) {
+	c := fake.NewClient(zap.NewNop())
+	vmid, err := c.AddVM("vm", `TEMPLATE_ID="0" VCPU="2" MEMORY="2048" CONTEXT=[NETWORK="YES"] DISK=[DISK_ID="0", SIZE="10240", DRIVE_TYPE="SSD"]`, nil)
+	if err != nil {
+		t.Fatalf("AddVM: %v", err)
+	}
+
+	month := int64(30 * 24 * 3600)
+	inst := &ipb.Instance{
+		Uuid: "inst",
+		BillingPlan: &billingpb.Plan{Resources: []*billingpb.ResourceConf{
+			{Key: "cpu", Kind: billingpb.Kind_PREPAID, Price: 10, Period: month},
+		}},
+		Resources: map[string]*structpb.Value{
+			"cpu": structpb.NewNumberValue(4),
+			"ram": structpb.NewNumberValue(2048),
+		},
+		Data: map[string]*structpb.Value{
+			one.DATA_VM_ID:        structpb.NewNumberValue(float64(vmid)),
+			"cpu_last_monitoring": structpb.NewNumberValue(float64(time.Now().Unix() + month/2)),
+		},
+	}
+
+	published := make(chan []*billingpb.Record, 2)
+	publish := func(_ context.Context, records []*billingpb.Record) { published <- records }
+
+	handleUpgradeBilling(zap.NewNop(), []*ipb.Instance{inst}, c, nil, publish, clock)
+	select {
+	case records := <-published:
+		if len(records) != 2 || records[0].Meta["proration"].GetStringValue() != "credit" || records[1].Meta["proration"].GetStringValue() != "charge" {
+			t.Fatalf("Expected credit and charge, got %v", records)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Proration records aren't published")
+	}
+	if billed := billedConfig(inst).Resources; billed["cpu"] != 4 || billed["ram"] != 2 {
+		t.Fatalf("Expected new resources to be remembered as billed, got %v", billed)
+	}
+
+	handleUpgradeBilling(zap.NewNop(), []*ipb.Instance{inst}, c, nil, publish, clock)
+	select {
+	case records := <-published:
+		t.Fatalf("Change must be prorated once, got %v", records)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
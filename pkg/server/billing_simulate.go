@@ -0,0 +1,76 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"maps"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	apb "github.com/slntopp/nocloud-proto/billing/addons"
+	epb "github.com/slntopp/nocloud-proto/events"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	statuspb "github.com/slntopp/nocloud-proto/statuses"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Outcome of the billing simulation, nothing of it is published
+type BillingSimulationResult struct {
+	Records []*billingpb.Record
+	Events  []*epb.Event
+	// Instance data keys changed by billing, e.g. <resource>_last_monitoring
+	Data    map[string]*structpb.Value
+	Balance float64
+}
+
+// Runs billing of the Instance at the clock time the same way Monitoring does, auto_renew Instances are billed regularly
+func SimulateBilling(log *zap.Logger, client one.IClient, inst *ipb.Instance, status statuspb.NoCloudStatus,
+	balance float64, addons map[string]*apb.Addon, sp *sppb.ServicesProvider, at utils.IClock) *BillingSimulationResult {
+
+	res := &BillingSimulationResult{Data: make(map[string]*structpb.Value)}
+	env := &billingEnv{
+		clock: at,
+		records: func(_ context.Context, recs []*billingpb.Record) {
+			res.Records = append(res.Records, recs...)
+		},
+		events: func(_ context.Context, event *epb.Event) {
+			res.Events = append(res.Events, event)
+		},
+		data:   func(string, map[string]*structpb.Value) {},
+		status: func(string, *statuspb.Status) {},
+		sync:   true,
+	}
+
+	before := maps.Clone(inst.GetData())
+	if inst.GetConfig()["auto_renew"].GetBoolValue() {
+		handleInstanceBilling(log, env, client, inst, status, &balance, addons, sp)
+	} else {
+		handleNonRegularInstanceBilling(log, env, client, inst, status, addons, sp)
+	}
+
+	for key, value := range inst.GetData() {
+		if old, ok := before[key]; !ok || !proto.Equal(old, value) {
+			res.Data[key] = value
+		}
+	}
+	res.Balance = balance
+	return res
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	stpb "github.com/slntopp/nocloud-proto/states"
+	statuspb "github.com/slntopp/nocloud-proto/statuses"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestSimulateBilling(t *testing.T) {
+	c := fake.NewClient(zap.NewNop())
+	at := &TestClock{time: time.Unix(1700010000, 0)}
+	c.Clock = at
+
+	// Running, powered off for the second hour, then running again
+	vmid, err := c.AddVM("sim", `VCPU="2" MEMORY="1024"`, []vm.HistoryRecord{
+		{STime: 1699990000, RSTime: 1699990000, RETime: 1700003600, Action: 20, ETime: 1700007200},
+		{STime: 1700007200, RSTime: 1700007200},
+	})
+	if err != nil {
+		t.Fatalf("AddVM: %v", err)
+	}
+
+	inst := &ipb.Instance{
+		Uuid: "sim",
+		BillingPlan: &billingpb.Plan{
+			Kind: billingpb.PlanKind_DYNAMIC,
+			Resources: []*billingpb.ResourceConf{{
+				Key: "cpu", Kind: billingpb.Kind_POSTPAID, Price: 1, Period: 3600,
+				On: []stpb.NoCloudState{stpb.NoCloudState_RUNNING},
+			}},
+		},
+		Resources: map[string]*structpb.Value{"cpu": structpb.NewNumberValue(2)},
+		State:     &stpb.State{State: stpb.NoCloudState_RUNNING},
+		Data: map[string]*structpb.Value{
+			one.DATA_VM_ID:        structpb.NewNumberValue(float64(vmid)),
+			"cpu_last_monitoring": structpb.NewNumberValue(1700000000),
+		},
+	}
+
+	res := SimulateBilling(zap.NewNop(), c, inst, statuspb.NoCloudStatus_UP, 0, nil, nil, at)
+
+	var total float64
+	for _, r := range res.Records {
+		total += r.Total
+		if r.Start < 1700007200 && r.End > 1700003600 {
+			t.Errorf("powered off hour is billed: %v", r)
+		}
+	}
+	if total != 2 {
+		t.Errorf("expected only the running hour billed for 2, got %v: %v", total, res.Records)
+	}
+	if got := res.Data["cpu_last_monitoring"].GetNumberValue(); got != 1700007200 {
+		t.Errorf("cpu_last_monitoring = %v, want 1700007200", got)
+	}
+	if _, ok := res.Data[one.DATA_VM_ID]; ok {
+		t.Error("unchanged data reported")
+	}
+	if len(res.Events) != 1 || res.Events[0].GetKey() != "instance_renew" {
+		t.Errorf("expected instance_renew event, got %v", res.Events)
+	}
+}
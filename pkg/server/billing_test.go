@@ -2,9 +2,12 @@ package server
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
 	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
 	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/virtualnetwork"
 	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
@@ -12,8 +15,11 @@ import (
 	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
 	billingpb "github.com/slntopp/nocloud-proto/billing"
 	ipb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
 	stpb "github.com/slntopp/nocloud-proto/states"
 	"github.com/slntopp/nocloud/pkg/nocloud"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 type TestClock struct {
@@ -243,3 +249,242 @@ func TestHandleIPBilling(t *testing.T) {
 		}
 	}
 }
+
+func TestBillingMap(t *testing.T) {
+	m := &BillingMap{handlers: map[string]BillingHandlerFunc{"cpu": handleCPUBilling}}
+	gpu := CapacityBilling("GPU", func(_ *zap.Logger, _ *ipb.Instance, o *vm.VM, _ one.IClient) float64 {
+		return TemplateAttributeAmount(o, "PCI")
+	})
+	if err := m.RegisterPattern(`gpu_`, gpu); err != nil {
+		t.Fatalf("RegisterPattern() => %v", err)
+	}
+	if err := m.RegisterPattern(`(`, gpu); err == nil {
+		t.Fatal("Expected invalid pattern to be rejected")
+	}
+	if _, ok := m.Get("gpu_a100"); !ok {
+		t.Fatal("Expected handler registered by pattern")
+	}
+	if _, ok := m.Get("gpu"); ok {
+		t.Fatal("Expected no handler for unregistered key")
+	}
+	if _, ok := m.Get("backup_gpu_count"); ok {
+		t.Fatal("Patterns must match from the key start")
+	}
+	m.Register("gpu", gpu)
+	if _, ok := m.Get("gpu"); !ok {
+		t.Fatal("Expected handler registered by key")
+	}
+	if _, ok := handlers.Get("drive_ssd"); !ok {
+		t.Fatal("Expected drive handler to be registered by default")
+	}
+	if _, ok := handlers.Get("backup_drive_size"); ok {
+		t.Fatal("Keys containing drive_ mustn't be billed as drives")
+	}
+
+	template := vm.NewTemplate()
+	template.AddVector("PCI").AddPair("VENDOR", "10de")
+	template.AddVector("PCI").AddPair("VENDOR", "10de")
+	o := &vm.VM{Template: *template}
+	o.UserTemplate.AddPair("GPU_MEMORY", 81920)
+
+	sp := &sppb.ServicesProvider{Vars: map[string]*sppb.Var{
+		one.BILLING_ATTRIBUTES: {Value: map[string]*structpb.Value{
+			"gpu_count": structpb.NewStringValue("PCI"),
+			"gpu_memory": structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+				"attribute": structpb.NewStringValue("GPU_MEMORY"),
+				"divisor":   structpb.NewNumberValue(1024),
+			}}),
+		}},
+	}}
+	if _, ok := handlers.Lookup("gpu_storage", sp); ok {
+		t.Fatal("Expected no handler for key missing in billing_attributes")
+	}
+
+	log := nocloud.NewLogger()
+	clock := &TestClock{time: time.Unix(100, 0)}
+	res := &billingpb.ResourceConf{Key: "gpu_count"}
+	for key, amount := range map[string]float64{"gpu_count": 2, "gpu_memory": 80} {
+		handler, ok := handlers.Lookup(key, sp)
+		if !ok {
+			t.Fatalf("Expected handler of %s configured by billing_attributes", key)
+		}
+		res.Key = key
+		records, _ := handler(log, nil, &ipb.Instance{Uuid: "1"}, func() (*vm.VM, error) { return o, nil }, res, nil, 0, clock)
+		if len(records) != 1 || records[0].Total != amount || records[0].Resource != key {
+			t.Fatalf("Unexpected %s records: %v", key, records)
+		}
+	}
+}
+
+type TestMonitoringClient struct {
+	one.IClient
+	records []string
+}
+
+func (c TestMonitoringClient) Monitoring(id int) (*vm.Monitoring, error) {
+	mon := &vm.Monitoring{}
+	for _, rec := range c.records {
+		t := dynamic.NewTemplate()
+		for _, pair := range strings.Fields(rec) {
+			key, value, _ := strings.Cut(pair, "=")
+			t.AddPair(key, value)
+		}
+		mon.Records = append(mon.Records, *t)
+	}
+	return mon, nil
+}
+
+func TestTrafficBytes(t *testing.T) {
+	samples := []TrafficSample{{10, 100}, {20, 300}, {30, 600}, {40, 50}, {50, 250}}
+	tests := []struct {
+		name     string
+		baseline TrafficSample
+		to       int64
+		want     int64
+		last     int64
+	}{
+		{"from baseline", TrafficSample{10, 100}, 30, 500, 30},
+		{"counter reset", TrafficSample{30, 600}, 50, 250, 50},
+		{"across reset", TrafficSample{20, 300}, 50, 550, 50},
+		{"nothing yet", TrafficSample{50, 250}, 60, 0, 50},
+		// Samples went out of monitoring retention since the baseline
+		{"baseline expired", TrafficSample{5, 80}, 20, 220, 20},
+	}
+	for _, test := range tests {
+		got, baseline := TrafficBytes(samples, test.baseline, test.to)
+		if got != test.want || baseline.Timestamp != test.last {
+			t.Errorf("%s: TrafficBytes(%v, %d) = %d, %v, want %d at %d", test.name, test.baseline, test.to, got, baseline, test.want, test.last)
+		}
+	}
+}
+
+func TestHandleTrafficBilling(t *testing.T) {
+	gb := int64(bytesInGB)
+	client := &TestMonitoringClient{records: []string{
+		fmt.Sprintf("TIMESTAMP=40 NETTX=%d NETRX=1", 10*gb),
+	}}
+	i := &ipb.Instance{Uuid: "1", BillingPlan: &billingpb.Plan{Meta: map[string]*structpb.Value{
+		"traffic_out_included": structpb.NewNumberValue(1),
+	}}}
+	o := func() (*vm.VM, error) { return &vm.VM{ID: 1}, nil }
+	res := &billingpb.ResourceConf{Key: "traffic_out", Kind: billingpb.Kind_POSTPAID, Period: 100}
+	handler, _ := handlers.Get("traffic_out")
+
+	// Traffic since VM boot can't be told apart, so counting starts now
+	records, last := handler(nocloud.NewLogger(), nil, i, o, res, client, 0, &TestClock{time: time.Unix(50, 0)})
+	if len(records) != 0 || last != 50 || i.Data["traffic_out_last_counter"].GetNumberValue() != float64(10*gb) {
+		t.Fatalf("Nothing must be billed without baseline, got %v, last %d, data %v", records, last, i.Data)
+	}
+
+	// Earlier samples are gone from monitoring by the next passes
+	client.records = []string{fmt.Sprintf("TIMESTAMP=100 NETTX=%d NETRX=2", 12*gb)}
+	records, last = handler(nocloud.NewLogger(), nil, i, o, res, client, last, &TestClock{time: time.Unix(120, 0)})
+	if len(records) != 0 || i.Data["traffic_out_bytes"].GetNumberValue() != float64(2*gb) {
+		t.Fatalf("Traffic of open period must be kept, got %v, data %v", records, i.Data)
+	}
+
+	// VM rebooted
+	client.records = []string{
+		fmt.Sprintf("TIMESTAMP=140 NETTX=%d NETRX=3", gb),
+		fmt.Sprintf("TIMESTAMP=200 NETTX=%d NETRX=4", 2*gb),
+	}
+	records, last = handler(nocloud.NewLogger(), nil, i, o, res, client, last, &TestClock{time: time.Unix(160, 0)})
+	if len(records) != 1 || last != 150 {
+		t.Fatalf("Expected a complete period billed, got %v, last %d", records, last)
+	}
+	if records[0].Total != 2 || records[0].Meta["traffic_gb"].GetNumberValue() != 3 {
+		t.Fatalf("Unexpected record %v", records[0])
+	}
+	if i.Data["traffic_out_bytes"].GetNumberValue() != 0 || i.Data["traffic_out_last_counter_ts"].GetNumberValue() != 140 {
+		t.Fatalf("Samples after now must be left for the next pass, data %v", i.Data)
+	}
+
+	records, last = handler(nocloud.NewLogger(), nil, i, o, res, client, last, &TestClock{time: time.Unix(250, 0)})
+	if len(records) != 1 || last != 250 || records[0].Total != 0 || records[0].Meta["traffic_gb"].GetNumberValue() != 1 {
+		t.Fatalf("Unexpected records %v, last %d", records, last)
+	}
+}
+
+func TestCPUSeconds(t *testing.T) {
+	samples := []CPUSample{{0, 0}, {60, 100}, {120, 50}, {3000, 200}}
+	tests := []struct {
+		name           string
+		since, to      int64
+		usage, covered float64
+		last           int64
+	}{
+		{"whole", 0, 120, 90, 120, 120},
+		{"after since", 60, 120, 30, 60, 120},
+		{"gap is capped", 120, 3000, 2 * cpuSampleMaxGap, cpuSampleMaxGap, 3000},
+		{"sample after to", 120, 2000, 0, 0, 120},
+		// Samples went out of monitoring retention since then
+		{"since expired", -30, 60, 60, 90, 60},
+	}
+	for _, test := range tests {
+		usage, covered, last := CPUSeconds(samples, test.since, test.to)
+		if usage != test.usage || covered != test.covered || last != test.last {
+			t.Errorf("%s: CPUSeconds(%d, %d) = %v, %v, %d, want %v, %v, %d", test.name, test.since, test.to,
+				usage, covered, last, test.usage, test.covered, test.last)
+		}
+	}
+}
+
+func TestHandleCPUUsageBilling(t *testing.T) {
+	client := &TestMonitoringClient{records: []string{"TIMESTAMP=0 CPU=0"}}
+	template := vm.NewTemplate()
+	template.VCPU(2)
+	o := func() (*vm.VM, error) { return &vm.VM{ID: 1, Template: *template}, nil }
+	i := &ipb.Instance{Uuid: "1", Data: map[string]*structpb.Value{}}
+	res := &billingpb.ResourceConf{Key: "cpu_usage", Kind: billingpb.Kind_POSTPAID, Period: 3600, Meta: map[string]*structpb.Value{
+		"baseline":    structpb.NewNumberValue(0.25),
+		"max_credits": structpb.NewNumberValue(1),
+	}}
+	handler, _ := handlers.Get("cpu_usage")
+	samples := func(from, to, cpu int) []string {
+		var records []string
+		for ts := from; ts <= to; ts += 600 {
+			records = append(records, fmt.Sprintf("TIMESTAMP=%d CPU=%d", ts, cpu))
+		}
+		return records
+	}
+
+	recs, last := handler(nocloud.NewLogger(), nil, i, o, res, client, 0, &TestClock{time: time.Unix(0, 0)})
+	if len(recs) != 0 || last != 0 {
+		t.Fatalf("Nothing must be billed before counting starts, got %v, last %d", recs, last)
+	}
+
+	// 2 vCPUs, fully idle during the first hour
+	client.records = samples(600, 3600, 0)
+	recs, last = handler(nocloud.NewLogger(), nil, i, o, res, client, last, &TestClock{time: time.Unix(3600, 0)})
+	if len(recs) != 1 || recs[0].Total != 0 || recs[0].Meta["credits"].GetNumberValue() != 0.5 {
+		t.Fatalf("Idle hour must earn 0.5 credits, got %v", recs)
+	}
+
+	// Fully loaded during the next two, samples of the first one are gone from monitoring
+	client.records = samples(4200, 3*3600, 200)
+	recs, last = handler(nocloud.NewLogger(), nil, i, o, res, client, last, &TestClock{time: time.Unix(3*3600, 0)})
+	if last != 3*3600 || len(recs) != 2 {
+		t.Fatalf("Expected two periods billed, got %d records, last %d", len(recs), last)
+	}
+	// 2 vCPU-hours are used against 0.5 baseline
+	want := []struct{ total, spent float64 }{{1, 0.5}, {1.5, 0}}
+	for k, w := range want {
+		if recs[k].Total != w.total || recs[k].Meta["credits_spent"].GetNumberValue() != w.spent || recs[k].Meta["credits"].GetNumberValue() != 0 {
+			t.Errorf("Period %d: unexpected record %v", k, recs[k])
+		}
+	}
+
+	// Powered off VM has no samples and earns nothing
+	client.records = nil
+	recs, last = handler(nocloud.NewLogger(), nil, i, o, res, client, last, &TestClock{time: time.Unix(86400, 0)})
+	if len(recs) != 21 || i.Data["cpu_usage_credits"].GetNumberValue() != 0 {
+		t.Fatalf("Expected no credits for power off, got %v credits in %d records", i.Data["cpu_usage_credits"], len(recs))
+	}
+
+	// Credits are capped by max_credits
+	client.records = samples(87000, 86400+5*3600, 0)
+	handler(nocloud.NewLogger(), nil, i, o, res, client, last, &TestClock{time: time.Unix(86400+5*3600, 0)})
+	if credits := i.Data["cpu_usage_credits"].GetNumberValue(); credits != 1 {
+		t.Errorf("Expected credits to be capped at 1, got %v", credits)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"math"
+	"sort"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/dynamic"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const bytesInGB = 1 << 30
+
+func handleTrafficOutBilling(log *zap.Logger, ltl LazyTimeline, i *ipb.Instance, vm LazyVM, res *billingpb.ResourceConf, c one.IClient, last int64, clock utils.IClock) ([]*billingpb.Record, int64) {
+	return handleTrafficBilling(log.Named("TRAFFIC_OUT"), "NETTX", i, vm, res, c, last, clock)
+}
+
+func handleTrafficInBilling(log *zap.Logger, ltl LazyTimeline, i *ipb.Instance, vm LazyVM, res *billingpb.ResourceConf, c one.IClient, last int64, clock utils.IClock) ([]*billingpb.Record, int64) {
+	return handleTrafficBilling(log.Named("TRAFFIC_IN"), "NETRX", i, vm, res, c, last, clock)
+}
+
+// Bills traffic counted by VM monitoring records in GB, once per complete period, always POSTPAID.
+// Monitoring keeps records for a few hours only, so counter is followed on every pass: the last seen value is kept
+// in <key>_last_counter and <key>_last_counter_ts, traffic of the open period in <key>_bytes. Counting starts
+// when there is no last seen value yet, nothing is billed for the traffic before.
+// Traffic included into plan comes from <key>_included plan meta, GB per period
+func handleTrafficBilling(log *zap.Logger, counter string, i *ipb.Instance, vm LazyVM, res *billingpb.ResourceConf, c one.IClient, last int64, clock utils.IClock) ([]*billingpb.Record, int64) {
+	if res.GetPeriod() == 0 {
+		log.Warn("Traffic can't be billed without period", zap.String("resource", res.GetKey()))
+		return nil, last
+	}
+	now := clock.Now().Unix()
+
+	o, err := vm()
+	if err != nil || o == nil {
+		log.Warn("Can't get VM to bill traffic", zap.Error(err))
+		return nil, last
+	}
+	mon, err := c.Monitoring(o.ID)
+	if err != nil {
+		log.Warn("Can't get VM monitoring records", zap.Int("vm", o.ID), zap.Error(err))
+		return nil, last
+	}
+	samples := TrafficSamples(mon.Records, counter)
+
+	if i.Data == nil {
+		i.Data = make(map[string]*structpb.Value)
+	}
+	key := res.GetKey()
+	baselineValue, ok := i.Data[key+"_last_counter"]
+	if !ok {
+		baseline := TrafficSample{Timestamp: now}
+		if len(samples) > 0 {
+			baseline = samples[len(samples)-1]
+		}
+		log.Debug("Starting to count traffic", zap.Int64("since", now), zap.Any("baseline", baseline))
+		setTrafficBaseline(i, key, baseline)
+		i.Data[key+"_bytes"] = structpb.NewNumberValue(0)
+		i.Data[key+"_last_monitoring"] = structpb.NewNumberValue(float64(now))
+		return nil, now
+	}
+	baseline := TrafficSample{
+		Timestamp: int64(i.Data[key+"_last_counter_ts"].GetNumberValue()),
+		Bytes:     int64(baselineValue.GetNumberValue()),
+	}
+	pending := int64(i.Data[key+"_bytes"].GetNumberValue())
+	included := i.GetBillingPlan().GetMeta()[key+"_included"].GetNumberValue()
+
+	var records []*billingpb.Record
+	for end := last + res.GetPeriod(); end <= now; end += res.GetPeriod() {
+		var bytes int64
+		bytes, baseline = TrafficBytes(samples, baseline, end)
+		gb := float64(pending+bytes) / bytesInGB
+		pending = 0
+		records = append(records, &billingpb.Record{
+			Resource: key,
+			Instance: i.GetUuid(),
+			Start:    last, End: end,
+			Exec:  end,
+			Total: math.Round(math.Max(gb-included, 0)*100) / 100.0,
+			Meta: map[string]*structpb.Value{
+				"instance_title": structpb.NewStringValue(i.GetTitle()),
+				"traffic_gb":     structpb.NewNumberValue(math.Round(gb*100) / 100.0),
+				"included_gb":    structpb.NewNumberValue(included),
+			},
+		})
+		last = end
+	}
+
+	bytes, baseline := TrafficBytes(samples, baseline, now)
+	setTrafficBaseline(i, key, baseline)
+	i.Data[key+"_bytes"] = structpb.NewNumberValue(float64(pending + bytes))
+	return records, last
+}
+
+func setTrafficBaseline(i *ipb.Instance, key string, baseline TrafficSample) {
+	i.Data[key+"_last_counter"] = structpb.NewNumberValue(float64(baseline.Bytes))
+	i.Data[key+"_last_counter_ts"] = structpb.NewNumberValue(float64(baseline.Timestamp))
+}
+
+// Counter value of VM monitoring record
+type TrafficSample struct {
+	Timestamp int64
+	Bytes     int64
+}
+
+// Returns samples of the counter (NETTX or NETRX) from VM monitoring records, ordered by time
+func TrafficSamples(records []dynamic.Template, counter string) []TrafficSample {
+	samples := make([]TrafficSample, 0, len(records))
+	for _, rec := range records {
+		ts, err := rec.GetInt("TIMESTAMP")
+		if err != nil {
+			continue
+		}
+		value, err := rec.GetFloat(counter)
+		if err != nil {
+			continue
+		}
+		samples = append(samples, TrafficSample{int64(ts), int64(value)})
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+	return samples
+}
+
+// Counts bytes transferred after the baseline sample till to out of counter samples, returns the last counted
+// sample as the new baseline. Counter is reset when VM is rebooted, so the value after reset is the traffic since then
+func TrafficBytes(samples []TrafficSample, baseline TrafficSample, to int64) (int64, TrafficSample) {
+	var total int64
+	for _, s := range samples {
+		if s.Timestamp <= baseline.Timestamp {
+			continue
+		}
+		if s.Timestamp > to {
+			break
+		}
+		delta := s.Bytes - baseline.Bytes
+		if delta < 0 {
+			delta = s.Bytes
+		}
+		total += delta
+		baseline = s
+	}
+	return total, baseline
+}
@@ -0,0 +1,57 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Syncs firewall rules from the Instances Group config into its security group, owned by the Instances Group User.
+// Rules are only pushed when config has changed since the last sync, so ones set by firewall_set at runtime survive
+func (s *DriverServiceServer) syncFirewall(client one.IClient, ig string, user int, config *structpb.Value, data map[string]*structpb.Value) error {
+	rules, err := one.FirewallRulesFromValue(config)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid firewall config: %v", err)
+	}
+
+	raw, _ := json.Marshal(rules)
+	hash := fmt.Sprintf("%x", sha256.Sum256(raw))
+	id, err := client.GetIGSecurityGroup(ig, user)
+	if err == nil && data["firewall_hash"].GetStringValue() == hash {
+		return nil
+	}
+
+	if err == nil {
+		err = client.SetFirewallRules(id, rules)
+	} else {
+		id, err = client.CreateIGSecurityGroup(ig, user, rules)
+	}
+	if err != nil {
+		s.log.Error("Couldn't sync firewall rules", zap.Error(err), zap.String("ig", ig), zap.Int("user", user))
+		return status.Error(codes.Internal, "Couldn't sync firewall rules")
+	}
+	data["security_group"] = structpb.NewNumberValue(float64(id))
+	data["firewall_hash"] = structpb.NewStringValue(hash)
+	return nil
+}
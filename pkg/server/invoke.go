@@ -18,14 +18,10 @@ package server
 import (
 	"context"
 	"fmt"
-	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
-	"github.com/slntopp/nocloud-proto/ansible"
 	epb "github.com/slntopp/nocloud-proto/events"
 	"google.golang.org/protobuf/types/known/structpb"
-	"time"
 
 	"github.com/slntopp/nocloud-driver-ione/pkg/actions"
-	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
 	accesspb "github.com/slntopp/nocloud-proto/access"
 	pb "github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
 	ipb "github.com/slntopp/nocloud-proto/instances"
@@ -39,11 +35,12 @@ import (
 func (s *DriverServiceServer) Invoke(ctx context.Context, req *pb.InvokeRequest) (res *ipb.InvokeResponse, err error) {
 	s.log.Debug("Invoke request received", zap.Any("instance", req.Instance.Uuid), zap.Any("action", req.Method), zap.Any("data", req.Params))
 	sp := req.GetServicesProvider()
-	client, err := one.NewClientFromSP(sp, s.log)
+	client, err := s.newClient(sp, s.log)
 	instance := req.GetInstance()
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Error making client: %v", err)
 	}
+	client.SetVars(sp.GetVars())
 
 	method := req.GetMethod()
 
@@ -61,32 +58,21 @@ func (s *DriverServiceServer) Invoke(ctx context.Context, req *pb.InvokeRequest)
 		}
 	}
 
-	// Check for running backup
-	allowedActionsWhileBackup := map[string]bool{
+	if method == "job_status" {
+		return s.jobStatus(ctx, instance, req.GetParams())
+	}
+
+	// Check for running job
+	allowedActionsWhileJob := map[string]bool{
 		"monitoring": true,
 	}
-	runningPlaybook := instance.GetData()["running_playbook"].GetStringValue()
-	runningPlaybookStart := instance.GetData()["running_playbook_start"].GetNumberValue()
-	if allowed := allowedActionsWhileBackup[req.GetMethod()]; runningPlaybook != "" && !allowed {
-		if runningPlaybookStart != 0 && int64(runningPlaybookStart)+86400*2 < time.Now().Unix() {
-			instance.Data["running_playbook"] = structpb.NewStringValue("")
-			instance.Data["running_playbook_start"] = structpb.NewNumberValue(0)
-			go datas.DataPublisher(datas.POST_INST_DATA)(instance.GetUuid(), instance.GetData())
-		} else {
-			get, err := s.ansibleClient.Get(s.ansibleCtx, &ansible.GetRunRequest{
-				Uuid: runningPlaybook,
-			})
-			if err != nil {
-				return nil, err
-			}
-			if get.GetStatus() == "running" || get.GetStatus() == "init" {
-				return nil, status.Error(codes.Unavailable, "backup is still running")
-			}
-			if get.GetStatus() == "successful" || get.GetStatus() == "failed" || get.GetStatus() == "undefined" {
-				instance.Data["running_playbook"] = structpb.NewStringValue("")
-				instance.Data["running_playbook_start"] = structpb.NewNumberValue(0)
-				go datas.DataPublisher(datas.POST_INST_DATA)(instance.GetUuid(), instance.GetData())
-			}
+	if !allowedActionsWhileJob[method] {
+		id, locked, err := s.jobs.Current(ctx, instance.GetUuid())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Can't check running jobs: %v", err)
+		}
+		if locked {
+			return nil, status.Errorf(codes.Unavailable, "job %s is still running", id)
 		}
 	}
 
@@ -104,17 +90,56 @@ func (s *DriverServiceServer) Invoke(ctx context.Context, req *pb.InvokeRequest)
 			})
 		}
 
+		if actions.IsAsync(method, req.GetParams()) {
+			params := req.GetParams()
+			var secrets map[string]*structpb.Value
+			if prepare, ok := actions.JobSecrets[method]; ok {
+				params = make(map[string]*structpb.Value, len(req.GetParams())+1)
+				for key, value := range req.GetParams() {
+					params[key] = value
+				}
+				secrets = prepare(instance, params)
+			}
+			job, err := s.startJob(ctx, instance, method, func(context.Context) (*ipb.InvokeResponse, error) {
+				return action(client, instance, params)
+			})
+			if err != nil {
+				return nil, err
+			}
+			res, err := jobResponse(job)
+			if err != nil {
+				return nil, err
+			}
+			for key, value := range secrets {
+				res.Meta[key] = value
+			}
+			return res, nil
+		}
+
 		return action(client, instance, req.GetParams())
 	}
 
 	ansibleAction, ok := actions.AnsibleActions[method]
 	if ok {
 		secrets := sp.GetSecrets()
+		if s.ansibleClient == nil {
+			return nil, status.Errorf(codes.Unavailable, "Ansible isn't configured")
+		}
 		ansibleSecret, ok := secrets["ansible"]
 		if !ok {
 			return nil, status.Errorf(codes.InvalidArgument, "No ansible config")
 		}
 		ansibleSecretValue := ansibleSecret.GetStructValue().AsMap()
+		actions.CredentialsFromVM(client, instance)
+		if actions.IsAsync(method, req.GetParams()) {
+			job, err := s.startJob(s.ansibleCtx, instance, method, func(ctx context.Context) (*ipb.InvokeResponse, error) {
+				return ansibleAction(ctx, s.ansibleClient, ansibleSecretValue, instance, req.GetParams(), sp)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return jobResponse(job)
+		}
 		return ansibleAction(s.ansibleCtx, s.ansibleClient, ansibleSecretValue, instance, req.GetParams(), sp)
 	}
 
@@ -124,7 +149,7 @@ func (s *DriverServiceServer) Invoke(ctx context.Context, req *pb.InvokeRequest)
 func (s *DriverServiceServer) SpInvoke(ctx context.Context, req *pb.SpInvokeRequest) (res *spb.InvokeResponse, err error) {
 	s.log.Debug("Invoke request received", zap.Any("action", req.Method), zap.Any("data", req.Params))
 	sp := req.GetServicesProvider()
-	client, err := one.NewClientFromSP(sp, s.log)
+	client, err := s.newClient(sp, s.log)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Error making client: %v", err)
 	}
@@ -149,7 +174,7 @@ func (s *DriverServiceServer) SpPrep(ctx context.Context, req *services_provider
 	log.Debug("ServicesProvider Preparation request received", zap.Any("sp", req.Sp), zap.Any("extra", req.Extra))
 
 	sp := req.GetSp()
-	client, err := one.NewClientFromSP(sp, log)
+	client, err := s.newClient(sp, log)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Error making client: %v", err)
 	}
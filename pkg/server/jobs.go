@@ -0,0 +1,267 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+	"github.com/slntopp/nocloud-driver-ione/pkg/actions"
+	epb "github.com/slntopp/nocloud-proto/events"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var (
+	JOBS_REDIS = "JOBS"
+	// How long finished jobs are kept
+	JobTTL = 7 * 24 * time.Hour
+	// Instance is released after it even if the job never finished, e.g. driver was restarted
+	JobLockTTL = 48 * time.Hour
+)
+
+const (
+	JOB_PENDING = "pending"
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	JOB_FAILED  = "failed"
+)
+
+// Job is an action running in background, Invoke returns its ID right away
+type Job struct {
+	ID       string                 `json:"id"`
+	Instance string                 `json:"instance"`
+	Method   string                 `json:"method"`
+	Status   string                 `json:"status"`
+	Progress int                    `json:"progress"`
+	Stage    string                 `json:"stage,omitempty"`
+	Result   map[string]interface{} `json:"result,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Created  int64                  `json:"created"`
+	Updated  int64                  `json:"updated"`
+}
+
+func (j *Job) Finished() bool {
+	return j.Status == JOB_DONE || j.Status == JOB_FAILED
+}
+
+// JobStore keeps jobs and which job holds the instance, so only one job runs per instance across driver replicas
+type JobStore interface {
+	Save(ctx context.Context, job *Job) error
+	Get(ctx context.Context, id string) (*Job, error)
+	// Marks instance as busy with the job, false if other job holds it
+	Lock(ctx context.Context, inst, id string) (bool, error)
+	Unlock(ctx context.Context, inst string) error
+	// Returns ID of the job holding the instance or the last one started
+	Current(ctx context.Context, inst string) (id string, locked bool, err error)
+}
+
+var ErrJobNotFound = errors.New("job not found")
+
+type redisJobStore struct {
+	rdb *redis.Client
+}
+
+func NewRedisJobStore(rdb *redis.Client) JobStore {
+	return &redisJobStore{rdb: rdb}
+}
+
+func (s *redisJobStore) Save(ctx context.Context, job *Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.rdb.Set(ctx, fmt.Sprintf("%s-%s", JOBS_REDIS, job.ID), body, JobTTL).Err()
+}
+
+func (s *redisJobStore) Get(ctx context.Context, id string) (*Job, error) {
+	body, err := s.rdb.Get(ctx, fmt.Sprintf("%s-%s", JOBS_REDIS, id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	return job, json.Unmarshal(body, job)
+}
+
+func (s *redisJobStore) Lock(ctx context.Context, inst, id string) (bool, error) {
+	ok, err := s.rdb.SetNX(ctx, fmt.Sprintf("%s-LOCK-%s", JOBS_REDIS, inst), id, JobLockTTL).Result()
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, s.rdb.Set(ctx, fmt.Sprintf("%s-LAST-%s", JOBS_REDIS, inst), id, JobTTL).Err()
+}
+
+func (s *redisJobStore) Unlock(ctx context.Context, inst string) error {
+	return s.rdb.Del(ctx, fmt.Sprintf("%s-LOCK-%s", JOBS_REDIS, inst)).Err()
+}
+
+func (s *redisJobStore) Current(ctx context.Context, inst string) (string, bool, error) {
+	id, err := s.rdb.Get(ctx, fmt.Sprintf("%s-LOCK-%s", JOBS_REDIS, inst)).Result()
+	if err == nil {
+		return id, true, nil
+	}
+	if err != redis.Nil {
+		return "", false, err
+	}
+	id, err = s.rdb.Get(ctx, fmt.Sprintf("%s-LAST-%s", JOBS_REDIS, inst)).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	return id, false, err
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Starts the action as a job holding the instance till it's finished. Job is run with ctx values, but not its cancellation.
+// Completion is published as job_done or job_failed event
+func (s *DriverServiceServer) startJob(
+	ctx context.Context, inst *ipb.Instance, method string,
+	run func(ctx context.Context) (*ipb.InvokeResponse, error),
+) (*Job, error) {
+	log := s.log.Named("Jobs").With(zap.String("instance", inst.GetUuid()), zap.String("method", method))
+
+	job := &Job{
+		ID: newJobID(), Instance: inst.GetUuid(), Method: method,
+		Status: JOB_PENDING, Created: time.Now().Unix(),
+	}
+	job.Updated = job.Created
+
+	ok, err := s.jobs.Lock(ctx, inst.GetUuid(), job.ID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't lock instance: %v", err)
+	}
+	if !ok {
+		return nil, status.Error(codes.Unavailable, "other job is still running")
+	}
+	if err := s.jobs.Save(ctx, job); err != nil {
+		_ = s.jobs.Unlock(ctx, inst.GetUuid())
+		return nil, status.Errorf(codes.Internal, "Can't save job: %v", err)
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	// Job is shared with the progress reporter, copy is returned to the caller
+	var mu sync.Mutex
+	save := func(update func(*Job)) {
+		mu.Lock()
+		defer mu.Unlock()
+		update(job)
+		job.Updated = time.Now().Unix()
+		if err := s.jobs.Save(ctx, job); err != nil {
+			log.Error("Error saving job", zap.String("job", job.ID), zap.Error(err))
+		}
+	}
+	started := *job
+
+	go func() {
+		defer func() {
+			if err := s.jobs.Unlock(ctx, inst.GetUuid()); err != nil {
+				log.Error("Error unlocking instance", zap.String("job", job.ID), zap.Error(err))
+			}
+		}()
+
+		save(func(j *Job) { j.Status = JOB_RUNNING })
+		res, err := run(actions.WithProgress(ctx, func(progress int, stage string) {
+			save(func(j *Job) { j.Progress, j.Stage = progress, stage })
+		}))
+
+		event := &epb.Event{
+			Uuid: inst.GetUuid(),
+			Key:  "job_done",
+			Data: map[string]*structpb.Value{
+				"job_id": structpb.NewStringValue(job.ID),
+				"method": structpb.NewStringValue(method),
+			},
+		}
+		save(func(j *Job) {
+			j.Progress = 100
+			if err != nil {
+				j.Status, j.Error = JOB_FAILED, err.Error()
+				return
+			}
+			j.Status = JOB_DONE
+			if res != nil && res.Meta != nil {
+				j.Result = (&structpb.Struct{Fields: res.Meta}).AsMap()
+				for _, key := range actions.SecretMeta {
+					delete(j.Result, key)
+				}
+			}
+		})
+		if err != nil {
+			log.Error("Job failed", zap.String("job", job.ID), zap.Error(err))
+			event.Key = "job_failed"
+			event.Data["error"] = structpb.NewStringValue(err.Error())
+		}
+		if s.HandlePublishEvents != nil {
+			s.HandlePublishEvents(ctx, event)
+		}
+	}()
+
+	return &started, nil
+}
+
+// Returns job of the instance by job_id, the current or the last one if not given
+func (s *DriverServiceServer) jobStatus(ctx context.Context, inst *ipb.Instance, params map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+	id := params["job_id"].GetStringValue()
+	if id == "" {
+		current, _, err := s.jobs.Current(ctx, inst.GetUuid())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Can't get current job: %v", err)
+		}
+		if current == "" {
+			return nil, status.Error(codes.NotFound, "Instance has no jobs")
+		}
+		id = current
+	}
+
+	job, err := s.jobs.Get(ctx, id)
+	if err == ErrJobNotFound || (err == nil && job.Instance != inst.GetUuid()) {
+		return nil, status.Errorf(codes.NotFound, "Job %s not found", id)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't get job: %v", err)
+	}
+
+	return jobResponse(job)
+}
+
+func jobResponse(job *Job) (*ipb.InvokeResponse, error) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't pass job: %v", err)
+	}
+	meta := &structpb.Struct{}
+	if err := meta.UnmarshalJSON(body); err != nil {
+		return nil, status.Errorf(codes.Internal, "Can't pass job: %v", err)
+	}
+	return &ipb.InvokeResponse{Result: true, Meta: meta.GetFields()}, nil
+}
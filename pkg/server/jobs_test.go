@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	"github.com/slntopp/nocloud-driver-ione/pkg/actions"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	pb "github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
+	epb "github.com/slntopp/nocloud-proto/events"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type memJobStore struct {
+	mu    sync.Mutex
+	jobs  map[string]Job
+	locks map[string]string
+	last  map[string]string
+}
+
+func newMemJobStore() *memJobStore {
+	return &memJobStore{jobs: map[string]Job{}, locks: map[string]string{}, last: map[string]string{}}
+}
+
+func (s *memJobStore) Save(_ context.Context, job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = *job
+	return nil
+}
+
+func (s *memJobStore) Get(_ context.Context, id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return &job, nil
+}
+
+func (s *memJobStore) Lock(_ context.Context, inst, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.locks[inst]; ok {
+		return false, nil
+	}
+	s.locks[inst], s.last[inst] = id, id
+	return true, nil
+}
+
+func (s *memJobStore) Unlock(_ context.Context, inst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.locks, inst)
+	return nil
+}
+
+func (s *memJobStore) Current(_ context.Context, inst string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id, ok := s.locks[inst]; ok {
+		return id, true, nil
+	}
+	return s.last[inst], false, nil
+}
+
+func TestJobs(t *testing.T) {
+	actions.ConfigureStatusesClient(zap.NewNop())
+
+	c := fake.NewClient(zap.NewNop())
+	tmpl, _ := c.AddTemplate("tmpl", "CPU=1\nMEMORY=512")
+	vmid, _ := c.InstantiateTemplate(tmpl, "vm", "", false)
+	c.SetVMState(vmid, vm.Active, vm.Running)
+
+	events := make(chan *epb.Event, 1)
+	s := &DriverServiceServer{log: zap.NewNop(), jobs: newMemJobStore()}
+	s.SetClientFactory(func(*sppb.ServicesProvider, *zap.Logger) (one.IClient, error) { return c, nil })
+	s.HandlePublishEvents = func(_ context.Context, e *epb.Event) { events <- e }
+
+	inst := &ipb.Instance{Uuid: "inst", Data: map[string]*structpb.Value{one.DATA_VM_ID: structpb.NewNumberValue(float64(vmid))}}
+	invoke := func(method string, params map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+		return s.Invoke(context.Background(), &pb.InvokeRequest{Instance: inst, ServicesProvider: &sppb.ServicesProvider{}, Method: method, Params: params})
+	}
+
+	if _, err := invoke("job_status", nil); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound without jobs, got %v", err)
+	}
+
+	// Instance is held by the job till it's finished
+	release := make(chan struct{})
+	started, err := s.startJob(context.Background(), inst, "test", func(ctx context.Context) (*ipb.InvokeResponse, error) {
+		<-release
+		return nil, errors.New("test failure")
+	})
+	if err != nil {
+		t.Fatalf("startJob() => %v", err)
+	}
+	if _, err := invoke("reinstall", nil); status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected Unavailable while job is running, got %v", err)
+	}
+	if _, err := invoke("monitoring", nil); status.Code(err) == codes.Unavailable {
+		t.Fatal("Monitoring must be allowed while job is running")
+	}
+	close(release)
+	if e := <-events; e.Key != "job_failed" || e.Data["job_id"].GetStringValue() != started.ID {
+		t.Fatalf("Unexpected event: %v", e)
+	}
+
+	// Reinstall is run in place unless job is asked for
+	resp, err := invoke("reinstall", nil)
+	if err != nil || !resp.GetResult() {
+		t.Fatalf("Invoke() => %v, %v", resp, err)
+	}
+	if _, ok := resp.Meta["id"]; ok {
+		t.Fatalf("Expected reinstall result, got job %v", resp.Meta)
+	}
+
+	resp, err = invoke("reinstall", map[string]*structpb.Value{"async": structpb.NewBoolValue(true)})
+	if err != nil {
+		t.Fatalf("Invoke() => %v", err)
+	}
+	id := resp.Meta["id"].GetStringValue()
+	if id == "" || id == started.ID {
+		t.Fatalf("Expected new job ID, got %v", resp.Meta)
+	}
+	if e := <-events; e.Key != "job_done" || e.Data["method"].GetStringValue() != "reinstall" {
+		t.Fatalf("Unexpected event: %v", e)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err = invoke("job_status", nil)
+		if err != nil {
+			t.Fatalf("job_status => %v", err)
+		}
+		if resp.Meta["status"].GetStringValue() == JOB_DONE || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp.Meta["id"].GetStringValue() != id || resp.Meta["status"].GetStringValue() != JOB_DONE || resp.Meta["progress"].GetNumberValue() != 100 {
+		t.Fatalf("Unexpected job: %v", resp.Meta)
+	}
+
+	resp, err = invoke("job_status", map[string]*structpb.Value{"job_id": structpb.NewStringValue(started.ID)})
+	if err != nil || resp.Meta["status"].GetStringValue() != JOB_FAILED || resp.Meta["error"].GetStringValue() != "test failure" {
+		t.Fatalf("Unexpected job: %v, %v", resp.GetMeta(), err)
+	}
+	if _, err := invoke("job_status", map[string]*structpb.Value{"job_id": structpb.NewStringValue("other")}); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound for unknown job, got %v", err)
+	}
+}
+
+func TestJobSecrets(t *testing.T) {
+	actions.ConfigureStatusesClient(zap.NewNop())
+
+	c := fake.NewClient(zap.NewNop())
+	tmpl, _ := c.AddTemplate("tmpl", "CPU=1\nMEMORY=512")
+	vmid, _ := c.InstantiateTemplate(tmpl, "vm", "", false)
+	c.SetVMState(vmid, vm.Active, vm.Running)
+	image := c.AddImage("rescue", 1)
+	sp := &sppb.ServicesProvider{Vars: map[string]*sppb.Var{
+		one.RESCUE_IMAGE: {Value: map[string]*structpb.Value{"default": structpb.NewNumberValue(float64(image))}},
+	}}
+
+	interval := one.StateWaitInterval
+	one.StateWaitInterval = 10 * time.Millisecond
+	t.Cleanup(func() { one.StateWaitInterval = interval })
+
+	events := make(chan *epb.Event, 1)
+	s := &DriverServiceServer{log: zap.NewNop(), jobs: newMemJobStore()}
+	s.SetClientFactory(func(*sppb.ServicesProvider, *zap.Logger) (one.IClient, error) { return c, nil })
+	s.HandlePublishEvents = func(_ context.Context, e *epb.Event) { events <- e }
+
+	inst := &ipb.Instance{Uuid: "inst", Data: map[string]*structpb.Value{one.DATA_VM_ID: structpb.NewNumberValue(float64(vmid))}}
+	resp, err := s.Invoke(context.Background(), &pb.InvokeRequest{Instance: inst, ServicesProvider: sp, Method: "rescue_enter"})
+	if err != nil {
+		t.Fatalf("Invoke() => %v", err)
+	}
+	password := resp.Meta["rescue_password"].GetStringValue()
+	if len(password) != actions.RESCUE_PASSWORD_LENGTH {
+		t.Fatalf("Expected rescue password in Invoke response, got %v", resp.Meta)
+	}
+	if e := <-events; e.Key != "job_done" || e.Data["job_id"].GetStringValue() != resp.Meta["id"].GetStringValue() {
+		t.Fatalf("Unexpected event: %v", e)
+	}
+
+	job, err := s.jobs.Get(context.Background(), resp.Meta["id"].GetStringValue())
+	if err != nil {
+		t.Fatalf("Get() => %v", err)
+	}
+	if job.Status != JOB_DONE {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+	if _, ok := job.Result["rescue_password"]; ok {
+		t.Fatalf("Rescue password must not be stored with job, got %v", job.Result)
+	}
+	v, _ := c.GetVM(vmid)
+	if pass, _ := v.Template.GetStrFromVec("CONTEXT", "PASSWORD"); pass != password {
+		t.Fatalf("VM is rescued with %q, Invoke returned %q", pass, password)
+	}
+}
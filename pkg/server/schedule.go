@@ -0,0 +1,199 @@
+/*
+Copyright © 2021-2022 Nikita Ivanovski info@slnt-opp.xyz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slntopp/nocloud-driver-ione/pkg/actions"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/utils"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+var (
+	SCHEDULE_REDIS = "SCHEDULE"
+	// Scheduled run lock lifetime, any run is either started or given up by then
+	ScheduleLockTTL = 24 * time.Hour
+)
+
+const (
+	// Names of snapshots made on schedule start with it, only those are rotated
+	SCHEDULED_SNAPSHOT_PREFIX = "scheduled-"
+	// snapshot_date passed to the backup playbook for scheduled backups
+	SCHEDULED_BACKUP_DATE_FORMAT = "2006-01-02_1504"
+)
+
+// Returns the schedule occurrence following the last run(or instance creation) and whether it's due by now
+func scheduleDue(expr string, last int64, now time.Time) (time.Time, bool, error) {
+	cron, err := utils.ParseCron(expr)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	next := cron.Next(time.Unix(last, 0))
+	return next, !next.IsZero() && !now.Before(next), nil
+}
+
+// Deletes the oldest scheduled snapshot of the VM if there are more than keep of them.
+// Only one snapshot is deleted per call, since VM takes snapshot operations one by one
+func rotateScheduledSnapshots(client one.IClient, vmid, keep int) (bool, error) {
+	vm, err := client.GetVM(vmid)
+	if err != nil {
+		return false, err
+	}
+	snaps, err := one.SnapshotsFromVM(vm)
+	if err != nil {
+		return false, err
+	}
+
+	type snapshot struct {
+		id int
+		ts int
+	}
+	scheduled := make([]snapshot, 0, len(snaps))
+	for id, s := range snaps {
+		snap := s.(map[string]interface{})
+		if !strings.HasPrefix(snap["name"].(string), SCHEDULED_SNAPSHOT_PREFIX) {
+			continue
+		}
+		sid, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		scheduled = append(scheduled, snapshot{sid, snap["ts"].(int)})
+	}
+	if len(scheduled) <= keep {
+		return false, nil
+	}
+
+	sort.Slice(scheduled, func(i, j int) bool {
+		if scheduled[i].ts == scheduled[j].ts {
+			return scheduled[i].id < scheduled[j].id
+		}
+		return scheduled[i].ts < scheduled[j].ts
+	})
+	return true, client.SnapDelete(scheduled[0].id, vmid)
+}
+
+func scheduleLockKey(inst *ipb.Instance, kind string, due time.Time) string {
+	return fmt.Sprintf("%s-%s-%s-%d", SCHEDULE_REDIS, inst.GetUuid(), kind, due.Unix())
+}
+
+// Locks the schedule occurrence, so only one driver replica starts the run
+func (s *DriverServiceServer) lockSchedule(ctx context.Context, inst *ipb.Instance, kind string, due time.Time) bool {
+	return s.rdb.SetNX(ctx, scheduleLockKey(inst, kind, due), "RUNNING", ScheduleLockTTL).Val()
+}
+
+// Releases the occurrence lock when the run couldn't be started, so it's retried on the next pass
+func (s *DriverServiceServer) unlockSchedule(ctx context.Context, inst *ipb.Instance, kind string, due time.Time) {
+	s.rdb.Del(ctx, scheduleLockKey(inst, kind, due))
+}
+
+// Starts scheduled snapshots and backups of the instance once they are due.
+// Config: snapshot_schedule and backup_schedule as cron expressions(UTC), keep - number of scheduled snapshots to retain.
+// Last runs are kept in last_snapshot and last_backup of instance data
+func (s *DriverServiceServer) handleSchedules(ctx context.Context, log *zap.Logger, client one.IClient, inst *ipb.Instance, sp *sppb.ServicesProvider) {
+	log = log.Named("Schedules")
+	cfg := inst.GetConfig()
+	data := inst.GetData()
+	if data["freeze"].GetBoolValue() {
+		return
+	}
+	if _, locked, err := s.jobs.Current(ctx, inst.GetUuid()); err != nil || locked {
+		return
+	}
+	now := clock.Now()
+
+	last := func(key string) int64 {
+		if v, ok := data[key]; ok {
+			return int64(v.GetNumberValue())
+		}
+		return inst.GetCreated()
+	}
+
+	if expr := cfg["snapshot_schedule"].GetStringValue(); expr != "" {
+		vmid, err := one.GetVMIDFromData(client, inst)
+		if err != nil {
+			log.Error("Can't get VM ID", zap.Error(err))
+			return
+		}
+
+		rotated := false
+		if keep := int(cfg["keep"].GetNumberValue()); keep > 0 {
+			rotated, err = rotateScheduledSnapshots(client, vmid, keep)
+			if err != nil {
+				log.Error("Error rotating scheduled snapshots", zap.Error(err))
+			}
+		}
+
+		due, ok, err := scheduleDue(expr, last("last_snapshot"), now)
+		if err != nil {
+			log.Error("Wrong snapshot_schedule", zap.String("schedule", expr), zap.Error(err))
+		} else if ok && !rotated && s.lockSchedule(ctx, inst, "snapshot", due) {
+			name := SCHEDULED_SNAPSHOT_PREFIX + due.Format(SCHEDULED_BACKUP_DATE_FORMAT)
+			log.Info("Creating scheduled snapshot", zap.String("name", name))
+			if err := client.SnapCreate(name, vmid); err != nil {
+				log.Error("Error creating scheduled snapshot", zap.Error(err))
+				s.unlockSchedule(ctx, inst, "snapshot", due)
+			} else {
+				data["last_snapshot"] = structpb.NewNumberValue(float64(now.Unix()))
+			}
+		}
+	}
+
+	if expr := cfg["backup_schedule"].GetStringValue(); expr != "" {
+		due, ok, err := scheduleDue(expr, last("last_backup"), now)
+		if err != nil {
+			log.Error("Wrong backup_schedule", zap.String("schedule", expr), zap.Error(err))
+			return
+		}
+		if !ok {
+			return
+		}
+		ansibleSecret, has := sp.GetSecrets()["ansible"]
+		if !has || s.ansibleClient == nil {
+			log.Warn("Backup is due, but ansible isn't configured")
+			return
+		}
+		if !s.lockSchedule(ctx, inst, "backup", due) {
+			return
+		}
+
+		date := due.Format(SCHEDULED_BACKUP_DATE_FORMAT)
+		log.Info("Starting scheduled backup", zap.String("snapshot_date", date))
+
+		instance := proto.Clone(inst).(*ipb.Instance)
+		params := map[string]*structpb.Value{"snapshot_date": structpb.NewStringValue(date)}
+		_, err = s.startJob(s.ansibleCtx, instance, "exec", func(ctx context.Context) (*ipb.InvokeResponse, error) {
+			return actions.BackupInstance(ctx, s.ansibleClient, ansibleSecret.GetStructValue().AsMap(), instance, params, sp)
+		})
+		if err != nil {
+			log.Error("Can't start scheduled backup", zap.Error(err))
+			s.unlockSchedule(ctx, inst, "backup", due)
+			return
+		}
+		data["last_backup"] = structpb.NewNumberValue(float64(now.Unix()))
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	"go.uber.org/zap"
+)
+
+func TestScheduleDue(t *testing.T) {
+	last := time.Date(2024, time.March, 1, 3, 0, 0, 0, time.UTC).Unix()
+
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{time.Date(2024, time.March, 1, 23, 59, 0, 0, time.UTC), false},
+		{time.Date(2024, time.March, 2, 3, 0, 0, 0, time.UTC), true},
+		// Missed runs are caught up once
+		{time.Date(2024, time.March, 5, 12, 0, 0, 0, time.UTC), true},
+	}
+	for _, tc := range tests {
+		due, ok, err := scheduleDue("0 3 * * *", last, tc.now)
+		if err != nil || ok != tc.want {
+			t.Errorf("scheduleDue(%v) = %v, %v, %v, want %v", tc.now, due, ok, err, tc.want)
+		}
+	}
+
+	if _, _, err := scheduleDue("daily", last, time.Now()); err == nil {
+		t.Error("Expected error on wrong schedule")
+	}
+}
+
+func TestRotateScheduledSnapshots(t *testing.T) {
+	c := fake.NewClient(zap.NewNop())
+	tmpl, _ := c.AddTemplate("tmpl", "CPU=1\nMEMORY=512")
+	vmid, err := c.InstantiateTemplate(tmpl, "vm", "", false)
+	if err != nil {
+		t.Fatalf("InstantiateTemplate() => %v", err)
+	}
+	c.SetVMState(vmid, vm.Active, vm.Running)
+
+	for _, name := range []string{"scheduled-1", "manual", "scheduled-2", "scheduled-3"} {
+		if err := c.SnapCreate(name, vmid); err != nil {
+			t.Fatalf("SnapCreate() => %v", err)
+		}
+	}
+
+	if rotated, err := rotateScheduledSnapshots(c, vmid, 3); rotated || err != nil {
+		t.Fatalf("Nothing to rotate, got %v, %v", rotated, err)
+	}
+	if rotated, err := rotateScheduledSnapshots(c, vmid, 1); !rotated || err != nil {
+		t.Fatalf("Expected rotation, got %v, %v", rotated, err)
+	}
+
+	v, _ := c.GetVM(vmid)
+	names := map[string]bool{}
+	for _, snap := range v.Template.GetVectors("SNAPSHOT") {
+		name, _ := snap.GetStr("NAME")
+		names[name] = true
+	}
+	if len(names) != 3 || names["scheduled-1"] || !names["manual"] {
+		t.Fatalf("Only the oldest scheduled snapshot must be deleted, left %v", names)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -41,6 +42,7 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
@@ -62,11 +64,32 @@ type DriverServiceServer struct {
 	ansibleClient        ansible.AnsibleServiceClient
 	ansibleConfig        *ansible_config.AnsibleConfig
 	rdb                  *redis.Client
+	jobs                 JobStore
+	newClient            ClientFactory
+}
+
+// ClientFactory makes ONe client for the given ServicesProvider, replaced in tests with fake clients
+type ClientFactory func(sp *sppb.ServicesProvider, log *zap.Logger) (one.IClient, error)
+
+func NewONeClientFromSP(sp *sppb.ServicesProvider, log *zap.Logger) (one.IClient, error) {
+	client, err := one.NewClientFromSP(sp, log)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
 }
 
 func NewDriverServiceServer(log *zap.Logger, key []byte, rdb *redis.Client) *DriverServiceServer {
 	auth.SetContext(log, rdb, key)
-	return &DriverServiceServer{log: log, rdb: rdb}
+	return &DriverServiceServer{log: log, rdb: rdb, jobs: NewRedisJobStore(rdb), newClient: NewONeClientFromSP}
+}
+
+func (s *DriverServiceServer) SetClientFactory(factory ClientFactory) {
+	s.newClient = factory
+}
+
+func (s *DriverServiceServer) SetJobStore(store JobStore) {
+	s.jobs = store
 }
 
 func (s *DriverServiceServer) SetAnsibleClient(ctx context.Context, client ansible.AnsibleServiceClient) {
@@ -147,7 +170,7 @@ func (s *DriverServiceServer) TestServiceProviderConfig(ctx context.Context, req
 	sp := req.GetServicesProvider()
 	s.log.Debug("TestServiceProviderConfig request received", zap.Any("sp", sp), zap.Bool("syntax_only", req.GetSyntaxOnly()))
 
-	client, err := one.NewClientFromSP(sp, s.log)
+	client, err := s.newClient(sp, s.log)
 
 	if err != nil {
 		return &sppb.TestResponse{Result: false, Error: err.Error()}, nil
@@ -233,6 +256,12 @@ func (s *DriverServiceServer) PrepareService(ctx context.Context, sp *sppb.Servi
 		client.SetQuotaFromConfig(oneID, igroup, sp)
 	}
 
+	if firewall, ok := config["firewall"]; ok {
+		if err := s.syncFirewall(client, igroup.GetUuid(), oneID, firewall, data); err != nil {
+			return data, err
+		}
+	}
+
 	resources := igroup.GetResources()
 	var public_ips_amount = 0
 	if resources["ips_public"] != nil {
@@ -268,12 +297,31 @@ func (s *DriverServiceServer) PrepareService(ctx context.Context, sp *sppb.Servi
 		data["public_vn"] = structpb.NewNumberValue(float64(public_ips_pool_id))
 	}
 
+	if public_ipv6_amount := int(resources["public_ipv6"].GetNumberValue()); public_ipv6_amount > 0 {
+		freePubIPv6 := 0
+		if vnetID, err := client.GetUserPublicVNet6(oneID); err == nil {
+			if publicVnet, err := client.GetVNet(vnetID); err == nil {
+				freePubIPv6 = one.FreeLeases(publicVnet)
+			}
+		}
+		if public_ipv6_amount > freePubIPv6 {
+			public_ipv6_pool_id, err := client.ReservePublicIPv6(oneID, public_ipv6_amount-freePubIPv6)
+			if err != nil {
+				s.log.Error("Couldn't reserve Public IPv6 addresses",
+					zap.Error(err), zap.Int("amount", public_ipv6_amount), zap.Int("user", oneID))
+				return data, status.Error(codes.Internal, "Couldn't reserve Public IPv6 addresses")
+			}
+			data["public_vn6"] = structpb.NewNumberValue(float64(public_ipv6_pool_id))
+		}
+	}
+
 	var private_ips_amount = 0
 	if resources["ips_private"] != nil {
 		private_ips_amount = int(resources["ips_private"].GetNumberValue())
 	}
+	private_ipv6_amount := int(resources["private_ipv6"].GetNumberValue())
 
-	if private_ips_amount <= 0 {
+	if private_ips_amount <= 0 && private_ipv6_amount <= 0 {
 		return data, nil
 	}
 
@@ -288,7 +336,7 @@ func (s *DriverServiceServer) PrepareService(ctx context.Context, sp *sppb.Servi
 
 	if !private_vn_ban_value.GetBoolValue() {
 		_, err := client.GetUserPrivateVNet(oneID)
-		if data["private_vn"] == nil && (err != nil && err.Error() == "resource not found") {
+		if private_ips_amount > 0 && data["private_vn"] == nil && (err != nil && err.Error() == "resource not found") {
 			vnMad, freeVlan, err := client.FindFreeVlan(sp)
 			if err != nil {
 				s.log.Error("Couldn't reserve Private IP addresses",
@@ -304,6 +352,35 @@ func (s *DriverServiceServer) PrepareService(ctx context.Context, sp *sppb.Servi
 			}
 			data["private_vn"] = structpb.NewNumberValue(float64(private_ips_pool_id))
 		}
+
+		_, err = client.GetUserPrivateVNet6(oneID)
+		if private_ipv6_amount > 0 && data["private_vn6"] == nil && (err != nil && err.Error() == "resource not found") {
+			// IPv6 VNet shares VLAN with the private IPv4 one, so both are in the same L2 segment
+			var vnMad string
+			var vlan int
+			if id, err := client.GetUserPrivateVNet(oneID); err == nil {
+				if vn, err := client.GetVNet(id); err == nil {
+					vnMad = vn.VNMad
+					vlan, _ = strconv.Atoi(vn.VlanID)
+				}
+			}
+			if vnMad == "" {
+				vnMad, vlan, err = client.FindFreeVlan(sp)
+				if err != nil {
+					s.log.Error("Couldn't reserve Private IPv6 addresses",
+						zap.Error(err), zap.Int("amount", private_ipv6_amount), zap.Int("user", oneID))
+					return data, status.Error(codes.Internal, "Couldn't reserve Private IPv6 addresses")
+				}
+			}
+
+			private_ipv6_pool_id, err := client.ReservePrivateIPv6(oneID, vnMad, vlan)
+			if err != nil {
+				s.log.Error("Couldn't reserve Private IPv6 addresses",
+					zap.Error(err), zap.Int("amount", private_ipv6_amount), zap.Int("user", oneID))
+				return data, status.Error(codes.Internal, "Couldn't reserve Private IPv6 addresses")
+			}
+			data["private_vn6"] = structpb.NewNumberValue(float64(private_ipv6_pool_id))
+		}
 	}
 
 	return data, nil
@@ -319,7 +396,7 @@ func (s *DriverServiceServer) Up(ctx context.Context, input *pb.UpRequest) (*pb.
 		return nil, status.Error(codes.InvalidArgument, "Wrong driver type")
 	}
 
-	client, err := one.NewClientFromSP(sp, log)
+	client, err := s.newClient(sp, log)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Error making client: %v", err)
 	}
@@ -359,7 +436,7 @@ func (s *DriverServiceServer) Down(ctx context.Context, input *pb.DownRequest) (
 		return nil, status.Error(codes.InvalidArgument, "Wrong driver type")
 	}
 
-	client, err := one.NewClientFromSP(sp, s.log)
+	client, err := s.newClient(sp, s.log)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Error making client: %v", err)
 	}
@@ -373,6 +450,7 @@ func (s *DriverServiceServer) Down(ctx context.Context, input *pb.DownRequest) (
 			s.log.Error("Instance has no VM ID in data", zap.Any("data", data), zap.String("instance", instance.GetUuid()))
 		}
 		vmid := int(data["vmid"].GetNumberValue())
+		actions.ReleasePTRs(client, []*ipb.Instance{instance})
 		client.TerminateVM(vmid, true)
 
 		delete(instance.Data, "vmid")
@@ -406,7 +484,7 @@ func (s *DriverServiceServer) Monitoring(ctx context.Context, req *pb.Monitoring
 	sp := req.GetServicesProvider()
 	log.Info("Starting Routine", zap.String("sp", sp.GetUuid()))
 
-	client, err := one.NewClientFromSP(sp, log)
+	client, err := s.newClient(sp, log)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Error making client: %v", err)
 	}
@@ -425,6 +503,7 @@ func (s *DriverServiceServer) Monitoring(ctx context.Context, req *pb.Monitoring
 	group := secrets["group"].GetNumberValue()
 
 	redisKey := fmt.Sprintf("%s-SP-%s", MONITORING_REDIS, sp.Uuid)
+	env := newBillingEnv(s.HandlePublishRecords, s.HandlePublishEvents)
 
 	for _, ig := range req.GetGroups() {
 		log.Debug("Monitoring group", zap.String("group", ig.GetUuid()), zap.String("title", ig.GetTitle()))
@@ -445,16 +524,25 @@ func (s *DriverServiceServer) Monitoring(ctx context.Context, req *pb.Monitoring
 		}
 		publicAddresses := 0
 		privateAddresses := 0
+		publicIPv6, privateIPv6 := 0, 0
 		for _, inst := range ig.GetInstances() {
 			if inst.GetStatus() == statuspb.NoCloudStatus_DEL || inst.GetResources() == nil {
 				continue
 			}
 			publicAddresses += int(inst.GetResources()["ips_public"].GetNumberValue())
 			privateAddresses += int(inst.GetResources()["ips_private"].GetNumberValue())
+			publicIPv6 += int(inst.GetResources()["public_ipv6"].GetNumberValue())
+			privateIPv6 += int(inst.GetResources()["private_ipv6"].GetNumberValue())
 		}
 		log.Debug("public ips for vnet", zap.Int("count", publicAddresses), zap.String("group", ig.GetUuid()))
 		ig.Resources["ips_public"] = structpb.NewNumberValue(float64(publicAddresses))
 		ig.Resources["ips_private"] = structpb.NewNumberValue(float64(privateAddresses))
+		if publicIPv6 > 0 || ig.Resources["public_ipv6"] != nil {
+			ig.Resources["public_ipv6"] = structpb.NewNumberValue(float64(publicIPv6))
+		}
+		if privateIPv6 > 0 || ig.Resources["private_ipv6"] != nil {
+			ig.Resources["private_ipv6"] = structpb.NewNumberValue(float64(privateIPv6))
+		}
 
 		err = client.CheckOrphanInstanceGroup(ig, group)
 		if err != nil {
@@ -468,6 +556,7 @@ func (s *DriverServiceServer) Monitoring(ctx context.Context, req *pb.Monitoring
 			log.Debug("Check Instances Group Response", zap.Any("resp", resp))
 			datasPublisher := datas.DataPublisher(datas.POST_IG_DATA)
 
+			actions.ReleasePTRs(client, resp.ToBeDeleted)
 			toBeDeleted := client.HandleDeletedInstances(resp.ToBeDeleted)
 
 			if len(resp.ToBeCreated) > 0 {
@@ -492,7 +581,7 @@ func (s *DriverServiceServer) Monitoring(ctx context.Context, req *pb.Monitoring
 			}
 
 			if len(resp.ToBeUpdated) != 0 {
-				go handleUpgradeBilling(log.Named("Upgrade billing"), resp.ToBeUpdated, client, s.HandlePublishRecords)
+				handleUpgradeBilling(log.Named("Upgrade billing"), resp.ToBeUpdated, client, req.Addons, s.HandlePublishRecords, clock)
 			}
 
 			_ = client.CheckInstancesGroupResponseProcess(resp, ig, int(group), creationBalance)
@@ -503,6 +592,10 @@ func (s *DriverServiceServer) Monitoring(ctx context.Context, req *pb.Monitoring
 			go handleInstEvents(ctx, successResp, s.HandlePublishEvents)
 		}
 
+		if updateIPLeases(client, ig) {
+			go datas.DataPublisher(datas.POST_IG_DATA)(ig.Uuid, ig.Data)
+		}
+
 		igStatus := ig.GetStatus()
 
 		//log.Debug("Monitoring instances", zap.String("group", ig.GetUuid()), zap.Int("instances", len(ig.GetInstances())))
@@ -574,6 +667,7 @@ func (s *DriverServiceServer) Monitoring(ctx context.Context, req *pb.Monitoring
 						}
 					}
 				}
+				s.handleSchedules(ctx, log, client, inst, sp)
 				_, err = actions.StatusesClient(client, inst, inst.Data, &ipb.InvokeResponse{Result: true})
 				if err != nil {
 					log.Error("Error Monitoring Instance", zap.Any("instance", inst), zap.Error(err))
@@ -592,9 +686,9 @@ func (s *DriverServiceServer) Monitoring(ctx context.Context, req *pb.Monitoring
 			balance := monitoringBalance[ig.GetUuid()]
 
 			if autoRenew {
-				handleInstanceBilling(log, s.HandlePublishRecords, s.HandlePublishEvents, client, inst, igStatus, &balance, req.Addons, sp)
+				handleInstanceBilling(log, env, client, inst, igStatus, &balance, req.Addons, sp)
 			} else {
-				handleNonRegularInstanceBilling(log, s.HandlePublishRecords, s.HandlePublishEvents, client, inst, igStatus, req.Addons, sp)
+				handleNonRegularInstanceBilling(log, env, client, inst, igStatus, req.Addons, sp)
 			}
 
 			monitoringBalance[ig.GetUuid()] = balance
@@ -624,3 +718,29 @@ func (s *DriverServiceServer) Monitoring(ctx context.Context, req *pb.Monitoring
 	log.Info("Routine Done", zap.String("sp", sp.GetUuid()))
 	return &pb.MonitoringResponse{}, nil
 }
+
+// Sets ip_leases of the group data to the addresses of its public network by VM ID(-1 for not assigned floating IPs),
+// returns whether they've changed
+func updateIPLeases(client one.IClient, ig *ipb.InstancesGroup) bool {
+	userid, ok := ig.GetData()["userid"]
+	if !ok {
+		return false
+	}
+	leases, err := client.IPLeases(int(userid.GetNumberValue()))
+	if err != nil {
+		return false
+	}
+	value := make(map[string]interface{}, len(leases))
+	for ip, vmid := range leases {
+		value[ip] = vmid
+	}
+	st, err := structpb.NewStruct(value)
+	if err != nil {
+		return false
+	}
+	if proto.Equal(ig.Data["ip_leases"].GetStructValue(), st) {
+		return false
+	}
+	ig.Data["ip_leases"] = structpb.NewStructValue(st)
+	return true
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/OpenNebula/one/src/oca/go/src/goca"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/shared"
+	"github.com/OpenNebula/one/src/oca/go/src/goca/schemas/vm"
+	"github.com/slntopp/nocloud-driver-ione/pkg/actions"
+	"github.com/slntopp/nocloud-driver-ione/pkg/datas"
+	one "github.com/slntopp/nocloud-driver-ione/pkg/driver"
+	"github.com/slntopp/nocloud-driver-ione/pkg/driver/fake"
+	"github.com/slntopp/nocloud-proto/ansible"
+	pb "github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestPrepareServicePrivateIPv6(t *testing.T) {
+	c := fake.NewClient(zap.NewNop())
+	vars := map[string]*sppb.Var{
+		one.PRIVATE_VN_TEMPLATE: {Value: map[string]*structpb.Value{"default": structpb.NewNumberValue(float64(c.AddVNTemplate("vxlan")))}},
+		one.PRIVATE_VN_BAN:      {Value: map[string]*structpb.Value{"default": structpb.NewBoolValue(false)}},
+	}
+	c.SetVars(vars)
+	c.SetSecrets(map[string]*structpb.Value{"group": structpb.NewNumberValue(fake.USERS_GROUP)})
+
+	uid, err := c.CreateUser("ig-uuid", "pass", []int{fake.USERS_GROUP})
+	if err != nil {
+		t.Fatalf("CreateUser() => %v", err)
+	}
+	// User has got private IPv4 VNet already, so IPv6 one must share its VLAN
+	private_vn, err := c.ReservePrivateIP(uid, "vxlan", 10)
+	if err != nil {
+		t.Fatalf("ReservePrivateIP() => %v", err)
+	}
+
+	ig := &ipb.InstancesGroup{
+		Uuid: "ig-uuid",
+		Data: map[string]*structpb.Value{
+			"userid":     structpb.NewNumberValue(float64(uid)),
+			"private_vn": structpb.NewNumberValue(float64(private_vn)),
+		},
+		Resources: map[string]*structpb.Value{
+			"ips_private":  structpb.NewNumberValue(1),
+			"private_ipv6": structpb.NewNumberValue(1),
+		},
+	}
+	sp := &sppb.ServicesProvider{Uuid: "sp-uuid", Vars: vars}
+	s := &DriverServiceServer{log: zap.NewNop()}
+
+	for run := 0; run < 2; run++ {
+		data, err := s.PrepareService(context.Background(), sp, ig, c, fake.USERS_GROUP)
+		if err != nil {
+			t.Fatalf("PrepareService() run %d => %v", run, err)
+		}
+		ig.Data = data
+	}
+
+	vn6, err := c.GetUserPrivateVNet6(uid)
+	if err != nil {
+		t.Fatalf("Private IPv6 VNet wasn't created: %v", err)
+	}
+	if got := int(ig.Data["private_vn6"].GetNumberValue()); got != vn6 {
+		t.Errorf("private_vn6 = %d, want %d", got, vn6)
+	}
+	vn, _ := c.GetVNet(vn6)
+	if vn.VNMad != "vxlan" || vn.VlanID != "10" {
+		t.Errorf("IPv6 VNet must share private VLAN, got %s %s", vn.VNMad, vn.VlanID)
+	}
+}
+
+type testAnsibleClient struct {
+	ansible.AnsibleServiceClient
+	runs []*ansible.Run
+}
+
+func (c *testAnsibleClient) Create(_ context.Context, req *ansible.CreateRunRequest, _ ...grpc.CallOption) (*ansible.Run, error) {
+	c.runs = append(c.runs, req.GetRun())
+	return nil, errors.New("not running playbooks in tests")
+}
+
+func TestResetPasswordAnsible(t *testing.T) {
+	actions.ConfigureStatusesClient(zap.NewNop())
+
+	c := fake.NewClient(zap.NewNop())
+	tmpl, _ := c.AddTemplate("tmpl", "CPU=1\nMEMORY=512")
+	vmid, _ := c.InstantiateTemplate(tmpl, "vm", `PASSWORD="old"`, false)
+	c.SetVMState(vmid, vm.Active, vm.Running)
+
+	s := &DriverServiceServer{log: zap.NewNop(), jobs: newMemJobStore()}
+	s.SetClientFactory(func(*sppb.ServicesProvider, *zap.Logger) (one.IClient, error) { return c, nil })
+	runner := &testAnsibleClient{}
+	s.SetAnsibleClient(context.Background(), runner)
+
+	sp := &sppb.ServicesProvider{Secrets: map[string]*structpb.Value{
+		"ansible": structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+			"check_linux_playbook": structpb.NewStringValue("playbook"),
+		}}),
+	}}
+	// Every request brings Instance as NoCloud has it, config isn't updated by actions
+	invoke := func(method string, params map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+		inst := &ipb.Instance{
+			Uuid: "inst",
+			Config: map[string]*structpb.Value{
+				"username": structpb.NewStringValue("root"),
+				"password": structpb.NewStringValue("old"),
+				"host":     structpb.NewStringValue("192.0.2.10"),
+			},
+			Data: map[string]*structpb.Value{one.DATA_VM_ID: structpb.NewNumberValue(float64(vmid))},
+		}
+		return s.Invoke(context.Background(), &pb.InvokeRequest{Instance: inst, ServicesProvider: sp, Method: method, Params: params})
+	}
+
+	var published []*ipb.ObjectData
+	datas.DIPub = func(msg *ipb.ObjectData) (int, error) {
+		published = append(published, msg)
+		return 0, nil
+	}
+	t.Cleanup(func() { datas.DIPub = nil })
+
+	resp, err := invoke("reset_password", map[string]*structpb.Value{"password": structpb.NewStringValue("new")})
+	if err != nil || resp.Meta["password"].GetStringValue() != "new" {
+		t.Fatalf("reset_password => %v, %v", resp.GetMeta(), err)
+	}
+	if len(published) != 1 || published[0].GetData()["password"].GetStringValue() != "new" {
+		t.Fatalf("New password must be published with Instance data, got %v", published)
+	}
+
+	invoke("check_linux_stats", nil)
+	if len(runner.runs) != 1 || runner.runs[0].GetInstances()[0].GetPass() != "new" {
+		t.Fatalf("Ansible must use the new password, got runs %v", runner.runs)
+	}
+}
+
+func TestFirewallSetPrecondition(t *testing.T) {
+	actions.ConfigureStatusesClient(zap.NewNop())
+
+	c := fake.NewClient(zap.NewNop())
+	c.SetSecrets(map[string]*structpb.Value{"group": structpb.NewNumberValue(fake.USERS_GROUP)})
+	uid, err := c.CreateUser("ig-uuid", "pass", []int{fake.USERS_GROUP})
+	if err != nil {
+		t.Fatalf("CreateUser() => %v", err)
+	}
+	vn, _ := c.AddVNet("public", "bridge", "192.0.2.1", 16)
+	tmpl, _ := c.AddTemplate("tmpl", "CPU=1\nMEMORY=512")
+	vmid, _ := c.InstantiateTemplate(tmpl, "vm", fmt.Sprintf("NIC=[NETWORK_ID=\"%d\"]", vn), false)
+	c.Chown("vm", vmid, uid, fake.USERS_GROUP)
+
+	s := &DriverServiceServer{log: zap.NewNop(), jobs: newMemJobStore()}
+	s.SetClientFactory(func(*sppb.ServicesProvider, *zap.Logger) (one.IClient, error) { return c, nil })
+	inst := &ipb.Instance{Uuid: "inst", Data: map[string]*structpb.Value{one.DATA_VM_ID: structpb.NewNumberValue(float64(vmid))}}
+	rules, _ := structpb.NewValue([]interface{}{
+		map[string]interface{}{"protocol": "TCP", "port_range": "22", "direction": "inbound"},
+	})
+	invoke := func() (*ipb.InvokeResponse, error) {
+		return s.Invoke(context.Background(), &pb.InvokeRequest{
+			Instance: inst, ServicesProvider: &sppb.ServicesProvider{}, Method: "firewall_set",
+			Params: map[string]*structpb.Value{"rules": rules},
+		})
+	}
+
+	// Group made by PrepareService from the IG config, but VM NIC was made without it, so rules can't be applied
+	config, _ := structpb.NewValue([]interface{}{})
+	data := map[string]*structpb.Value{}
+	if err := s.syncFirewall(c, "ig-uuid", uid, config, data); err != nil {
+		t.Fatalf("syncFirewall() => %v", err)
+	}
+	sg := int(data["security_group"].GetNumberValue())
+	if _, err := invoke(); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition without security group on NICs, got %v", err)
+	}
+
+	nic := shared.NewNIC()
+	nic.Add(shared.NetworkID, vn)
+	nic.Add(shared.SecurityGroups, sg)
+	if err := goca.NewController(c.Client).VM(vmid).AttachNIC(nic.String()); err != nil {
+		t.Fatalf("AttachNIC() => %v", err)
+	}
+	resp, err := invoke()
+	if err != nil {
+		t.Fatalf("firewall_set => %v", err)
+	}
+	if int(resp.Meta["security_group"].GetNumberValue()) != sg {
+		t.Fatalf("Rules must be set to the existing group %d, got %v", sg, resp.Meta)
+	}
+	if got, _ := c.GetFirewallRules(sg); len(got) != 1 || got[0].PortRange != "22" {
+		t.Fatalf("Unexpected rules: %+v", got)
+	}
+
+	// Rules set at runtime survive sync with the same config
+	if err := s.syncFirewall(c, "ig-uuid", uid, config, data); err != nil {
+		t.Fatalf("syncFirewall() => %v", err)
+	}
+	if got, _ := c.GetFirewallRules(sg); len(got) != 1 {
+		t.Fatalf("Rules set by firewall_set must be kept, got %+v", got)
+	}
+
+	// Another IG of the same User doesn't touch the group
+	otherData := map[string]*structpb.Value{}
+	if err := s.syncFirewall(c, "other-ig-uuid", uid, config, otherData); err != nil {
+		t.Fatalf("syncFirewall() => %v", err)
+	}
+	if other := int(otherData["security_group"].GetNumberValue()); other == sg {
+		t.Fatalf("Expected own security group for another IG, got %d", other)
+	}
+	if got, _ := c.GetFirewallRules(sg); len(got) != 1 {
+		t.Fatalf("Rules of the first IG must be kept, got %+v", got)
+	}
+}
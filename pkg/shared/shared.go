@@ -22,6 +22,11 @@ import (
 
 const (
 	DRIVE_TYPE         shared.DiskKeys = "DRIVE_TYPE"
+	NOCLOUD_DATA_DISK  shared.DiskKeys = "NOCLOUD_DATA_DISK"
+	NOCLOUD_DISK_ID    shared.DiskKeys = "NOCLOUD_DISK_ID"
+	NOCLOUD_RESCUE     shared.DiskKeys = "NOCLOUD_RESCUE"
+	NOCLOUD_ISO        shared.DiskKeys = "NOCLOUD_ISO"
+	NOCLOUD_FLOATING   shared.NICKeys  = "NOCLOUD_FLOATING"
 	NOCLOUD_VM         keys.Template   = "NOCLOUD"
 	NOCLOUD_VM_TOKEN   keys.Template   = "NOCLOUD_VM_TOKEN"
 	NOCLOUD_INST_TITLE keys.Template   = "NOCLOUD_INST_TITLE"
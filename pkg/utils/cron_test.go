@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, time.February, 27, 3, 30, 0, 0, time.UTC) // Tuesday
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"0 3 * * *", time.Date(2024, time.February, 28, 3, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.February, 27, 3, 45, 0, 0, time.UTC)},
+		{"30 3 * * *", time.Date(2024, time.February, 28, 3, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 1 1 * *", time.Date(2024, time.March, 1, 1, 0, 0, 0, time.UTC)},
+		{"0 12 * * 0", time.Date(2024, time.March, 3, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2024, time.March, 3, 12, 0, 0, 0, time.UTC)},
+		{"0 4-6/2 * * 1-5", time.Date(2024, time.February, 27, 4, 0, 0, 0, time.UTC)},
+		// Either day of month or day of week
+		{"0 0 15 * 4", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// Stepped star is unrestricted, so both must match: odd day and Monday
+		{"0 0 */2 * 1", time.Date(2024, time.March, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tc := range tests {
+		c, err := ParseCron(tc.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q) => %v", tc.expr, err)
+		}
+		if got := c.Next(from); !got.Equal(tc.want) {
+			t.Errorf("%q: Next() = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) expected error", expr)
+		}
+	}
+}